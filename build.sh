@@ -232,7 +232,7 @@ if [ "$BUILD_TYPE" = "server" ]; then
   echo "Executing go build..."
 
 	if [ "$PLATFORM" = "windows" ]; then
-    GOOS="$PLATFORM" GOARCH="$ARCH_FLAG" go build -ldflags "-X main.VersionName=$VERSION_NAME -X main.VersionCode=$VERSION_CODE" -o "$OUTPUT_DIR/proxyscotch-server.exe" server/server.go
+    GOOS="$PLATFORM" GOARCH="$ARCH_FLAG" go build -ldflags "-X main.VersionName=$VERSION_NAME -X main.VersionCode=$VERSION_CODE" -o "$OUTPUT_DIR/proxyscotch-server.exe" ./server
     
     BINARY_PATH="$OUTPUT_DIR/proxyscotch-server-windows-${ARCH_FLAG}-v${VERSION_NAME}.exe"
     mv "$OUTPUT_DIR/proxyscotch-server.exe" "$BINARY_PATH"
@@ -242,8 +242,8 @@ if [ "$BUILD_TYPE" = "server" ]; then
     # For macOS, we check if user wants a universal binary
     if [ "$ARCH_FLAG" = "universal" ]; then
       # Build both architectures and create a universal binary
-      GOOS="$PLATFORM" GOARCH="amd64" go build -ldflags "-X main.VersionName=$VERSION_NAME -X main.VersionCode=$VERSION_CODE" -o "$OUTPUT_DIR/proxyscotch-server-amd64" server/server.go
-      GOOS="$PLATFORM" GOARCH="arm64" go build -ldflags "-X main.VersionName=$VERSION_NAME -X main.VersionCode=$VERSION_CODE" -o "$OUTPUT_DIR/proxyscotch-server-arm64" server/server.go
+      GOOS="$PLATFORM" GOARCH="amd64" go build -ldflags "-X main.VersionName=$VERSION_NAME -X main.VersionCode=$VERSION_CODE" -o "$OUTPUT_DIR/proxyscotch-server-amd64" ./server
+      GOOS="$PLATFORM" GOARCH="arm64" go build -ldflags "-X main.VersionName=$VERSION_NAME -X main.VersionCode=$VERSION_CODE" -o "$OUTPUT_DIR/proxyscotch-server-arm64" ./server
       
       # Use lipo to create universal binary
       lipo -create -output "$OUTPUT_DIR/proxyscotch-server" "$OUTPUT_DIR/proxyscotch-server-amd64" "$OUTPUT_DIR/proxyscotch-server-arm64"
@@ -254,7 +254,7 @@ if [ "$BUILD_TYPE" = "server" ]; then
       echo "macOS Universal build complete. Binary available at: $BINARY_PATH"
     else
       # Build for specific architecture
-      GOOS="$PLATFORM" GOARCH="$ARCH_FLAG" go build -ldflags "-X main.VersionName=$VERSION_NAME -X main.VersionCode=$VERSION_CODE" -o "$OUTPUT_DIR/proxyscotch-server" server/server.go
+      GOOS="$PLATFORM" GOARCH="$ARCH_FLAG" go build -ldflags "-X main.VersionName=$VERSION_NAME -X main.VersionCode=$VERSION_CODE" -o "$OUTPUT_DIR/proxyscotch-server" ./server
       
       BINARY_PATH="$OUTPUT_DIR/proxyscotch-server-${PLATFORM}-${ARCH_FLAG}-v${VERSION_NAME}"
       mv "$OUTPUT_DIR/proxyscotch-server" "$BINARY_PATH"
@@ -263,7 +263,7 @@ if [ "$BUILD_TYPE" = "server" ]; then
 
 	elif [ "$PLATFORM" = "linux" ]; then
     # Build only for the specified architecture
-    GOOS="$PLATFORM" GOARCH="$ARCH_FLAG" go build -ldflags "-X main.VersionName=$VERSION_NAME -X main.VersionCode=$VERSION_CODE" -o "$OUTPUT_DIR/proxyscotch-server" server/server.go
+    GOOS="$PLATFORM" GOARCH="$ARCH_FLAG" go build -ldflags "-X main.VersionName=$VERSION_NAME -X main.VersionCode=$VERSION_CODE" -o "$OUTPUT_DIR/proxyscotch-server" ./server
     
     BINARY_PATH="$OUTPUT_DIR/proxyscotch-server-${PLATFORM}-${ARCH_FLAG}-v${VERSION_NAME}"
     mv "$OUTPUT_DIR/proxyscotch-server" "$BINARY_PATH"
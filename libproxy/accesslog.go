@@ -0,0 +1,485 @@
+package libproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AccessLogConfig configures the access log, which records every request made to the proxy.
+type AccessLogConfig struct {
+	// Sinks are where the access log is written: any of "stdout", "file" and "syslog". If empty,
+	// no access log is written.
+	Sinks []string `json:"sinks,omitempty" yaml:"sinks,omitempty"`
+	// Format is "json" (the default) for JSON lines, "common" for the Common Log Format or
+	// "combined" for the Combined Log Format.
+	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+	// Level is the least severe level recorded: "debug", "info" (the default), "warn" or
+	// "error". Requests that are proxied successfully are logged at info, requests the proxy
+	// rejects at warn and requests that fail at error. Preflight and status requests are logged
+	// at debug.
+	Level string `json:"level,omitempty" yaml:"level,omitempty"`
+	// File is the path of the file sink (default: access.log in the data directory).
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+	// MaxFileSize is the size at which the file is rotated (default: 10MB).
+	MaxFileSize ByteSize `json:"maxFileSize,omitempty" yaml:"maxFileSize,omitempty"`
+	// MaxFiles is the number of rotated files kept (default: 5).
+	MaxFiles int `json:"maxFiles,omitempty" yaml:"maxFiles,omitempty"`
+	// Syslog is the address of the syslog server, e.g. udp://logs.example.com:514. If blank, the
+	// local syslog daemon is used.
+	Syslog string `json:"syslog,omitempty" yaml:"syslog,omitempty"`
+}
+
+// The severity of an access log entry.
+const (
+	accessLogDebug = iota
+	accessLogInfo
+	accessLogWarn
+	accessLogError
+)
+
+var accessLogLevels = []string{"debug", "info", "warn", "error"}
+
+// accessLogEntry is the record of a request made to the proxy.
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	RequestID string    `json:"requestId"`
+	// TraceID is the ID of the request's trace, if tracing is enabled.
+	TraceID  string `json:"traceId,omitempty"`
+	ClientIP string `json:"clientIp"`
+	Origin   string `json:"origin,omitempty"`
+	// Token is the name of the access token the request was made with, if one is required.
+	Token string `json:"token,omitempty"`
+	// Path is the proxy endpoint that was called.
+	Path string `json:"path"`
+	// Method and Destination describe the proxied request. The destination's query string is
+	// omitted, as it may contain credentials.
+	Method      string `json:"method,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	// Status is the status of the response to the client, and UpstreamStatus that of the
+	// response from the destination.
+	Status         int     `json:"status"`
+	UpstreamStatus int     `json:"upstreamStatus,omitempty"`
+	BytesIn        int64   `json:"bytesIn"`
+	BytesOut       int64   `json:"bytesOut"`
+	UpstreamBytes  int64   `json:"upstreamBytes,omitempty"`
+	Duration       float64 `json:"durationMs"`
+	UpstreamTime   float64 `json:"upstreamDurationMs,omitempty"`
+	ErrorCode      string  `json:"errorCode,omitempty"`
+	Error          string  `json:"error,omitempty"`
+	// RateLimit is the name of the rate limit the request exceeded, and DeniedBy the policy rule
+	// that rejected it, if any.
+	RateLimit string `json:"rateLimit,omitempty"`
+	DeniedBy  string `json:"deniedBy,omitempty"`
+	// Mock is the name of the mock the response was served from, in mock mode.
+	Mock string `json:"mock,omitempty"`
+	// Cache reports how the response cache was used (see Response.Cache).
+	Cache string `json:"cache,omitempty"`
+	// Attempts is the number of times the request was sent, if the retry policy allowed it to be
+	// sent more than once.
+	Attempts  int    `json:"attempts,omitempty"`
+	Referer   string `json:"referer,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+
+	level int
+	start time.Time
+	// tracked lists the request in the admin API while it is in progress. It may be nil.
+	tracked *trackedRequest
+}
+
+// setDestination records the proxied request's method and destination.
+func (e *accessLogEntry) setDestination(p *policy, method string, destination *url.URL) {
+	withoutQuery := *destination
+	withoutQuery.RawQuery, withoutQuery.Fragment, withoutQuery.User = "", "", nil
+
+	e.Method = method
+	e.Destination = p.redactor.RedactString(withoutQuery.String())
+	e.tracked.setDestination(e.Method, e.Destination)
+}
+
+// setUpstream records the response from the destination.
+func (e *accessLogEntry) setUpstream(status int, bytes int64, start time.Time) {
+	e.UpstreamStatus = status
+	e.UpstreamBytes = bytes
+	e.UpstreamTime = milliseconds(time.Since(start))
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration.Microseconds()) / 1000
+}
+
+// accessLogEntryFor returns the entry recording the request answered by response. If the request
+// isn't being recorded, the entry is discarded.
+func accessLogEntryFor(response http.ResponseWriter) *accessLogEntry {
+	if writer, ok := response.(*accessLogWriter); ok {
+		return writer.entry
+	}
+
+	return &accessLogEntry{}
+}
+
+// requestFailedMessage is the error reported when the request to the destination fails.
+var requestFailedMessage = func() string {
+	var body errorBody
+	_ = json.Unmarshal([]byte(ErrorBodyProxyRequestFailed), &body)
+	return body.Data.Message
+}()
+
+// maxErrorBodySize is the size of the start of each response kept to find the error it reports,
+// if any. Error bodies are much smaller than this.
+const maxErrorBodySize = 4096
+
+// accessLogWriter records the status and size of a response, and keeps its start so that errors
+// reported in the body can be logged.
+type accessLogWriter struct {
+	http.ResponseWriter
+	entry *accessLogEntry
+	head  []byte
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.entry.Status == 0 {
+		w.entry.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(data []byte) (int, error) {
+	if w.entry.Status == 0 {
+		w.entry.Status = http.StatusOK
+	}
+	if len(w.head) < maxErrorBodySize {
+		keep := maxErrorBodySize - len(w.head)
+		if keep > len(data) {
+			keep = len(data)
+		}
+		w.head = append(w.head, data[:keep]...)
+	}
+
+	n, err := w.ResponseWriter.Write(data)
+	w.entry.BytesOut += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (r countingReader) Read(data []byte) (int, error) {
+	n, err := r.ReadCloser.Read(data)
+	*r.count += int64(n)
+	return n, err
+}
+
+// accessLogSink is a destination for access log lines.
+type accessLogSink interface {
+	write(level int, line []byte) error
+	Close() error
+}
+
+// accessLogger writes access log entries to its sinks.
+type accessLogger struct {
+	format string
+	level  int
+
+	mu    sync.Mutex
+	sinks []accessLogSink
+	// closed is set once the logger has been replaced and the requests that were in progress
+	// under it have been logged. Any later entries are dropped.
+	closed bool
+}
+
+// newAccessLogger opens the sinks in config. It returns nil if no sinks are configured.
+func newAccessLogger(config AccessLogConfig) (*accessLogger, error) {
+	if len(config.Sinks) == 0 {
+		return nil, nil
+	}
+
+	logger := &accessLogger{format: strings.ToLower(config.Format), level: -1}
+	switch logger.format {
+	case "":
+		logger.format = "json"
+	case "json", "common", "combined":
+	default:
+		return nil, fmt.Errorf("invalid access log format %q (must be json, common or combined)", config.Format)
+	}
+
+	if config.Level == "" {
+		logger.level = accessLogInfo
+	}
+	for level, name := range accessLogLevels {
+		if strings.EqualFold(config.Level, name) {
+			logger.level = level
+		}
+	}
+	if logger.level < 0 {
+		return nil, fmt.Errorf("invalid access log level %q (must be one of %s)", config.Level, strings.Join(accessLogLevels, ", "))
+	}
+
+	for _, name := range config.Sinks {
+		var sink accessLogSink
+		var err error
+		switch strings.ToLower(name) {
+		case "stdout":
+			sink = writerSink{os.Stdout}
+		case "file":
+			sink, err = newRotatingFile(config)
+		case "syslog":
+			sink, err = newSyslogSink(config.Syslog)
+		default:
+			err = fmt.Errorf("invalid access log sink %q (must be stdout, file or syslog)", name)
+		}
+		if err != nil {
+			logger.close()
+			return nil, err
+		}
+
+		logger.sinks = append(logger.sinks, sink)
+	}
+
+	return logger, nil
+}
+
+// beginAccessLog starts recording a request, returning the writer its response should be written
+// to.
+func beginAccessLog(response http.ResponseWriter, request *http.Request) *accessLogWriter {
+	entry := &accessLogEntry{
+		RequestID: uuid.New().String(),
+		ClientIP:  clientIP(request),
+		Origin:    request.Header.Get("Origin"),
+		Path:      request.URL.Path,
+		Referer:   request.Referer(),
+		UserAgent: request.UserAgent(),
+		level:     accessLogInfo,
+		start:     time.Now(),
+	}
+	if request.Body != nil {
+		request.Body = countingReader{request.Body, &entry.BytesIn}
+	}
+
+	response.Header().Set("X-Request-Id", entry.RequestID)
+	return &accessLogWriter{ResponseWriter: response, entry: entry}
+}
+
+// deniedByErrorCode are the policy rules that deny requests with the given error codes.
+var deniedByErrorCode = map[string]string{
+	ErrorCodeRequestTooLarge:  "max-request-size",
+	ErrorCodeUploadTooLarge:   "max-upload-size",
+	ErrorCodeResponseTooLarge: "max-response-size",
+	ErrorCodeHookFailed:       "hook",
+	ErrorCodeUnauthorized:     "admin-token",
+}
+
+// complete finishes the record of a request once it has been answered.
+func (w *accessLogWriter) complete() {
+	entry := w.entry
+	entry.Time = entry.start
+	entry.Duration = milliseconds(time.Since(entry.start))
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+
+	// The proxy reports most errors in the body of a 200 response.
+	var body errorBody
+	if len(w.head) < maxErrorBodySize && json.Unmarshal(w.head, &body) == nil && !body.Success && body.Data.Message != "" {
+		entry.ErrorCode = body.Data.Code
+		entry.Error = body.Data.Message
+		entry.RateLimit = body.Data.Limit
+	}
+	if entry.DeniedBy == "" {
+		entry.DeniedBy = deniedByErrorCode[entry.ErrorCode]
+	}
+
+	switch {
+	case entry.Status >= 500:
+		entry.level = accessLogError
+	case entry.DeniedBy != "" || entry.RateLimit != "":
+		entry.level = accessLogWarn
+	case entry.Error == requestFailedMessage:
+		entry.level = accessLogError
+	case entry.Error != "" || entry.Status >= 400:
+		entry.level = accessLogWarn
+	case entry.Method == "" && entry.Path == "/", entry.Path == "/healthz", entry.Path == "/readyz":
+		// Preflight, status and health check requests.
+		entry.level = accessLogDebug
+	}
+	entry.Level = accessLogLevels[entry.level]
+}
+
+// log writes a completed entry to the sinks, if it is at or above the logger's level.
+func (l *accessLogger) log(entry *accessLogEntry) {
+	if entry.level < l.level {
+		return
+	}
+
+	line := l.formatEntry(entry)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	for _, sink := range l.sinks {
+		if err := sink.write(entry.level, line); err != nil {
+			log.Printf("Failed to write to the access log: %v", err)
+		}
+	}
+}
+
+// formatEntry formats entry as a line in the logger's format.
+func (l *accessLogger) formatEntry(entry *accessLogEntry) []byte {
+	if l.format == "json" {
+		line, _ := json.Marshal(entry)
+		return append(line, '\n')
+	}
+
+	dash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+		return value
+	}
+
+	method, target := entry.Method, entry.Destination
+	if method == "" {
+		method, target = "-", entry.Path
+	}
+	status := entry.UpstreamStatus
+	if status == 0 {
+		status = entry.Status
+	}
+	size := "-"
+	if entry.BytesOut > 0 {
+		size = strconv.FormatInt(entry.BytesOut, 10)
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s",
+		entry.ClientIP,
+		dash(entry.Token),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(method+" "+target+" HTTP/1.1"),
+		status,
+		size,
+	)
+	if l.format == "combined" {
+		line += " " + strconv.Quote(dash(entry.Referer)) + " " + strconv.Quote(dash(entry.UserAgent))
+	}
+
+	return []byte(line + "\n")
+}
+
+// close closes the logger's sinks. It is safe to call on a nil logger.
+func (l *accessLogger) close() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	for _, sink := range l.sinks {
+		_ = sink.Close()
+	}
+}
+
+// writerSink writes to a stream, such as stdout, which it doesn't close.
+type writerSink struct {
+	writer io.Writer
+}
+
+func (s writerSink) write(_ int, line []byte) error {
+	_, err := s.writer.Write(line)
+	return err
+}
+
+func (s writerSink) Close() error {
+	return nil
+}
+
+// rotatingFile writes to a file, which is renamed with the suffix .1 once it reaches its maximum
+// size (and any older files to .2, .3 and so on, up to the maximum number of files).
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(config AccessLogConfig) (*rotatingFile, error) {
+	file := &rotatingFile{path: config.File, maxSize: int64(config.MaxFileSize), maxFiles: config.MaxFiles}
+	if file.path == "" {
+		file.path = filepath.Join(GetOrCreateDataPath(), "access.log")
+	}
+	if file.maxSize <= 0 {
+		file.maxSize = 10 << 20
+	}
+	if file.maxFiles <= 0 {
+		file.maxFiles = 5
+	}
+
+	return file, file.open()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		_ = os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+	}
+	renameErr := os.Rename(f.path, f.path+".1")
+
+	// Keep writing, even if to the same file, if it couldn't be renamed.
+	if err := f.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+func (f *rotatingFile) write(_ int, line []byte) error {
+	if f.size > 0 && f.size+int64(len(line)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
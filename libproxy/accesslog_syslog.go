@@ -0,0 +1,52 @@
+//go:build !windows
+
+package libproxy
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+)
+
+// syslogSink writes to syslog, at the priority matching each entry's level.
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// newSyslogSink connects to the syslog server at address (e.g. udp://logs.example.com:514), or
+// to the local syslog daemon if address is blank.
+func newSyslogSink(address string) (*syslogSink, error) {
+	network, host := "", ""
+	if address != "" {
+		parsed, err := url.Parse(address)
+		if err != nil || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %q (e.g. udp://localhost:514)", address)
+		}
+		network, host = parsed.Scheme, parsed.Host
+	}
+
+	writer, err := syslog.Dial(network, host, syslog.LOG_INFO|syslog.LOG_DAEMON, "proxyscotch")
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) write(level int, line []byte) error {
+	message := string(line)
+	switch level {
+	case accessLogDebug:
+		return s.writer.Debug(message)
+	case accessLogWarn:
+		return s.writer.Warning(message)
+	case accessLogError:
+		return s.writer.Err(message)
+	default:
+		return s.writer.Info(message)
+	}
+}
+
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
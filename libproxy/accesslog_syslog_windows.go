@@ -0,0 +1,7 @@
+package libproxy
+
+import "errors"
+
+func newSyslogSink(string) (accessLogSink, error) {
+	return nil, errors.New("syslog is not supported on Windows")
+}
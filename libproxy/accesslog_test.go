@@ -0,0 +1,236 @@
+package libproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAccessLog(t *testing.T, path string) []accessLogEntry {
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	var entries []accessLogEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry accessLogEntry
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	proxy, err := New(Options{Config: Config{
+		AccessToken:    "secret-token",
+		AllowedOrigins: []string{"*"},
+		BannedDests:    []string{"banned.example.com"},
+		AccessLog:      AccessLogConfig{Sinks: []string{"file"}, File: path},
+	}})
+	assert.Nil(t, err)
+
+	resp := getResultFrom(proxy, Request{
+		AccessToken: "secret-token",
+		Method:      "POST",
+		Url:         testServerUrl + "/anything/path?key=value",
+		Data:        "hello",
+	}, "validorigin1.com")
+	assert.Equal(t, 200, resp.requestResponse.Status)
+	requestID := resp.proxyResponse.Header().Get("X-Request-Id")
+	assert.NotEmpty(t, requestID)
+
+	getResultFrom(proxy, Request{Method: "GET", Url: testServerUrl + "/get"}, "validorigin1.com")
+	getResultFrom(proxy, Request{AccessToken: "secret-token", Method: "GET", Url: "https://banned.example.com/"}, "validorigin1.com")
+	getResultFrom(proxy, Request{AccessToken: "secret-token", Method: "GET", Url: "http://127.0.0.1:1/"}, "validorigin1.com")
+
+	entries := readAccessLog(t, path)
+	assert.Len(t, entries, 4)
+
+	entry := entries[0]
+	assert.Equal(t, requestID, entry.RequestID)
+	assert.Equal(t, "info", entry.Level)
+	assert.Equal(t, "default", entry.Token)
+	assert.Equal(t, "validorigin1.com", entry.Origin)
+	assert.Equal(t, "/", entry.Path)
+	assert.Equal(t, "POST", entry.Method)
+	assert.Equal(t, testServerUrl+"/anything/path", entry.Destination)
+	assert.Equal(t, 200, entry.Status)
+	assert.Equal(t, 200, entry.UpstreamStatus)
+	assert.Greater(t, entry.BytesIn, int64(0))
+	assert.Equal(t, int64(resp.proxyResponse.Body.Len()), entry.BytesOut)
+	assert.Greater(t, entry.UpstreamBytes, int64(0))
+	assert.Greater(t, entry.Duration, 0.0)
+	assert.Empty(t, entry.Error)
+
+	// the access token is checked before the destination is known
+	assert.Equal(t, "warn", entries[1].Level)
+	assert.Contains(t, entries[1].Error, "Unauthorized")
+	assert.Empty(t, entries[1].Destination)
+
+	assert.Equal(t, "warn", entries[2].Level)
+	assert.Equal(t, "https://banned.example.com/", entries[2].Destination)
+	assert.Contains(t, entries[2].Error, "destination")
+
+	assert.Equal(t, "error", entries[3].Level)
+	assert.Equal(t, requestFailedMessage, entries[3].Error)
+	assert.Zero(t, entries[3].UpstreamStatus)
+}
+
+func TestAccessLogLevel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	proxy, err := New(Options{Config: Config{
+		AllowedOrigins: []string{"*"},
+		AccessLog:      AccessLogConfig{Sinks: []string{"file"}, File: path, Level: "warn"},
+	}})
+	assert.Nil(t, err)
+
+	getResultFrom(proxy, Request{Method: "GET", Url: testServerUrl + "/get"}, "validorigin1.com")
+	getResultFrom(proxy, Request{Method: "GET", Url: "http://127.0.0.1:1/"}, "validorigin1.com")
+	entries := readAccessLog(t, path)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "error", entries[0].Level)
+
+	// reloading with debug also records status requests
+	assert.Nil(t, proxy.updateConfig(func(config *Config) { config.AccessLog.Level = "debug" }))
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Origin", "validorigin1.com")
+	proxy.ServeHTTP(httptest.NewRecorder(), request)
+	entries = readAccessLog(t, path)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "debug", entries[1].Level)
+	assert.Empty(t, entries[1].Method)
+}
+
+func TestAccessLogReloadedDuringRequest(t *testing.T) {
+	received, release := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		close(received)
+		<-release
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	proxy, err := New(Options{Config: Config{
+		AllowedOrigins: []string{"*"},
+		AccessLog:      AccessLogConfig{Sinks: []string{"file"}, File: filepath.Join(dir, "before.log")},
+	}})
+	assert.Nil(t, err)
+	previous := proxy.loadPolicy().accessLog
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		getResultFrom(proxy, Request{Method: "GET", Url: backend.URL}, "validorigin1.com")
+	}()
+	<-received
+
+	// the previous log is kept open until the request in progress has been logged
+	assert.Nil(t, proxy.updateConfig(func(config *Config) { config.AccessLog.File = filepath.Join(dir, "after.log") }))
+	previous.mu.Lock()
+	assert.False(t, previous.closed)
+	previous.mu.Unlock()
+	close(release)
+	<-done
+
+	assert.Len(t, readAccessLog(t, filepath.Join(dir, "before.log")), 1)
+	previous.mu.Lock()
+	assert.True(t, previous.closed)
+	previous.mu.Unlock()
+}
+
+func TestAccessLogSyslog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("syslog is not supported on Windows")
+	}
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Close()
+
+	proxy, err := New(Options{Config: Config{
+		AllowedOrigins: []string{"*"},
+		AccessLog:      AccessLogConfig{Sinks: []string{"syslog"}, Format: "common", Syslog: "udp://" + server.LocalAddr().String()},
+	}})
+	assert.Nil(t, err)
+	getResultFrom(proxy, Request{Method: "GET", Url: "http://127.0.0.1:1/"}, "validorigin1.com")
+
+	buffer := make([]byte, 2048)
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := server.ReadFrom(buffer)
+	assert.Nil(t, err)
+	message := string(buffer[:n])
+	// <27> is daemon.err
+	assert.True(t, strings.HasPrefix(message, "<27>"), message)
+	assert.Contains(t, message, "proxyscotch")
+	assert.Contains(t, message, `"GET http://127.0.0.1:1/ HTTP/1.1"`)
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	entry := &accessLogEntry{
+		Time:           time.Date(2023, 2, 1, 13, 4, 5, 0, time.FixedZone("", -7*60*60)),
+		ClientIP:       "192.0.2.1",
+		Token:          "default",
+		Path:           "/",
+		Method:         "GET",
+		Destination:    "https://api.example.com/users",
+		Status:         200,
+		UpstreamStatus: 404,
+		BytesOut:       1234,
+		Referer:        "https://hoppscotch.io/",
+		UserAgent:      `Mozilla/5.0 "quoted"`,
+	}
+
+	common := &accessLogger{format: "common"}
+	assert.Equal(t, `192.0.2.1 - default [01/Feb/2023:13:04:05 -0700] "GET https://api.example.com/users HTTP/1.1" 404 1234`+"\n", string(common.formatEntry(entry)))
+
+	combined := &accessLogger{format: "combined"}
+	assert.Equal(t, `192.0.2.1 - default [01/Feb/2023:13:04:05 -0700] "GET https://api.example.com/users HTTP/1.1" 404 1234 "https://hoppscotch.io/" "Mozilla/5.0 \"quoted\""`+"\n", string(combined.formatEntry(entry)))
+
+	status := &accessLogEntry{Time: entry.Time, ClientIP: "192.0.2.1", Path: "/", Status: 200}
+	assert.Equal(t, `192.0.2.1 - - [01/Feb/2023:13:04:05 -0700] "- / HTTP/1.1" 200 -`+"\n", string(common.formatEntry(status)))
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := newRotatingFile(AccessLogConfig{File: path, MaxFileSize: 20, MaxFiles: 2})
+	assert.Nil(t, err)
+
+	for _, line := range []string{"first line\n", "second line\n", "third line\n", "fourth line\n"} {
+		assert.Nil(t, file.write(accessLogInfo, []byte(line)))
+	}
+	assert.Nil(t, file.Close())
+
+	read := func(name string) string {
+		data, _ := os.ReadFile(name)
+		return string(data)
+	}
+	assert.Equal(t, "fourth line\n", read(path))
+	assert.Equal(t, "third line\n", read(path+".1"))
+	assert.Equal(t, "second line\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestInvalidAccessLogConfig(t *testing.T) {
+	for _, config := range []AccessLogConfig{
+		{Sinks: []string{"stderr"}},
+		{Sinks: []string{"stdout"}, Format: "xml"},
+		{Sinks: []string{"stdout"}, Level: "verbose"},
+		{Sinks: []string{"file"}, File: filepath.Join(t.TempDir(), "missing", "access.log")},
+	} {
+		_, err := New(Options{Config: Config{AccessLog: config}})
+		assert.NotNil(t, err, strings.Join(config.Sinks, ","))
+	}
+}
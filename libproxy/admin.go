@@ -0,0 +1,357 @@
+package libproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The admin API manages the running proxy. Each endpoint requires the admin token as a bearer
+// token (see isAdminRequest), and responds with the same {"success", "data"} body as the proxy.
+// Changes are made to the running configuration only. They are applied again after the
+// configuration is reloaded from a file, so they win over the file until the proxy restarts (see
+// updateSetting).
+
+// ErrorCodeInvalidConfig is returned when an admin API request would make the configuration
+// invalid, and ErrorCodeCertificateFailed when the certificate couldn't be regenerated.
+const (
+	ErrorCodeInvalidConfig     = "INVALID_CONFIG"
+	ErrorCodeCertificateFailed = "CERTIFICATE_FAILED"
+)
+
+// localAdminKey marks requests made in-process by a LocalAdminClient, which don't need the admin
+// token.
+type localAdminKey struct{}
+
+// ActiveRequest is a request the proxy is relaying, as listed by the admin API.
+type ActiveRequest struct {
+	ID          string    `json:"id"`
+	ClientIP    string    `json:"clientIp"`
+	Origin      string    `json:"origin,omitempty"`
+	Path        string    `json:"path"`
+	Method      string    `json:"method,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	StartedAt   time.Time `json:"startedAt"`
+	// Duration is how long the request has been in progress, in milliseconds.
+	Duration float64 `json:"durationMs"`
+}
+
+// AdminConnections describes the connections the proxy holds and the requests it is relaying.
+type AdminConnections struct {
+	// OpenConnections is the number of connections to destinations, whether in use or idle.
+	OpenConnections int64 `json:"openConnections"`
+	// AuthTransports is the number of transports holding NTLM or Negotiate authenticated
+	// connections.
+	AuthTransports int `json:"authTransports"`
+	// OAuth2Sessions is the number of OAuth 2.0 credentials cached by /oauth2/token.
+	OAuth2Sessions int             `json:"oauth2Sessions"`
+	Requests       []ActiveRequest `json:"requests"`
+}
+
+// trackedRequest is a request in progress. Its destination is filled in by the handler once it
+// is known, while the admin API may be reading it.
+type trackedRequest struct {
+	mu      sync.Mutex
+	request ActiveRequest
+}
+
+func (r *trackedRequest) setDestination(method string, destination string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.request.Method, r.request.Destination = method, destination
+}
+
+// activeRequests are the requests in progress.
+type activeRequests struct {
+	mu       sync.Mutex
+	requests map[*trackedRequest]struct{}
+}
+
+// relayPaths are the routes that make requests to destinations, and so are tracked while in
+// progress. Admin and health check requests are left out.
+var relayPaths = map[string]bool{"/": true, "/oauth2/token": true}
+
+// track adds the request recorded by entry until the returned function is called.
+func (a *activeRequests) track(entry *accessLogEntry) (done func()) {
+	if !relayPaths[entry.Path] {
+		return func() {}
+	}
+
+	tracked := &trackedRequest{request: ActiveRequest{
+		ID:        entry.RequestID,
+		ClientIP:  entry.ClientIP,
+		Origin:    entry.Origin,
+		Path:      entry.Path,
+		StartedAt: entry.start,
+	}}
+	entry.tracked = tracked
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.requests == nil {
+		a.requests = map[*trackedRequest]struct{}{}
+	}
+	a.requests[tracked] = struct{}{}
+
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.requests, tracked)
+	}
+}
+
+// list returns the requests in progress, oldest first.
+func (a *activeRequests) list() []ActiveRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	requests := make([]ActiveRequest, 0, len(a.requests))
+	for tracked := range a.requests {
+		tracked.mu.Lock()
+		request := tracked.request
+		tracked.mu.Unlock()
+
+		request.Duration = milliseconds(time.Since(request.StartedAt))
+		requests = append(requests, request)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].StartedAt.Before(requests[j].StartedAt) })
+	return requests
+}
+
+// Connections returns the connections the proxy holds and the requests it is relaying.
+func (proxy *Proxy) Connections() AdminConnections {
+	connections := AdminConnections{
+		OpenConnections: atomic.LoadInt64(&proxy.openConnections),
+		Requests:        proxy.active.list(),
+	}
+
+	proxy.authTransportsMu.Lock()
+	connections.AuthTransports = len(proxy.authTransports)
+	proxy.authTransportsMu.Unlock()
+
+	proxy.oauth2.mu.Lock()
+	connections.OAuth2Sessions = len(proxy.oauth2.credentials)
+	proxy.oauth2.mu.Unlock()
+
+	return connections
+}
+
+// RegenerateCertificate replaces the certificate in the data directory with a new one. If the
+// proxy is serving HTTPS with it (rather than certificate files or ACME), new connections use it
+// straight away; as it is self-signed, it must be trusted again before browsers will accept it.
+func (proxy *Proxy) RegenerateCertificate() error {
+	keyPair := CreateKeyPair()
+	certificate, err := tls.X509KeyPair(keyPair[0].Bytes(), keyPair[1].Bytes())
+	if err != nil {
+		return err
+	}
+
+	dataPath := GetOrCreateDataPath()
+	if err := os.WriteFile(dataPath+"/cert.pem", keyPair[0].Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(dataPath+"/key.pem", keyPair[1].Bytes(), 0600); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		if err := os.WriteFile(dataPath+"/cert.cer", keyPair[0].Bytes(), 0600); err != nil {
+			return err
+		}
+	}
+
+	proxy.certificate.Store(&certificate)
+	log.Print("The certificate has been regenerated.")
+	return nil
+}
+
+// getCertificate returns the certificate the proxy serves HTTPS with.
+func (proxy *Proxy) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate, _ := proxy.certificate.Load().(*tls.Certificate)
+	if certificate == nil {
+		return nil, errors.New("no certificate has been loaded")
+	}
+
+	return certificate, nil
+}
+
+// authorizeAdmin returns true if the request was made by an admin. Otherwise, it responds with
+// an error.
+func (proxy *Proxy) authorizeAdmin(response http.ResponseWriter, request *http.Request) bool {
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if request.Context().Value(localAdminKey{}) != nil || proxy.loadPolicy().isAdminRequest(request) {
+		return true
+	}
+
+	response.WriteHeader(http.StatusUnauthorized)
+	writeErrorBody(response, errorData{Message: "(Proxy Error) Unauthorized request.", Code: ErrorCodeUnauthorized})
+	return false
+}
+
+// allowMethods returns true if the request uses one of methods. Otherwise, it responds with an
+// error.
+func allowMethods(response http.ResponseWriter, request *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if request.Method == method {
+			return true
+		}
+	}
+
+	response.WriteHeader(http.StatusMethodNotAllowed)
+	writeErrorBody(response, errorData{Message: "(Proxy Error) Method not allowed."})
+	return false
+}
+
+func writeAdminData(response http.ResponseWriter, data interface{}) {
+	_ = json.NewEncoder(response).Encode(struct {
+		Success bool        `json:"success"`
+		Data    interface{} `json:"data"`
+	}{true, data})
+}
+
+func writeInvalidConfig(response http.ResponseWriter, err error) {
+	response.WriteHeader(http.StatusBadRequest)
+	writeErrorBody(response, errorData{Message: "(Proxy Error) Invalid configuration: " + err.Error() + ".", Code: ErrorCodeInvalidConfig})
+}
+
+// adminSettingHandler serves a setting of the configuration: GET returns it, and PUT replaces it
+// with the JSON value in the request body, if it passes validate (which may be nil).
+func adminSettingHandler[T any](proxy *Proxy, setting func(config *Config) *T, validate func(value T) error) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		if !proxy.authorizeAdmin(response, request) || !allowMethods(response, request, http.MethodGet, http.MethodPut) {
+			return
+		}
+
+		if request.Method == http.MethodPut {
+			var value T
+			if err := json.NewDecoder(request.Body).Decode(&value); err != nil {
+				writeInvalidConfig(response, err)
+				return
+			}
+			if validate != nil {
+				if err := validate(value); err != nil {
+					writeInvalidConfig(response, err)
+					return
+				}
+			}
+
+			name := strings.TrimPrefix(request.URL.Path, "/admin/")
+			if err := proxy.updateSetting(name, func(config *Config) { *setting(config) = value }); err != nil {
+				writeInvalidConfig(response, err)
+				return
+			}
+			log.Printf("The %s setting was changed through the admin API.", request.URL.Path)
+		}
+
+		config := proxy.loadPolicy().config
+		writeAdminData(response, *setting(&config))
+	}
+}
+
+func validateNonBlank(values []string) error {
+	for _, value := range values {
+		if value == "" {
+			return errors.New("values may not be blank")
+		}
+	}
+
+	return nil
+}
+
+// adminConfigHandler returns the running configuration.
+func (proxy *Proxy) adminConfigHandler(response http.ResponseWriter, request *http.Request) {
+	if !proxy.authorizeAdmin(response, request) || !allowMethods(response, request, http.MethodGet) {
+		return
+	}
+
+	writeAdminData(response, proxy.loadPolicy().config)
+}
+
+// adminConnectionsHandler lists the connections and requests in progress on GET, and closes the
+// idle connections to destinations on DELETE.
+func (proxy *Proxy) adminConnectionsHandler(response http.ResponseWriter, request *http.Request) {
+	if !proxy.authorizeAdmin(response, request) || !allowMethods(response, request, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	if request.Method == http.MethodDelete {
+		proxy.closeIdleConnections()
+	}
+	writeAdminData(response, proxy.Connections())
+}
+
+// adminCertificateHandler regenerates the certificate on a POST request.
+func (proxy *Proxy) adminCertificateHandler(response http.ResponseWriter, request *http.Request) {
+	if !proxy.authorizeAdmin(response, request) || !allowMethods(response, request, http.MethodPost) {
+		return
+	}
+
+	if err := proxy.RegenerateCertificate(); err != nil {
+		log.Printf("Failed to regenerate the certificate: %v", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(response, errorData{Message: fmt.Sprintf("(Proxy Error) Failed to regenerate the certificate: %v", err), Code: ErrorCodeCertificateFailed})
+		return
+	}
+
+	writeAdminData(response, map[string]string{"message": "Certificate regenerated."})
+}
+
+// adminRecordingsHandler lists the recordings in progress on GET, and stops the one with the ID
+// in the id query parameter on DELETE, writing it to a file.
+func (proxy *Proxy) adminRecordingsHandler(response http.ResponseWriter, request *http.Request) {
+	if !proxy.authorizeAdmin(response, request) || !allowMethods(response, request, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	if request.Method == http.MethodDelete {
+		info, err := proxy.StopRecording(request.URL.Query().Get("id"))
+		if err != nil {
+			response.WriteHeader(http.StatusNotFound)
+			writeErrorBody(response, errorData{Message: "(Proxy Error) Failed to stop recording: " + err.Error() + ".", Code: ErrorCodeRecordingFailed})
+			return
+		}
+		writeAdminData(response, info)
+		return
+	}
+
+	writeAdminData(response, proxy.Recordings())
+}
+
+// registerAdminHandlers adds the admin API to the proxy's routes.
+func (proxy *Proxy) registerAdminHandlers() {
+	proxy.mux.HandleFunc("/admin/reload", proxy.adminReloadHandler)
+	proxy.mux.HandleFunc("/admin/config", proxy.adminConfigHandler)
+	proxy.mux.HandleFunc("/admin/connections", proxy.adminConnectionsHandler)
+	proxy.mux.HandleFunc("/admin/certificate", proxy.adminCertificateHandler)
+	proxy.mux.HandleFunc("/admin/recordings", proxy.adminRecordingsHandler)
+	proxy.mux.Handle("/admin/allowed-origins", adminSettingHandler(proxy, func(c *Config) *[]string { return &c.AllowedOrigins }, validateNonBlank))
+	proxy.mux.Handle("/admin/banned-dests", adminSettingHandler(proxy, func(c *Config) *[]string { return &c.BannedDests }, validateNonBlank))
+	proxy.mux.Handle("/admin/banned-outputs", adminSettingHandler(proxy, func(c *Config) *[]string { return &c.BannedOutputs }, validateNonBlank))
+	proxy.mux.Handle("/admin/redaction-rules", adminSettingHandler(proxy, func(c *Config) *[]RedactionRule { return &c.RedactionRules }, nil))
+	proxy.mux.Handle("/admin/access-token", adminSettingHandler(proxy, func(c *Config) *string { return &c.AccessToken }, nil))
+	proxy.mux.Handle("/admin/admin-token", adminSettingHandler(proxy, func(c *Config) *string { return &c.AdminToken }, func(token string) error {
+		if token == "" {
+			return errors.New("the admin token may not be blank, as the admin API would be disabled")
+		}
+		return nil
+	}))
+}
+
+// withLocalAdmin marks ctx as belonging to an in-process admin request.
+func withLocalAdmin(ctx context.Context) context.Context {
+	return context.WithValue(ctx, localAdminKey{}, true)
+}
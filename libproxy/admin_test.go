@@ -0,0 +1,188 @@
+package libproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newAdminTestProxy(t *testing.T) (*Proxy, *AdminClient) {
+	proxy, err := New(Options{Config: Config{
+		AccessToken:    "access",
+		AdminToken:     "admin",
+		AllowedOrigins: []string{"https://hoppscotch.io"},
+	}})
+	assert.Nil(t, err)
+
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return proxy, NewAdminClient(server.URL, "admin")
+}
+
+func TestAdminAPIRequiresToken(t *testing.T) {
+	proxy, client := newAdminTestProxy(t)
+
+	for _, path := range []string{"/admin/config", "/admin/allowed-origins", "/admin/access-token", "/admin/connections"} {
+		response := httptest.NewRecorder()
+		proxy.ServeHTTP(response, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusUnauthorized, response.Code, path)
+		assert.NotContains(t, response.Body.String(), "access", path)
+	}
+
+	// the token must be sent as a bearer token
+	for _, authorization := range []string{"admin", "Basic admin", "bearer admin"} {
+		request := httptest.NewRequest("GET", "/admin/config", nil)
+		request.Header.Set("Authorization", authorization)
+		response := httptest.NewRecorder()
+		proxy.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusUnauthorized, response.Code, authorization)
+	}
+
+	client.Token = "wrong"
+	_, err := client.AccessToken()
+	assert.Equal(t, &AdminError{StatusCode: http.StatusUnauthorized, Message: "(Proxy Error) Unauthorized request.", Code: ErrorCodeUnauthorized}, err)
+}
+
+func TestAdminAPISettings(t *testing.T) {
+	proxy, client := newAdminTestProxy(t)
+
+	origins, err := client.AllowedOrigins()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"https://hoppscotch.io"}, origins)
+
+	assert.Nil(t, client.SetAllowedOrigins([]string{"https://hoppscotch.io", "https://example.com"}))
+	assert.True(t, proxy.loadPolicy().isAllowedOrigin("https://example.com"))
+
+	assert.Nil(t, client.SetBannedDests([]string{"example.com"}))
+	assert.Nil(t, client.SetBannedOutputs([]string{"hunter2"}))
+	assert.Nil(t, client.SetRedactionRules([]RedactionRule{{Name: "api-key", Pattern: "key-[0-9]+"}}))
+	assert.Nil(t, client.SetAccessToken("new-access"))
+
+	config, err := client.Config()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"example.com"}, config.BannedDests)
+	assert.Equal(t, []string{"hunter2"}, config.BannedOutputs)
+	assert.Equal(t, "api-key", config.RedactionRules[0].Name)
+	assert.Equal(t, "new-access", proxy.AccessToken())
+
+	// invalid changes are rejected, leaving the configuration as it was
+	err = client.SetRedactionRules([]RedactionRule{{Name: "broken", Pattern: "("}})
+	assert.Equal(t, ErrorCodeInvalidConfig, err.(*AdminError).Code)
+	assert.Equal(t, http.StatusBadRequest, err.(*AdminError).StatusCode)
+	assert.Equal(t, "api-key", proxy.loadPolicy().config.RedactionRules[0].Name)
+
+	err = client.SetAllowedOrigins([]string{""})
+	assert.Equal(t, ErrorCodeInvalidConfig, err.(*AdminError).Code)
+
+	err = client.SetAdminToken("")
+	assert.Equal(t, ErrorCodeInvalidConfig, err.(*AdminError).Code)
+
+	// the client switches to the new admin token
+	assert.Nil(t, client.SetAdminToken("new-admin"))
+	assert.Equal(t, "new-admin", client.Token)
+	_, err = client.Config()
+	assert.Nil(t, err)
+	_, err = NewAdminClient(client.URL, "admin").Config()
+	assert.Equal(t, ErrorCodeUnauthorized, err.(*AdminError).Code)
+
+	// unsupported methods are refused
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/admin/allowed-origins", strings.NewReader("[]"))
+	request.Header.Set("Authorization", "Bearer new-admin")
+	proxy.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusMethodNotAllowed, response.Code)
+
+	// changes are kept when the configuration is reloaded, while the rest of it is replaced
+	proxy.SetConfigLoader(func() (Config, error) {
+		return Config{AccessToken: "file", AdminToken: "file-admin", AllowedOrigins: []string{"https://file.example"}, Retry: RetryPolicy{MaxAttempts: 3}}, nil
+	})
+	assert.Nil(t, client.Reload())
+	config, err = client.Config()
+	assert.Nil(t, err)
+	assert.Equal(t, "new-access", proxy.AccessToken())
+	assert.Equal(t, []string{"https://hoppscotch.io", "https://example.com"}, config.AllowedOrigins)
+	assert.Equal(t, []string{"example.com"}, config.BannedDests)
+	assert.Equal(t, 3, config.Retry.MaxAttempts)
+}
+
+func TestAdminAPIConnections(t *testing.T) {
+	proxy, client := newAdminTestProxy(t)
+
+	release := make(chan struct{})
+	destination := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, _ *http.Request) {
+		<-release
+	}))
+	defer destination.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		getResultFrom(proxy, Request{AccessToken: "access", Method: "GET", Url: destination.URL + "/slow"}, "https://hoppscotch.io")
+	}()
+
+	var connections AdminConnections
+	assert.Eventually(t, func() bool {
+		var err error
+		connections, err = client.Connections()
+		return err == nil && len(connections.Requests) == 1 && connections.Requests[0].Destination != ""
+	}, 5*time.Second, 10*time.Millisecond)
+
+	request := connections.Requests[0]
+	assert.Equal(t, "/", request.Path)
+	assert.Equal(t, "https://hoppscotch.io", request.Origin)
+	assert.Equal(t, "GET", request.Method)
+	assert.Equal(t, destination.URL+"/slow", request.Destination)
+	assert.Equal(t, int64(1), connections.OpenConnections)
+
+	close(release)
+	<-done
+
+	assert.Nil(t, client.CloseIdleConnections())
+	connections, err := client.Connections()
+	assert.Nil(t, err)
+	assert.Empty(t, connections.Requests)
+	assert.Equal(t, int64(0), connections.OpenConnections)
+}
+
+func TestLocalAdminClient(t *testing.T) {
+	proxy, err := New(Options{Config: Config{AccessToken: "access"}})
+	assert.Nil(t, err)
+
+	// no admin token is configured, but in-process requests are trusted
+	client := proxy.LocalAdminClient()
+	token, err := client.AccessToken()
+	assert.Nil(t, err)
+	assert.Equal(t, "access", token)
+
+	assert.Nil(t, client.SetAccessToken(""))
+	assert.Equal(t, "", proxy.AccessToken())
+
+	// but requests from elsewhere aren't
+	response := httptest.NewRecorder()
+	proxy.ServeHTTP(response, httptest.NewRequest("GET", "/admin/access-token", nil))
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+}
+
+func TestRegenerateCertificate(t *testing.T) {
+	proxy, err := New(Options{Config: Config{Host: "127.0.0.1:0", WithSSL: true}})
+	assert.Nil(t, err)
+	assert.Nil(t, proxy.Start())
+	defer proxy.Shutdown(context.Background())
+
+	certificate := func() []byte {
+		conn, err := tls.Dial("tcp", proxy.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		assert.Nil(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+
+	before := certificate()
+	assert.Nil(t, proxy.LocalAdminClient().RegenerateCertificate())
+	assert.NotEqual(t, before, certificate())
+}
@@ -0,0 +1,236 @@
+package libproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AdminClient makes requests to the admin API of a proxy.
+type AdminClient struct {
+	// URL is the address of the proxy (or its admin listener), e.g. http://localhost:9159.
+	URL string
+	// Token is the admin token.
+	Token      string
+	HTTPClient *http.Client
+}
+
+// NewAdminClient returns a client for the admin API of the proxy at url.
+func NewAdminClient(url string, token string) *AdminClient {
+	return &AdminClient{
+		URL:        strings.TrimSuffix(url, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// localTransport hands requests straight to a proxy in the same process.
+type localTransport struct {
+	proxy *Proxy
+}
+
+func (t localTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	t.proxy.ServeHTTP(recorder, request.WithContext(withLocalAdmin(request.Context())))
+	return recorder.Result(), nil
+}
+
+// LocalAdminClient returns a client for the admin API of proxy that calls it in-process, without
+// the admin token. This is how the desktop application manages its proxy.
+func (proxy *Proxy) LocalAdminClient() *AdminClient {
+	return &AdminClient{URL: "http://proxyscotch.local", HTTPClient: &http.Client{Transport: localTransport{proxy}}}
+}
+
+// AdminError is an error returned by the admin API.
+type AdminError struct {
+	StatusCode int
+	Message    string
+	Code       string
+}
+
+func (e *AdminError) Error() string {
+	return e.Message
+}
+
+// do makes a request to the admin API, sending in as JSON (unless it is nil) and decoding the
+// data of the response into out (unless it is nil).
+func (c *AdminClient) do(method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+
+	request, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var result struct {
+		Success bool            `json:"success"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return fmt.Errorf("unexpected response from the admin API (%s): %w", response.Status, err)
+	}
+	if !result.Success {
+		var data errorData
+		_ = json.Unmarshal(result.Data, &data)
+		if data.Message == "" {
+			data.Message = "the admin API request failed: " + response.Status
+		}
+		return &AdminError{StatusCode: response.StatusCode, Message: data.Message, Code: data.Code}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(result.Data, out)
+}
+
+// Config returns the running configuration.
+func (c *AdminClient) Config() (Config, error) {
+	var config Config
+	err := c.do(http.MethodGet, "/admin/config", nil, &config)
+	return config, err
+}
+
+func (c *AdminClient) getList(path string) ([]string, error) {
+	var values []string
+	err := c.do(http.MethodGet, path, nil, &values)
+	return values, err
+}
+
+func (c *AdminClient) setList(path string, values []string) error {
+	if values == nil {
+		values = []string{}
+	}
+	return c.do(http.MethodPut, path, values, nil)
+}
+
+// AllowedOrigins returns the origins allowed to use the proxy.
+func (c *AdminClient) AllowedOrigins() ([]string, error) {
+	return c.getList("/admin/allowed-origins")
+}
+
+// SetAllowedOrigins replaces the origins allowed to use the proxy.
+func (c *AdminClient) SetAllowedOrigins(origins []string) error {
+	return c.setList("/admin/allowed-origins", origins)
+}
+
+// BannedDests returns the destination hosts the proxy refuses to make requests to.
+func (c *AdminClient) BannedDests() ([]string, error) {
+	return c.getList("/admin/banned-dests")
+}
+
+// SetBannedDests replaces the destination hosts the proxy refuses to make requests to.
+func (c *AdminClient) SetBannedDests(dests []string) error {
+	return c.setList("/admin/banned-dests", dests)
+}
+
+// BannedOutputs returns the values redacted from every response.
+func (c *AdminClient) BannedOutputs() ([]string, error) {
+	return c.getList("/admin/banned-outputs")
+}
+
+// SetBannedOutputs replaces the values redacted from every response.
+func (c *AdminClient) SetBannedOutputs(outputs []string) error {
+	return c.setList("/admin/banned-outputs", outputs)
+}
+
+// RedactionRules returns the redaction rules applied in addition to the banned outputs.
+func (c *AdminClient) RedactionRules() ([]RedactionRule, error) {
+	var rules []RedactionRule
+	err := c.do(http.MethodGet, "/admin/redaction-rules", nil, &rules)
+	return rules, err
+}
+
+// SetRedactionRules replaces the redaction rules applied in addition to the banned outputs.
+func (c *AdminClient) SetRedactionRules(rules []RedactionRule) error {
+	if rules == nil {
+		rules = []RedactionRule{}
+	}
+	return c.do(http.MethodPut, "/admin/redaction-rules", rules, nil)
+}
+
+// AccessToken returns the access token required to use the proxy.
+func (c *AdminClient) AccessToken() (string, error) {
+	var token string
+	err := c.do(http.MethodGet, "/admin/access-token", nil, &token)
+	return token, err
+}
+
+// SetAccessToken replaces the access token required to use the proxy. A blank token allows
+// anyone to use it.
+func (c *AdminClient) SetAccessToken(token string) error {
+	return c.do(http.MethodPut, "/admin/access-token", token, nil)
+}
+
+// SetAdminToken replaces the admin token. The client uses the new token for later requests.
+func (c *AdminClient) SetAdminToken(token string) error {
+	if err := c.do(http.MethodPut, "/admin/admin-token", token, nil); err != nil {
+		return err
+	}
+
+	if c.Token != "" {
+		c.Token = token
+	}
+	return nil
+}
+
+// Connections returns the connections the proxy holds and the requests it is relaying.
+func (c *AdminClient) Connections() (AdminConnections, error) {
+	var connections AdminConnections
+	err := c.do(http.MethodGet, "/admin/connections", nil, &connections)
+	return connections, err
+}
+
+// CloseIdleConnections closes the proxy's idle connections to destinations.
+func (c *AdminClient) CloseIdleConnections() error {
+	return c.do(http.MethodDelete, "/admin/connections", nil, nil)
+}
+
+// Recordings returns the recordings in progress.
+func (c *AdminClient) Recordings() ([]RecordingInfo, error) {
+	var recordings []RecordingInfo
+	err := c.do(http.MethodGet, "/admin/recordings", nil, &recordings)
+	return recordings, err
+}
+
+// StopRecording stops the recording with the given ID, returning where it was written.
+func (c *AdminClient) StopRecording(id string) (RecordingInfo, error) {
+	var recording RecordingInfo
+	err := c.do(http.MethodDelete, "/admin/recordings?id="+url.QueryEscape(id), nil, &recording)
+	return recording, err
+}
+
+// RegenerateCertificate replaces the proxy's certificate (see Proxy.RegenerateCertificate).
+func (c *AdminClient) RegenerateCertificate() error {
+	return c.do(http.MethodPost, "/admin/certificate", nil, nil)
+}
+
+// Reload reloads the proxy's configuration from its file.
+func (c *AdminClient) Reload() error {
+	return c.do(http.MethodPost, "/admin/reload", nil, nil)
+}
@@ -0,0 +1,625 @@
+package libproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Authentication schemes supported by RequestAuth.
+const (
+	AuthTypeBasic    = "basic"
+	AuthTypeDigest   = "digest"
+	AuthTypeAWSSigV4 = "aws-sigv4"
+	AuthTypeOAuth1   = "oauth1"
+	AuthTypeHMAC     = "hmac"
+	// AuthTypeNTLM and AuthTypeNegotiate authenticate the connection, rather than each request.
+	// Negotiate uses Kerberos if the proxy has a Kerberos identity configured (see
+	// KerberosConfig), and NTLM otherwise.
+	AuthTypeNTLM      = "ntlm"
+	AuthTypeNegotiate = "negotiate"
+)
+
+// RequestAuth describes how the proxy should authenticate a request. Schemes other than Basic
+// sign the request exactly as it is sent, after the proxy's own headers and any hooks have been
+// applied.
+type RequestAuth struct {
+	// Type is the authentication scheme. If blank, Basic authentication is used when both a
+	// username and password are given.
+	Type string
+	// Username and Password are used by Basic, Digest and NTLM authentication. For NTLM, the
+	// username may include the domain, e.g. DOMAIN\user.
+	Username string
+	Password string
+	// SPN is the service principal name used for Negotiate authentication with Kerberos
+	// (default: HTTP/<host>).
+	SPN string
+	// Credential names the OAuth 2.0 credential, fetched with the /oauth2/token endpoint, whose
+	// token is attached to the request.
+	Credential string
+
+	AWS    AWSSigV4Auth
+	OAuth1 OAuth1Auth
+	HMAC   HMACAuth
+}
+
+// AWSSigV4Auth holds the credentials used to sign a request with AWS Signature Version 4.
+type AWSSigV4Auth struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is sent as X-Amz-Security-Token when using temporary credentials.
+	SessionToken string
+	Region       string
+	Service      string
+}
+
+// OAuth1Auth holds the credentials used to sign a request with OAuth 1.0a (RFC 5849).
+type OAuth1Auth struct {
+	ConsumerKey    string
+	ConsumerSecret string
+	Token          string
+	TokenSecret    string
+	// SignatureMethod is HMAC-SHA1 (the default), HMAC-SHA256 or PLAINTEXT.
+	SignatureMethod string
+	Realm           string
+}
+
+// HMACAuth signs a request with a shared secret. The signature is computed over the method, the
+// request URI (path and query), the timestamp and the hex encoded SHA-256 hash of the body, each
+// followed by a newline except the last.
+type HMACAuth struct {
+	Secret string
+	// Algorithm is sha256 (the default), sha1 or sha512.
+	Algorithm string
+	// Encoding is hex (the default) or base64.
+	Encoding string
+	// Header receives the signature (default: X-Signature).
+	Header string
+	// TimestampHeader receives the Unix time the request was signed at (default: X-Timestamp).
+	TimestampHeader string
+}
+
+// signingTime and signingNonce are replaced by tests to make signatures reproducible.
+var (
+	signingTime  = time.Now
+	signingNonce = func() string {
+		nonce := make([]byte, 16)
+		_, _ = rand.Read(nonce)
+		return hex.EncodeToString(nonce)
+	}
+)
+
+// errUnknownAuthType is returned for an unsupported RequestAuth.Type.
+var errUnknownAuthType = errors.New("unknown authentication type")
+
+// usesBasicAuth returns true if the request should be sent with Basic authentication.
+func (auth RequestAuth) usesBasicAuth() bool {
+	switch auth.Type {
+	case "", AuthTypeBasic:
+		return len(auth.Username) > 0 && len(auth.Password) > 0
+	default:
+		return false
+	}
+}
+
+// validate checks the auth type is supported, so that a mistake is reported before the request
+// is sent rather than sending it unauthenticated.
+func (auth RequestAuth) validate() error {
+	switch auth.Type {
+	case "", AuthTypeBasic, AuthTypeDigest, AuthTypeAWSSigV4, AuthTypeOAuth1, AuthTypeHMAC, AuthTypeNTLM, AuthTypeNegotiate:
+		return nil
+	case AuthTypeOAuth2:
+		if auth.Credential == "" {
+			return errors.New("oauth2 authentication requires the name of a credential")
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w %q", errUnknownAuthType, auth.Type)
+	}
+}
+
+// sign adds the signature for the schemes that sign the request up front. Digest and NTLM
+// authentication are handled by sendWithAuth, as they need the server's challenge. kerberos is the
+// proxy's Kerberos identity, or nil if it has none.
+func (auth RequestAuth) sign(request *http.Request, kerberos *kerberosAuth) error {
+	switch auth.Type {
+	case AuthTypeNegotiate:
+		if kerberos != nil {
+			return kerberos.setHeader(request, auth.SPN)
+		}
+		if auth.Username == "" || auth.Password == "" {
+			return errors.New("negotiate authentication requires a username and password, as the proxy has no Kerberos identity configured")
+		}
+	case AuthTypeAWSSigV4:
+		return auth.AWS.sign(request)
+	case AuthTypeOAuth1:
+		return auth.OAuth1.sign(request)
+	case AuthTypeHMAC:
+		return auth.HMAC.sign(request)
+	}
+
+	return nil
+}
+
+// sendWithAuth sends the (signed) request with client. For Digest authentication, the request is
+// first sent without credentials and, if the server responds with a Digest challenge, sent again
+// with the response to it. NTLM (and Negotiate, without Kerberos) take a further round trip.
+func (auth RequestAuth) sendWithAuth(client *http.Client, request *http.Request, kerberos *kerberosAuth) (*http.Response, error) {
+	switch {
+	case auth.Type == AuthTypeNTLM || (auth.Type == AuthTypeNegotiate && kerberos == nil):
+		return sendWithNTLM(client, request, auth.Username, auth.Password)
+	case auth.Type != AuthTypeDigest:
+		return client.Do(request)
+	}
+
+	// The body may need to be sent twice.
+	body, err := bufferBody(request)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.Do(request)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+
+	challenge, ok := parseDigestChallenge(response.Header.Values("WWW-Authenticate"))
+	if !ok {
+		return response, nil
+	}
+	discardResponse(response)
+
+	authorization, err := challenge.authorize(request, body, auth.Username, auth.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	retry := request.Clone(request.Context())
+	if request.GetBody != nil {
+		retry.Body, _ = request.GetBody()
+	}
+	retry.Header.Set("Authorization", authorization)
+	return client.Do(retry)
+}
+
+// bufferBody reads the request body into memory so that it can be hashed, replacing it (and
+// GetBody) so that it can still be sent, and sent again.
+func bufferBody(request *http.Request) ([]byte, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(request.Body)
+	_ = request.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	request.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	request.ContentLength = int64(len(body))
+	return body, nil
+}
+
+// requestHost returns the host the request will be sent to, as it appears in the Host header.
+func requestHost(request *http.Request) string {
+	if request.Host != "" {
+		return request.Host
+	}
+
+	return request.URL.Host
+}
+
+// percentEncode encodes s as described by RFC 3986, leaving only unreserved characters (and
+// slashes, unless encodeSlash is set) unencoded. Both AWS and OAuth 1.0a require this exact
+// encoding, which differs from url.QueryEscape.
+func percentEncode(s string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+
+	return encoded.String()
+}
+
+func hmacSum(newHash func() hash.Hash, key []byte, data string) []byte {
+	mac := hmac.New(newHash, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign signs request with AWS Signature Version 4, adding the Authorization and X-Amz-Date
+// headers (and X-Amz-Security-Token and, for S3, X-Amz-Content-Sha256).
+func (aws AWSSigV4Auth) sign(request *http.Request) error {
+	if aws.AccessKeyID == "" || aws.SecretAccessKey == "" || aws.Region == "" || aws.Service == "" {
+		return errors.New("AWS Signature V4 requires an access key ID, secret access key, region and service")
+	}
+
+	body, err := bufferBody(request)
+	if err != nil {
+		return err
+	}
+
+	now := signingTime().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	if aws.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", aws.SessionToken)
+	}
+	if aws.Service == "s3" {
+		request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	// The host, content type and any x-amz-* headers are signed.
+	headers := map[string]string{"host": requestHost(request)}
+	for name, values := range request.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			// The values are trimmed for signing only, and sent as they are.
+			trimmed := make([]string, len(values))
+			for i, value := range values {
+				trimmed[i] = strings.Join(strings.Fields(value), " ")
+			}
+			headers[name] = strings.Join(trimmed, ",")
+		}
+	}
+	signedHeaders := make([]string, 0, len(headers))
+	for name := range headers {
+		signedHeaders = append(signedHeaders, name)
+	}
+	sort.Strings(signedHeaders)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	// Paths are encoded once more, except for S3.
+	path := request.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if aws.Service != "s3" {
+		path = percentEncode(path, false)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		path,
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + aws.Region + "/" + aws.Service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSum(sha256.New, []byte("AWS4"+aws.SecretAccessKey), date)
+	key = hmacSum(sha256.New, key, aws.Region)
+	key = hmacSum(sha256.New, key, aws.Service)
+	key = hmacSum(sha256.New, key, "aws4_request")
+	signature := hex.EncodeToString(hmacSum(sha256.New, key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		aws.AccessKeyID, scope, strings.Join(signedHeaders, ";"), signature,
+	))
+	return nil
+}
+
+// canonicalQuery encodes query parameters sorted by encoded name and then value, as required by
+// AWS and OAuth 1.0a. The pairs aren't sorted as joined strings, which would put "a-b=1" before
+// "a=1".
+func canonicalQuery(query url.Values) string {
+	var params [][2]string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, [2]string{percentEncode(name, true), percentEncode(value, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+
+	encoded := make([]string, len(params))
+	for i, param := range params {
+		encoded[i] = param[0] + "=" + param[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+// sign signs request with OAuth 1.0a, adding the Authorization header.
+func (oauth OAuth1Auth) sign(request *http.Request) error {
+	if oauth.ConsumerKey == "" {
+		return errors.New("OAuth 1.0a requires a consumer key")
+	}
+
+	method := oauth.SignatureMethod
+	if method == "" {
+		method = "HMAC-SHA1"
+	}
+
+	oauthParams := map[string]string{
+		"oauth_consumer_key":     oauth.ConsumerKey,
+		"oauth_nonce":            signingNonce(),
+		"oauth_signature_method": method,
+		"oauth_timestamp":        strconv.FormatInt(signingTime().Unix(), 10),
+	}
+	if oauth.Token != "" {
+		oauthParams["oauth_token"] = oauth.Token
+	}
+
+	// The query and any form encoded body are included in the signature.
+	params := request.URL.Query()
+	if strings.HasPrefix(request.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		body, err := bufferBody(request)
+		if err != nil {
+			return err
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return err
+		}
+		for name, values := range form {
+			params[name] = append(params[name], values...)
+		}
+	}
+	for name, value := range oauthParams {
+		params.Set(name, value)
+	}
+
+	baseURL := url.URL{Scheme: strings.ToLower(request.URL.Scheme), Host: strings.ToLower(requestHost(request)), Path: request.URL.Path}
+	if port := baseURL.Port(); (baseURL.Scheme == "http" && port == "80") || (baseURL.Scheme == "https" && port == "443") {
+		baseURL.Host = baseURL.Hostname()
+	}
+
+	baseString := strings.Join([]string{
+		strings.ToUpper(request.Method),
+		percentEncode(baseURL.String(), true),
+		percentEncode(canonicalQuery(params), true),
+	}, "&")
+	key := percentEncode(oauth.ConsumerSecret, true) + "&" + percentEncode(oauth.TokenSecret, true)
+
+	switch method {
+	case "HMAC-SHA1":
+		oauthParams["oauth_signature"] = base64.StdEncoding.EncodeToString(hmacSum(sha1.New, []byte(key), baseString))
+	case "HMAC-SHA256":
+		oauthParams["oauth_signature"] = base64.StdEncoding.EncodeToString(hmacSum(sha256.New, []byte(key), baseString))
+	case "PLAINTEXT":
+		oauthParams["oauth_signature"] = key
+	default:
+		return fmt.Errorf("unsupported OAuth 1.0a signature method %q", method)
+	}
+
+	names := make([]string, 0, len(oauthParams))
+	for name := range oauthParams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var fields []string
+	if oauth.Realm != "" {
+		fields = append(fields, "realm=\""+percentEncode(oauth.Realm, true)+"\"")
+	}
+	for _, name := range names {
+		fields = append(fields, name+"=\""+percentEncode(oauthParams[name], true)+"\"")
+	}
+
+	request.Header.Set("Authorization", "OAuth "+strings.Join(fields, ", "))
+	return nil
+}
+
+// sign signs request with the shared secret, adding the signature and timestamp headers.
+func (h HMACAuth) sign(request *http.Request) error {
+	if h.Secret == "" {
+		return errors.New("HMAC signing requires a secret")
+	}
+
+	var newHash func() hash.Hash
+	switch strings.ToLower(h.Algorithm) {
+	case "", "sha256":
+		newHash = sha256.New
+	case "sha1":
+		newHash = sha1.New
+	case "sha512":
+		newHash = sha512.New
+	default:
+		return fmt.Errorf("unsupported HMAC algorithm %q", h.Algorithm)
+	}
+
+	body, err := bufferBody(request)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(signingTime().Unix(), 10)
+	signature := hmacSum(newHash, []byte(h.Secret), strings.Join([]string{
+		request.Method,
+		request.URL.RequestURI(),
+		timestamp,
+		sha256Hex(body),
+	}, "\n"))
+
+	var encoded string
+	switch strings.ToLower(h.Encoding) {
+	case "", "hex":
+		encoded = hex.EncodeToString(signature)
+	case "base64":
+		encoded = base64.StdEncoding.EncodeToString(signature)
+	default:
+		return fmt.Errorf("unsupported HMAC encoding %q", h.Encoding)
+	}
+
+	header, timestampHeader := h.Header, h.TimestampHeader
+	if header == "" {
+		header = "X-Signature"
+	}
+	if timestampHeader == "" {
+		timestampHeader = "X-Timestamp"
+	}
+	request.Header.Set(timestampHeader, timestamp)
+	request.Header.Set(header, encoded)
+	return nil
+}
+
+// digestChallenge holds the parameters of a WWW-Authenticate: Digest challenge (RFC 7616).
+type digestChallenge map[string]string
+
+// parseDigestChallenge finds a Digest challenge among the WWW-Authenticate headers.
+func parseDigestChallenge(headers []string) (digestChallenge, bool) {
+	for _, header := range headers {
+		if len(header) < 7 || !strings.EqualFold(header[:7], "Digest ") {
+			continue
+		}
+
+		challenge := digestChallenge{}
+		rest := header[7:]
+		for rest != "" {
+			rest = strings.TrimLeft(rest, " ,")
+			eq := strings.IndexByte(rest, '=')
+			if eq < 0 {
+				break
+			}
+			name := strings.ToLower(strings.TrimSpace(rest[:eq]))
+			rest = rest[eq+1:]
+
+			var value string
+			if strings.HasPrefix(rest, "\"") {
+				end := 1
+				var unquoted strings.Builder
+				for ; end < len(rest) && rest[end] != '"'; end++ {
+					if rest[end] == '\\' && end+1 < len(rest) {
+						end++
+					}
+					unquoted.WriteByte(rest[end])
+				}
+				value = unquoted.String()
+				if end < len(rest) {
+					end++
+				}
+				rest = rest[end:]
+			} else {
+				end := strings.IndexByte(rest, ',')
+				if end < 0 {
+					end = len(rest)
+				}
+				value = strings.TrimSpace(rest[:end])
+				rest = rest[end:]
+			}
+			challenge[name] = value
+		}
+
+		return challenge, true
+	}
+
+	return nil, false
+}
+
+// authorize returns the Authorization header answering the challenge for request.
+func (c digestChallenge) authorize(request *http.Request, body []byte, username string, password string) (string, error) {
+	algorithm := c["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	case "SHA-512-256":
+		newHash = sha512.New512_256
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	h := func(data string) string {
+		digest := newHash()
+		digest.Write([]byte(data))
+		return hex.EncodeToString(digest.Sum(nil))
+	}
+
+	// Prefer qop=auth, which is the most widely supported.
+	var qop string
+	for _, offered := range strings.Split(c["qop"], ",") {
+		offered = strings.TrimSpace(offered)
+		if offered == "auth" || (offered == "auth-int" && qop == "") {
+			qop = offered
+		}
+	}
+
+	uri := request.URL.RequestURI()
+	nonce, cnonce, nc := c["nonce"], signingNonce(), "00000001"
+
+	ha1 := h(username + ":" + c["realm"] + ":" + password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(request.Method + ":" + uri)
+	if qop == "auth-int" {
+		ha2 = h(request.Method + ":" + uri + ":" + h(string(body)))
+	}
+
+	var response string
+	if qop == "" {
+		response = h(ha1 + ":" + nonce + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+	}
+
+	quote := func(value string) string {
+		return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(value) + "\""
+	}
+	fields := []string{
+		"username=" + quote(username),
+		"realm=" + quote(c["realm"]),
+		"nonce=" + quote(nonce),
+		"uri=" + quote(uri),
+		"algorithm=" + algorithm,
+		"response=" + quote(response),
+	}
+	if qop != "" {
+		fields = append(fields, "qop="+qop, "nc="+nc, "cnonce="+quote(cnonce))
+	}
+	if opaque, ok := c["opaque"]; ok {
+		fields = append(fields, "opaque="+quote(opaque))
+	}
+
+	return "Digest " + strings.Join(fields, ", "), nil
+}
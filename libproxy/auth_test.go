@@ -0,0 +1,161 @@
+package libproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withSigningValues fixes the time and nonce used in signatures for the duration of the test.
+func withSigningValues(t *testing.T, now time.Time, nonce string) {
+	previousTime, previousNonce := signingTime, signingNonce
+	signingTime = func() time.Time { return now }
+	signingNonce = func() string { return nonce }
+	t.Cleanup(func() {
+		signingTime, signingNonce = previousTime, previousNonce
+	})
+}
+
+func TestAWSSigV4(t *testing.T) {
+	// test cases from the AWS Signature Version 4 test suite
+	withSigningValues(t, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC), "")
+	auth := AWSSigV4Auth{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:          "us-east-1",
+		Service:         "service",
+	}
+
+	for url, signature := range map[string]string{
+		"https://example.amazonaws.com/":                             "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		"https://example.amazonaws.com/?Param2=value2&Param1=value1": "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+	} {
+		request, _ := http.NewRequest("GET", url, nil)
+		assert.Nil(t, auth.sign(request))
+		assert.Equal(t, "20150830T123600Z", request.Header.Get("X-Amz-Date"))
+		assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature="+signature, request.Header.Get("Authorization"), url)
+	}
+
+	// the body is hashed, but can still be sent
+	request, _ := http.NewRequest("PUT", "https://bucket.s3.amazonaws.com/key", strings.NewReader("content"))
+	auth.Service = "s3"
+	auth.SessionToken = "session"
+	assert.Nil(t, auth.sign(request))
+	assert.Equal(t, sha256Hex([]byte("content")), request.Header.Get("X-Amz-Content-Sha256"))
+	assert.Contains(t, request.Header.Get("Authorization"), "SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token,")
+	body, _ := bufferBody(request)
+	assert.Equal(t, "content", string(body))
+
+	// header values are trimmed for signing only
+	request, _ = http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	request.Header.Set("X-Amz-Meta-Note", "  spaced   out ")
+	assert.Nil(t, auth.sign(request))
+	assert.Equal(t, "  spaced   out ", request.Header.Get("X-Amz-Meta-Note"))
+
+	assert.NotNil(t, AWSSigV4Auth{AccessKeyID: "AKIDEXAMPLE"}.sign(request))
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	// parameters are sorted by name, then value, rather than as "name=value" strings
+	assert.Equal(t, "a=1&a=2&a-b=1&b=%20", canonicalQuery(url.Values{"a-b": {"1"}, "a": {"2", "1"}, "b": {" "}}))
+}
+
+func TestOAuth1(t *testing.T) {
+	// the example from RFC 5849, section 1.2
+	withSigningValues(t, time.Unix(137131202, 0), "chapoH")
+	auth := OAuth1Auth{
+		ConsumerKey:    "dpf43f3p2l4k3l03",
+		ConsumerSecret: "kd94hf93k423kf44",
+		Token:          "nnch734d00sl2jdk",
+		TokenSecret:    "pfkkdhi9sl3r4s00",
+		Realm:          "Photos",
+	}
+
+	request, _ := http.NewRequest("GET", "http://photos.example.net/photos?file=vacation.jpg&size=original", nil)
+	assert.Nil(t, auth.sign(request))
+	assert.Equal(t, "OAuth realm=\"Photos\", "+
+		"oauth_consumer_key=\"dpf43f3p2l4k3l03\", "+
+		"oauth_nonce=\"chapoH\", "+
+		"oauth_signature=\"MdpQcU8iPSUjWoN%2FUDMsK2sui9I%3D\", "+
+		"oauth_signature_method=\"HMAC-SHA1\", "+
+		"oauth_timestamp=\"137131202\", "+
+		"oauth_token=\"nnch734d00sl2jdk\"", request.Header.Get("Authorization"))
+
+	auth.SignatureMethod = "RSA-SHA1"
+	assert.NotNil(t, auth.sign(request))
+}
+
+func TestHMACAuth(t *testing.T) {
+	withSigningValues(t, time.Unix(1700000000, 0), "")
+
+	resp := getResultDef(Request{
+		Method: "POST",
+		Url:    testServerUrl + "/anything?a=b",
+		Data:   "payload",
+		Auth:   RequestAuth{Type: AuthTypeHMAC, HMAC: HMACAuth{Secret: "shared-secret"}},
+	})
+	assert.Equal(t, 200, resp.requestResponse.Status)
+	httpBinResponse := checkErrorNUnmarshalHTTPBinResponse(resp.requestResponse.Data, t)
+
+	mac := hmac.New(sha256.New, []byte("shared-secret"))
+	mac.Write([]byte("POST\n/anything?a=b\n1700000000\n" + sha256Hex([]byte("payload"))))
+	assert.Equal(t, "1700000000", httpBinResponse.Headers.Get("X-Timestamp"))
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), httpBinResponse.Headers.Get("X-Signature"))
+}
+
+func TestDigestAuth(t *testing.T) {
+	for _, path := range []string{"/digest-auth/auth/user/passwd", "/digest-auth/auth/user/passwd/SHA-256"} {
+		request := Request{
+			Method: "GET",
+			Url:    testServerUrl + path,
+			Auth:   RequestAuth{Type: AuthTypeDigest, Username: "user", Password: "passwd"},
+		}
+		resp := getResultDef(request)
+		assert.Equal(t, 200, resp.requestResponse.Status, path)
+
+		request.Auth.Password = "wrong"
+		resp = getResultDef(request)
+		assert.Equal(t, 401, resp.requestResponse.Status, path)
+	}
+}
+
+func TestParseDigestChallenge(t *testing.T) {
+	challenge, ok := parseDigestChallenge([]string{
+		"Basic realm=\"basic\"",
+		"Digest realm=\"a \\\"quoted\\\", realm\", qop=\"auth,auth-int\", nonce=\"abc\", algorithm=MD5-sess, opaque=\"xyz\"",
+	})
+	assert.True(t, ok)
+	assert.Equal(t, digestChallenge{
+		"realm":     "a \"quoted\", realm",
+		"qop":       "auth,auth-int",
+		"nonce":     "abc",
+		"algorithm": "MD5-sess",
+		"opaque":    "xyz",
+	}, challenge)
+
+	_, ok = parseDigestChallenge([]string{"Basic realm=\"basic\""})
+	assert.False(t, ok)
+}
+
+func TestInvalidAuth(t *testing.T) {
+	resp := getResultDef(Request{
+		Method: "GET",
+		Url:    testServerUrl + "/get",
+		Auth:   RequestAuth{Type: "kerberos-but-spelled-wrong"},
+	})
+	assert.Equal(t, ErrorCodeAuthFailed, getErrorBody(t, resp).Data.Code)
+
+	resp = getResultDef(Request{
+		Method: "GET",
+		Url:    testServerUrl + "/get",
+		Auth:   RequestAuth{Type: AuthTypeAWSSigV4},
+	})
+	assert.Equal(t, ErrorCodeAuthFailed, getErrorBody(t, resp).Data.Code)
+}
@@ -0,0 +1,640 @@
+package libproxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values of Request.Cache.
+const (
+	// CacheBypass fetches the response from the destination without looking in the cache. The
+	// response is still stored, if it may be.
+	CacheBypass = "bypass"
+	// CacheForce serves any cached response, however stale, without revalidating it.
+	CacheForce = "force"
+)
+
+// Values of Response.Cache, reporting how the cache was used.
+const (
+	CacheHit         = "hit"
+	CacheMiss        = "miss"
+	CacheRevalidated = "revalidated"
+)
+
+// defaultCacheMemorySize is the size of the in-memory cache if CacheConfig.MaxMemorySize isn't
+// set.
+const defaultCacheMemorySize = ByteSize(32 << 20)
+
+// heuristicFreshnessLimit caps the freshness of responses with a Last-Modified date but no
+// explicit expiry (see freshnessLifetime).
+const heuristicFreshnessLimit = 24 * time.Hour
+
+// CacheConfig configures the cache of responses to GET requests.
+type CacheConfig struct {
+	// Enabled caches responses according to their Cache-Control, Expires, ETag and Last-Modified
+	// headers.
+	Enabled bool `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	// MaxMemorySize is the size of the in-memory cache. Defaults to 32MB.
+	MaxMemorySize ByteSize `json:"maxMemorySize,omitempty" yaml:"maxMemorySize,omitempty"`
+	// MaxDiskSize is the size of the cache kept in the cache folder of the data directory, which
+	// survives restarts. If 0, responses are only cached in memory.
+	MaxDiskSize ByteSize `json:"maxDiskSize,omitempty" yaml:"maxDiskSize,omitempty"`
+}
+
+// cacheableStatuses are the statuses of responses that may be cached.
+var cacheableStatuses = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true, 404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	Status     string      `json:"status"`
+	StatusCode int         `json:"statusCode"`
+	Proto      string      `json:"proto"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	// Vary holds the values of the request headers named by the response's Vary header.
+	Vary map[string]string `json:"vary,omitempty"`
+	// RequestTime and ResponseTime are when the request that fetched (or last revalidated) the
+	// response was sent, and when the response was received.
+	RequestTime  time.Time `json:"requestTime"`
+	ResponseTime time.Time `json:"responseTime"`
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.Body))
+	for name, values := range e.Header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+
+	return size
+}
+
+// cacheControl parses the Cache-Control directives in header, with their names in lower case.
+func cacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, argument, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(argument, "\"")
+			}
+		}
+	}
+	// Pragma: no-cache is the HTTP/1.0 equivalent of Cache-Control: no-cache.
+	if _, ok := directives["no-cache"]; !ok && strings.EqualFold(header.Get("Pragma"), "no-cache") && header.Get("Cache-Control") == "" {
+		directives["no-cache"] = ""
+	}
+
+	return directives
+}
+
+// seconds parses a delta-seconds directive value, returning false if it isn't valid.
+func seconds(value string) (time.Duration, bool) {
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed < 0 {
+		return 0, false
+	}
+
+	return time.Duration(parsed) * time.Second, true
+}
+
+// date returns the Date of the response, or when it was received if it has none.
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+
+	return e.ResponseTime
+}
+
+// freshnessLifetime returns how long the response is fresh for after it was generated (RFC 9111
+// section 4.2.1).
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	if maxAge, ok := seconds(cacheControl(e.Header)["max-age"]); ok {
+		return maxAge
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		// An invalid Expires date means the response has already expired.
+		expiry, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return expiry.Sub(e.date())
+	}
+
+	// Otherwise, assume that a response that hasn't changed for a while won't change for a tenth
+	// of that time again.
+	lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	if err != nil {
+		return 0
+	}
+	lifetime := e.date().Sub(lastModified) / 10
+	if lifetime > heuristicFreshnessLimit {
+		lifetime = heuristicFreshnessLimit
+	}
+	return lifetime
+}
+
+// age returns how old the response is at now (RFC 9111 section 4.2.3).
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparentAge := e.ResponseTime.Sub(e.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	ageValue, _ := seconds(e.Header.Get("Age"))
+	correctedAge := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	if correctedAge > apparentAge {
+		apparentAge = correctedAge
+	}
+
+	return apparentAge + now.Sub(e.ResponseTime)
+}
+
+// hasValidators returns true if the response can be revalidated.
+func (e *cacheEntry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// response returns the cached response, as an answer to request.
+func (e *cacheEntry) response(request *http.Request, now time.Time) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+
+	return &http.Response{
+		Status:        e.Status,
+		StatusCode:    e.StatusCode,
+		Proto:         e.Proto,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       request,
+	}
+}
+
+// memoryCache holds the most recently used entries, up to a total size.
+type memoryCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	// order lists the keys of the entries, most recently used first.
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *cacheEntry
+}
+
+func (m *memoryCache) get(key string) *cacheEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	m.order.MoveToFront(element)
+	return element.Value.(*memoryItem).entry
+}
+
+func (m *memoryCache) put(key string, entry *cacheEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remove(key)
+	if entry.size() > m.maxSize {
+		return
+	}
+	m.entries[key] = m.order.PushFront(&memoryItem{key, entry})
+	m.size += entry.size()
+	for m.size > m.maxSize {
+		m.remove(m.order.Back().Value.(*memoryItem).key)
+	}
+}
+
+// remove removes the entry with key. m.mu must be held.
+func (m *memoryCache) remove(key string) {
+	if element, ok := m.entries[key]; ok {
+		m.order.Remove(element)
+		delete(m.entries, key)
+		m.size -= element.Value.(*memoryItem).entry.size()
+	}
+}
+
+// diskCache keeps entries in files named by their key, up to a total size. The least recently
+// used files are removed first.
+type diskCache struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64
+	size    int64
+	files   map[string]*diskFile
+}
+
+type diskFile struct {
+	size int64
+	used time.Time
+}
+
+// newDiskCache opens the cache in dir, indexing the files already in it.
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &diskCache{dir: dir, maxSize: maxSize, files: map[string]*diskFile{}}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		cache.files[strings.TrimSuffix(entry.Name(), ".json")] = &diskFile{size: info.Size(), used: info.ModTime()}
+		cache.size += info.Size()
+	}
+	cache.mu.Lock()
+	cache.evict()
+	cache.mu.Unlock()
+
+	return cache, nil
+}
+
+func (d *diskCache) path(key string) string {
+	return filepath.Join(d.dir, key+".json")
+}
+
+func (d *diskCache) get(key string) *cacheEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	file, ok := d.files[key]
+	if !ok {
+		return nil
+	}
+
+	var entry cacheEntry
+	data, err := os.ReadFile(d.path(key))
+	if err == nil {
+		err = json.Unmarshal(data, &entry)
+	}
+	if err != nil {
+		d.remove(key)
+		return nil
+	}
+
+	file.used = time.Now()
+	return &entry
+}
+
+func (d *diskCache) put(key string, entry *cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.remove(key)
+	if int64(len(data)) > d.maxSize {
+		return nil
+	}
+	// Write the file in full before it replaces any existing one.
+	temporary := d.path(key) + ".tmp"
+	if err := os.WriteFile(temporary, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(temporary, d.path(key)); err != nil {
+		_ = os.Remove(temporary)
+		return err
+	}
+
+	d.files[key] = &diskFile{size: int64(len(data)), used: time.Now()}
+	d.size += int64(len(data))
+	d.evict()
+	return nil
+}
+
+// remove removes the file with key. d.mu must be held.
+func (d *diskCache) remove(key string) {
+	if file, ok := d.files[key]; ok {
+		_ = os.Remove(d.path(key))
+		delete(d.files, key)
+		d.size -= file.size
+	}
+}
+
+// evict removes the least recently used files until the cache fits its maximum size. d.mu must
+// be held.
+func (d *diskCache) evict() {
+	if d.size <= d.maxSize {
+		return
+	}
+
+	keys := make([]string, 0, len(d.files))
+	for key := range d.files {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return d.files[keys[i]].used.Before(d.files[keys[j]].used) })
+	for _, key := range keys {
+		if d.size <= d.maxSize {
+			break
+		}
+		d.remove(key)
+	}
+}
+
+// responseCache caches responses in memory and, optionally, on disk. A nil responseCache caches
+// nothing.
+type responseCache struct {
+	memory *memoryCache
+	disk   *diskCache
+}
+
+// newResponseCache creates the cache described by config, or returns nil if caching is disabled.
+func newResponseCache(config CacheConfig) (*responseCache, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	maxMemorySize := config.MaxMemorySize
+	if maxMemorySize <= 0 {
+		maxMemorySize = defaultCacheMemorySize
+	}
+	cache := &responseCache{memory: &memoryCache{maxSize: int64(maxMemorySize), order: list.New(), entries: map[string]*list.Element{}}}
+	if config.MaxDiskSize > 0 {
+		disk, err := newDiskCache(filepath.Join(GetOrCreateDataPath(), "cache"), int64(config.MaxDiskSize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the cache: %w", err)
+		}
+		cache.disk = disk
+	}
+
+	return cache, nil
+}
+
+func (c *responseCache) get(key string) *cacheEntry {
+	if entry := c.memory.get(key); entry != nil {
+		return entry
+	}
+	if c.disk == nil {
+		return nil
+	}
+
+	entry := c.disk.get(key)
+	if entry != nil {
+		c.memory.put(key, entry)
+	}
+	return entry
+}
+
+func (c *responseCache) put(key string, entry *cacheEntry) {
+	c.memory.put(key, entry)
+	if c.disk != nil {
+		if err := c.disk.put(key, entry); err != nil {
+			log.Printf("Failed to write to the cache: %v", err)
+		}
+	}
+}
+
+func (c *responseCache) remove(key string) {
+	c.memory.mu.Lock()
+	c.memory.remove(key)
+	c.memory.mu.Unlock()
+	if c.disk != nil {
+		c.disk.mu.Lock()
+		c.disk.remove(key)
+		c.disk.mu.Unlock()
+	}
+}
+
+// cacheKey identifies the responses to requests made by the same client, with the same
+// credentials and DNS overrides, to the same URL. Clients are told apart by their access token
+// and session, so responses are shared between clients that send neither.
+func cacheKey(request *http.Request, requestData Request, method string) string {
+	auth, _ := json.Marshal(requestData.Auth)
+	resolve := make([]string, 0, len(requestData.Resolve))
+	for host, address := range requestData.Resolve {
+		resolve = append(resolve, host+"="+address)
+	}
+	sort.Strings(resolve)
+	key := sha256.Sum256([]byte(strings.Join([]string{
+		requestData.AccessToken,
+		requestData.Session,
+		requestData.UnixSocket,
+		strings.Join(resolve, ","),
+		method,
+		canonicalURL(request.URL.String()),
+		string(auth),
+		request.Header.Get("Authorization"),
+		request.Header.Get("Cookie"),
+	}, "\x00")))
+
+	return hex.EncodeToString(key[:])
+}
+
+// cacheLookup is the use of the cache by a request. Its methods may be called on a nil
+// cacheLookup, for requests the cache doesn't apply to.
+type cacheLookup struct {
+	cache       *responseCache
+	key         string
+	mode        string
+	entry       *cacheEntry
+	requestTime time.Time
+	noStore     bool
+	// invalidate is the key of the cached response to a GET request to the same URL, which is
+	// removed if an unsafe request (e.g. a POST) succeeds.
+	invalidate string
+	status     string
+}
+
+// lookup finds the cached response to request, if the cache applies to it.
+func (c *responseCache) lookup(request *http.Request, requestData Request) *cacheLookup {
+	if c == nil {
+		return nil
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+	case http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return nil
+	default:
+		return &cacheLookup{cache: c, invalidate: cacheKey(request, requestData, http.MethodGet)}
+	}
+	// Range and conditional requests are left to the destination, so that the client gets the
+	// response it asked for.
+	for _, header := range []string{"Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		if request.Header.Get(header) != "" {
+			return nil
+		}
+	}
+
+	directives := cacheControl(request.Header)
+	_, noStore := directives["no-store"]
+	lookup := &cacheLookup{cache: c, key: cacheKey(request, requestData, request.Method), mode: requestData.Cache, requestTime: time.Now(), noStore: noStore, status: CacheMiss}
+	if lookup.mode == CacheBypass {
+		lookup.status = CacheBypass
+		return lookup
+	}
+
+	entry := c.get(lookup.key)
+	if entry == nil {
+		return lookup
+	}
+	for name, value := range entry.Vary {
+		if request.Header.Get(name) != value {
+			return lookup
+		}
+	}
+	lookup.entry = entry
+	return lookup
+}
+
+// response returns the cached response if it may be served without contacting the destination,
+// or nil otherwise.
+func (l *cacheLookup) response(request *http.Request) *http.Response {
+	if l == nil || l.entry == nil {
+		return nil
+	}
+
+	now := time.Now()
+	if l.mode != CacheForce {
+		_, noCache := cacheControl(l.entry.Header)["no-cache"]
+		requestDirectives := cacheControl(request.Header)
+		_, requestNoCache := requestDirectives["no-cache"]
+		lifetime := l.entry.freshnessLifetime()
+		if maxAge, ok := seconds(requestDirectives["max-age"]); ok && maxAge < lifetime {
+			lifetime = maxAge
+		}
+		if noCache || requestNoCache || l.entry.age(now) >= lifetime {
+			return nil
+		}
+	}
+
+	l.status = CacheHit
+	return l.entry.response(request, now)
+}
+
+// addConditions makes request conditional on the cached response having changed, if there is one
+// to revalidate.
+func (l *cacheLookup) addConditions(request *http.Request) {
+	if l == nil || l.entry == nil || l.status == CacheHit {
+		return
+	}
+
+	if etag := l.entry.Header.Get("ETag"); etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := l.entry.Header.Get("Last-Modified"); lastModified != "" {
+		request.Header.Set("If-Modified-Since", lastModified)
+	}
+	l.requestTime = time.Now()
+}
+
+// complete handles the response from the destination. If it confirms that the cached response is
+// still valid, the cached response is refreshed and returned in its place.
+func (l *cacheLookup) complete(response *http.Response) *http.Response {
+	if l == nil {
+		return response
+	}
+	if l.invalidate != "" {
+		if response.StatusCode < 400 {
+			l.cache.remove(l.invalidate)
+		}
+		return response
+	}
+	if l.entry == nil || response.StatusCode != http.StatusNotModified {
+		return response
+	}
+
+	// Update the cached response with the headers of the 304 response (RFC 9111 section 4.3.4).
+	entry := *l.entry
+	entry.Header = l.entry.Header.Clone()
+	for name, values := range response.Header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		entry.Header[name] = values
+	}
+	entry.RequestTime, entry.ResponseTime = l.requestTime, time.Now()
+	l.cache.put(l.key, &entry)
+
+	discardResponse(response)
+	l.status = CacheRevalidated
+	return entry.response(response.Request, entry.ResponseTime)
+}
+
+// store caches the response read from the destination, if it may be.
+func (l *cacheLookup) store(response *http.Response, body []byte, truncated bool) {
+	if l == nil || l.key == "" || l.status == CacheHit || l.status == CacheRevalidated || l.noStore || truncated {
+		return
+	}
+
+	directives := cacheControl(response.Header)
+	if _, noStore := directives["no-store"]; noStore || !cacheableStatuses[response.StatusCode] {
+		return
+	}
+	entry := &cacheEntry{
+		Status:       response.Status,
+		StatusCode:   response.StatusCode,
+		Proto:        response.Proto,
+		Header:       response.Header.Clone(),
+		Body:         body,
+		RequestTime:  l.requestTime,
+		ResponseTime: time.Now(),
+	}
+	// A response without an explicit or heuristic lifetime is only worth keeping if it can be
+	// revalidated.
+	if entry.freshnessLifetime() <= 0 && !entry.hasValidators() {
+		return
+	}
+	for _, value := range response.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				if entry.Vary == nil {
+					entry.Vary = map[string]string{}
+				}
+				entry.Vary[name] = response.Request.Header.Get(name)
+			}
+		}
+	}
+
+	l.cache.put(l.key, entry)
+}
+
+// cacheStatus returns how the cache was used, or an empty string if it wasn't.
+func (l *cacheLookup) cacheStatus() string {
+	if l == nil {
+		return ""
+	}
+
+	return l.status
+}
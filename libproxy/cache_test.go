@@ -0,0 +1,176 @@
+package libproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newCacheBackend returns a server whose responses carry cacheControl and an ETag, and counts the
+// requests it receives.
+func newCacheBackend(t *testing.T, cacheControl string) (*httptest.Server, *int64) {
+	var requests int64
+	backend := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		count := atomic.AddInt64(&requests, 1)
+		response.Header().Set("Cache-Control", cacheControl)
+		response.Header().Set("ETag", `"v1"`)
+		response.Header().Set("Vary", "Accept-Language")
+		if request.Header.Get("If-None-Match") == `"v1"` {
+			response.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = fmt.Fprintf(response, "response %d in %s", count, request.Header.Get("Accept-Language"))
+	}))
+	t.Cleanup(backend.Close)
+	return backend, &requests
+}
+
+func TestCache(t *testing.T) {
+	backend, requests := newCacheBackend(t, "max-age=60")
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, Cache: CacheConfig{Enabled: true}}})
+	assert.Nil(t, err)
+
+	request := Request{Method: "GET", Url: backend.URL + "/resource", Headers: map[string]string{"Accept-Language": "en"}}
+	resp := getResultFrom(proxy, request, "https://hoppscotch.io")
+	assert.Equal(t, CacheMiss, resp.requestResponse.Cache)
+	assert.Equal(t, "response 1 in en", resp.requestResponse.Data)
+
+	resp = getResultFrom(proxy, request, "https://hoppscotch.io")
+	assert.Equal(t, CacheHit, resp.requestResponse.Cache)
+	assert.Equal(t, "response 1 in en", resp.requestResponse.Data)
+	assert.Equal(t, "0", resp.requestResponse.Headers["age"])
+	assert.Equal(t, int64(1), atomic.LoadInt64(requests))
+
+	// responses vary by Accept-Language
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: request.Url, Headers: map[string]string{"Accept-Language": "fr"}}, "https://hoppscotch.io")
+	assert.Equal(t, CacheMiss, resp.requestResponse.Cache)
+	assert.Equal(t, "response 2 in fr", resp.requestResponse.Data)
+
+	// other clients don't see the cached responses
+	resp = getResultFrom(proxy, Request{Session: "other", Method: "GET", Url: request.Url, Headers: map[string]string{"Accept-Language": "fr"}}, "https://hoppscotch.io")
+	assert.Equal(t, CacheMiss, resp.requestResponse.Cache)
+
+	bypass := request
+	bypass.Cache = CacheBypass
+	resp = getResultFrom(proxy, bypass, "https://hoppscotch.io")
+	assert.Equal(t, CacheBypass, resp.requestResponse.Cache)
+	assert.Equal(t, "response 4 in en", resp.requestResponse.Data)
+	assert.Equal(t, int64(4), atomic.LoadInt64(requests))
+
+	// an unsafe request invalidates the cached response
+	getResultFrom(proxy, Request{Method: "POST", Url: request.Url}, "https://hoppscotch.io")
+	resp = getResultFrom(proxy, request, "https://hoppscotch.io")
+	assert.Equal(t, CacheMiss, resp.requestResponse.Cache)
+}
+
+func TestCacheDNSOverrides(t *testing.T) {
+	backend, requests := newCacheBackend(t, "max-age=60")
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, Cache: CacheConfig{Enabled: true}}})
+	assert.Nil(t, err)
+
+	// the same URL, fetched with and without a DNS override, is cached separately
+	url := strings.Replace(backend.URL, "127.0.0.1", "localhost", 1) + "/resource"
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: url}, "https://hoppscotch.io")
+	assert.Equal(t, "response 1 in ", resp.requestResponse.Data)
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: url, Resolve: map[string]string{"localhost": "127.0.0.1"}}, "https://hoppscotch.io")
+	assert.Equal(t, CacheMiss, resp.requestResponse.Cache)
+	assert.Equal(t, "response 2 in ", resp.requestResponse.Data)
+
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: url}, "https://hoppscotch.io")
+	assert.Equal(t, CacheHit, resp.requestResponse.Cache)
+	assert.Equal(t, "response 1 in ", resp.requestResponse.Data)
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: url, Resolve: map[string]string{"localhost": "127.0.0.1"}}, "https://hoppscotch.io")
+	assert.Equal(t, CacheHit, resp.requestResponse.Cache)
+	assert.Equal(t, "response 2 in ", resp.requestResponse.Data)
+	assert.Equal(t, int64(2), atomic.LoadInt64(requests))
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	backend, requests := newCacheBackend(t, "no-cache")
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, Cache: CacheConfig{Enabled: true}}})
+	assert.Nil(t, err)
+
+	request := Request{Method: "GET", Url: backend.URL + "/resource"}
+	resp := getResultFrom(proxy, request, "https://hoppscotch.io")
+	assert.Equal(t, CacheMiss, resp.requestResponse.Cache)
+
+	resp = getResultFrom(proxy, request, "https://hoppscotch.io")
+	assert.Equal(t, CacheRevalidated, resp.requestResponse.Cache)
+	assert.Equal(t, 200, resp.requestResponse.Status)
+	assert.Equal(t, "response 1 in ", resp.requestResponse.Data)
+	assert.Equal(t, int64(2), atomic.LoadInt64(requests))
+
+	// forcing the cache skips the revalidation
+	request.Cache = CacheForce
+	resp = getResultFrom(proxy, request, "https://hoppscotch.io")
+	assert.Equal(t, CacheHit, resp.requestResponse.Cache)
+	assert.Equal(t, int64(2), atomic.LoadInt64(requests))
+
+	// the client's own conditional requests reach the destination
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: request.Url, Headers: map[string]string{"If-None-Match": `"v1"`}}, "https://hoppscotch.io")
+	assert.Equal(t, 304, resp.requestResponse.Status)
+	assert.Equal(t, "", resp.requestResponse.Cache)
+}
+
+func TestCacheNoStore(t *testing.T) {
+	backend, requests := newCacheBackend(t, "no-store")
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, Cache: CacheConfig{Enabled: true}}})
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		resp := getResultFrom(proxy, Request{Method: "GET", Url: backend.URL + "/resource"}, "https://hoppscotch.io")
+		assert.Equal(t, CacheMiss, resp.requestResponse.Cache)
+	}
+	assert.Equal(t, int64(2), atomic.LoadInt64(requests))
+}
+
+func TestDiskCache(t *testing.T) {
+	backend, requests := newCacheBackend(t, "max-age=60")
+	config := Config{AllowedOrigins: []string{"*"}, Cache: CacheConfig{Enabled: true, MaxDiskSize: 1 << 20}}
+	t.Cleanup(func() { _ = os.RemoveAll(filepath.Join(GetOrCreateDataPath(), "cache")) })
+
+	proxy, err := New(Options{Config: config})
+	assert.Nil(t, err)
+	request := Request{Method: "GET", Url: backend.URL + "/resource"}
+	resp := getResultFrom(proxy, request, "https://hoppscotch.io")
+	assert.Equal(t, CacheMiss, resp.requestResponse.Cache)
+
+	// a new proxy finds the response on disk
+	proxy, err = New(Options{Config: config})
+	assert.Nil(t, err)
+	resp = getResultFrom(proxy, request, "https://hoppscotch.io")
+	assert.Equal(t, CacheHit, resp.requestResponse.Cache)
+	assert.Equal(t, "response 1 in ", resp.requestResponse.Data)
+	assert.Equal(t, int64(1), atomic.LoadInt64(requests))
+
+	// and evicts it when it no longer fits
+	disk, err := newDiskCache(filepath.Join(GetOrCreateDataPath(), "cache"), 1)
+	assert.Nil(t, err)
+	assert.Empty(t, disk.files)
+}
+
+func TestCacheFreshness(t *testing.T) {
+	date := "Mon, 19 Oct 2026 10:00:00 GMT"
+	for _, test := range []struct {
+		header   http.Header
+		lifetime string
+	}{
+		{http.Header{"Cache-Control": {"public, max-age=120"}, "Expires": {"Mon, 19 Oct 2026 11:00:00 GMT"}}, "2m0s"},
+		{http.Header{"Expires": {"Mon, 19 Oct 2026 11:00:00 GMT"}}, "1h0m0s"},
+		{http.Header{"Expires": {"0"}}, "0s"},
+		{http.Header{"Last-Modified": {"Sun, 18 Oct 2026 10:00:00 GMT"}}, "2h24m0s"},
+		{http.Header{"Last-Modified": {"Mon, 19 Oct 2025 10:00:00 GMT"}}, "24h0m0s"},
+		{http.Header{}, "0s"},
+	} {
+		test.header.Set("Date", date)
+		entry := &cacheEntry{Header: test.header}
+		assert.Equal(t, test.lifetime, entry.freshnessLifetime().String(), test.header)
+	}
+}
@@ -0,0 +1,181 @@
+package libproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig configures the certificate the proxy serves HTTPS with. By default, it is the
+// self-signed certificate in the data directory.
+type TLSConfig struct {
+	// CertFile and KeyFile are the paths of a PEM encoded certificate (which may be followed by
+	// its chain) and private key to serve instead. They are reloaded when they change.
+	CertFile string `json:"certFile,omitempty" yaml:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty" yaml:"keyFile,omitempty"`
+	// ACME obtains certificates from a certificate authority, such as Let's Encrypt, instead.
+	ACME ACMEConfig `json:"acme,omitempty" yaml:"acme,omitempty"`
+}
+
+// ACMEConfig configures the certificates obtained, and renewed, from a certificate authority
+// with ACME. Their domains are validated with the TLS-ALPN-01 challenge on the proxy's HTTPS
+// listeners, or the HTTP-01 challenge on its HTTP listeners.
+type ACMEConfig struct {
+	// Domains are the host names certificates are obtained for. If empty, ACME is disabled.
+	Domains []string `json:"domains,omitempty" yaml:"domains,omitempty"`
+	// Email is the contact address registered with the certificate authority.
+	Email string `json:"email,omitempty" yaml:"email,omitempty"`
+	// DirectoryURL is the URL of the certificate authority's ACME directory (default: Let's
+	// Encrypt's).
+	DirectoryURL string `json:"directoryURL,omitempty" yaml:"directoryURL,omitempty"`
+	// CARoots is the path of PEM encoded certificates trusted, besides the system's, when
+	// connecting to the directory, e.g. those of a test server such as Pebble.
+	CARoots string `json:"caRoots,omitempty" yaml:"caRoots,omitempty"`
+}
+
+// enabled returns true if certificates are obtained with ACME.
+func (c ACMEConfig) enabled() bool {
+	return len(c.Domains) > 0
+}
+
+// validate checks the TLS settings.
+func (c TLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("invalid TLS configuration: both a certificate and a key file are required")
+	}
+	if !c.ACME.enabled() {
+		return nil
+	}
+	if c.CertFile != "" {
+		return errors.New("invalid TLS configuration: certificate files and ACME can't both be used")
+	}
+	for _, domain := range c.ACME.Domains {
+		if domain == "" || strings.ContainsAny(domain, "*:/") {
+			return fmt.Errorf("invalid ACME domain %q: expected a host name, e.g. proxy.example.com", domain)
+		}
+	}
+	if c.ACME.DirectoryURL != "" {
+		directory, err := url.Parse(c.ACME.DirectoryURL)
+		if err != nil || (directory.Scheme != "https" && directory.Scheme != "http") || directory.Host == "" {
+			return fmt.Errorf("invalid ACME directory %q (e.g. https://acme-v02.api.letsencrypt.org/directory)", c.ACME.DirectoryURL)
+		}
+	}
+
+	return nil
+}
+
+// newACMEManager returns the manager of the certificates obtained with ACME, which are kept in
+// the acme directory of the data directory so that they survive restarts.
+func newACMEManager(config ACMEConfig) (*autocert.Manager, error) {
+	httpClient := http.DefaultClient
+	if config.CARoots != "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		certificates, err := os.ReadFile(config.CARoots)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the ACME CA roots: %w", err)
+		}
+		if !roots.AppendCertsFromPEM(certificates) {
+			return nil, fmt.Errorf("no certificates were found in %s", config.CARoots)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		httpClient = &http.Client{Transport: transport}
+	}
+
+	return &autocert.Manager{
+		// The terms of service are accepted by configuring a certificate authority.
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(filepath.Join(GetOrCreateDataPath(), "acme")),
+		HostPolicy: autocert.HostWhitelist(config.Domains...),
+		Email:      config.Email,
+		Client:     &acme.Client{DirectoryURL: config.DirectoryURL, HTTPClient: httpClient},
+	}, nil
+}
+
+// certificateCheckInterval is how often certificate files are checked for changes, at most.
+var certificateCheckInterval = time.Second
+
+// certificateFiles serves a certificate loaded from files, reloading it when they change. They
+// are checked when connections are made, rather than on a timer.
+type certificateFiles struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	// stamp is the modification times and sizes of the files the certificate was loaded from.
+	stamp   string
+	checked time.Time
+}
+
+// loadCertificateFiles loads the certificate in certFile, with the private key in keyFile.
+func loadCertificateFiles(certFile string, keyFile string) (*certificateFiles, error) {
+	files := &certificateFiles{certFile: certFile, keyFile: keyFile}
+	if err := files.load(); err != nil {
+		return nil, fmt.Errorf("failed to load the certificate: %w", err)
+	}
+
+	return files, nil
+}
+
+// stat returns a summary of the modification times and sizes of the files, which changes when
+// either of them does.
+func (f *certificateFiles) stat() string {
+	var stamp []string
+	for _, path := range []string{f.certFile, f.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return ""
+		}
+		stamp = append(stamp, fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size()))
+	}
+	return strings.Join(stamp, " ")
+}
+
+// load (re)loads the certificate. f.mu must be held, unless f hasn't been shared yet.
+func (f *certificateFiles) load() error {
+	stamp := f.stat()
+	certificate, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return err
+	}
+
+	f.certificate, f.stamp = &certificate, stamp
+	return nil
+}
+
+// getCertificate returns the certificate, reloading it first if the files have changed. If they
+// can't be loaded, perhaps because only one of them has been replaced so far, the previous
+// certificate is served until they can.
+func (f *certificateFiles) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.checked) >= certificateCheckInterval {
+		f.checked = time.Now()
+		if stamp := f.stat(); stamp != "" && stamp != f.stamp {
+			if err := f.load(); err != nil {
+				log.Printf("Failed to reload the certificate: %v", err)
+			} else {
+				log.Print("The certificate has been reloaded.")
+			}
+		}
+	}
+
+	return f.certificate, nil
+}
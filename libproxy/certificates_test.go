@@ -0,0 +1,144 @@
+package libproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// peerCertificate returns the certificate served at address for serverName.
+func peerCertificate(t *testing.T, address string, serverName string) ([]byte, error) {
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Raw, nil
+}
+
+func TestCertificateFiles(t *testing.T) {
+	dir, err := os.MkdirTemp("", "proxyscotch")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeKeyPair := func(modified time.Time) []byte {
+		keyPair := CreateKeyPair()
+		assert.Nil(t, os.WriteFile(certFile, keyPair[0].Bytes(), 0600))
+		assert.Nil(t, os.WriteFile(keyFile, keyPair[1].Bytes(), 0600))
+		assert.Nil(t, os.Chtimes(certFile, modified, modified))
+		assert.Nil(t, os.Chtimes(keyFile, modified, modified))
+		certificate, err := tls.X509KeyPair(keyPair[0].Bytes(), keyPair[1].Bytes())
+		assert.Nil(t, err)
+		return certificate.Certificate[0]
+	}
+	first := writeKeyPair(time.Now().Add(-time.Hour))
+
+	previous := certificateCheckInterval
+	certificateCheckInterval = 0
+	defer func() { certificateCheckInterval = previous }()
+
+	proxy, err := New(Options{Config: Config{Host: "127.0.0.1:0", WithSSL: true, TLS: TLSConfig{CertFile: certFile, KeyFile: keyFile}}})
+	assert.Nil(t, err)
+	assert.Nil(t, proxy.Start())
+	defer proxy.Shutdown(context.Background())
+
+	served, err := peerCertificate(t, proxy.Addr().String(), "")
+	assert.Nil(t, err)
+	assert.Equal(t, first, served)
+
+	// the certificate is reloaded when the files change
+	second := writeKeyPair(time.Now())
+	served, err = peerCertificate(t, proxy.Addr().String(), "")
+	assert.Nil(t, err)
+	assert.Equal(t, second, served)
+
+	// and kept if they can't be loaded
+	assert.Nil(t, os.WriteFile(keyFile, []byte("not a key"), 0600))
+	served, err = peerCertificate(t, proxy.Addr().String(), "")
+	assert.Nil(t, err)
+	assert.Equal(t, second, served)
+
+	_, err = New(Options{Config: Config{TLS: TLSConfig{CertFile: certFile}}})
+	assert.NotNil(t, err)
+}
+
+func TestACME(t *testing.T) {
+	proxy, err := New(Options{Config: Config{
+		Host:   "127.0.0.1:0",
+		Listen: []string{"https://127.0.0.1:0"},
+		TLS:    TLSConfig{ACME: ACMEConfig{Domains: []string{"proxy.example.test"}, DirectoryURL: "https://127.0.0.1:1/dir"}},
+	}})
+	assert.Nil(t, err)
+	assert.Nil(t, proxy.Start())
+	defer proxy.Shutdown(context.Background())
+	addrs := proxy.Addrs()
+
+	// HTTP-01 challenges are answered on the HTTP listeners, for the configured domains only
+	for host, status := range map[string]int{"proxy.example.test": http.StatusNotFound, "other.example.test": http.StatusForbidden} {
+		request, _ := http.NewRequest("GET", "http://"+addrs[0].String()+"/.well-known/acme-challenge/token", nil)
+		request.Host = host
+		response, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		_ = response.Body.Close()
+		assert.Equal(t, status, response.StatusCode, host)
+	}
+	response, err := http.Get("http://" + addrs[0].String() + "/healthz")
+	assert.Nil(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	// certificates are never requested for other domains
+	_, err = peerCertificate(t, addrs[1].String(), "other.example.test")
+	assert.NotNil(t, err)
+
+	for _, config := range []TLSConfig{
+		{ACME: ACMEConfig{Domains: []string{"*.example.test"}}},
+		{ACME: ACMEConfig{Domains: []string{"proxy.example.test"}, DirectoryURL: "acme.example.test"}},
+		{CertFile: "cert.pem", KeyFile: "key.pem", ACME: ACMEConfig{Domains: []string{"proxy.example.test"}}},
+	} {
+		_, err := New(Options{Config: Config{TLS: config}})
+		assert.NotNil(t, err, config)
+	}
+}
+
+// TestACMEIssuance obtains a certificate from a local ACME test server, such as Pebble
+// (https://github.com/letsencrypt/pebble), which must be configured to validate the HTTP-01
+// challenge on port 5002 or to skip validation (PEBBLE_VA_ALWAYS_VALID=1), e.g.
+//
+//	PROXYSCOTCH_TEST_ACME_DIRECTORY=https://localhost:14000/dir \
+//	PROXYSCOTCH_TEST_ACME_CA_ROOTS=pebble/test/certs/pebble.minica.pem go test -run TestACMEIssuance
+func TestACMEIssuance(t *testing.T) {
+	directory := os.Getenv("PROXYSCOTCH_TEST_ACME_DIRECTORY")
+	if directory == "" {
+		t.Skip("PROXYSCOTCH_TEST_ACME_DIRECTORY isn't set")
+	}
+
+	proxy, err := New(Options{Config: Config{
+		Host:   "127.0.0.1:5002",
+		Listen: []string{"https://127.0.0.1:0"},
+		TLS: TLSConfig{ACME: ACMEConfig{
+			Domains:      []string{"proxy.example.test"},
+			Email:        "admin@example.test",
+			DirectoryURL: directory,
+			CARoots:      os.Getenv("PROXYSCOTCH_TEST_ACME_CA_ROOTS"),
+		}},
+	}})
+	assert.Nil(t, err)
+	assert.Nil(t, proxy.Start())
+	defer proxy.Shutdown(context.Background())
+
+	conn, err := tls.Dial("tcp", proxy.Addrs()[1].String(), &tls.Config{ServerName: "proxy.example.test", InsecureSkipVerify: true})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	certificate := conn.ConnectionState().PeerCertificates[0]
+	assert.Equal(t, []string{"proxy.example.test"}, certificate.DNSNames)
+	assert.NotEqual(t, certificate.Subject.String(), certificate.Issuer.String())
+}
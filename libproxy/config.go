@@ -0,0 +1,354 @@
+package libproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings used to start the proxy. It may be loaded from a YAML or JSON file
+// with LoadConfig, and overridden by environment variables with ApplyEnvironment.
+type Config struct {
+	// AccessToken restricts access to the proxy to requests with the same token. If blank,
+	// anyone may use the proxy.
+	AccessToken string `json:"token" yaml:"token"`
+	// Host is the address (host:port) the proxy listens on.
+	Host string `json:"host" yaml:"host"`
+	// Listen are other addresses the proxy listens on: host:port, http://host:port or
+	// https://host:port, unix://<path> for a Unix socket, or systemd (or systemd:<name>) for the
+	// sockets passed by a service manager. If Host is blank, the proxy only listens on these.
+	Listen []string `json:"listen,omitempty" yaml:"listen,omitempty"`
+	// ListenSocketMode is the permissions, in octal, of the Unix sockets in Listen, e.g. 0660.
+	ListenSocketMode string `json:"listenSocketMode,omitempty" yaml:"listenSocketMode,omitempty"`
+	// AllowedOrigins are the origins allowed to use the proxy, or "*" to permit any.
+	AllowedOrigins []string `json:"allowedOrigins" yaml:"allowedOrigins"`
+	// BannedOutputs are values redacted from every response.
+	BannedOutputs []string `json:"bannedOutputs,omitempty" yaml:"bannedOutputs,omitempty"`
+	// BannedDests are destination hosts the proxy refuses to make requests to.
+	BannedDests []string `json:"bannedDests,omitempty" yaml:"bannedDests,omitempty"`
+	// WithSSL serves the proxy over HTTPS using a certificate in the data directory, or the one
+	// configured in TLS.
+	WithSSL bool `json:"ssl,omitempty" yaml:"ssl,omitempty"`
+	// TLS configures the certificate HTTPS is served with.
+	TLS TLSConfig `json:"tls,omitempty" yaml:"tls,omitempty"`
+	// AdminToken is the bearer token required by the admin endpoints. If blank, the admin
+	// endpoints are disabled.
+	AdminToken string `json:"adminToken,omitempty" yaml:"adminToken,omitempty"`
+	// AdminHost is the address (host:port) of the admin listener, which serves the metrics at
+	// /metrics. If blank, there is no admin listener.
+	AdminHost string `json:"adminHost,omitempty" yaml:"adminHost,omitempty"`
+
+	RateLimits     RateLimits      `json:"rateLimits,omitempty" yaml:"rateLimits,omitempty"`
+	BodyLimits     BodyLimits      `json:"bodyLimits,omitempty" yaml:"bodyLimits,omitempty"`
+	RedactionRules []RedactionRule `json:"redactionRules,omitempty" yaml:"redactionRules,omitempty"`
+	// Hooks are the hooks (see RegisterHook) run on each request, in order.
+	Hooks []HookConfig `json:"hooks,omitempty" yaml:"hooks,omitempty"`
+	// Kerberos is the identity used for Negotiate authentication.
+	Kerberos KerberosConfig `json:"kerberos,omitempty" yaml:"kerberos,omitempty"`
+	// AccessLog configures the log of requests made to the proxy.
+	AccessLog AccessLogConfig `json:"accessLog,omitempty" yaml:"accessLog,omitempty"`
+	// Tracing configures the export of OpenTelemetry traces.
+	Tracing TracingConfig `json:"tracing,omitempty" yaml:"tracing,omitempty"`
+	// Recording configures the recording of proxied exchanges to HAR files.
+	Recording RecordingConfig `json:"recording,omitempty" yaml:"recording,omitempty"`
+	// Mock configures the mock mode, in which responses are served from files instead of
+	// destinations.
+	Mock MockConfig `json:"mock,omitempty" yaml:"mock,omitempty"`
+	// Cache configures the cache of responses to GET requests.
+	Cache CacheConfig `json:"cache,omitempty" yaml:"cache,omitempty"`
+	// Retry is the policy for sending requests again when their destination fails. Requests may
+	// override it.
+	Retry RetryPolicy `json:"retry,omitempty" yaml:"retry,omitempty"`
+	// DNS configures how the host names of destinations are resolved.
+	DNS DNSConfig `json:"dns,omitempty" yaml:"dns,omitempty"`
+	// UnixSockets are the Unix sockets requests may be sent to, by name. Requests may refer to
+	// them by name or path.
+	UnixSockets map[string]string `json:"unixSockets,omitempty" yaml:"unixSockets,omitempty"`
+}
+
+// DefaultServerConfig returns the default configuration of the server binary.
+func DefaultServerConfig() Config {
+	return Config{
+		Host:           "localhost:9159",
+		AllowedOrigins: []string{"*"},
+	}
+}
+
+// DefaultDesktopConfig returns the default configuration of the desktop (tray) application.
+func DefaultDesktopConfig() Config {
+	return Config{
+		AccessToken:    "hoppscotch",
+		Host:           "127.0.0.1:9159",
+		AllowedOrigins: []string{"https://hoppscotch.io"},
+		WithSSL:        true,
+	}
+}
+
+// configFileNames are the names of the configuration files looked for in the data directory, in
+// order of preference.
+var configFileNames = []string{"config.yaml", "config.yml", "config.json"}
+
+// FindConfigFile returns the path of the configuration file in the data directory, or an empty
+// string if there isn't one.
+func FindConfigFile() string {
+	for _, name := range configFileNames {
+		path := filepath.Join(GetOrCreateDataPath(), name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	return ""
+}
+
+// LoadConfig reads the configuration file at path into config. Any settings not present in the
+// file keep their existing values, so config should be initialized with the defaults. The file
+// is parsed as JSON if it has a .json extension, and as YAML otherwise.
+func LoadConfig(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, config)
+	} else {
+		err = yaml.Unmarshal(data, config)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// ReadConfig returns the configuration from defaults, overridden by the configuration file at
+// path (or, if path is empty, the one found by FindConfigFile) and then by the environment. It
+// also returns the path of the configuration file that was read, if any.
+func ReadConfig(defaults func() Config, path string) (Config, string, error) {
+	config := defaults()
+	if path == "" {
+		path = FindConfigFile()
+	}
+	if path != "" {
+		if err := LoadConfig(path, &config); err != nil {
+			return config, path, err
+		}
+	}
+
+	return config, path, ApplyEnvironment(&config)
+}
+
+// splitList splits a comma separated list, ignoring blank entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// ConfigOption is a setting that may be overridden by an environment variable or a command-line
+// flag.
+type ConfigOption struct {
+	// Name is the name of the command-line flag. The environment variable is the name in upper
+	// case, with dashes replaced by underscores and prefixed with PROXYSCOTCH_.
+	Name  string
+	Usage string
+	// IsBool is set for options that may be given as a flag with no value, meaning true.
+	IsBool bool
+	Set    func(config *Config, value string) error
+}
+
+// EnvironmentVariable returns the name of the environment variable that overrides the option.
+func (o ConfigOption) EnvironmentVariable() string {
+	return "PROXYSCOTCH_" + strings.ToUpper(strings.ReplaceAll(o.Name, "-", "_"))
+}
+
+func stringOption(name string, usage string, field func(config *Config) *string) ConfigOption {
+	return ConfigOption{Name: name, Usage: usage, Set: func(config *Config, value string) error {
+		*field(config) = value
+		return nil
+	}}
+}
+
+func listOption(name string, usage string, field func(config *Config) *[]string) ConfigOption {
+	return ConfigOption{Name: name, Usage: usage, Set: func(config *Config, value string) error {
+		*field(config) = splitList(value)
+		return nil
+	}}
+}
+
+func intListOption(name string, usage string, field func(config *Config) *[]int) ConfigOption {
+	return ConfigOption{Name: name, Usage: usage, Set: func(config *Config, value string) error {
+		var parsed []int
+		for _, item := range splitList(value) {
+			number, err := strconv.Atoi(item)
+			if err != nil {
+				return err
+			}
+			parsed = append(parsed, number)
+		}
+		*field(config) = parsed
+		return nil
+	}}
+}
+
+func mapOption(name string, usage string, field func(config *Config) *map[string]string) ConfigOption {
+	return ConfigOption{Name: name, Usage: usage, Set: func(config *Config, value string) error {
+		parsed := map[string]string{}
+		for _, item := range splitList(value) {
+			key, value, ok := strings.Cut(item, "=")
+			if !ok {
+				return fmt.Errorf("invalid entry %q: expected key=value", item)
+			}
+			parsed[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		*field(config) = parsed
+		return nil
+	}}
+}
+
+func boolOption(name string, usage string, field func(config *Config) *bool) ConfigOption {
+	return ConfigOption{Name: name, Usage: usage, IsBool: true, Set: func(config *Config, value string) error {
+		parsed, err := strconv.ParseBool(value)
+		*field(config) = parsed
+		return err
+	}}
+}
+
+func intOption(name string, usage string, field func(config *Config) *int) ConfigOption {
+	return ConfigOption{Name: name, Usage: usage, Set: func(config *Config, value string) error {
+		parsed, err := strconv.Atoi(value)
+		*field(config) = parsed
+		return err
+	}}
+}
+
+func floatOption(name string, usage string, field func(config *Config) *float64) ConfigOption {
+	return ConfigOption{Name: name, Usage: usage, Set: func(config *Config, value string) error {
+		parsed, err := strconv.ParseFloat(value, 64)
+		*field(config) = parsed
+		return err
+	}}
+}
+
+func textOption[T interface{ UnmarshalText([]byte) error }](name string, usage string, field func(config *Config) T) ConfigOption {
+	return ConfigOption{Name: name, Usage: usage, Set: func(config *Config, value string) error {
+		return field(config).UnmarshalText([]byte(value))
+	}}
+}
+
+func redactionOption(name string, usage string, rules func(value string) ([]RedactionRule, error)) ConfigOption {
+	return ConfigOption{Name: name, Usage: usage, Set: func(config *Config, value string) error {
+		parsed, err := rules(value)
+		config.RedactionRules = append(config.RedactionRules, parsed...)
+		return err
+	}}
+}
+
+// ConfigOptions are the settings that may be overridden by environment variables or command-line
+// flags.
+var ConfigOptions = []ConfigOption{
+	stringOption("host", "the hostname that the server should listen on.", func(c *Config) *string { return &c.Host }),
+	stringOption("token", "the Proxy Access Token used to restrict access to the server.", func(c *Config) *string { return &c.AccessToken }),
+	listOption("allowed-origins", "a comma separated list of allowed origins.", func(c *Config) *[]string { return &c.AllowedOrigins }),
+	listOption("banned-outputs", "a comma separated list of banned outputs.", func(c *Config) *[]string { return &c.BannedOutputs }),
+	listOption("banned-dests", "a comma separated list of banned proxy destinations.", func(c *Config) *[]string { return &c.BannedDests }),
+	stringOption("admin-token", "the bearer token required to use the admin endpoints (disabled if blank).", func(c *Config) *string { return &c.AdminToken }),
+	stringOption("admin-host", "the address of the admin listener serving /metrics (disabled if blank).", func(c *Config) *string { return &c.AdminHost }),
+	boolOption("ssl", "serve the proxy over HTTPS using the certificate in the data directory (or tls-cert-file, or from ACME).", func(c *Config) *bool { return &c.WithSSL }),
+	textOption("rate-limit-token", "the rate limit per access token, e.g. 600/m:50.", func(c *Config) *RateLimit { return &c.RateLimits.PerToken }),
+	textOption("rate-limit-origin", "the rate limit per origin, e.g. 600/m:50.", func(c *Config) *RateLimit { return &c.RateLimits.PerOrigin }),
+	textOption("rate-limit-ip", "the rate limit per client IP address, e.g. 600/m:50.", func(c *Config) *RateLimit { return &c.RateLimits.PerClientIP }),
+	textOption("rate-limit-dest", "the rate limit per destination host, e.g. 600/m:50.", func(c *Config) *RateLimit { return &c.RateLimits.PerDestination }),
+	intOption("max-concurrent", "the maximum number of in-flight proxied requests (0 for unlimited).", func(c *Config) *int { return &c.RateLimits.MaxConcurrent }),
+	textOption("max-request-size", "the maximum size of a request made to the proxy, e.g. 32MB.", func(c *Config) *ByteSize { return &c.BodyLimits.MaxRequestBodySize }),
+	textOption("max-upload-size", "the maximum size of a request body sent to a destination, e.g. 32MB.", func(c *Config) *ByteSize { return &c.BodyLimits.MaxUploadSize }),
+	textOption("max-response-size", "the maximum size of a response read from a destination, e.g. 32MB.", func(c *Config) *ByteSize { return &c.BodyLimits.MaxResponseSize }),
+	boolOption("truncate-responses", "truncate responses larger than max-response-size instead of failing.", func(c *Config) *bool { return &c.BodyLimits.TruncateResponses }),
+	redactionOption("redact-detectors", "a comma separated list of built-in detectors to redact, e.g. aws-access-key,jwt,credit-card.", func(value string) ([]RedactionRule, error) {
+		var rules []RedactionRule
+		for _, detector := range splitList(value) {
+			rules = append(rules, RedactionRule{Detector: detector})
+		}
+		return rules, nil
+	}),
+	redactionOption("redact-headers", "a comma separated list of response headers to redact.", func(value string) ([]RedactionRule, error) {
+		var rules []RedactionRule
+		for _, header := range splitList(value) {
+			rules = append(rules, RedactionRule{Header: header})
+		}
+		return rules, nil
+	}),
+	redactionOption("redaction-rules", "the path to a JSON file containing redaction rules.", LoadRedactionRules),
+	stringOption("kerberos-keytab", "the path of the keytab used for Negotiate (Kerberos) authentication.", func(c *Config) *string { return &c.Kerberos.Keytab }),
+	stringOption("kerberos-principal", "the principal used for Negotiate (Kerberos) authentication, e.g. proxyscotch@EXAMPLE.COM.", func(c *Config) *string { return &c.Kerberos.Principal }),
+	stringOption("kerberos-config", "the path of the krb5.conf file used for Negotiate (Kerberos) authentication.", func(c *Config) *string { return &c.Kerberos.ConfigFile }),
+	listOption("access-log", "a comma separated list of access log sinks: stdout, file and syslog.", func(c *Config) *[]string { return &c.AccessLog.Sinks }),
+	stringOption("access-log-format", "the format of the access log: json, common or combined.", func(c *Config) *string { return &c.AccessLog.Format }),
+	stringOption("access-log-level", "the least severe access log entries recorded: debug, info, warn or error.", func(c *Config) *string { return &c.AccessLog.Level }),
+	stringOption("access-log-file", "the path of the access log file (default: access.log in the data directory).", func(c *Config) *string { return &c.AccessLog.File }),
+	textOption("access-log-max-size", "the size at which the access log file is rotated, e.g. 10MB.", func(c *Config) *ByteSize { return &c.AccessLog.MaxFileSize }),
+	intOption("access-log-max-files", "the number of rotated access log files kept.", func(c *Config) *int { return &c.AccessLog.MaxFiles }),
+	stringOption("tracing-endpoint", "the URL of the OTLP/HTTP collector traces are exported to, e.g. http://localhost:4318 (disabled if blank).", func(c *Config) *string { return &c.Tracing.Endpoint }),
+	stringOption("tracing-service-name", "the service name traces are recorded under (default: proxyscotch).", func(c *Config) *string { return &c.Tracing.ServiceName }),
+	boolOption("recording", "allow clients to record their sessions to HAR files in the data directory.", func(c *Config) *bool { return &c.Recording.Enabled }),
+	intOption("recording-max-entries", "the number of exchanges kept in a recording (default: 1000).", func(c *Config) *int { return &c.Recording.MaxEntries }),
+	intOption("recording-max-per-token", "the number of recordings that may be in progress at once with an access token (default: 4).", func(c *Config) *int { return &c.Recording.MaxPerToken }),
+	textOption("recording-max-size", "the total size of the bodies kept in a recording, e.g. 64MB (default: 64MB).", func(c *Config) *ByteSize { return &c.Recording.MaxSize }),
+	listOption("mock-files", "a comma separated list of HAR or mock definition files to serve responses from (mock mode disabled if blank).", func(c *Config) *[]string { return &c.Mock.Files }),
+	listOption("mock-match-headers", "a comma separated list of request headers recorded exchanges must match.", func(c *Config) *[]string { return &c.Mock.MatchHeaders }),
+	boolOption("mock-match-body", "require request bodies to match those of recorded exchanges.", func(c *Config) *bool { return &c.Mock.MatchBody }),
+	stringOption("mock-unmatched", "what to do with requests matching no mock: pass (to the destination) or fail.", func(c *Config) *string { return &c.Mock.Unmatched }),
+	textOption("mock-latency", "the latency added to mocked responses, e.g. 250ms.", func(c *Config) *Duration { return &c.Mock.Latency }),
+	floatOption("mock-failure-rate", "the fraction (0 to 1) of mocked responses that fail.", func(c *Config) *float64 { return &c.Mock.FailureRate }),
+	intOption("mock-failure-status", "the status of failed mocked responses (0 to fail as though the destination couldn't be reached).", func(c *Config) *int { return &c.Mock.FailureStatus }),
+	boolOption("cache", "cache responses to GET requests according to their Cache-Control, Expires, ETag and Last-Modified headers.", func(c *Config) *bool { return &c.Cache.Enabled }),
+	textOption("cache-memory-size", "the size of the in-memory response cache, e.g. 32MB (default: 32MB).", func(c *Config) *ByteSize { return &c.Cache.MaxMemorySize }),
+	textOption("cache-disk-size", "the size of the response cache kept in the data directory, e.g. 256MB (responses only cached in memory if blank).", func(c *Config) *ByteSize { return &c.Cache.MaxDiskSize }),
+	intOption("retry-max-attempts", "the number of times a request may be sent when its destination fails, including the first (at most 10).", func(c *Config) *int { return &c.Retry.MaxAttempts }),
+	textOption("retry-backoff", "the delay before the first retry, doubled for each retry after it, e.g. 200ms (default: 200ms).", func(c *Config) *Duration { return &c.Retry.Backoff }),
+	textOption("retry-max-backoff", "the longest delay between retries, e.g. 10s (default: 10s).", func(c *Config) *Duration { return &c.Retry.MaxBackoff }),
+	intListOption("retry-statuses", "a comma separated list of the response statuses that are retried (default: 429,502,503,504).", func(c *Config) *[]int { return &c.Retry.Statuses }),
+	boolOption("retry-non-idempotent", "retry requests with non-idempotent methods, such as POST, too.", func(c *Config) *bool { return &c.Retry.NonIdempotent }),
+	mapOption("dns-overrides", "a comma separated list of host names (or host:port pairs) and the IP addresses to connect to instead, e.g. api.example.com=10.0.0.5.", func(c *Config) *map[string]string { return &c.DNS.Overrides }),
+	stringOption("dns-server", "the address of the DNS server used instead of the system's, e.g. 10.0.0.2:53.", func(c *Config) *string { return &c.DNS.Server }),
+	stringOption("dns-doh", "the URL of a DNS over HTTPS endpoint used instead of the system's resolver, e.g. https://cloudflare-dns.com/dns-query.", func(c *Config) *string { return &c.DNS.DoH }),
+	stringOption("dns-prefer", "the address family connected to first: ipv4 or ipv6.", func(c *Config) *string { return &c.DNS.Prefer }),
+	mapOption("unix-sockets", "a comma separated list of names and paths of the Unix sockets requests may be sent to, e.g. docker=/var/run/docker.sock.", func(c *Config) *map[string]string { return &c.UnixSockets }),
+	listOption("listen", "a comma separated list of other addresses to listen on, e.g. [::1]:9159,https://:9443,unix:///run/proxyscotch.sock or systemd.", func(c *Config) *[]string { return &c.Listen }),
+	stringOption("listen-socket-mode", "the permissions, in octal, of the Unix sockets listened on, e.g. 0660.", func(c *Config) *string { return &c.ListenSocketMode }),
+	stringOption("tls-cert-file", "the path of the PEM certificate HTTPS is served with, reloaded when it changes (default: the self-signed certificate in the data directory).", func(c *Config) *string { return &c.TLS.CertFile }),
+	stringOption("tls-key-file", "the path of the PEM private key of tls-cert-file.", func(c *Config) *string { return &c.TLS.KeyFile }),
+	listOption("acme-domains", "a comma separated list of the domains to obtain certificates for with ACME (disabled if blank).", func(c *Config) *[]string { return &c.TLS.ACME.Domains }),
+	stringOption("acme-email", "the contact email address registered with the ACME certificate authority.", func(c *Config) *string { return &c.TLS.ACME.Email }),
+	stringOption("acme-directory", "the URL of the ACME directory (default: Let's Encrypt's).", func(c *Config) *string { return &c.TLS.ACME.DirectoryURL }),
+	stringOption("acme-ca-roots", "the path of PEM certificates trusted when connecting to the ACME directory, e.g. a test server's.", func(c *Config) *string { return &c.TLS.ACME.CARoots }),
+	stringOption("access-log-syslog", "the address of the syslog server for the access log, e.g. udp://localhost:514 (default: the local syslog daemon).", func(c *Config) *string { return &c.AccessLog.Syslog }),
+}
+
+// ApplyEnvironment overrides the settings in config with any that are set in the environment
+// (see ConfigOption.EnvironmentVariable).
+func ApplyEnvironment(config *Config) error {
+	for _, option := range ConfigOptions {
+		value, ok := os.LookupEnv(option.EnvironmentVariable())
+		if !ok {
+			continue
+		}
+
+		if err := option.Set(config, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", option.EnvironmentVariable(), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package libproxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlPath := filepath.Join(dir, "config.yaml")
+	assert.Nil(t, os.WriteFile(yamlPath, []byte(`
+token: secret
+allowedOrigins: [validorigin1.com, validorigin2.com]
+rateLimits:
+  perClientIP: 600/m:50
+  maxConcurrent: 10
+bodyLimits:
+  maxResponseSize: 10MB
+  truncateResponses: true
+redactionRules:
+  - detector: jwt
+    hosts: ["*.example.com"]
+`), 0600))
+
+	config := DefaultServerConfig()
+	assert.Nil(t, LoadConfig(yamlPath, &config))
+	assert.Equal(t, "secret", config.AccessToken)
+	// settings not in the file keep their defaults
+	assert.Equal(t, "localhost:9159", config.Host)
+	assert.Equal(t, []string{"validorigin1.com", "validorigin2.com"}, config.AllowedOrigins)
+	assert.Equal(t, RateLimit{Rate: 10, Burst: 50}, config.RateLimits.PerClientIP)
+	assert.Equal(t, 10, config.RateLimits.MaxConcurrent)
+	assert.Equal(t, ByteSize(10<<20), config.BodyLimits.MaxResponseSize)
+	assert.True(t, config.BodyLimits.TruncateResponses)
+	assert.Equal(t, []RedactionRule{{Detector: "jwt", Hosts: []string{"*.example.com"}}}, config.RedactionRules)
+
+	jsonPath := filepath.Join(dir, "config.json")
+	assert.Nil(t, os.WriteFile(jsonPath, []byte(`{"host": "0.0.0.0:9159", "rateLimits": {"perToken": "5/s"}}`), 0600))
+
+	config = DefaultServerConfig()
+	assert.Nil(t, LoadConfig(jsonPath, &config))
+	assert.Equal(t, "0.0.0.0:9159", config.Host)
+	assert.Equal(t, RateLimit{Rate: 5, Burst: 5}, config.RateLimits.PerToken)
+
+	assert.Nil(t, os.WriteFile(jsonPath, []byte(`{"rateLimits": {"perToken": "often"}}`), 0600))
+	assert.NotNil(t, LoadConfig(jsonPath, &config))
+}
+
+func TestApplyEnvironment(t *testing.T) {
+	t.Setenv("PROXYSCOTCH_TOKEN", "from-env")
+	t.Setenv("PROXYSCOTCH_BANNED_DESTS", "localhost, 127.0.0.1")
+	t.Setenv("PROXYSCOTCH_TRUNCATE_RESPONSES", "true")
+	t.Setenv("PROXYSCOTCH_RATE_LIMIT_DEST", "1/h")
+
+	config := DefaultServerConfig()
+	assert.Nil(t, ApplyEnvironment(&config))
+	assert.Equal(t, "from-env", config.AccessToken)
+	assert.Equal(t, []string{"localhost", "127.0.0.1"}, config.BannedDests)
+	assert.True(t, config.BodyLimits.TruncateResponses)
+	assert.Equal(t, "1/h:1", config.RateLimits.PerDestination.String())
+
+	t.Setenv("PROXYSCOTCH_MAX_CONCURRENT", "many")
+	assert.NotNil(t, ApplyEnvironment(&config))
+}
+
+func TestRateLimitString(t *testing.T) {
+	for _, value := range []string{"10/s:20", "30/m:30", "1/h:1"} {
+		limit, err := ParseRateLimit(value)
+		assert.Nil(t, err)
+		assert.Equal(t, value, limit.String())
+	}
+}
@@ -83,7 +83,7 @@ func EnsurePrivateKeyInstalled() error {
 	if os.IsNotExist(err) {
 		encodedPEM := CreateKeyPair()
 		err = os.WriteFile(GetOrCreateDataPath()+"/cert.pem", encodedPEM[0].Bytes(), 0600)
-		
+
 		// There's no point writing the key if we failed to write the certificate, so only do that
 		// if there is no error.
 		if err == nil {
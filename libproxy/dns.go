@@ -0,0 +1,406 @@
+package libproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Values of DNSConfig.Prefer.
+const (
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+)
+
+// dnsTimeout limits how long a lookup with DNSConfig.Server or DNSConfig.DoH may take.
+const dnsTimeout = 5 * time.Second
+
+// maxDNSResponseSize is the largest DNS over HTTPS response read.
+const maxDNSResponseSize = 64 << 10
+
+// DNSConfig configures how the host names of destinations are resolved.
+type DNSConfig struct {
+	// Overrides maps host names, or host:port pairs, to the IP address connections to them are
+	// made to instead, like curl's --resolve. The Host header and TLS server name are unchanged.
+	Overrides map[string]string `json:"overrides,omitempty" yaml:"overrides,omitempty"`
+	// Server is the address of the DNS server host names are resolved with instead of the
+	// system's, e.g. 10.0.0.2 or 10.0.0.2:5353.
+	Server string `json:"server,omitempty" yaml:"server,omitempty"`
+	// DoH is the URL of a DNS over HTTPS (RFC 8484) endpoint host names are resolved with instead,
+	// e.g. https://cloudflare-dns.com/dns-query.
+	DoH string `json:"doh,omitempty" yaml:"doh,omitempty"`
+	// Prefer is the address family that is connected to first when a host name resolves to both
+	// IPv4 and IPv6 addresses: ipv4 or ipv6. The other family is still tried if those fail.
+	Prefer string `json:"prefer,omitempty" yaml:"prefer,omitempty"`
+}
+
+// dnsResolver resolves the host names of destinations as configured by a DNSConfig. A nil
+// dnsResolver leaves them to the system.
+type dnsResolver struct {
+	// overrides maps host names and host:port pairs, in lower case, to addresses.
+	overrides map[string]net.IP
+	prefer    string
+	// lookup resolves host names, or is nil if the system resolver is used.
+	lookup func(ctx context.Context, host string) ([]net.IP, error)
+	// tracesLookups is set if lookup calls the DNS hooks of an httptrace.ClientTrace itself, as
+	// the net package's resolvers do.
+	tracesLookups bool
+}
+
+// parseDNSOverrides checks and parses a map of DNS overrides (see DNSConfig.Overrides).
+func parseDNSOverrides(overrides map[string]string) (map[string]net.IP, error) {
+	parsed := make(map[string]net.IP, len(overrides))
+	for host, address := range overrides {
+		ip := net.ParseIP(strings.Trim(address, "[]"))
+		if host == "" || ip == nil {
+			return nil, fmt.Errorf("invalid DNS override %q: %q isn't an IP address", host, address)
+		}
+		parsed[normalizeHost(host)] = ip
+	}
+
+	return parsed, nil
+}
+
+// normalizeHost returns a host name, or host:port pair, in the form DNS overrides are keyed by.
+func normalizeHost(host string) string {
+	if name, port, err := net.SplitHostPort(host); err == nil {
+		return net.JoinHostPort(strings.TrimSuffix(strings.ToLower(name), "."), port)
+	}
+
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// newDNSResolver creates the resolver described by config, or returns nil if host names are left
+// to the system.
+func newDNSResolver(config DNSConfig) (*dnsResolver, error) {
+	overrides, err := parseDNSOverrides(config.Overrides)
+	if err != nil {
+		return nil, err
+	}
+	if config.Prefer != "" && config.Prefer != PreferIPv4 && config.Prefer != PreferIPv6 {
+		return nil, fmt.Errorf("invalid DNS preference %q: must be %s or %s", config.Prefer, PreferIPv4, PreferIPv6)
+	}
+	if config.Server != "" && config.DoH != "" {
+		return nil, errors.New("invalid DNS configuration: only one of a DNS server and a DNS over HTTPS endpoint may be set")
+	}
+
+	resolver := &dnsResolver{overrides: overrides, prefer: config.Prefer}
+	switch {
+	case config.Server != "":
+		server := config.Server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		dialer := &net.Dialer{Timeout: dnsTimeout}
+		custom := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, server)
+		}}
+		resolver.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+			return lookupIP(ctx, custom, host)
+		}
+		resolver.tracesLookups = true
+	case config.DoH != "":
+		endpoint, err := url.Parse(config.DoH)
+		if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid DNS over HTTPS endpoint %q", config.DoH)
+		}
+		client := &http.Client{Timeout: dnsTimeout}
+		resolver.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+			return lookupDoH(ctx, client, endpoint.String(), host)
+		}
+	case config.Prefer != "":
+		resolver.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+			return lookupIP(ctx, net.DefaultResolver, host)
+		}
+		resolver.tracesLookups = true
+	case len(overrides) == 0:
+		return nil, nil
+	}
+
+	return resolver, nil
+}
+
+func lookupIP(ctx context.Context, resolver *net.Resolver, host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	addresses, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addresses))
+	for i, address := range addresses {
+		ips[i] = address.IP
+	}
+	return ips, nil
+}
+
+// lookupDoH resolves host by asking the DNS over HTTPS endpoint for its A and AAAA records.
+func lookupDoH(ctx context.Context, client *http.Client, endpoint string, host string) ([]net.IP, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, recordType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		found, err := queryDoH(ctx, client, endpoint, name, recordType)
+		if err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: host, Server: endpoint}
+		}
+		ips = append(ips, found...)
+	}
+	return ips, nil
+}
+
+// withoutValues is a context without the values of the one it wraps, but which is still canceled
+// with it.
+type withoutValues struct {
+	context.Context
+}
+
+func (withoutValues) Value(interface{}) interface{} {
+	return nil
+}
+
+func queryDoH(ctx context.Context, client *http.Client, endpoint string, name dnsmessage.Name, recordType dnsmessage.Type) ([]net.IP, error) {
+	// The ID is 0, so that responses can be cached by HTTP caches (RFC 8484 section 4.1).
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: name, Type: recordType, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	// The lookup's own connections aren't part of the proxied request's trace.
+	request, err := http.NewRequestWithContext(withoutValues{ctx}, http.MethodPost, endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS endpoint returned %s", response.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxDNSResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(body)
+	if err != nil {
+		return nil, err
+	}
+	// A name that doesn't exist has no addresses.
+	if header.RCode == dnsmessage.RCodeNameError {
+		return nil, nil
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("DNS over HTTPS endpoint returned %s", header.RCode)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for {
+		answer, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			return ips, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case answer.Type == dnsmessage.TypeA && recordType == dnsmessage.TypeA:
+			record, err := parser.AResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, net.IP(record.A[:]))
+		case answer.Type == dnsmessage.TypeAAAA && recordType == dnsmessage.TypeAAAA:
+			record, err := parser.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, net.IP(record.AAAA[:]))
+		default:
+			// CNAME records are followed by the endpoint, which includes the records they lead to.
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// withOverrides returns a resolver that applies overrides before those of r.
+func (r *dnsResolver) withOverrides(overrides map[string]net.IP) *dnsResolver {
+	combined := &dnsResolver{overrides: map[string]net.IP{}}
+	if r != nil {
+		*combined = *r
+		combined.overrides = make(map[string]net.IP, len(r.overrides)+len(overrides))
+		for host, ip := range r.overrides {
+			combined.overrides[host] = ip
+		}
+	}
+	for host, ip := range overrides {
+		combined.overrides[host] = ip
+	}
+
+	return combined
+}
+
+// resolve returns the addresses to connect to for host and port, in the order they should be
+// tried, or nil if the host name should be left to the system.
+func (r *dnsResolver) resolve(ctx context.Context, host, port string) ([]net.IP, error) {
+	name := normalizeHost(host)
+	ip, ok := r.overrides[net.JoinHostPort(name, port)]
+	if !ok {
+		ip, ok = r.overrides[name]
+	}
+	if !ok && r.lookup == nil {
+		return nil, nil
+	}
+
+	// Report the lookup to the request's trace, unless the resolver already does.
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace == nil || (!ok && r.tracesLookups) {
+		trace = &httptrace.ClientTrace{}
+	}
+	if trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	var ips []net.IP
+	var err error
+	if ok {
+		ips = []net.IP{ip}
+	} else {
+		ips, err = r.lookup(ctx, host)
+	}
+	if trace.DNSDone != nil {
+		addresses := make([]net.IPAddr, len(ips))
+		for i, ip := range ips {
+			addresses[i] = net.IPAddr{IP: ip}
+		}
+		trace.DNSDone(httptrace.DNSDoneInfo{Addrs: addresses, Err: err})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r.prefer != "" {
+		sort.SliceStable(ips, func(i, j int) bool {
+			return (ips[i].To4() != nil) == (r.prefer == PreferIPv4) && (ips[j].To4() != nil) != (r.prefer == PreferIPv4)
+		})
+	}
+	return ips, nil
+}
+
+// dial connects to address, resolving its host name with r. Each address it resolves to is
+// tried in turn.
+func (r *dnsResolver) dial(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if r == nil || err != nil || net.ParseIP(host) != nil {
+		return dial(ctx, network, address)
+	}
+
+	ips, err := r.resolve(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+	if ips == nil {
+		return dial(ctx, network, address)
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// resolveConnections wraps the transport's dialer so that the host names of destinations are
+// resolved by the resolver that resolver returns when each connection is made.
+func resolveConnections(transport *http.Transport, resolver func() *dnsResolver) {
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return resolver().dial(ctx, dial, network, address)
+	}
+}
+
+// resolvedAddresses collects the addresses a request's destination resolved to, and the one its
+// response came from.
+type resolvedAddresses struct {
+	mu       sync.Mutex
+	resolved []string
+	remote   string
+}
+
+// trace returns request with a context that records its addresses in a.
+func (a *resolvedAddresses) trace(request *http.Request) *http.Request {
+	return request.WithContext(httptrace.WithClientTrace(request.Context(), &httptrace.ClientTrace{
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.resolved = a.resolved[:0]
+			for _, address := range info.Addrs {
+				a.resolved = append(a.resolved, address.IP.String())
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if address, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+				a.remote = address.IP.String()
+			} else {
+				a.remote = info.Conn.RemoteAddr().String()
+			}
+		},
+	}))
+}
+
+func (a *resolvedAddresses) addresses() ([]string, string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]string(nil), a.resolved...), a.remote
+}
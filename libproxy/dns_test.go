@@ -0,0 +1,145 @@
+package libproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answerDNS answers a DNS query for any name with 127.0.0.1, and no IPv6 addresses.
+func answerDNS(t *testing.T, query []byte) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	assert.Nil(t, err)
+	question, err := parser.Question()
+	assert.Nil(t, err)
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, RecursionAvailable: true})
+	_ = builder.StartQuestions()
+	_ = builder.Question(question)
+	_ = builder.StartAnswers()
+	if question.Type == dnsmessage.TypeA {
+		_ = builder.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+	}
+	answer, err := builder.Finish()
+	assert.Nil(t, err)
+	return answer
+}
+
+// newHostBackend returns a server that responds with the Host header of each request, and the
+// port it listens on.
+func newHostBackend(t *testing.T) (*httptest.Server, string) {
+	backend := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		_, _ = response.Write([]byte(request.Host))
+	}))
+	t.Cleanup(backend.Close)
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	return backend, port
+}
+
+func TestDNSOverrides(t *testing.T) {
+	_, port := newHostBackend(t)
+	proxy, err := New(Options{Config: Config{
+		AllowedOrigins: []string{"*"},
+		BannedDests:    []string{"10.0.0.1"},
+		DNS:            DNSConfig{Overrides: map[string]string{"server.example.test:" + port: "127.0.0.1"}},
+	}})
+	assert.Nil(t, err)
+
+	// the Host header is kept
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: "http://server.example.test:" + port + "/"}, "https://hoppscotch.io")
+	assert.Equal(t, "server.example.test:"+port, resp.requestResponse.Data)
+	assert.Equal(t, []string{"127.0.0.1"}, resp.requestResponse.ResolvedAddresses)
+	assert.Equal(t, "127.0.0.1", resp.requestResponse.RemoteAddress)
+
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: "http://request.example.test:" + port + "/", Resolve: map[string]string{"Request.Example.Test": "127.0.0.1"}}, "https://hoppscotch.io")
+	assert.Equal(t, "request.example.test:"+port, resp.requestResponse.Data)
+	assert.Equal(t, "127.0.0.1", resp.requestResponse.RemoteAddress)
+
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: "http://request.example.test:" + port + "/", Resolve: map[string]string{"request.example.test": "10.0.0.1"}}, "https://hoppscotch.io")
+	assert.Contains(t, resp.proxyResponse.Body.String(), "Request cannot be to this destination")
+
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: "http://request.example.test:" + port + "/", Resolve: map[string]string{"request.example.test": "nowhere"}}, "https://hoppscotch.io")
+	assert.Contains(t, resp.proxyResponse.Body.String(), "invalid DNS override")
+}
+
+func TestDNSOverHTTPS(t *testing.T) {
+	_, port := newHostBackend(t)
+	doh := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		assert.Equal(t, "application/dns-message", request.Header.Get("Content-Type"))
+		query, _ := io.ReadAll(request.Body)
+		response.Header().Set("Content-Type", "application/dns-message")
+		_, _ = response.Write(answerDNS(t, query))
+	}))
+	defer doh.Close()
+
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, DNS: DNSConfig{DoH: doh.URL + "/dns-query"}}})
+	assert.Nil(t, err)
+
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: "http://backend.doh.test:" + port + "/"}, "https://hoppscotch.io")
+	assert.Equal(t, 200, resp.requestResponse.Status)
+	assert.Equal(t, "backend.doh.test:"+port, resp.requestResponse.Data)
+	assert.Equal(t, []string{"127.0.0.1"}, resp.requestResponse.ResolvedAddresses)
+}
+
+func TestDNSServer(t *testing.T) {
+	_, port := newHostBackend(t)
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Close()
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, address, err := server.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = server.WriteTo(answerDNS(t, buffer[:n]), address)
+		}
+	}()
+
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, DNS: DNSConfig{Server: server.LocalAddr().String()}}})
+	assert.Nil(t, err)
+
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: "http://backend.dns.test:" + port + "/"}, "https://hoppscotch.io")
+	assert.Equal(t, 200, resp.requestResponse.Status)
+	assert.Equal(t, []string{"127.0.0.1"}, resp.requestResponse.ResolvedAddresses)
+}
+
+func TestDNSPreference(t *testing.T) {
+	lookup := func(context.Context, string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1"), net.ParseIP("::2")}, nil
+	}
+	for prefer, expected := range map[string]string{
+		PreferIPv4: "127.0.0.1 ::1 ::2",
+		PreferIPv6: "::1 ::2 127.0.0.1",
+	} {
+		resolver := &dnsResolver{prefer: prefer, lookup: lookup}
+		ips, err := resolver.resolve(context.Background(), "example.test", "443")
+		assert.Nil(t, err)
+		var addresses []string
+		for _, ip := range ips {
+			addresses = append(addresses, ip.String())
+		}
+		assert.Equal(t, expected, strings.Join(addresses, " "))
+	}
+}
+
+func TestInvalidDNSConfig(t *testing.T) {
+	for _, config := range []DNSConfig{
+		{Overrides: map[string]string{"example.test": "example.com"}},
+		{Prefer: "ipv5"},
+		{Server: "10.0.0.2", DoH: "https://dns.example.test/dns-query"},
+		{DoH: "dns.example.test"},
+	} {
+		_, err := New(Options{Config: Config{DNS: config}})
+		assert.NotNil(t, err, config)
+	}
+}
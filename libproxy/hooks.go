@@ -0,0 +1,200 @@
+package libproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Hook customizes the requests the proxy makes and the responses it returns. Hooks are run in
+// order: those added with Proxy.Use (or Options.Hooks) first, followed by those in the
+// configuration.
+type Hook interface {
+	// BeforeRequest is called just before the request is sent to its destination, and may modify
+	// it. Returning an error aborts the request.
+	BeforeRequest(request *http.Request) error
+	// AfterResponse is called with the response before it is returned to the client, and may
+	// modify it. Data holds the response body as received (it is encoded afterwards if the client
+	// asked for binary data), and redaction is applied after every hook has run. Returning an
+	// error fails the request.
+	AfterResponse(request *http.Request, response *Response) error
+}
+
+// HookFuncs adapts a pair of functions to a Hook. Either function may be nil.
+type HookFuncs struct {
+	Before func(request *http.Request) error
+	After  func(request *http.Request, response *Response) error
+}
+
+func (h HookFuncs) BeforeRequest(request *http.Request) error {
+	if h.Before == nil {
+		return nil
+	}
+
+	return h.Before(request)
+}
+
+func (h HookFuncs) AfterResponse(request *http.Request, response *Response) error {
+	if h.After == nil {
+		return nil
+	}
+
+	return h.After(request, response)
+}
+
+// HookConfig configures a hook registered with RegisterHook.
+type HookConfig struct {
+	Name    string            `json:"name" yaml:"name"`
+	Options map[string]string `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+// HookFactory creates a hook from the options given in its configuration.
+type HookFactory func(options map[string]string) (Hook, error)
+
+var (
+	hookFactoriesMu sync.RWMutex
+	hookFactories   = map[string]HookFactory{
+		"set-header":    newSetHeaderHook,
+		"remove-header": newRemoveHeaderHook,
+		"rewrite-host":  newRewriteHostHook,
+	}
+)
+
+// RegisterHook makes a hook available to the configuration under name. It panics if a hook is
+// already registered with the same name.
+func RegisterHook(name string, factory HookFactory) {
+	hookFactoriesMu.Lock()
+	defer hookFactoriesMu.Unlock()
+
+	if _, exists := hookFactories[name]; exists {
+		panic("libproxy: RegisterHook called twice for hook " + name)
+	}
+	hookFactories[name] = factory
+}
+
+// RegisteredHooks returns the names of the hooks that may be used in the configuration.
+func RegisteredHooks() []string {
+	hookFactoriesMu.RLock()
+	defer hookFactoriesMu.RUnlock()
+
+	return registeredHookNames()
+}
+
+// newHookChain creates the hooks listed in configs, in order.
+func newHookChain(configs []HookConfig) ([]Hook, error) {
+	hookFactoriesMu.RLock()
+	defer hookFactoriesMu.RUnlock()
+
+	hooks := make([]Hook, 0, len(configs))
+	for i, config := range configs {
+		factory, ok := hookFactories[config.Name]
+		if !ok {
+			return nil, fmt.Errorf("hook %d: unknown hook %q (expected one of %s)", i, config.Name, strings.Join(registeredHookNames(), ", "))
+		}
+
+		hook, err := factory(config.Options)
+		if err != nil {
+			return nil, fmt.Errorf("hook %d (%s): %w", i, config.Name, err)
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
+
+// registeredHookNames is RegisteredHooks for callers already holding hookFactoriesMu.
+func registeredHookNames() []string {
+	names := make([]string, 0, len(hookFactories))
+	for name := range hookFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// beforeRequest runs the BeforeRequest stage of every hook, stopping at the first error.
+func (p *policy) beforeRequest(request *http.Request) error {
+	for _, chain := range [][]Hook{p.registeredHooks, p.configuredHooks} {
+		for _, hook := range chain {
+			if err := hook.BeforeRequest(request); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// afterResponse runs the AfterResponse stage of every hook, stopping at the first error.
+func (p *policy) afterResponse(request *http.Request, response *Response) error {
+	for _, chain := range [][]Hook{p.registeredHooks, p.configuredHooks} {
+		for _, hook := range chain {
+			if err := hook.AfterResponse(request, response); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// requireOptions returns an error if any of names are missing from options.
+func requireOptions(options map[string]string, names ...string) error {
+	for _, name := range names {
+		if options[name] == "" {
+			return fmt.Errorf("the %q option is required", name)
+		}
+	}
+
+	return nil
+}
+
+// newSetHeaderHook sets the "header" request header to "value", replacing any existing value.
+func newSetHeaderHook(options map[string]string) (Hook, error) {
+	if err := requireOptions(options, "header"); err != nil {
+		return nil, err
+	}
+
+	header, value := options["header"], options["value"]
+	return HookFuncs{Before: func(request *http.Request) error {
+		request.Header.Set(header, value)
+		return nil
+	}}, nil
+}
+
+// newRemoveHeaderHook removes the "header" request header.
+func newRemoveHeaderHook(options map[string]string) (Hook, error) {
+	if err := requireOptions(options, "header"); err != nil {
+		return nil, err
+	}
+
+	header := options["header"]
+	return HookFuncs{Before: func(request *http.Request) error {
+		request.Header.Del(header)
+		return nil
+	}}, nil
+}
+
+// newRewriteHostHook sends requests for the "from" host to the "to" host (which may include a
+// port) instead, e.g. to direct requests for production hosts to staging.
+func newRewriteHostHook(options map[string]string) (Hook, error) {
+	if err := requireOptions(options, "from", "to"); err != nil {
+		return nil, err
+	}
+	if strings.Contains(options["to"], "/") {
+		return nil, errors.New("the \"to\" option must be a host, not a URL")
+	}
+
+	from, to := options["from"], options["to"]
+	return HookFuncs{Before: func(request *http.Request) error {
+		if strings.EqualFold(request.URL.Hostname(), from) {
+			request.URL.Host = to
+			request.Host = ""
+		}
+		return nil
+	}}, nil
+}
@@ -0,0 +1,125 @@
+package libproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHookChain(t *testing.T) {
+	var order []string
+	proxy, err := New(Options{
+		Config: Config{
+			AllowedOrigins: []string{"*"},
+			Hooks: []HookConfig{
+				{Name: "set-header", Options: map[string]string{"header": "X-Trace-Id", "value": "configured"}},
+				{Name: "remove-header", Options: map[string]string{"header": "X-Remove-Me"}},
+			},
+		},
+		Hooks: []Hook{HookFuncs{
+			Before: func(request *http.Request) error {
+				order = append(order, "first")
+				request.Header.Set("X-Trace-Id", "registered")
+				return nil
+			},
+		}},
+	})
+	assert.Nil(t, err)
+	proxy.Use(HookFuncs{
+		Before: func(request *http.Request) error {
+			order = append(order, "second")
+			return nil
+		},
+		After: func(request *http.Request, response *Response) error {
+			response.Headers["x-hooked"] = request.URL.Path
+			response.Data = strings.ToUpper(response.Data)
+			return nil
+		},
+	})
+
+	result := getResultFrom(proxy, Request{
+		Method:  "GET",
+		Url:     testServerUrl + "/headers",
+		Headers: map[string]string{"X-Remove-Me": "value"},
+	}, "validorigin1.com")
+	assert.Nil(t, result.err)
+	assert.True(t, result.requestResponse.Success)
+	assert.Equal(t, []string{"first", "second"}, order)
+	assert.Equal(t, "/headers", result.requestResponse.Headers["x-hooked"])
+
+	// the configured hooks run last, and the after-response hook sees the raw body
+	assert.Contains(t, result.requestResponse.Data, "\"X-TRACE-ID\"")
+	assert.Contains(t, result.requestResponse.Data, "\"CONFIGURED\"")
+	assert.NotContains(t, result.requestResponse.Data, "X-REMOVE-ME")
+}
+
+func TestHookErrors(t *testing.T) {
+	proxy, err := New(Options{
+		Config: Config{AllowedOrigins: []string{"*"}},
+		Hooks: []Hook{HookFuncs{Before: func(request *http.Request) error {
+			if request.URL.Path == "/status/418" {
+				return errors.New("teapots are not allowed")
+			}
+			return nil
+		}}},
+	})
+	assert.Nil(t, err)
+
+	result := getResultFrom(proxy, Request{Method: "GET", Url: testServerUrl + "/status/418"}, "validorigin1.com")
+	body := getErrorBody(t, result)
+	assert.Equal(t, ErrorCodeHookFailed, body.Data.Code)
+	assert.Contains(t, body.Data.Message, "teapots are not allowed")
+
+	proxy.Use(HookFuncs{After: func(request *http.Request, response *Response) error {
+		return errors.New("no responses today")
+	}})
+	result = getResultFrom(proxy, Request{Method: "GET", Url: testServerUrl + "/get"}, "validorigin1.com")
+	body = getErrorBody(t, result)
+	assert.Equal(t, ErrorCodeHookFailed, body.Data.Code)
+}
+
+func TestRewriteHostHook(t *testing.T) {
+	testServer, _ := url.Parse(testServerUrl)
+	proxy, err := New(Options{Config: Config{
+		AllowedOrigins: []string{"*"},
+		BannedDests:    []string{"banned.example"},
+		Hooks: []HookConfig{
+			{Name: "rewrite-host", Options: map[string]string{"from": "api.example", "to": testServer.Host}},
+			{Name: "rewrite-host", Options: map[string]string{"from": "staging.example", "to": "banned.example"}},
+		},
+	}})
+	assert.Nil(t, err)
+
+	result := getResultFrom(proxy, Request{Method: "GET", Url: "http://api.example/get"}, "validorigin1.com")
+	assert.True(t, result.requestResponse.Success)
+	assert.Equal(t, 200, result.requestResponse.Status)
+
+	// the destination is checked again after the hooks have run
+	result = getResultFrom(proxy, Request{Method: "GET", Url: "http://staging.example/get"}, "validorigin1.com")
+	assert.False(t, result.requestResponse.Success)
+}
+
+func TestInvalidHookConfig(t *testing.T) {
+	_, err := New(Options{Config: Config{Hooks: []HookConfig{{Name: "does-not-exist"}}}})
+	assert.NotNil(t, err)
+
+	_, err = New(Options{Config: Config{Hooks: []HookConfig{{Name: "set-header"}}}})
+	assert.NotNil(t, err)
+
+	RegisterHook("test-hook", func(options map[string]string) (Hook, error) {
+		return HookFuncs{}, nil
+	})
+	assert.Contains(t, RegisteredHooks(), "test-hook")
+	assert.Panics(t, func() {
+		RegisterHook("test-hook", nil)
+	})
+
+	proxy, err := New(Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, proxy.SetHooks([]HookConfig{{Name: "test-hook"}}))
+	assert.NotNil(t, proxy.SetHooks([]HookConfig{{Name: "rewrite-host", Options: map[string]string{"from": "a", "to": "http://b/"}}}))
+}
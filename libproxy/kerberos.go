@@ -0,0 +1,84 @@
+package libproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	krb5client "github.com/jcmturner/gokrb5/v8/client"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// KerberosConfig configures the Kerberos identity the proxy uses for Negotiate (SPNEGO)
+// authentication. Requests using Negotiate authenticate as this principal, so it should only be
+// configured for proxies whose users may all act as it.
+type KerberosConfig struct {
+	// Keytab is the path of the keytab holding the principal's keys.
+	Keytab string `json:"keytab,omitempty" yaml:"keytab,omitempty"`
+	// Principal is the principal to authenticate as, e.g. proxyscotch@EXAMPLE.COM. If it has no
+	// realm, the default realm from the Kerberos configuration is used.
+	Principal string `json:"principal,omitempty" yaml:"principal,omitempty"`
+	// ConfigFile is the path of the krb5.conf file describing the realm (default: /etc/krb5.conf).
+	ConfigFile string `json:"configFile,omitempty" yaml:"configFile,omitempty"`
+}
+
+// Enabled returns true if a Kerberos identity has been configured.
+func (c KerberosConfig) Enabled() bool {
+	return c.Keytab != "" || c.Principal != ""
+}
+
+// kerberosAuth sets SPNEGO headers using the configured Kerberos identity. It logs in to the KDC
+// when it is first used, and renews its tickets as needed.
+type kerberosAuth struct {
+	client *krb5client.Client
+}
+
+// newKerberosAuth loads the Kerberos configuration and keytab. It doesn't contact the KDC.
+func newKerberosAuth(config KerberosConfig) (*kerberosAuth, error) {
+	if config.Keytab == "" || config.Principal == "" {
+		return nil, errors.New("kerberos: both a keytab and a principal are required")
+	}
+
+	configFile := config.ConfigFile
+	if configFile == "" {
+		configFile = "/etc/krb5.conf"
+	}
+	krb5conf, err := krb5config.Load(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("kerberos: failed to load %s: %w", configFile, err)
+	}
+
+	kt, err := keytab.Load(config.Keytab)
+	if err != nil {
+		return nil, fmt.Errorf("kerberos: failed to load keytab %s: %w", config.Keytab, err)
+	}
+
+	username, realm := config.Principal, krb5conf.LibDefaults.DefaultRealm
+	if at := strings.LastIndexByte(username, '@'); at >= 0 {
+		username, realm = username[:at], username[at+1:]
+	}
+	if realm == "" {
+		return nil, errors.New("kerberos: the principal has no realm, and there is no default realm")
+	}
+
+	// Active Directory doesn't support FAST, which is the most common reason for using SPNEGO.
+	return &kerberosAuth{
+		client: krb5client.NewWithKeytab(username, realm, kt, krb5conf, krb5client.DisablePAFXFAST(true)),
+	}, nil
+}
+
+// setHeader sets the Negotiate Authorization header on request, for the service principal spn
+// (or, if blank, HTTP/<host>).
+func (k *kerberosAuth) setHeader(request *http.Request, spn string) error {
+	return spnego.SetSPNEGOHeader(k.client, request, spn)
+}
+
+// destroy stops renewing the identity's tickets.
+func (k *kerberosAuth) destroy() {
+	if k != nil {
+		k.client.Destroy()
+	}
+}
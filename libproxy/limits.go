@@ -0,0 +1,138 @@
+package libproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a size in bytes. In configuration files, it may be written in the format accepted
+// by ParseByteSize.
+type ByteSize int64
+
+// UnmarshalText parses a size in the format accepted by ParseByteSize.
+func (s *ByteSize) UnmarshalText(text []byte) error {
+	size, err := ParseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+
+	*s = ByteSize(size)
+	return nil
+}
+
+// MarshalText formats the size as a plain number of bytes.
+func (s ByteSize) MarshalText() ([]byte, error) {
+	return []byte(strconv.FormatInt(int64(s), 10)), nil
+}
+
+// BodyLimits holds the maximum sizes (in bytes) of the bodies passing through the proxy. A zero
+// limit means unlimited.
+type BodyLimits struct {
+	// MaxRequestBodySize is the maximum size of the request made to the proxy itself, including
+	// any multipart files.
+	MaxRequestBodySize ByteSize `json:"maxRequestBodySize,omitempty" yaml:"maxRequestBodySize,omitempty"`
+	// MaxUploadSize is the maximum size of the body the proxy will send to the upstream.
+	MaxUploadSize ByteSize `json:"maxUploadSize,omitempty" yaml:"maxUploadSize,omitempty"`
+	// MaxResponseSize is the maximum size of the upstream response body the proxy will read.
+	MaxResponseSize ByteSize `json:"maxResponseSize,omitempty" yaml:"maxResponseSize,omitempty"`
+	// TruncateResponses returns the first MaxResponseSize bytes of an oversized response (with
+	// Response.Truncated set), instead of failing the request.
+	TruncateResponses bool `json:"truncateResponses,omitempty" yaml:"truncateResponses,omitempty"`
+}
+
+// errBodyTooLarge is returned by a limitedReader once its limit has been exceeded.
+var errBodyTooLarge = errors.New("body exceeds the size limit")
+
+// limitedReader is like io.LimitedReader, except that it returns errBodyTooLarge rather than
+// io.EOF when more than N bytes are available, so that callers can tell a large body apart from
+// one that ended exactly at the limit. Once exceeded, N is negative; callers should check that
+// rather than the error, as some readers (e.g. multipart) don't wrap the errors they return.
+type limitedReader struct {
+	R io.ReadCloser
+	N int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.N < 0 {
+		return 0, errBodyTooLarge
+	}
+
+	// Read one byte more than the limit, so we can tell if it was exceeded.
+	if int64(len(p)) > l.N+1 {
+		p = p[:l.N+1]
+	}
+	n, err := l.R.Read(p)
+	l.N -= int64(n)
+	if l.N < 0 {
+		return n + int(l.N), errBodyTooLarge
+	}
+
+	return n, err
+}
+
+// exceeded returns true if more than the limit was read.
+func (l *limitedReader) exceeded() bool {
+	return l.N < 0
+}
+
+func (l *limitedReader) Close() error {
+	return l.R.Close()
+}
+
+// readLimited reads up to limit bytes from reader. If the reader had more data, the first limit
+// bytes are returned with truncated set. A limit of zero reads everything.
+func readLimited(reader io.Reader, limit int64) (data []byte, truncated bool, err error) {
+	if limit <= 0 {
+		data, err = io.ReadAll(reader)
+		return data, false, err
+	}
+
+	data, err = io.ReadAll(io.LimitReader(reader, limit+1))
+	if int64(len(data)) > limit {
+		return data[:limit], true, err
+	}
+
+	return data, false, err
+}
+
+// ParseByteSize parses a size such as "512", "64KB", "10MB" or "1GB" into a number of bytes.
+// Units are binary (1KB = 1024 bytes). An empty string returns zero.
+func ParseByteSize(value string) (int64, error) {
+	original := value
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q: expected a number of bytes, optionally suffixed with KB, MB or GB", original)
+	}
+
+	if size > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q: too large", original)
+	}
+
+	return size * multiplier, nil
+}
@@ -0,0 +1,130 @@
+package libproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getErrorBody(t *testing.T, result RespResult) errorBody {
+	var body errorBody
+	err := json.Unmarshal(result.proxyResponse.Body.Bytes(), &body)
+	assert.Nil(t, err)
+	assert.False(t, body.Success)
+	return body
+}
+
+func TestParseByteSize(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"":      0,
+		"512":   512,
+		"512B":  512,
+		"64KB":  64 << 10,
+		"10mb":  10 << 20,
+		"1 GB":  1 << 30,
+		" 2MB ": 2 << 20,
+	} {
+		size, err := ParseByteSize(value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, size, value)
+	}
+
+	for _, value := range []string{"ten MB", "-1KB", "9999999999GB", "9223372036854775808"} {
+		_, err := ParseByteSize(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+func TestMaxRequestBodySize(t *testing.T) {
+	testProxy.SetBodyLimits(BodyLimits{MaxRequestBodySize: 128})
+	defer testProxy.SetBodyLimits(BodyLimits{})
+
+	result := getResultDef(Request{
+		Method: "POST",
+		Url:    testServerUrl + "/post",
+		Data:   strings.Repeat("a", 256),
+	})
+	body := getErrorBody(t, result)
+	assert.Equal(t, ErrorCodeRequestTooLarge, body.Data.Code)
+	assert.Equal(t, int64(128), body.Data.MaxSize)
+}
+
+func TestMaxUploadSize(t *testing.T) {
+	testProxy.SetBodyLimits(BodyLimits{MaxUploadSize: 16})
+	defer testProxy.SetBodyLimits(BodyLimits{})
+
+	result := getResultDef(Request{
+		Method: "POST",
+		Url:    testServerUrl + "/post",
+		Data:   strings.Repeat("a", 17),
+	})
+	body := getErrorBody(t, result)
+	assert.Equal(t, ErrorCodeUploadTooLarge, body.Data.Code)
+
+	result = getResultDef(Request{
+		Method: "POST",
+		Url:    testServerUrl + "/post",
+		Data:   strings.Repeat("a", 16),
+	})
+	assert.True(t, result.requestResponse.Success)
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	testProxy.SetBodyLimits(BodyLimits{MaxResponseSize: 100})
+	defer testProxy.SetBodyLimits(BodyLimits{})
+
+	// Both with a known Content-Length, and without.
+	for _, path := range []string{"/bytes/101", "/stream-bytes/101"} {
+		result := getResultDef(Request{
+			Method: "GET",
+			Url:    testServerUrl + path,
+		})
+		body := getErrorBody(t, result)
+		assert.Equal(t, ErrorCodeResponseTooLarge, body.Data.Code, path)
+	}
+
+	result := getResultDef(Request{
+		Method: "GET",
+		Url:    testServerUrl + "/bytes/100",
+	})
+	assert.True(t, result.requestResponse.Success)
+	assert.False(t, result.requestResponse.Truncated)
+}
+
+func TestResponseReadError(t *testing.T) {
+	// the connection is closed before the whole body has been sent
+	backend := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Length", "100")
+		_, _ = response.Write([]byte("partial"))
+	}))
+	defer backend.Close()
+
+	result := getResultDef(Request{Method: "GET", Url: backend.URL})
+	body := getErrorBody(t, result)
+	assert.Equal(t, "(Proxy Error) Request failed.", body.Data.Message)
+}
+
+func TestTruncatedResponse(t *testing.T) {
+	testProxy.SetBodyLimits(BodyLimits{MaxResponseSize: 100, TruncateResponses: true})
+	defer testProxy.SetBodyLimits(BodyLimits{})
+
+	result := getResultDef(Request{
+		Method:      "GET",
+		Url:         testServerUrl + "/bytes/1000",
+		WantsBinary: true,
+	})
+	assert.True(t, result.requestResponse.Success)
+	assert.True(t, result.requestResponse.Truncated)
+	assert.Equal(t, 100, len(decodeBinaryData(t, result.requestResponse.Data)))
+}
+
+func decodeBinaryData(t *testing.T, data string) []byte {
+	decoded, err := base64.RawStdEncoding.DecodeString(data)
+	assert.Nil(t, err)
+	return decoded
+}
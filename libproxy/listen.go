@@ -0,0 +1,225 @@
+package libproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// systemdListen is the prefix of the listen addresses of sockets inherited from a service
+// manager, e.g. systemd or systemd:web.
+const systemdListen = "systemd"
+
+// listenAddress is an address the proxy listens on (see Config.Listen).
+type listenAddress struct {
+	// network is tcp, unix or systemd.
+	network string
+	// address is a host:port, the path of a Unix socket, or the name of the inherited sockets to
+	// listen on (blank for all of them).
+	address string
+	tls     bool
+}
+
+// parseListenAddress parses an entry of Config.Listen. Addresses without a scheme are served
+// over HTTPS if withSSL is set, like Config.Host.
+func parseListenAddress(address string, withSSL bool) (listenAddress, error) {
+	if address == systemdListen || strings.HasPrefix(address, systemdListen+":") {
+		return listenAddress{network: systemdListen, address: strings.TrimPrefix(strings.TrimPrefix(address, systemdListen), ":"), tls: withSSL}, nil
+	}
+
+	scheme, rest, ok := strings.Cut(address, "://")
+	if !ok {
+		scheme, rest = "", address
+	}
+	switch scheme {
+	case "unix":
+		if rest == "" {
+			return listenAddress{}, fmt.Errorf("invalid listen address %q: the socket's path is missing", address)
+		}
+		return listenAddress{network: "unix", address: rest, tls: withSSL}, nil
+	case "", "http", "https":
+		if _, _, err := net.SplitHostPort(rest); err != nil {
+			return listenAddress{}, fmt.Errorf("invalid listen address %q: %w", address, err)
+		}
+		return listenAddress{network: "tcp", address: rest, tls: scheme == "https" || (scheme == "" && withSSL)}, nil
+	default:
+		return listenAddress{}, fmt.Errorf("invalid listen address %q: unknown scheme %q", address, scheme)
+	}
+}
+
+// listenAddresses returns the addresses the configuration listens on: Host, unless it is blank
+// and there are others, and those in Listen.
+func listenAddresses(config Config) ([]listenAddress, error) {
+	var addresses []listenAddress
+	if config.Host != "" || len(config.Listen) == 0 {
+		addresses = append(addresses, listenAddress{network: "tcp", address: config.Host, tls: config.WithSSL})
+	}
+	for _, address := range config.Listen {
+		parsed, err := parseListenAddress(address, config.WithSSL)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, parsed)
+	}
+
+	return addresses, nil
+}
+
+// parseSocketMode parses the permissions of Unix sockets the proxy listens on (see
+// Config.ListenSocketMode), returning 0 if they should be left as created.
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsed > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q: expected octal permissions, e.g. 0660", mode)
+	}
+	return os.FileMode(parsed), nil
+}
+
+// validateListen checks the listen settings of config.
+func validateListen(config Config) error {
+	if _, err := listenAddresses(config); err != nil {
+		return err
+	}
+	_, err := parseSocketMode(config.ListenSocketMode)
+	return err
+}
+
+// listen opens the listeners for the address. Inherited sockets may give more than one.
+func (a listenAddress) listen(mode os.FileMode) ([]net.Listener, error) {
+	switch a.network {
+	case systemdListen:
+		return inheritedListeners(a.address)
+	case "unix":
+		// Remove the socket left behind by a proxy that didn't shut down cleanly, but nothing else.
+		if info, err := os.Lstat(a.address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(a.address)
+		}
+		listener, err := net.Listen("unix", a.address)
+		if err != nil {
+			return nil, err
+		}
+		if mode != 0 {
+			if err := os.Chmod(a.address, mode); err != nil {
+				_ = listener.Close()
+				return nil, err
+			}
+		}
+		return []net.Listener{listener}, nil
+	default:
+		listener, err := net.Listen("tcp", a.address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+}
+
+// listenURL returns the URL the proxy is reached at through listener.
+func listenURL(listener net.Listener, withTLS bool) string {
+	if listener.Addr().Network() == "unix" {
+		return "unix://" + listener.Addr().String()
+	}
+	if withTLS {
+		return "https://" + listener.Addr().String() + "/"
+	}
+	return "http://" + listener.Addr().String() + "/"
+}
+
+// firstInheritedSocket is the file descriptor of the first socket passed by a service manager.
+var firstInheritedSocket = 3
+
+// inheritedSockets are the sockets passed to the process by a service manager. They are read
+// from the environment the first time they're needed, and each may only be listened on once.
+var inheritedSockets struct {
+	mu     sync.Mutex
+	loaded bool
+	files  []*os.File
+	names  []string
+	err    error
+}
+
+// inheritedListeners returns listeners for the sockets passed to the process by systemd (or
+// another service manager following its socket activation protocol) with the given name in
+// LISTEN_FDNAMES, or all of them if name is blank.
+func inheritedListeners(name string) ([]net.Listener, error) {
+	inheritedSockets.mu.Lock()
+	defer inheritedSockets.mu.Unlock()
+
+	if !inheritedSockets.loaded {
+		inheritedSockets.loaded = true
+		inheritedSockets.err = loadInheritedSockets()
+	}
+	if inheritedSockets.err != nil {
+		return nil, inheritedSockets.err
+	}
+
+	var listeners []net.Listener
+	for i, file := range inheritedSockets.files {
+		if file == nil || (name != "" && inheritedSockets.names[i] != name) {
+			continue
+		}
+		listener, err := net.FileListener(file)
+		if err != nil {
+			for _, listener := range listeners {
+				_ = listener.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on inherited socket %d: %w", firstInheritedSocket+i, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		if name != "" {
+			return nil, fmt.Errorf("no inherited socket is named %q", name)
+		}
+		return nil, errors.New("no sockets were inherited")
+	}
+
+	// The listeners have their own copies of the descriptors.
+	for i, file := range inheritedSockets.files {
+		if file != nil && (name == "" || inheritedSockets.names[i] == name) {
+			_ = file.Close()
+			inheritedSockets.files[i] = nil
+		}
+	}
+	return listeners, nil
+}
+
+// loadInheritedSockets reads the sockets passed to the process from LISTEN_PID, LISTEN_FDS and
+// LISTEN_FDNAMES, which are then removed from the environment so that child processes don't
+// take them for their own.
+func loadInheritedSockets() error {
+	pid, count, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	if count == "" {
+		return errors.New("no sockets were inherited: LISTEN_FDS isn't set")
+	}
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return errors.New("no sockets were inherited: LISTEN_PID is another process's")
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid LISTEN_FDS %q", count)
+	}
+
+	nameList := strings.Split(names, ":")
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(nameList) {
+			name = nameList[i]
+		}
+		inheritedSockets.files = append(inheritedSockets.files, os.NewFile(uintptr(firstInheritedSocket+i), "LISTEN_FD_"+strconv.Itoa(firstInheritedSocket+i)))
+		inheritedSockets.names = append(inheritedSockets.names, name)
+	}
+	return nil
+}
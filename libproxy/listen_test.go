@@ -0,0 +1,140 @@
+//go:build !windows
+
+package libproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	for address, expected := range map[string]listenAddress{
+		"127.0.0.1:9159":         {network: "tcp", address: "127.0.0.1:9159"},
+		"[::1]:9159":             {network: "tcp", address: "[::1]:9159"},
+		"https://:9443":          {network: "tcp", address: ":9443", tls: true},
+		"http://localhost:9159":  {network: "tcp", address: "localhost:9159"},
+		"unix:///run/proxy.sock": {network: "unix", address: "/run/proxy.sock"},
+		"systemd":                {network: "systemd"},
+		"systemd:web":            {network: "systemd", address: "web"},
+	} {
+		parsed, err := parseListenAddress(address, false)
+		assert.Nil(t, err, address)
+		assert.Equal(t, expected, parsed, address)
+	}
+
+	// addresses without a scheme follow the ssl setting
+	parsed, err := parseListenAddress("[::1]:9159", true)
+	assert.Nil(t, err)
+	assert.True(t, parsed.tls)
+	parsed, err = parseListenAddress("http://[::1]:9159", true)
+	assert.Nil(t, err)
+	assert.False(t, parsed.tls)
+
+	for _, address := range []string{"localhost", "ftp://localhost:21", "unix://"} {
+		_, err := parseListenAddress(address, false)
+		assert.NotNil(t, err, address)
+	}
+	_, err = New(Options{Config: Config{Listen: []string{"unix://"}}})
+	assert.NotNil(t, err)
+	_, err = New(Options{Config: Config{ListenSocketMode: "0999"}})
+	assert.NotNil(t, err)
+}
+
+func TestListenOnSeveralAddresses(t *testing.T) {
+	dir, err := os.MkdirTemp("", "proxyscotch")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.sock")
+	// a socket left behind by a previous run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("Unix sockets aren't supported: ", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	proxy, err := New(Options{Config: Config{
+		Host:             "127.0.0.1:0",
+		Listen:           []string{"https://127.0.0.1:0", "unix://" + path},
+		ListenSocketMode: "0660",
+		AllowedOrigins:   []string{"*"},
+	}})
+	assert.Nil(t, err)
+	assert.Nil(t, proxy.Start())
+	defer proxy.Shutdown(context.Background())
+
+	addrs := proxy.Addrs()
+	assert.Len(t, addrs, 3)
+	assert.Equal(t, addrs[0], proxy.Addr())
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for _, url := range []string{"http://" + addrs[0].String() + "/", "https://" + addrs[1].String() + "/"} {
+		response, err := client.Get(url + "healthz")
+		assert.Nil(t, err, url)
+		_ = response.Body.Close()
+		assert.Equal(t, http.StatusOK, response.StatusCode, url)
+	}
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+	client = &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}}}
+	response, err := client.Get("http://localhost/healthz")
+	assert.Nil(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	assert.Nil(t, proxy.Shutdown(context.Background()))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestListenOnInheritedSockets(t *testing.T) {
+	inherited, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer inherited.Close()
+	file, err := inherited.(*net.TCPListener).File()
+	assert.Nil(t, err)
+	defer file.Close()
+	// The proxy takes ownership of the inherited descriptor, so it gets a copy of its own.
+	fd, err := syscall.Dup(int(file.Fd()))
+	assert.Nil(t, err)
+
+	previous := firstInheritedSocket
+	firstInheritedSocket = fd
+	defer func() {
+		firstInheritedSocket = previous
+		inheritedSockets.loaded, inheritedSockets.files, inheritedSockets.names, inheritedSockets.err = false, nil, nil, nil
+	}()
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "web")
+
+	proxy, err := New(Options{Config: Config{Host: "", Listen: []string{"systemd:web"}}})
+	assert.Nil(t, err)
+	assert.Nil(t, proxy.Start())
+	defer proxy.Shutdown(context.Background())
+	assert.Equal(t, inherited.Addr().String(), proxy.Addr().String())
+	_, ok := os.LookupEnv("LISTEN_FDS")
+	assert.False(t, ok)
+
+	response, err := http.Get("http://" + proxy.Addr().String() + "/healthz")
+	assert.Nil(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	// each socket is only listened on once
+	_, err = inheritedListeners("web")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,139 @@
+package libproxy
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// proxyMetrics are the Prometheus metrics of a proxy. Each proxy has its own registry, so that
+// several may run in the same process.
+type proxyMetrics struct {
+	registry *prometheus.Registry
+
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	upstreamDuration *prometheus.HistogramVec
+	bytesReceived    prometheus.Counter
+	bytesSent        prometheus.Counter
+	upstreamBytes    prometheus.Counter
+	rateLimited      *prometheus.CounterVec
+	denials          *prometheus.CounterVec
+}
+
+// metricsPaths are the proxy's endpoints, which requests are counted by.
+var metricsPaths = map[string]bool{
+	"/": true, "/oauth2/token": true, "/recording": true, "/admin/reload": true, "/healthz": true, "/readyz": true, "/status": true,
+}
+
+// requestOutcomes name the outcome of a request for each access log level: status requests,
+// requests that were proxied, rejected by the proxy or failed.
+var requestOutcomes = []string{"status", "success", "rejected", "failed"}
+
+func newProxyMetrics(proxy *Proxy) *proxyMetrics {
+	metrics := &proxyMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "proxyscotch",
+			Name:      "requests_total",
+			Help:      "Requests made to the proxy, by outcome (success, rejected, failed or status) and error code.",
+		}, []string{"path", "outcome", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "proxyscotch",
+			Name:      "request_duration_seconds",
+			Help:      "The time taken to answer requests made to the proxy.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"path", "outcome"}),
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "proxyscotch",
+			Name:      "upstream_duration_seconds",
+			Help:      "The time taken by destinations to respond, by status class (e.g. 2xx).",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"status_class"}),
+		bytesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proxyscotch",
+			Name:      "received_bytes_total",
+			Help:      "Bytes received from clients in request bodies.",
+		}),
+		bytesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proxyscotch",
+			Name:      "sent_bytes_total",
+			Help:      "Bytes sent to clients in response bodies.",
+		}),
+		upstreamBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proxyscotch",
+			Name:      "upstream_received_bytes_total",
+			Help:      "Bytes received from destinations in response bodies.",
+		}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "proxyscotch",
+			Name:      "rate_limited_total",
+			Help:      "Requests rejected by a rate limit, by limit.",
+		}, []string{"limit"}),
+		denials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "proxyscotch",
+			Name:      "policy_denials_total",
+			Help:      "Requests rejected by the proxy's policy, by rule.",
+		}, []string{"rule"}),
+	}
+
+	metrics.registry.MustRegister(
+		metrics.requests,
+		metrics.requestDuration,
+		metrics.upstreamDuration,
+		metrics.bytesReceived,
+		metrics.bytesSent,
+		metrics.upstreamBytes,
+		metrics.rateLimited,
+		metrics.denials,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "proxyscotch",
+			Name:      "requests_in_flight",
+			Help:      "Requests being handled by the proxy.",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&proxy.inFlight))
+		}),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return metrics
+}
+
+// observe records a completed request.
+func (m *proxyMetrics) observe(entry *accessLogEntry) {
+	path := entry.Path
+	if !metricsPaths[path] {
+		// Keep the number of label values bounded.
+		path = "other"
+	}
+	outcome := requestOutcomes[entry.level]
+
+	m.requests.WithLabelValues(path, outcome, entry.ErrorCode).Inc()
+	m.requestDuration.WithLabelValues(path, outcome).Observe(entry.Duration / 1000)
+	m.bytesReceived.Add(float64(entry.BytesIn))
+	m.bytesSent.Add(float64(entry.BytesOut))
+
+	if entry.UpstreamStatus != 0 {
+		statusClass := strconv.Itoa(entry.UpstreamStatus/100) + "xx"
+		m.upstreamDuration.WithLabelValues(statusClass).Observe(entry.UpstreamTime / 1000)
+		m.upstreamBytes.Add(float64(entry.UpstreamBytes))
+	}
+	if entry.RateLimit != "" {
+		m.rateLimited.WithLabelValues(entry.RateLimit).Inc()
+	}
+	if entry.DeniedBy != "" {
+		m.denials.WithLabelValues(entry.DeniedBy).Inc()
+	}
+}
+
+// MetricsHandler returns a handler serving the proxy's metrics in the Prometheus format. It is
+// served at /metrics on the admin listener (see Config.AdminHost), but may also be mounted
+// elsewhere.
+func (proxy *Proxy) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(proxy.metrics.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,64 @@
+package libproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	proxy, err := New(Options{Config: Config{
+		AllowedOrigins: []string{"*"},
+		BannedDests:    []string{"banned.example.com"},
+		RateLimits:     RateLimits{PerDestination: RateLimit{Rate: 0.01, Burst: 1}},
+	}})
+	assert.Nil(t, err)
+
+	getResultFrom(proxy, Request{Method: "POST", Url: testServerUrl + "/post", Data: "hello"}, "validorigin1.com")
+	getResultFrom(proxy, Request{Method: "POST", Url: testServerUrl + "/post", Data: "hello"}, "validorigin1.com")
+	getResultFrom(proxy, Request{Method: "GET", Url: "https://banned.example.com/"}, "validorigin1.com")
+	// a different destination, so that it isn't rate limited
+	getResultFrom(proxy, Request{Method: "GET", Url: "http://localhost:1/"}, "validorigin1.com")
+
+	metrics := proxy.metrics
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.requests.WithLabelValues("/", "success", "")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.requests.WithLabelValues("/", "rejected", ErrorCodeRateLimited)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.requests.WithLabelValues("/", "rejected", "")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.requests.WithLabelValues("/", "failed", "")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.rateLimited.WithLabelValues("destination")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.denials.WithLabelValues("banned-dests")))
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.upstreamDuration))
+	assert.Greater(t, testutil.ToFloat64(metrics.bytesReceived), 0.0)
+	assert.Greater(t, testutil.ToFloat64(metrics.bytesSent), 0.0)
+	assert.Greater(t, testutil.ToFloat64(metrics.upstreamBytes), 0.0)
+}
+
+func TestAdminListener(t *testing.T) {
+	proxy, err := New(Options{Config: Config{Host: "127.0.0.1:0", AdminHost: "127.0.0.1:0", AllowedOrigins: []string{"*"}}})
+	assert.Nil(t, err)
+	assert.Nil(t, proxy.AdminAddr())
+	assert.Nil(t, proxy.Start())
+
+	assert.True(t, postToProxy(t, "http://"+proxy.Addr().String()+"/", "validorigin1.com", Request{
+		Method: "GET",
+		Url:    testServerUrl + "/get",
+	}))
+
+	metricsURL := "http://" + proxy.AdminAddr().String() + "/metrics"
+	response, err := http.Get(metricsURL)
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(response.Body)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, string(body), `proxyscotch_requests_total{code="",outcome="success",path="/"} 1`)
+	assert.Contains(t, string(body), "proxyscotch_requests_in_flight 0")
+	assert.Contains(t, string(body), "go_goroutines")
+
+	assert.Nil(t, proxy.Shutdown(context.Background()))
+	_, err = http.Get(metricsURL)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,436 @@
+package libproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrorCodeMockNotFound is returned in mock mode when a request matches no mock and unmatched
+// requests aren't passed through.
+const ErrorCodeMockNotFound = "MOCK_NOT_FOUND"
+
+// What happens to requests that match no mock (see MockConfig.Unmatched).
+const (
+	MockUnmatchedPass = "pass"
+	MockUnmatchedFail = "fail"
+)
+
+// errMockFailure is the error a simulated failure returns, as though the destination couldn't be
+// reached.
+var errMockFailure = errors.New("simulated failure")
+
+// Duration is a length of time. In configuration files, it is written in the format accepted by
+// time.ParseDuration, e.g. 250ms.
+type Duration time.Duration
+
+// UnmarshalText parses a duration in the format accepted by time.ParseDuration.
+func (d *Duration) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*d = 0
+		return nil
+	}
+
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// MockConfig configures the mock mode, in which the proxy serves responses from recorded HAR
+// files or mock definition files instead of making requests to destinations.
+type MockConfig struct {
+	// Files are the HAR files (ending in .har) and mock definition files (YAML, or JSON if they
+	// end in .json) to serve responses from. Relative paths are in the data directory. If empty,
+	// mock mode is disabled.
+	Files []string `json:"files,omitempty" yaml:"files,omitempty"`
+	// MatchHeaders are the request headers that must have the same values as in a recorded
+	// exchange for it to match. Recorded exchanges are otherwise matched by method and URL.
+	MatchHeaders []string `json:"matchHeaders,omitempty" yaml:"matchHeaders,omitempty"`
+	// MatchBody requires the request body to be the same as in a recorded exchange for it to
+	// match.
+	MatchBody bool `json:"matchBody,omitempty" yaml:"matchBody,omitempty"`
+	// Unmatched is what happens to requests that match no mock: "pass" (the default) sends them
+	// to the destination, and "fail" responds with an error.
+	Unmatched string `json:"unmatched,omitempty" yaml:"unmatched,omitempty"`
+	// Latency delays every mocked response.
+	Latency Duration `json:"latency,omitempty" yaml:"latency,omitempty"`
+	// FailureRate is the fraction (from 0 to 1) of mocked responses that fail.
+	FailureRate float64 `json:"failureRate,omitempty" yaml:"failureRate,omitempty"`
+	// FailureStatus is the status failed responses have. If 0, they fail as though the
+	// destination couldn't be reached.
+	FailureStatus int `json:"failureStatus,omitempty" yaml:"failureStatus,omitempty"`
+}
+
+// Enabled returns true if mock mode is enabled.
+func (c MockConfig) Enabled() bool {
+	return len(c.Files) > 0
+}
+
+// MockRule is a mock in a mock definition file: a response served to the requests that match.
+type MockRule struct {
+	// Name identifies the mock in the access log.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Method is the method of the requests that match, or any if blank.
+	Method string `json:"method,omitempty" yaml:"method,omitempty"`
+	// URL is the URL of the requests that match, in which "*" matches any characters, e.g.
+	// https://api.example.com/users/*. The query string of requests is sorted before matching.
+	URL string `json:"url" yaml:"url"`
+	// Headers are the headers the requests that match must have, in which "*" in a value matches
+	// any characters.
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	// Body is a regular expression the body of the requests that match must contain a match of.
+	Body string `json:"body,omitempty" yaml:"body,omitempty"`
+
+	Response MockResponse `json:"response" yaml:"response"`
+
+	// Latency, FailureRate and FailureStatus override those of MockConfig for this mock, if set.
+	Latency       Duration `json:"latency,omitempty" yaml:"latency,omitempty"`
+	FailureRate   float64  `json:"failureRate,omitempty" yaml:"failureRate,omitempty"`
+	FailureStatus int      `json:"failureStatus,omitempty" yaml:"failureStatus,omitempty"`
+}
+
+// MockResponse is the response a mock is served with.
+type MockResponse struct {
+	// Status defaults to 200.
+	Status  int               `json:"status,omitempty" yaml:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Body    string            `json:"body,omitempty" yaml:"body,omitempty"`
+}
+
+// mockFile is the format of a mock definition file.
+type mockFile struct {
+	Mocks []MockRule `json:"mocks" yaml:"mocks"`
+}
+
+type mockRule struct {
+	name    string
+	method  string
+	url     *regexp.Regexp
+	headers map[string]*regexp.Regexp
+	body    *regexp.Regexp
+
+	status        int
+	header        http.Header
+	responseBody  []byte
+	latency       time.Duration
+	failureRate   float64
+	failureStatus int
+}
+
+// mockSet is the compiled mocks of a MockConfig. A nil mockSet matches nothing.
+type mockSet struct {
+	rules     []*mockRule
+	passOther bool
+	// readsBody is set if any rule matches on the request body.
+	readsBody bool
+}
+
+// globPattern compiles a pattern in which "*" matches any characters into an anchored regular
+// expression.
+func globPattern(glob string) *regexp.Regexp {
+	parts := strings.Split(glob, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+// exactPattern compiles a regular expression matching value exactly.
+func exactPattern(value string) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(value) + "$")
+}
+
+// canonicalURL returns rawURL with its query parameters sorted, so that URLs differing only in
+// the order of their parameters match.
+func canonicalURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	parsed.RawQuery = parsed.Query().Encode()
+	parsed.Fragment = ""
+	return parsed.String()
+}
+
+// newMockSet loads and compiles the mocks in the files of config.
+func newMockSet(config MockConfig) (*mockSet, error) {
+	if !config.Enabled() {
+		return nil, nil
+	}
+	if config.FailureRate < 0 || config.FailureRate > 1 {
+		return nil, fmt.Errorf("the mock failure rate must be between 0 and 1")
+	}
+
+	set := &mockSet{readsBody: config.MatchBody}
+	switch config.Unmatched {
+	case "", MockUnmatchedPass:
+		set.passOther = true
+	case MockUnmatchedFail:
+	default:
+		return nil, fmt.Errorf("unknown action for unmatched mock requests %q (must be %s or %s)", config.Unmatched, MockUnmatchedPass, MockUnmatchedFail)
+	}
+
+	for _, path := range config.Files {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(GetOrCreateDataPath(), path)
+		}
+
+		var rules []*mockRule
+		var err error
+		if strings.EqualFold(filepath.Ext(path), ".har") {
+			rules, err = loadHARMocks(path, config)
+		} else {
+			rules, err = loadMockFile(path, config, set)
+		}
+		if err != nil {
+			return nil, err
+		}
+		set.rules = append(set.rules, rules...)
+	}
+
+	return set, nil
+}
+
+// loadHARMocks turns the exchanges recorded in the HAR file at path into mocks, which match
+// requests with the same method and URL (and the headers and body selected by config).
+func loadHARMocks(path string, config MockConfig) ([]*mockRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("failed to parse HAR file %s: %w", path, err)
+	}
+
+	rules := make([]*mockRule, 0, len(har.Log.Entries))
+	for i, entry := range har.Log.Entries {
+		rule := &mockRule{
+			name:          fmt.Sprintf("%s#%d", filepath.Base(path), i+1),
+			method:        entry.Request.Method,
+			url:           exactPattern(canonicalURL(entry.Request.URL)),
+			headers:       map[string]*regexp.Regexp{},
+			status:        entry.Response.Status,
+			header:        http.Header{},
+			latency:       time.Duration(config.Latency),
+			failureRate:   config.FailureRate,
+			failureStatus: config.FailureStatus,
+		}
+		for _, name := range config.MatchHeaders {
+			value := ""
+			for _, header := range entry.Request.Headers {
+				if strings.EqualFold(header.Name, name) {
+					value = header.Value
+					break
+				}
+			}
+			rule.headers[name] = exactPattern(value)
+		}
+		if config.MatchBody {
+			body := ""
+			if entry.Request.PostData != nil {
+				body = entry.Request.PostData.Text
+			}
+			rule.body = exactPattern(body)
+		}
+
+		if entry.Response.Status == 0 {
+			// The recorded request got no response, so neither does the replayed one.
+			rule.failureRate, rule.failureStatus = 1, 0
+		}
+		for _, header := range entry.Response.Headers {
+			// The body is served decoded, and in full.
+			switch http.CanonicalHeaderKey(header.Name) {
+			case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+				continue
+			}
+			rule.header.Add(header.Name, header.Value)
+		}
+		rule.responseBody = []byte(entry.Response.Content.Text)
+		if entry.Response.Content.Encoding == "base64" {
+			if rule.responseBody, err = base64.StdEncoding.DecodeString(entry.Response.Content.Text); err != nil {
+				return nil, fmt.Errorf("failed to parse HAR file %s: entry %d: %w", path, i+1, err)
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// loadMockFile compiles the mocks in the mock definition file at path.
+func loadMockFile(path string, config MockConfig, set *mockSet) ([]*mockRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file mockFile
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mock file %s: %w", path, err)
+	}
+
+	rules := make([]*mockRule, 0, len(file.Mocks))
+	for i, mock := range file.Mocks {
+		name := mock.Name
+		if name == "" {
+			name = fmt.Sprintf("%s#%d", filepath.Base(path), i+1)
+		}
+		if mock.URL == "" {
+			return nil, fmt.Errorf("mock %s: url must be set", name)
+		}
+		if mock.FailureRate < 0 || mock.FailureRate > 1 {
+			return nil, fmt.Errorf("mock %s: the failure rate must be between 0 and 1", name)
+		}
+
+		rule := &mockRule{
+			name:          name,
+			method:        mock.Method,
+			url:           globPattern(canonicalURL(mock.URL)),
+			headers:       map[string]*regexp.Regexp{},
+			status:        mock.Response.Status,
+			header:        http.Header{},
+			responseBody:  []byte(mock.Response.Body),
+			latency:       time.Duration(config.Latency),
+			failureRate:   config.FailureRate,
+			failureStatus: config.FailureStatus,
+		}
+		if rule.status == 0 {
+			rule.status = http.StatusOK
+		}
+		for name, value := range mock.Headers {
+			rule.headers[name] = globPattern(value)
+		}
+		if mock.Body != "" {
+			if rule.body, err = regexp.Compile(mock.Body); err != nil {
+				return nil, fmt.Errorf("mock %s: invalid body pattern: %w", name, err)
+			}
+			set.readsBody = true
+		}
+		for name, value := range mock.Response.Headers {
+			rule.header.Set(name, value)
+		}
+		if mock.Latency > 0 {
+			rule.latency = time.Duration(mock.Latency)
+		}
+		if mock.FailureRate > 0 {
+			rule.failureRate = mock.FailureRate
+		}
+		if mock.FailureStatus > 0 {
+			rule.failureStatus = mock.FailureStatus
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// matches returns true if the rule matches a request with the given canonical URL and body.
+func (r *mockRule) matches(request *http.Request, url string, body []byte) bool {
+	if r.method != "" && !strings.EqualFold(r.method, request.Method) {
+		return false
+	}
+	if !r.url.MatchString(url) {
+		return false
+	}
+	for name, pattern := range r.headers {
+		if !pattern.MatchString(request.Header.Get(name)) {
+			return false
+		}
+	}
+
+	return r.body == nil || r.body.Match(body)
+}
+
+// match returns the first mock that matches request, or nil if the request should be sent to the
+// destination. It returns an error if there is no match and unmatched requests fail.
+func (m *mockSet) match(request *http.Request) (*mockRule, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	var body []byte
+	if m.readsBody {
+		var err error
+		if body, err = bufferBody(request); err != nil {
+			return nil, err
+		}
+	}
+
+	url := canonicalURL(request.URL.String())
+	for _, rule := range m.rules {
+		if rule.matches(request, url, body) {
+			return rule, nil
+		}
+	}
+
+	if m.passOther {
+		return nil, nil
+	}
+	return nil, errors.New("no mock matches this request")
+}
+
+// respond serves the mock, after its latency, or fails as configured. It returns early if the
+// request is canceled.
+func (r *mockRule) respond(request *http.Request) (*http.Response, error) {
+	if r.latency > 0 {
+		timer := time.NewTimer(r.latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		}
+	}
+
+	status, header, body := r.status, r.header.Clone(), r.responseBody
+	if r.failureRate > 0 && rand.Float64() < r.failureRate {
+		if r.failureStatus == 0 {
+			return nil, fmt.Errorf("%s %q: %w", request.Method, request.URL.Redacted(), errMockFailure)
+		}
+		status, header, body = r.failureStatus, http.Header{}, nil
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}, nil
+}
@@ -0,0 +1,146 @@
+package libproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMockFile = `
+mocks:
+  - name: users
+    method: GET
+    url: https://api.example.com/users*
+    headers:
+      X-Tenant: acme
+    response:
+      headers:
+        Content-Type: application/json
+      body: '{"users": []}'
+  - name: admins
+    method: POST
+    url: https://api.example.com/users
+    body: '"role":\s*"admin"'
+    response:
+      status: 201
+      body: created
+  - name: slow
+    url: https://api.example.com/slow
+    latency: 50ms
+    response:
+      body: eventually
+  - name: down
+    url: https://api.example.com/down
+    failureRate: 1
+  - name: unavailable
+    url: https://api.example.com/unavailable
+    failureRate: 1
+    failureStatus: 503
+`
+
+func writeMockFile(t *testing.T, name string, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func TestMocks(t *testing.T) {
+	proxy, err := New(Options{Config: Config{
+		AllowedOrigins: []string{"*"},
+		Mock:           MockConfig{Files: []string{writeMockFile(t, "mocks.yaml", testMockFile)}},
+	}})
+	assert.Nil(t, err)
+
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: "https://api.example.com/users?page=2", Headers: map[string]string{"X-Tenant": "acme"}}, "https://hoppscotch.io")
+	assert.Equal(t, 200, resp.requestResponse.Status)
+	assert.Equal(t, "OK", resp.requestResponse.StatusText)
+	assert.Equal(t, `{"users": []}`, resp.requestResponse.Data)
+	assert.Equal(t, "application/json", resp.requestResponse.Headers["content-type"])
+
+	resp = getResultFrom(proxy, Request{Method: "POST", Url: "https://api.example.com/users", Data: `{"role": "admin"}`}, "https://hoppscotch.io")
+	assert.Equal(t, 201, resp.requestResponse.Status)
+	assert.Equal(t, "created", resp.requestResponse.Data)
+
+	start := time.Now()
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: "https://api.example.com/slow"}, "https://hoppscotch.io")
+	assert.Equal(t, "eventually", resp.requestResponse.Data)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: "https://api.example.com/down"}, "https://hoppscotch.io")
+	assert.Equal(t, ErrorBodyProxyRequestFailed+"\n", resp.proxyResponse.Body.String())
+
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: "https://api.example.com/unavailable"}, "https://hoppscotch.io")
+	assert.Equal(t, 503, resp.requestResponse.Status)
+
+	// unmatched requests are passed through to the destination
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: testServerUrl + "/status/418"}, "https://hoppscotch.io")
+	assert.Equal(t, 418, resp.requestResponse.Status)
+
+	// or refused
+	assert.Nil(t, proxy.updateConfig(func(config *Config) { config.Mock.Unmatched = MockUnmatchedFail }))
+	for _, request := range []Request{
+		{Method: "GET", Url: "https://api.example.com/users", Headers: map[string]string{"X-Tenant": "other"}},
+		{Method: "POST", Url: "https://api.example.com/users", Data: `{"role": "viewer"}`},
+		{Method: "GET", Url: testServerUrl + "/status/418"},
+	} {
+		resp = getResultFrom(proxy, request, "https://hoppscotch.io")
+		assert.Contains(t, resp.proxyResponse.Body.String(), ErrorCodeMockNotFound, request)
+	}
+}
+
+func TestReplayRecording(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "text/plain")
+		response.Header().Set("X-Tenant", request.Header.Get("X-Tenant"))
+		_, _ = response.Write([]byte("hello " + request.Header.Get("X-Tenant")))
+	}))
+
+	recorder, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, Recording: RecordingConfig{Enabled: true}}})
+	assert.Nil(t, err)
+	postRecording(recorder, RecordingRequest{Action: "start"})
+	for _, tenant := range []string{"acme", "globex"} {
+		getResultFrom(recorder, Request{Method: "GET", Url: backend.URL + "/greeting?b=2&a=1", Headers: map[string]string{"X-Tenant": tenant}}, "https://hoppscotch.io")
+	}
+	info, err := recorder.StopRecording(recorder.Recordings()[0].ID)
+	assert.Nil(t, err)
+	defer os.Remove(info.File)
+
+	// the backend is down, but the recording is replayed
+	backend.Close()
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, Mock: MockConfig{
+		Files:        []string{info.File},
+		MatchHeaders: []string{"X-Tenant"},
+		Unmatched:    MockUnmatchedFail,
+	}}})
+	assert.Nil(t, err)
+
+	for _, tenant := range []string{"globex", "acme"} {
+		// the order of the query parameters doesn't matter
+		resp := getResultFrom(proxy, Request{Method: "GET", Url: backend.URL + "/greeting?a=1&b=2", Headers: map[string]string{"X-Tenant": tenant}}, "https://hoppscotch.io")
+		assert.Equal(t, 200, resp.requestResponse.Status)
+		assert.Equal(t, "hello "+tenant, resp.requestResponse.Data)
+		assert.Equal(t, tenant, resp.requestResponse.Headers["x-tenant"])
+	}
+
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: backend.URL + "/greeting?a=1&b=2", Headers: map[string]string{"X-Tenant": "initech"}}, "https://hoppscotch.io")
+	assert.Contains(t, resp.proxyResponse.Body.String(), ErrorCodeMockNotFound)
+}
+
+func TestInvalidMockConfig(t *testing.T) {
+	valid := writeMockFile(t, "mocks.yaml", testMockFile)
+	for _, config := range []MockConfig{
+		{Files: []string{valid}, Unmatched: "sometimes"},
+		{Files: []string{valid}, FailureRate: 2},
+		{Files: []string{filepath.Join(t.TempDir(), "missing.har")}},
+		{Files: []string{writeMockFile(t, "broken.yaml", "mocks:\n  - url: https://example.com\n    body: '('\n")}},
+		{Files: []string{writeMockFile(t, "nourl.json", `{"mocks": [{"name": "nowhere"}]}`)}},
+	} {
+		_, err := New(Options{Config: Config{Mock: config}})
+		assert.NotNil(t, err, config)
+	}
+}
@@ -0,0 +1,173 @@
+package libproxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Azure/go-ntlmssp"
+)
+
+// maxAuthTransports is the number of connection-authenticated transports, and transports with
+// DNS overrides (see transportFor), kept at once. When there are more, an arbitrary one is closed.
+const maxAuthTransports = 64
+
+// usesConnectionAuth returns true if the request is authenticated with a scheme that
+// authenticates the connection rather than the request.
+func (auth RequestAuth) usesConnectionAuth() bool {
+	return auth.Type == AuthTypeNTLM || auth.Type == AuthTypeNegotiate
+}
+
+// transportFor returns the transport to send a request with. NTLM and Negotiate authenticate the
+// connection, not the request, so their connections must never be shared with requests using
+// other credentials (or none). Each set of credentials gets its own transport, limited to one
+// connection per host so that the handshake finishes on the connection it started on.
+//
+// Requests with their own DNS overrides, or to a Unix socket, likewise get a transport per set of
+// overrides or socket, so that they never reuse a connection made to another address.
+func (proxy *Proxy) transportFor(auth RequestAuth, overrides map[string]net.IP, socket string) http.RoundTripper {
+	if !auth.usesConnectionAuth() && len(overrides) == 0 && socket == "" {
+		return proxy.transport
+	}
+
+	identity := []string{"unix=" + socket}
+	if auth.usesConnectionAuth() {
+		identity = append(identity, auth.Type, auth.Username, auth.Password)
+	}
+	for host, ip := range overrides {
+		identity = append(identity, host+"="+ip.String())
+	}
+	sort.Strings(identity[len(identity)-len(overrides):])
+	key := sha256.Sum256([]byte(strings.Join(identity, "\x00")))
+	id := hex.EncodeToString(key[:])
+
+	proxy.authTransportsMu.Lock()
+	defer proxy.authTransportsMu.Unlock()
+
+	if transport, ok := proxy.authTransports[id]; ok {
+		return transport
+	}
+
+	if len(proxy.authTransports) >= maxAuthTransports {
+		for evicted, transport := range proxy.authTransports {
+			transport.CloseIdleConnections()
+			delete(proxy.authTransports, evicted)
+			break
+		}
+	}
+
+	transport := proxy.transport.Clone()
+	if auth.usesConnectionAuth() {
+		transport.MaxConnsPerHost = 1
+	}
+	if socket != "" {
+		dialUnixSocket(transport, socket)
+		countConnections(transport, &proxy.openConnections)
+	} else if len(overrides) > 0 {
+		resolveConnections(transport, func() *dnsResolver { return proxy.loadPolicy().resolver.withOverrides(overrides) })
+	}
+	proxy.authTransports[id] = transport
+	return transport
+}
+
+// closeIdleConnections closes the idle connections of every transport.
+func (proxy *Proxy) closeIdleConnections() {
+	proxy.transport.CloseIdleConnections()
+
+	proxy.authTransportsMu.Lock()
+	defer proxy.authTransportsMu.Unlock()
+
+	for _, transport := range proxy.authTransports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// discardResponse reads and closes the body of a response that won't be returned, so that its
+// connection can be reused for the next leg of a handshake.
+func discardResponse(response *http.Response) {
+	_, _ = io.Copy(io.Discard, response.Body)
+	_ = response.Body.Close()
+}
+
+// ntlmChallenge returns the scheme (NTLM or Negotiate) the server offers NTLM authentication with,
+// and the data sent with it, if any.
+func ntlmChallenge(response *http.Response) (scheme string, data []byte, ok bool) {
+	for _, preferred := range []string{"NTLM", "Negotiate"} {
+		for _, header := range response.Header.Values("WWW-Authenticate") {
+			name, value, _ := strings.Cut(header, " ")
+			if !strings.EqualFold(name, preferred) {
+				continue
+			}
+
+			data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+			if err != nil {
+				continue
+			}
+			return preferred, data, true
+		}
+	}
+
+	return "", nil, false
+}
+
+// sendWithNTLM sends request with client, answering an NTLM challenge (offered as either NTLM or
+// Negotiate) with username and password. The password is never sent in any other form.
+func sendWithNTLM(client *http.Client, request *http.Request, username string, password string) (*http.Response, error) {
+	if username == "" || password == "" {
+		return nil, errors.New("NTLM authentication requires a username and password")
+	}
+
+	// The body may need to be sent three times.
+	if _, err := bufferBody(request); err != nil {
+		return nil, err
+	}
+	withAuthorization := func(authorization string) *http.Request {
+		leg := request.Clone(request.Context())
+		if request.GetBody != nil {
+			leg.Body, _ = request.GetBody()
+		}
+		leg.Header.Set("Authorization", authorization)
+		return leg
+	}
+
+	// The connection may already be authenticated, in which case no challenge is sent.
+	response, err := client.Do(request)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+	scheme, _, ok := ntlmChallenge(response)
+	if !ok {
+		return response, nil
+	}
+	discardResponse(response)
+
+	user, domain, domainNeeded := ntlmssp.GetDomain(username)
+	negotiate, err := ntlmssp.NewNegotiateMessage(domain, "")
+	if err != nil {
+		return nil, err
+	}
+
+	response, err = client.Do(withAuthorization(scheme + " " + base64.StdEncoding.EncodeToString(negotiate)))
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+	_, challenge, ok := ntlmChallenge(response)
+	if !ok || len(challenge) == 0 {
+		// The server rejected the negotiation; let the client see why.
+		return response, nil
+	}
+	discardResponse(response)
+
+	authenticate, err := ntlmssp.ProcessChallenge(challenge, user, password, domainNeeded)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Do(withAuthorization(scheme + " " + base64.StdEncoding.EncodeToString(authenticate)))
+}
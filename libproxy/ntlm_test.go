@@ -0,0 +1,187 @@
+package libproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/md4"
+)
+
+// mockNTLMServer imitates IIS with Windows authentication: it challenges unauthenticated
+// requests, and once a connection has completed the NTLM handshake, it treats further requests
+// on that connection as authenticated.
+type mockNTLMServer struct {
+	*httptest.Server
+	scheme   string
+	domain   string
+	username string
+	password string
+
+	mu sync.Mutex
+	// challenged holds the connections that have been sent a challenge, and authenticated those
+	// that completed the handshake, by remote address.
+	challenged    map[string][]byte
+	authenticated map[string]string
+}
+
+func newMockNTLMServer(t *testing.T, scheme string) *mockNTLMServer {
+	server := &mockNTLMServer{
+		scheme:        scheme,
+		domain:        "CORP",
+		username:      "alice",
+		password:      "correct horse",
+		challenged:    map[string][]byte{},
+		authenticated: map[string]string{},
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func utf16le(s string) []byte {
+	var encoded []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		encoded = append(encoded, byte(c), byte(c>>8))
+	}
+	return encoded
+}
+
+func (s *mockNTLMServer) handle(response http.ResponseWriter, request *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.authenticated[request.RemoteAddr]; ok {
+		_, _ = response.Write([]byte("hello " + user))
+		return
+	}
+
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), s.scheme+" ")
+	message, _ := base64.StdEncoding.DecodeString(token)
+	switch {
+	case len(message) > 12 && bytes.HasPrefix(message, []byte("NTLMSSP\x00")) && message[8] == 1:
+		serverChallenge := []byte("8bytes!!")
+		s.challenged[request.RemoteAddr] = serverChallenge
+
+		// A challenge message with the target name and target info in the payload.
+		target := utf16le(s.domain)
+		targetInfo := append([]byte{2, 0, byte(len(target)), 0}, target...)
+		targetInfo = append(targetInfo, 0, 0, 0, 0)
+		challenge := &bytes.Buffer{}
+		write := func(values ...interface{}) {
+			for _, value := range values {
+				_ = binary.Write(challenge, binary.LittleEndian, value)
+			}
+		}
+		write([]byte("NTLMSSP\x00"), uint32(2))
+		write(uint16(len(target)), uint16(len(target)), uint32(48))
+		write(uint32(0x00800205)) // unicode, request target, NTLM, target info
+		write(serverChallenge, make([]byte, 8))
+		write(uint16(len(targetInfo)), uint16(len(targetInfo)), uint32(48+len(target)))
+		challenge.Write(target)
+		challenge.Write(targetInfo)
+
+		response.Header().Set("WWW-Authenticate", s.scheme+" "+base64.StdEncoding.EncodeToString(challenge.Bytes()))
+		response.WriteHeader(http.StatusUnauthorized)
+
+	case len(message) > 64 && bytes.HasPrefix(message, []byte("NTLMSSP\x00")) && message[8] == 3:
+		// The authenticate message must arrive on the connection that was challenged.
+		serverChallenge, ok := s.challenged[request.RemoteAddr]
+		field := func(offset int) []byte {
+			length := binary.LittleEndian.Uint16(message[offset:])
+			start := binary.LittleEndian.Uint32(message[offset+4:])
+			return message[start : start+uint32(length)]
+		}
+		ntResponse, domain, user := field(20), field(28), field(36)
+
+		hash := md4.New()
+		hash.Write(utf16le(s.password))
+		mac := hmac.New(md5.New, hash.Sum(nil))
+		mac.Write(utf16le(strings.ToUpper(s.username) + s.domain))
+		proofMac := hmac.New(md5.New, mac.Sum(nil))
+		proofMac.Write(serverChallenge)
+		proofMac.Write(ntResponse[16:])
+
+		if ok && bytes.Equal(domain, utf16le(s.domain)) && bytes.Equal(user, utf16le(s.username)) &&
+			hmac.Equal(proofMac.Sum(nil), ntResponse[:16]) {
+			s.authenticated[request.RemoteAddr] = s.username
+			_, _ = response.Write([]byte("hello " + s.username))
+			return
+		}
+		response.WriteHeader(http.StatusUnauthorized)
+
+	default:
+		response.Header().Add("WWW-Authenticate", s.scheme)
+		response.WriteHeader(http.StatusUnauthorized)
+	}
+}
+
+func TestNTLMAuth(t *testing.T) {
+	for _, scheme := range []string{"NTLM", "Negotiate"} {
+		server := newMockNTLMServer(t, scheme)
+		proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}}})
+		assert.Nil(t, err)
+
+		for _, authType := range []string{AuthTypeNTLM, AuthTypeNegotiate} {
+			request := Request{
+				Method: "POST",
+				Url:    server.URL + "/secure",
+				Data:   "body",
+				Auth:   RequestAuth{Type: authType, Username: "CORP\\alice", Password: "correct horse"},
+			}
+			resp := getResultFrom(proxy, request, "validorigin1.com")
+			assert.Equal(t, 200, resp.requestResponse.Status, scheme+" "+authType)
+			assert.Equal(t, "hello alice", resp.requestResponse.Data)
+
+			request.Auth.Password = "wrong"
+			resp = getResultFrom(proxy, request, "validorigin1.com")
+			assert.Equal(t, 401, resp.requestResponse.Status, scheme+" "+authType)
+		}
+
+		// the authenticated connection isn't used for requests without the credentials
+		resp := getResultFrom(proxy, Request{Method: "GET", Url: server.URL + "/secure"}, "validorigin1.com")
+		assert.Equal(t, 401, resp.requestResponse.Status, scheme)
+		resp = getResultFrom(proxy, Request{
+			Method: "GET",
+			Url:    server.URL + "/secure",
+			Auth:   RequestAuth{Type: AuthTypeNTLM, Username: "CORP\\bob", Password: "correct horse"},
+		}, "validorigin1.com")
+		assert.Equal(t, 401, resp.requestResponse.Status, scheme)
+	}
+}
+
+func TestNTLMRequiresCredentials(t *testing.T) {
+	server := newMockNTLMServer(t, "NTLM")
+
+	resp := getResultDef(Request{
+		Method: "GET",
+		Url:    server.URL,
+		Auth:   RequestAuth{Type: AuthTypeNegotiate},
+	})
+	assert.Equal(t, ErrorCodeAuthFailed, getErrorBody(t, resp).Data.Code)
+}
+
+func TestKerberosConfig(t *testing.T) {
+	_, err := New(Options{Config: Config{Kerberos: KerberosConfig{Principal: "proxyscotch@EXAMPLE.COM"}}})
+	assert.NotNil(t, err)
+
+	krb5conf := filepath.Join(t.TempDir(), "krb5.conf")
+	assert.Nil(t, os.WriteFile(krb5conf, []byte("[libdefaults]\n  default_realm = EXAMPLE.COM\n"), 0600))
+	_, err = New(Options{Config: Config{Kerberos: KerberosConfig{
+		Principal:  "proxyscotch",
+		Keytab:     filepath.Join(t.TempDir(), "missing.keytab"),
+		ConfigFile: krb5conf,
+	}}})
+	assert.ErrorContains(t, err, "keytab")
+}
@@ -0,0 +1,554 @@
+package libproxy
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth 2.0 grant types supported by the token endpoint.
+const (
+	GrantClientCredentials = "client_credentials"
+	GrantPassword          = "password"
+	GrantRefreshToken      = "refresh_token"
+	GrantDeviceCode        = "device_code"
+)
+
+// AuthTypeOAuth2 attaches a token cached by the /oauth2/token endpoint to the request. The
+// credential is named by RequestAuth.Credential, in the session named by Request.Session.
+const AuthTypeOAuth2 = "oauth2"
+
+// tokenExpirySkew is how long before it expires a token is treated as expired, so that it isn't
+// sent only to expire on the way.
+const tokenExpirySkew = 10 * time.Second
+
+// maxOAuth2Credentials is the number of cached credentials, beyond which the least recently used
+// are evicted.
+var maxOAuth2Credentials = 1024
+
+// OAuth2Request is the body of a request to the /oauth2/token endpoint. Credentials are cached by
+// the proxy access token, Session and Name, so that later proxied requests can refer to them.
+type OAuth2Request struct {
+	AccessToken string
+	// Session identifies the client, so that clients sharing the proxy keep separate caches. It
+	// is required, and should be a random value that other clients can't guess, since anyone
+	// with the access token and session may use the credentials.
+	Session string
+	// Name identifies the credential within the session.
+	Name string
+
+	GrantType string
+	TokenUrl  string
+	// DeviceAuthorizationUrl is the endpoint that starts the device code grant.
+	DeviceAuthorizationUrl string
+	ClientId               string
+	ClientSecret           string
+	// ClientAuth is how the client credentials are sent: "basic" (the default) in the
+	// Authorization header, or "post" in the request body.
+	ClientAuth   string
+	Scope        string
+	Username     string
+	Password     string
+	RefreshToken string
+	// Params are further parameters to send to the token endpoint, e.g. audience.
+	Params map[string]string
+}
+
+// oauth2Response is the data returned by the /oauth2/token endpoint.
+type oauth2Response struct {
+	Name string `json:"name"`
+	// Status is "ready" once a token has been issued, or "pending" while the user completes the
+	// device code grant.
+	Status      string `json:"status"`
+	TokenType   string `json:"tokenType,omitempty"`
+	AccessToken string `json:"accessToken,omitempty"`
+	ExpiresIn   int64  `json:"expiresIn,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+	Refreshable bool   `json:"refreshable,omitempty"`
+
+	UserCode                string `json:"userCode,omitempty"`
+	VerificationUri         string `json:"verificationUri,omitempty"`
+	VerificationUriComplete string `json:"verificationUriComplete,omitempty"`
+	Interval                int64  `json:"interval,omitempty"`
+}
+
+// oauth2Number is a number in a token response, which some servers send as a string.
+type oauth2Number int64
+
+func (n *oauth2Number) UnmarshalJSON(data []byte) error {
+	parsed, err := strconv.ParseInt(strings.Trim(string(data), "\""), 10, 64)
+	*n = oauth2Number(parsed)
+	return err
+}
+
+// oauth2TokenResponse is a response from a token or device authorization endpoint (RFC 6749 and
+// RFC 8628).
+type oauth2TokenResponse struct {
+	AccessToken  string       `json:"access_token"`
+	TokenType    string       `json:"token_type"`
+	ExpiresIn    oauth2Number `json:"expires_in"`
+	RefreshToken string       `json:"refresh_token"`
+	Scope        string       `json:"scope"`
+
+	DeviceCode              string       `json:"device_code"`
+	UserCode                string       `json:"user_code"`
+	VerificationUri         string       `json:"verification_uri"`
+	VerificationUrl         string       `json:"verification_url"`
+	VerificationUriComplete string       `json:"verification_uri_complete"`
+	Interval                oauth2Number `json:"interval"`
+
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// OAuth2Error is an error returned by a token endpoint.
+type OAuth2Error struct {
+	Code        string
+	Description string
+}
+
+func (e *OAuth2Error) Error() string {
+	if e.Description == "" {
+		return "the token endpoint returned " + e.Code
+	}
+
+	return fmt.Sprintf("the token endpoint returned %s: %s", e.Code, e.Description)
+}
+
+// oauth2Credential is a cached token, along with what is needed to get a new one.
+type oauth2Credential struct {
+	// mu serializes refreshes, so that concurrent requests don't each refresh the token.
+	mu sync.Mutex
+
+	request      OAuth2Request
+	tokenType    string
+	accessToken  string
+	refreshToken string
+	scope        string
+	expiry       time.Time
+
+	// deviceCode is set while a device code grant is waiting for the user.
+	deviceCode   string
+	deviceExpiry time.Time
+}
+
+// expired returns true if the token has expired, or is about to. Tokens without an expiry time
+// never expire.
+func (c *oauth2Credential) expired(now time.Time) bool {
+	return !c.expiry.IsZero() && now.Add(tokenExpirySkew).After(c.expiry)
+}
+
+// renewable returns true if a new token can be fetched without the user's involvement.
+func (c *oauth2Credential) renewable() bool {
+	return c.refreshToken != "" || c.request.GrantType == GrantClientCredentials || c.request.GrantType == GrantPassword
+}
+
+// oauth2Cache holds the credentials fetched through the /oauth2/token endpoint. It lives as long
+// as the proxy, across configuration reloads.
+type oauth2Cache struct {
+	mu sync.Mutex
+	// order lists the keys of the credentials, most recently used first.
+	order       *list.List
+	credentials map[string]*list.Element
+}
+
+type oauth2Item struct {
+	key        string
+	credential *oauth2Credential
+}
+
+func newOAuth2Cache() *oauth2Cache {
+	return &oauth2Cache{order: list.New(), credentials: map[string]*list.Element{}}
+}
+
+// errNoOAuth2Session is returned for OAuth 2.0 credentials without a session, which would be
+// shared by every client with the access token.
+var errNoOAuth2Session = errors.New("OAuth 2.0 credentials require a session")
+
+func oauth2CacheKey(accessToken string, session string, name string) string {
+	key := sha256.Sum256([]byte(accessToken + "\x00" + session + "\x00" + name))
+	return hex.EncodeToString(key[:])
+}
+
+func (cache *oauth2Cache) get(key string) *oauth2Credential {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	element, ok := cache.credentials[key]
+	if !ok {
+		return nil
+	}
+	cache.order.MoveToFront(element)
+	return element.Value.(*oauth2Item).credential
+}
+
+func (cache *oauth2Cache) put(key string, credential *oauth2Credential) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if element, ok := cache.credentials[key]; ok {
+		cache.order.Remove(element)
+	}
+	cache.credentials[key] = cache.order.PushFront(&oauth2Item{key, credential})
+	for len(cache.credentials) > maxOAuth2Credentials {
+		oldest := cache.order.Remove(cache.order.Back()).(*oauth2Item)
+		delete(cache.credentials, oldest.key)
+	}
+}
+
+// tokenRequest makes a request to an OAuth 2.0 endpoint on behalf of the credentials in request.
+func (proxy *Proxy) tokenRequest(ctx context.Context, p *policy, endpoint string, form url.Values, request OAuth2Request) (*oauth2TokenResponse, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") {
+		return nil, fmt.Errorf("invalid endpoint URL %q", endpoint)
+	}
+	if !p.isAllowedDest(endpointURL.Hostname()) {
+		return nil, errors.New("requests cannot be made to this destination")
+	}
+
+	for name, value := range request.Params {
+		form.Set(name, value)
+	}
+	if request.ClientAuth == "post" {
+		form.Set("client_id", request.ClientId)
+		if request.ClientSecret != "" {
+			form.Set("client_secret", request.ClientSecret)
+		}
+	} else if request.ClientSecret == "" {
+		// Public clients identify themselves in the body.
+		form.Set("client_id", request.ClientId)
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpRequest.Header.Set("Accept", "application/json")
+	httpRequest.Header.Set("User-Agent", "Proxyscotch/1.1")
+	if request.ClientAuth != "post" && request.ClientSecret != "" {
+		httpRequest.SetBasicAuth(url.QueryEscape(request.ClientId), url.QueryEscape(request.ClientSecret))
+	}
+
+	client := http.Client{Transport: proxy.transport}
+	httpResponse, err := client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	body, _, err := readLimited(httpResponse.Body, 1<<20)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokenResponse oauth2TokenResponse
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		// Some servers (e.g. GitHub, without an Accept header) reply with a form.
+		values, parseErr := url.ParseQuery(string(body))
+		if parseErr != nil || len(values) == 0 {
+			return nil, fmt.Errorf("the token endpoint returned an invalid response (status %d)", httpResponse.StatusCode)
+		}
+		tokenResponse = oauth2TokenResponse{
+			AccessToken:      values.Get("access_token"),
+			TokenType:        values.Get("token_type"),
+			RefreshToken:     values.Get("refresh_token"),
+			Scope:            values.Get("scope"),
+			Error:            values.Get("error"),
+			ErrorDescription: values.Get("error_description"),
+		}
+		_ = tokenResponse.ExpiresIn.UnmarshalJSON([]byte(values.Get("expires_in")))
+	}
+
+	if tokenResponse.Error != "" {
+		return nil, &OAuth2Error{Code: tokenResponse.Error, Description: tokenResponse.ErrorDescription}
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the token endpoint returned status %d", httpResponse.StatusCode)
+	}
+
+	return &tokenResponse, nil
+}
+
+// setToken records a token issued to the credential.
+func (c *oauth2Credential) setToken(token *oauth2TokenResponse, now time.Time) {
+	c.tokenType = token.TokenType
+	c.accessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		c.refreshToken = token.RefreshToken
+	}
+	if token.Scope != "" {
+		c.scope = token.Scope
+	}
+	c.expiry = time.Time{}
+	if token.ExpiresIn > 0 {
+		c.expiry = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	c.deviceCode = ""
+}
+
+// grantForm returns the token request parameters for the credential's grant.
+func (c *oauth2Credential) grantForm() url.Values {
+	form := url.Values{}
+	request := c.request
+	if request.Scope != "" {
+		form.Set("scope", request.Scope)
+	}
+
+	switch request.GrantType {
+	case GrantClientCredentials:
+		form.Set("grant_type", GrantClientCredentials)
+	case GrantPassword:
+		form.Set("grant_type", GrantPassword)
+		form.Set("username", request.Username)
+		form.Set("password", request.Password)
+	case GrantRefreshToken:
+		form.Set("grant_type", GrantRefreshToken)
+		form.Set("refresh_token", request.RefreshToken)
+	case GrantDeviceCode:
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+		form.Set("device_code", c.deviceCode)
+	}
+
+	return form
+}
+
+// renew fetches a new token for the credential, with its refresh token if it has one, or by
+// repeating its grant. The caller must hold c.mu.
+func (proxy *Proxy) renew(ctx context.Context, p *policy, c *oauth2Credential) error {
+	form := c.grantForm()
+	if c.refreshToken != "" {
+		form = url.Values{"grant_type": {GrantRefreshToken}, "refresh_token": {c.refreshToken}}
+		if c.request.Scope != "" {
+			form.Set("scope", c.request.Scope)
+		}
+	} else if !c.renewable() {
+		return errors.New("the token has expired and can't be renewed; request a new one")
+	}
+
+	token, err := proxy.tokenRequest(ctx, p, c.request.TokenUrl, form, c.request)
+	if err != nil {
+		return err
+	}
+
+	c.setToken(token, time.Now())
+	return nil
+}
+
+// attachOAuth2Token sets the Authorization header of request to the cached token named by auth,
+// renewing it first if it has expired.
+func (proxy *Proxy) attachOAuth2Token(p *policy, request *http.Request, requestData Request) error {
+	if requestData.Session == "" {
+		return errNoOAuth2Session
+	}
+	credential := proxy.oauth2.get(oauth2CacheKey(requestData.AccessToken, requestData.Session, requestData.Auth.Credential))
+	if credential == nil {
+		return fmt.Errorf("there is no OAuth 2.0 credential named %q in this session", requestData.Auth.Credential)
+	}
+
+	credential.mu.Lock()
+	defer credential.mu.Unlock()
+
+	if credential.accessToken == "" {
+		return fmt.Errorf("the OAuth 2.0 credential %q has no token yet", requestData.Auth.Credential)
+	}
+	if credential.expired(time.Now()) {
+		if err := proxy.renew(request.Context(), p, credential); err != nil {
+			return err
+		}
+	}
+
+	tokenType := credential.tokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		tokenType = "Bearer"
+	}
+	request.Header.Set("Authorization", tokenType+" "+credential.accessToken)
+	return nil
+}
+
+// oauth2Handler fetches a token with the grant in the request, caches it and returns it.
+func (proxy *Proxy) oauth2Handler(response http.ResponseWriter, request *http.Request) {
+	p := proxy.policyFor(request)
+	if !p.handleCORS(response, request) {
+		return
+	}
+
+	response.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if request.Method != "POST" {
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		writeErrorBody(response, errorData{Message: "(Proxy Error) Method not allowed."})
+		return
+	}
+
+	var oauth2Request OAuth2Request
+	if err := json.NewDecoder(io.LimitReader(request.Body, 1<<20)).Decode(&oauth2Request); err != nil || oauth2Request.Name == "" || oauth2Request.TokenUrl == "" {
+		_, _ = fmt.Fprintln(response, ErrorBodyInvalidRequest)
+		return
+	}
+	if !p.isAllowedAccessToken(oauth2Request.AccessToken) {
+		log.Print("An unauthorized request was made.")
+		accessLogEntryFor(response).DeniedBy = "token"
+		_, _ = fmt.Fprintln(response, "{\"success\": false, \"data\":{\"message\":\"(Proxy Error) Unauthorized request; you may need to set your access token in Settings.\"}}")
+		return
+	}
+	if oauth2Request.Session == "" {
+		writeErrorBody(response, errorData{Message: "(Proxy Error) Failed to fetch token: " + errNoOAuth2Session.Error(), Code: ErrorCodeOAuth2Failed})
+		return
+	}
+
+	key := oauth2CacheKey(oauth2Request.AccessToken, oauth2Request.Session, oauth2Request.Name)
+	result, err := proxy.grant(request.Context(), p, key, oauth2Request)
+	if err != nil {
+		log.Print("Failed to fetch an OAuth 2.0 token: ", p.redactedError(err))
+		data := errorData{Message: "(Proxy Error) Failed to fetch token: " + p.redactedError(err), Code: ErrorCodeOAuth2Failed}
+		var oauth2Err *OAuth2Error
+		if errors.As(err, &oauth2Err) {
+			data.Error = oauth2Err.Code
+		}
+		writeErrorBody(response, data)
+		return
+	}
+
+	_ = json.NewEncoder(response).Encode(struct {
+		Success bool           `json:"success"`
+		Data    oauth2Response `json:"data"`
+	}{true, *result})
+}
+
+// grant performs the grant in request, caching the credential under key.
+func (proxy *Proxy) grant(ctx context.Context, p *policy, key string, request OAuth2Request) (*oauth2Response, error) {
+	now := time.Now()
+	credential := &oauth2Credential{request: request}
+
+	switch request.GrantType {
+	case GrantClientCredentials, GrantPassword, GrantRefreshToken:
+		if request.GrantType == GrantRefreshToken {
+			credential.refreshToken = request.RefreshToken
+		}
+
+	case GrantDeviceCode:
+		// The grant continues while the user authorizes the device, with the client polling
+		// this endpoint until it completes.
+		if pending := proxy.oauth2.get(key); pending != nil {
+			pending.mu.Lock()
+			defer pending.mu.Unlock()
+
+			if pending.deviceCode != "" && now.Before(pending.deviceExpiry) {
+				return proxy.pollDeviceCode(ctx, p, pending)
+			}
+		}
+
+		return proxy.startDeviceCode(ctx, p, key, credential)
+
+	default:
+		return nil, fmt.Errorf("unsupported grant type %q", request.GrantType)
+	}
+
+	token, err := proxy.tokenRequest(ctx, p, request.TokenUrl, credential.grantForm(), request)
+	if err != nil {
+		return nil, err
+	}
+	credential.setToken(token, now)
+	proxy.oauth2.put(key, credential)
+
+	return credential.response(now), nil
+}
+
+// startDeviceCode starts a device code grant (RFC 8628), returning the code the user should enter.
+func (proxy *Proxy) startDeviceCode(ctx context.Context, p *policy, key string, credential *oauth2Credential) (*oauth2Response, error) {
+	request := credential.request
+	if request.DeviceAuthorizationUrl == "" {
+		return nil, errors.New("the device code grant requires a device authorization URL")
+	}
+
+	form := url.Values{}
+	if request.Scope != "" {
+		form.Set("scope", request.Scope)
+	}
+	authorization, err := proxy.tokenRequest(ctx, p, request.DeviceAuthorizationUrl, form, request)
+	if err != nil {
+		return nil, err
+	}
+	if authorization.DeviceCode == "" {
+		return nil, errors.New("the device authorization endpoint didn't return a device code")
+	}
+
+	expiresIn := time.Duration(authorization.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = 10 * time.Minute
+	}
+	credential.deviceCode = authorization.DeviceCode
+	credential.deviceExpiry = time.Now().Add(expiresIn)
+	proxy.oauth2.put(key, credential)
+
+	interval := int64(authorization.Interval)
+	if interval <= 0 {
+		interval = 5
+	}
+	verificationUri := authorization.VerificationUri
+	if verificationUri == "" {
+		verificationUri = authorization.VerificationUrl
+	}
+
+	return &oauth2Response{
+		Name:                    request.Name,
+		Status:                  "pending",
+		UserCode:                authorization.UserCode,
+		VerificationUri:         verificationUri,
+		VerificationUriComplete: authorization.VerificationUriComplete,
+		ExpiresIn:               int64(expiresIn / time.Second),
+		Interval:                interval,
+	}, nil
+}
+
+// pollDeviceCode checks whether the user has completed a device code grant. The caller must hold
+// credential.mu.
+func (proxy *Proxy) pollDeviceCode(ctx context.Context, p *policy, credential *oauth2Credential) (*oauth2Response, error) {
+	token, err := proxy.tokenRequest(ctx, p, credential.request.TokenUrl, credential.grantForm(), credential.request)
+
+	var oauth2Err *OAuth2Error
+	if errors.As(err, &oauth2Err) && (oauth2Err.Code == "authorization_pending" || oauth2Err.Code == "slow_down") {
+		return &oauth2Response{
+			Name:      credential.request.Name,
+			Status:    "pending",
+			ExpiresIn: int64(time.Until(credential.deviceExpiry) / time.Second),
+		}, nil
+	}
+	if err != nil {
+		credential.deviceCode = ""
+		return nil, err
+	}
+
+	now := time.Now()
+	credential.setToken(token, now)
+	return credential.response(now), nil
+}
+
+// response describes the credential's token to the client.
+func (c *oauth2Credential) response(now time.Time) *oauth2Response {
+	result := &oauth2Response{
+		Name:        c.request.Name,
+		Status:      "ready",
+		TokenType:   c.tokenType,
+		AccessToken: c.accessToken,
+		Scope:       c.scope,
+		Refreshable: c.renewable(),
+	}
+	if !c.expiry.IsZero() {
+		result.ExpiresIn = int64(c.expiry.Sub(now) / time.Second)
+	}
+
+	return result
+}
@@ -0,0 +1,277 @@
+package libproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockTokenServer is an OAuth 2.0 authorization server issuing numbered tokens, and a resource
+// that only accepts the latest one.
+type mockTokenServer struct {
+	*httptest.Server
+	expiresIn int
+
+	mu       sync.Mutex
+	issued   int
+	forms    []map[string]string
+	polls    int
+	approved bool
+}
+
+func newMockTokenServer(t *testing.T) *mockTokenServer {
+	server := &mockTokenServer{expiresIn: 3600}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", server.token)
+	mux.HandleFunc("/device", func(response http.ResponseWriter, request *http.Request) {
+		_, _ = response.Write([]byte(`{"device_code":"dc","user_code":"ABCD-EFGH","verification_uri":"https://example.com/device","expires_in":600,"interval":"2"}`))
+	})
+	mux.HandleFunc("/resource", func(response http.ResponseWriter, request *http.Request) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if request.Header.Get("Authorization") != fmt.Sprintf("Bearer token-%d", server.issued) {
+			response.WriteHeader(http.StatusUnauthorized)
+		}
+		_, _ = response.Write([]byte(request.Header.Get("Authorization")))
+	})
+	server.Server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *mockTokenServer) token(response http.ResponseWriter, request *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_ = request.ParseForm()
+	form := map[string]string{}
+	for name := range request.PostForm {
+		form[name] = request.PostForm.Get(name)
+	}
+	if username, password, ok := request.BasicAuth(); ok {
+		form["basic"] = username + ":" + password
+	}
+	s.forms = append(s.forms, form)
+
+	if form["client_id"] == "wrong" || form["basic"] == "client:wrong" {
+		response.WriteHeader(http.StatusUnauthorized)
+		_, _ = response.Write([]byte(`{"error":"invalid_client","error_description":"unknown client"}`))
+		return
+	}
+	if form["grant_type"] == "urn:ietf:params:oauth:grant-type:device_code" {
+		s.polls++
+		if !s.approved {
+			response.WriteHeader(http.StatusBadRequest)
+			_, _ = response.Write([]byte(`{"error":"authorization_pending"}`))
+			return
+		}
+	}
+
+	s.issued++
+	_, _ = fmt.Fprintf(response, `{"access_token":"token-%d","token_type":"bearer","expires_in":%d,"refresh_token":"refresh-%d"}`, s.issued, s.expiresIn, s.issued)
+}
+
+func (s *mockTokenServer) lastForm() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.forms[len(s.forms)-1]
+}
+
+type oauth2Result struct {
+	Success bool           `json:"success"`
+	Data    oauth2Response `json:"data"`
+	Error   errorData
+}
+
+func requestToken(t *testing.T, proxy *Proxy, request OAuth2Request) oauth2Result {
+	body, _ := json.Marshal(request)
+	httpRequest := httptest.NewRequest("POST", "/oauth2/token", bytes.NewReader(body))
+	httpRequest.Header.Set("Origin", "validorigin1.com")
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, httpRequest)
+
+	var result oauth2Result
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	if !result.Success {
+		var failure errorBody
+		_ = json.Unmarshal(recorder.Body.Bytes(), &failure)
+		result.Error = failure.Data
+	}
+	return result
+}
+
+func TestOAuth2Grants(t *testing.T) {
+	server := newMockTokenServer(t)
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}}})
+	assert.Nil(t, err)
+
+	result := requestToken(t, proxy, OAuth2Request{
+		Session:      "s1",
+		Name:         "service",
+		GrantType:    GrantClientCredentials,
+		TokenUrl:     server.URL + "/token",
+		ClientId:     "client",
+		ClientSecret: "secret",
+		Scope:        "read write",
+		Params:       map[string]string{"audience": "api"},
+	})
+	assert.True(t, result.Success)
+	assert.Equal(t, "ready", result.Data.Status)
+	assert.Equal(t, "token-1", result.Data.AccessToken)
+	assert.Equal(t, int64(3600), result.Data.ExpiresIn)
+	assert.Equal(t, map[string]string{
+		"grant_type": "client_credentials",
+		"scope":      "read write",
+		"audience":   "api",
+		"basic":      "client:secret",
+	}, server.lastForm())
+
+	result = requestToken(t, proxy, OAuth2Request{
+		Session:    "s1",
+		Name:       "user",
+		GrantType:  GrantPassword,
+		TokenUrl:   server.URL + "/token",
+		ClientId:   "client",
+		ClientAuth: "post",
+		Username:   "alice",
+		Password:   "hunter2",
+	})
+	assert.Equal(t, "token-2", result.Data.AccessToken)
+	assert.Equal(t, map[string]string{
+		"grant_type": "password",
+		"username":   "alice",
+		"password":   "hunter2",
+		"client_id":  "client",
+	}, server.lastForm())
+
+	result = requestToken(t, proxy, OAuth2Request{
+		Session:      "s1",
+		Name:         "refreshed",
+		GrantType:    GrantRefreshToken,
+		TokenUrl:     server.URL + "/token",
+		ClientId:     "client",
+		RefreshToken: "refresh-1",
+	})
+	assert.Equal(t, "token-3", result.Data.AccessToken)
+	assert.True(t, result.Data.Refreshable)
+	assert.Equal(t, "refresh-1", server.lastForm()["refresh_token"])
+
+	result = requestToken(t, proxy, OAuth2Request{
+		Session:      "s1",
+		Name:         "service",
+		GrantType:    GrantClientCredentials,
+		TokenUrl:     server.URL + "/token",
+		ClientId:     "client",
+		ClientSecret: "wrong",
+	})
+	assert.False(t, result.Success)
+	assert.Equal(t, ErrorCodeOAuth2Failed, result.Error.Code)
+	assert.Equal(t, "invalid_client", result.Error.Error)
+	assert.Contains(t, result.Error.Message, "unknown client")
+
+	result = requestToken(t, proxy, OAuth2Request{Session: "s1", Name: "x", GrantType: "implicit", TokenUrl: server.URL + "/token"})
+	assert.False(t, result.Success)
+	assert.Equal(t, ErrorCodeOAuth2Failed, result.Error.Code)
+}
+
+func TestOAuth2DeviceCode(t *testing.T) {
+	server := newMockTokenServer(t)
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}}})
+	assert.Nil(t, err)
+
+	request := OAuth2Request{
+		Session:                "s1",
+		Name:                   "device",
+		GrantType:              GrantDeviceCode,
+		TokenUrl:               server.URL + "/token",
+		DeviceAuthorizationUrl: server.URL + "/device",
+		ClientId:               "client",
+	}
+	result := requestToken(t, proxy, request)
+	assert.Equal(t, "pending", result.Data.Status)
+	assert.Equal(t, "ABCD-EFGH", result.Data.UserCode)
+	assert.Equal(t, "https://example.com/device", result.Data.VerificationUri)
+	assert.Equal(t, int64(2), result.Data.Interval)
+	assert.Equal(t, 0, server.polls)
+
+	result = requestToken(t, proxy, request)
+	assert.Equal(t, "pending", result.Data.Status)
+	assert.Equal(t, 1, server.polls)
+	assert.Equal(t, "dc", server.lastForm()["device_code"])
+
+	server.mu.Lock()
+	server.approved = true
+	server.mu.Unlock()
+	result = requestToken(t, proxy, request)
+	assert.Equal(t, "ready", result.Data.Status)
+	assert.Equal(t, "token-1", result.Data.AccessToken)
+}
+
+func TestOAuth2AttachToken(t *testing.T) {
+	server := newMockTokenServer(t)
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}}})
+	assert.Nil(t, err)
+
+	auth := RequestAuth{Type: AuthTypeOAuth2, Credential: "api"}
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: server.URL + "/resource", Session: "s1", Auth: auth}, "validorigin1.com")
+	assert.Equal(t, ErrorCodeAuthFailed, getErrorBody(t, resp).Data.Code)
+
+	// tokens expiring within the skew are renewed with the refresh token before each request
+	server.expiresIn = 5
+	result := requestToken(t, proxy, OAuth2Request{
+		Session:      "s1",
+		Name:         "api",
+		GrantType:    GrantClientCredentials,
+		TokenUrl:     server.URL + "/token",
+		ClientId:     "client",
+		ClientSecret: "secret",
+	})
+	assert.True(t, result.Success)
+
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: server.URL + "/resource", Session: "s1", Auth: auth}, "validorigin1.com")
+	assert.Equal(t, 200, resp.requestResponse.Status)
+	assert.Equal(t, "Bearer token-2", resp.requestResponse.Data)
+	assert.Equal(t, "refresh_token", server.lastForm()["grant_type"])
+	assert.Equal(t, "refresh-1", server.lastForm()["refresh_token"])
+
+	server.expiresIn = 3600
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: server.URL + "/resource", Session: "s1", Auth: auth}, "validorigin1.com")
+	assert.Equal(t, "Bearer token-3", resp.requestResponse.Data)
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: server.URL + "/resource", Session: "s1", Auth: auth}, "validorigin1.com")
+	assert.Equal(t, "Bearer token-3", resp.requestResponse.Data)
+
+	// credentials are only visible to the session that fetched them
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: server.URL + "/resource", Session: "s2", Auth: auth}, "validorigin1.com")
+	assert.True(t, strings.Contains(getErrorBody(t, resp).Data.Message, "no OAuth 2.0 credential"))
+
+	// and a session is required, so that credentials aren't shared by every client
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: server.URL + "/resource", Auth: auth}, "validorigin1.com")
+	assert.Contains(t, getErrorBody(t, resp).Data.Message, "require a session")
+	result = requestToken(t, proxy, OAuth2Request{Name: "api", GrantType: GrantClientCredentials, TokenUrl: server.URL + "/token", ClientId: "client", ClientSecret: "secret"})
+	assert.False(t, result.Success)
+	assert.Equal(t, ErrorCodeOAuth2Failed, result.Error.Code)
+}
+
+func TestOAuth2CacheEviction(t *testing.T) {
+	previous := maxOAuth2Credentials
+	maxOAuth2Credentials = 2
+	defer func() { maxOAuth2Credentials = previous }()
+
+	cache := newOAuth2Cache()
+	cache.put("a", &oauth2Credential{accessToken: "a"})
+	cache.put("b", &oauth2Credential{accessToken: "b"})
+	// the least recently used credential is evicted
+	assert.NotNil(t, cache.get("a"))
+	cache.put("c", &oauth2Credential{accessToken: "c"})
+	assert.Nil(t, cache.get("b"))
+	assert.Equal(t, "a", cache.get("a").accessToken)
+	assert.Equal(t, "c", cache.get("c").accessToken)
+	assert.Len(t, cache.credentials, 2)
+}
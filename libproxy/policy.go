@@ -0,0 +1,550 @@
+package libproxy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// policy is the part of the configuration that can change while the proxy is running. It is
+// never modified once published; changes build a new policy and swap it in atomically, so each
+// request is handled entirely under the policy that was current when it arrived.
+type policy struct {
+	config   Config
+	redactor *Redactor
+	limiter  *rateLimiter
+	// kerberos is the Kerberos identity used for Negotiate authentication, or nil if none is
+	// configured.
+	kerberos *kerberosAuth
+	// accessLog records requests, or is nil if the access log is disabled.
+	accessLog *accessLogger
+	// tracer exports the spans of requests, or is nil if tracing is disabled.
+	tracer *proxyTracer
+	// mocks serve responses in place of destinations, or is nil if mock mode is disabled.
+	mocks *mockSet
+	// cache holds responses to GET requests, or is nil if caching is disabled.
+	cache *responseCache
+	// resolver resolves the host names of destinations, or is nil if they are left to the system.
+	resolver *dnsResolver
+
+	// registeredHooks are those added with Proxy.Use, and configuredHooks are those created from
+	// config.Hooks. They run in that order.
+	registeredHooks []Hook
+	configuredHooks []Hook
+
+	// users counts the requests handled under the policy, so that what it held can be released
+	// once they have finished. Copies of a policy that share its resources share its users.
+	users *policyUsers
+}
+
+// policyUsers counts the requests using a policy. Once the policy has been replaced (retired),
+// it can't gain users, and its release functions run when the last one finishes.
+type policyUsers struct {
+	mu      sync.Mutex
+	count   int
+	retired bool
+	release []func()
+}
+
+// acquire adds a user, unless the policy has been retired.
+func (u *policyUsers) acquire() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.retired {
+		return false
+	}
+	u.count++
+	return true
+}
+
+// done removes a user, running the release functions if it was the last of a retired policy.
+func (u *policyUsers) done() {
+	u.mu.Lock()
+	u.count--
+	var release []func()
+	if u.retired && u.count == 0 {
+		release, u.release = u.release, nil
+	}
+	u.mu.Unlock()
+
+	for _, f := range release {
+		f()
+	}
+}
+
+// retire marks the policy as replaced, and runs release once it has no users left.
+func (u *policyUsers) retire(release ...func()) {
+	u.mu.Lock()
+	u.retired = true
+	u.release = append(u.release, release...)
+	if u.count > 0 {
+		u.mu.Unlock()
+		return
+	}
+	release, u.release = u.release, nil
+	u.mu.Unlock()
+
+	for _, f := range release {
+		f()
+	}
+}
+
+// newPolicy builds a policy from config. The rate limiter of the previous policy is kept if the
+// limits haven't changed, so that reloading doesn't reset every bucket.
+func newPolicy(config Config, previous *policy) (*policy, error) {
+	compiled, err := NewRedactor(append(LiteralRedactionRules(config.BannedOutputs), config.RedactionRules...))
+	if err != nil {
+		return nil, err
+	}
+
+	hooks, err := newHookChain(config.Hooks)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateListen(config); err != nil {
+		return nil, err
+	}
+	if err := config.TLS.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Retry.validate(); err != nil {
+		return nil, err
+	}
+
+	resolver, err := newDNSResolver(config.DNS)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateUnixSockets(config.UnixSockets); err != nil {
+		return nil, err
+	}
+
+	// The mock files are read again on every reload, so that changes to them can be picked up.
+	mocks, err := newMockSet(config.Mock)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the cached responses if the cache's configuration hasn't changed.
+	cache := previous.cache
+	if cache == nil || !reflect.DeepEqual(previous.config.Cache, config.Cache) {
+		if cache, err = newResponseCache(config.Cache); err != nil {
+			return nil, err
+		}
+	}
+
+	limiter := previous.limiter
+	if limiter == nil || !reflect.DeepEqual(previous.config.RateLimits, config.RateLimits) {
+		limiter = newRateLimiter(config.RateLimits)
+	}
+
+	// Keep the previous identity (and so its tickets) if it hasn't changed.
+	kerberos := previous.kerberos
+	if !reflect.DeepEqual(previous.config.Kerberos, config.Kerberos) {
+		kerberos = nil
+		if config.Kerberos.Enabled() {
+			if kerberos, err = newKerberosAuth(config.Kerberos); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Keep the access log's files and connections open if its configuration hasn't changed.
+	accessLog := previous.accessLog
+	if !reflect.DeepEqual(previous.config.AccessLog, config.AccessLog) {
+		if accessLog, err = newAccessLogger(config.AccessLog); err != nil {
+			if kerberos != previous.kerberos {
+				kerberos.destroy()
+			}
+			return nil, err
+		}
+	}
+
+	tracer := previous.tracer
+	if !reflect.DeepEqual(previous.config.Tracing, config.Tracing) {
+		if tracer, err = newProxyTracer(config.Tracing); err != nil {
+			if kerberos != previous.kerberos {
+				kerberos.destroy()
+			}
+			if accessLog != previous.accessLog {
+				accessLog.close()
+			}
+			return nil, err
+		}
+	}
+
+	return &policy{
+		config:          config,
+		redactor:        compiled,
+		limiter:         limiter,
+		kerberos:        kerberos,
+		accessLog:       accessLog,
+		tracer:          tracer,
+		mocks:           mocks,
+		cache:           cache,
+		resolver:        resolver,
+		registeredHooks: previous.registeredHooks,
+		configuredHooks: hooks,
+		users:           &policyUsers{},
+	}, nil
+}
+
+// loadPolicy returns the current policy.
+func (proxy *Proxy) loadPolicy() *policy {
+	return proxy.currentPolicy.Load().(*policy)
+}
+
+// acquirePolicy returns the current policy, which isn't released until done is called.
+func (proxy *Proxy) acquirePolicy() (p *policy, done func()) {
+	for {
+		p := proxy.loadPolicy()
+		if p.users.acquire() {
+			return p, p.users.done
+		}
+		// The policy was replaced since it was loaded, so use its replacement.
+	}
+}
+
+// policyKey is the context key of the policy a request is handled under.
+type policyKey struct{}
+
+// policyFor returns the policy the request is handled under, so that it is handled entirely
+// under the same one, even if the configuration is reloaded part way through.
+func (proxy *Proxy) policyFor(request *http.Request) *policy {
+	if p, ok := request.Context().Value(policyKey{}).(*policy); ok {
+		return p
+	}
+
+	return proxy.loadPolicy()
+}
+
+// updateConfig applies update to a copy of the current configuration and swaps in the resulting
+// policy. If the new configuration is invalid, the current policy is kept.
+func (proxy *Proxy) updateConfig(update func(config *Config)) error {
+	proxy.policyMu.Lock()
+	defer proxy.policyMu.Unlock()
+
+	return proxy.updateConfigLocked(update)
+}
+
+// runtimeSetting is a setting changed while the proxy runs, e.g. through the admin API.
+type runtimeSetting struct {
+	name   string
+	update func(config *Config)
+}
+
+// updateSetting changes the named setting like updateConfig, and keeps the change across
+// reloads of the configuration.
+func (proxy *Proxy) updateSetting(name string, update func(config *Config)) error {
+	proxy.policyMu.Lock()
+	defer proxy.policyMu.Unlock()
+
+	if err := proxy.updateConfigLocked(update); err != nil {
+		return err
+	}
+	proxy.keepSetting(name, update)
+	return nil
+}
+
+// keepSetting records a change to the named setting, replacing any earlier change to it.
+// proxy.policyMu must be held.
+func (proxy *Proxy) keepSetting(name string, update func(config *Config)) {
+	settings := make([]runtimeSetting, 0, len(proxy.runtimeSettings)+1)
+	for _, setting := range proxy.runtimeSettings {
+		if setting.name != name {
+			settings = append(settings, setting)
+		}
+	}
+	proxy.runtimeSettings = append(settings, runtimeSetting{name, update})
+}
+
+// updateConfigLocked is updateConfig, for callers holding proxy.policyMu.
+func (proxy *Proxy) updateConfigLocked(update func(config *Config)) error {
+	previous := proxy.loadPolicy()
+	config := previous.config
+	update(&config)
+
+	next, err := newPolicy(config, previous)
+	if err != nil {
+		return err
+	}
+
+	proxy.currentPolicy.Store(next)
+	// Connections made to the addresses the previous settings resolved to aren't reused.
+	if !reflect.DeepEqual(previous.config.DNS, next.config.DNS) {
+		proxy.closeIdleConnections()
+	}
+	// The Kerberos identity, access log and tracer are still used by the requests in progress
+	// under the previous policy (e.g. in the middle of a Negotiate handshake), so they're released
+	// once those have finished.
+	var release []func()
+	if previous.kerberos != next.kerberos {
+		release = append(release, previous.kerberos.destroy)
+	}
+	if previous.accessLog != next.accessLog {
+		release = append(release, previous.accessLog.close)
+	}
+	if previous.tracer != next.tracer {
+		// Exporting the remaining spans may take a while, so don't hold up the last request.
+		release = append(release, func() { go previous.tracer.shutdown() })
+	}
+	previous.users.retire(release...)
+	return nil
+}
+
+func (p *policy) isAllowedDest(dest string) bool {
+	for _, b := range p.config.BannedDests {
+		if b == dest {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *policy) isAllowedOrigin(origin string) bool {
+	for _, b := range p.config.AllowedOrigins {
+		if b == "*" || b == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// accessTokenName returns the name the access token is recorded under in the access log, or a
+// blank string if no token is required.
+func (p *policy) accessTokenName() string {
+	if len(p.config.AccessToken) == 0 {
+		return ""
+	}
+
+	return "default"
+}
+
+// AccessToken returns the access token required to use the proxy.
+func (proxy *Proxy) AccessToken() string {
+	return proxy.loadPolicy().config.AccessToken
+}
+
+// SetAccessToken replaces the access token required to use the proxy. Like the other setters,
+// the change is kept when the configuration is reloaded.
+func (proxy *Proxy) SetAccessToken(newAccessToken string) {
+	_ = proxy.updateSetting("access-token", func(config *Config) {
+		config.AccessToken = newAccessToken
+	})
+}
+
+// SetRateLimits replaces the rate limits applied to proxied requests. Any existing bucket state
+// is discarded.
+func (proxy *Proxy) SetRateLimits(limits RateLimits) {
+	proxy.policyMu.Lock()
+	defer proxy.policyMu.Unlock()
+
+	next := *proxy.loadPolicy()
+	next.config.RateLimits = limits
+	next.limiter = newRateLimiter(limits)
+	proxy.currentPolicy.Store(&next)
+	proxy.keepSetting("rate-limits", func(config *Config) { config.RateLimits = limits })
+}
+
+// Use adds hooks to the end of the proxy's hook chain, before any hooks in the configuration.
+func (proxy *Proxy) Use(hooks ...Hook) {
+	proxy.policyMu.Lock()
+	defer proxy.policyMu.Unlock()
+
+	next := *proxy.loadPolicy()
+	next.registeredHooks = append(next.registeredHooks[:len(next.registeredHooks):len(next.registeredHooks)], hooks...)
+	proxy.currentPolicy.Store(&next)
+}
+
+// SetHooks replaces the hooks in the configuration.
+func (proxy *Proxy) SetHooks(hooks []HookConfig) error {
+	return proxy.updateSetting("hooks", func(config *Config) {
+		config.Hooks = hooks
+	})
+}
+
+// SetRedactionRules replaces the redaction rules applied in addition to the banned outputs.
+func (proxy *Proxy) SetRedactionRules(rules []RedactionRule) error {
+	return proxy.updateSetting("redaction-rules", func(config *Config) {
+		config.RedactionRules = rules
+	})
+}
+
+// SetBodyLimits replaces the request, upload and response size limits.
+func (proxy *Proxy) SetBodyLimits(limits BodyLimits) {
+	_ = proxy.updateSetting("body-limits", func(config *Config) {
+		config.BodyLimits = limits
+	})
+}
+
+// SetConfigLoader sets the function used to re-read the configuration when it is reloaded, e.g.
+// a function that reads the configuration file and applies any overrides.
+func (proxy *Proxy) SetConfigLoader(loader func() (Config, error)) {
+	proxy.policyMu.Lock()
+	defer proxy.policyMu.Unlock()
+
+	proxy.configLoader = loader
+}
+
+// ErrNoConfigLoader is returned by Reload if no loader has been set.
+var ErrNoConfigLoader = errors.New("the configuration cannot be reloaded as it was not loaded from a file")
+
+// Reload re-reads the configuration with the proxy's config loader and applies it. Requests
+// already in progress finish under the previous configuration. The listen addresses and SSL
+// setting can't be changed without a restart, so changes to them are ignored. Settings changed
+// while the proxy runs, with the setters or the admin API, win over the reloaded configuration
+// until the proxy restarts.
+func (proxy *Proxy) Reload() error {
+	proxy.policyMu.Lock()
+	loader := proxy.configLoader
+	proxy.policyMu.Unlock()
+
+	if loader == nil {
+		return ErrNoConfigLoader
+	}
+
+	config, err := loader()
+	if err != nil {
+		return err
+	}
+
+	err = proxy.updateConfig(func(current *Config) {
+		if config.Host != current.Host || !reflect.DeepEqual(config.Listen, current.Listen) || config.ListenSocketMode != current.ListenSocketMode ||
+			config.AdminHost != current.AdminHost || config.WithSSL != current.WithSSL || !reflect.DeepEqual(config.TLS, current.TLS) {
+			log.Print("The listen addresses and SSL settings can't be changed without restarting; ignoring them.")
+		}
+		config.Host = current.Host
+		config.Listen = current.Listen
+		config.ListenSocketMode = current.ListenSocketMode
+		config.AdminHost = current.AdminHost
+		config.WithSSL = current.WithSSL
+		config.TLS = current.TLS
+		var kept []string
+		for _, setting := range proxy.runtimeSettings {
+			setting.update(&config)
+			kept = append(kept, setting.name)
+		}
+		if len(kept) > 0 {
+			log.Printf("The settings changed while running (%s) were kept.", strings.Join(kept, ", "))
+		}
+		*current = config
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Print("Configuration reloaded.")
+	return nil
+}
+
+// WatchConfigFile reloads the configuration whenever the file at path changes, checking every
+// interval. The returned function stops watching.
+func (proxy *Proxy) WatchConfigFile(path string, interval time.Duration) (stop func()) {
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		lastModified, lastSize := stat()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				modified, size := stat()
+				if modified.Equal(lastModified) && size == lastSize {
+					continue
+				}
+				lastModified, lastSize = modified, size
+
+				if err := proxy.Reload(); err != nil {
+					log.Printf("Failed to reload configuration from %s: %v", path, err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// isAdminRequest returns true if the request carries the admin token as a bearer token. Admin
+// endpoints are disabled if no admin token is configured.
+func (p *policy) isAdminRequest(request *http.Request) bool {
+	adminToken := p.config.AdminToken
+	if adminToken == "" {
+		return false
+	}
+
+	// The token must be sent as a bearer token, not on its own.
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// adminReloadHandler reloads the configuration on a POST request from an admin.
+func (proxy *Proxy) adminReloadHandler(response http.ResponseWriter, request *http.Request) {
+	if !proxy.authorizeAdmin(response, request) || !allowMethods(response, request, http.MethodPost) {
+		return
+	}
+
+	if err := proxy.Reload(); err != nil {
+		log.Printf("Failed to reload configuration: %v", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(response, errorData{Message: fmt.Sprintf("(Proxy Error) Failed to reload configuration: %v", err), Code: ErrorCodeReloadFailed})
+		return
+	}
+
+	_, _ = fmt.Fprintln(response, "{\"success\": true, \"data\":{\"message\":\"Configuration reloaded.\"}}")
+}
+
+// The following functions apply to the default proxy (see Default), which is the one started by
+// Initialize.
+
+func GetAccessToken() string {
+	return Default().AccessToken()
+}
+
+func SetAccessToken(newAccessToken string) {
+	Default().SetAccessToken(newAccessToken)
+}
+
+// SetConfigLoader sets the config loader of the default proxy.
+func SetConfigLoader(loader func() (Config, error)) {
+	Default().SetConfigLoader(loader)
+}
+
+// ReloadConfig reloads the configuration of the default proxy.
+func ReloadConfig() error {
+	return Default().Reload()
+}
+
+// WatchConfigFile reloads the configuration of the default proxy whenever the file at path
+// changes.
+func WatchConfigFile(path string, interval time.Duration) (stop func()) {
+	return Default().WatchConfigFile(path, interval)
+}
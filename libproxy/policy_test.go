@@ -0,0 +1,166 @@
+package libproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withConfigLoader sets the config loader for the duration of a test, restoring the current
+// policy afterwards.
+func withConfigLoader(t *testing.T, loader func() (Config, error)) {
+	previous := testProxy.loadPolicy()
+	testProxy.SetConfigLoader(loader)
+	testProxy.policyMu.Lock()
+	testProxy.runtimeSettings = nil
+	testProxy.policyMu.Unlock()
+	t.Cleanup(func() {
+		testProxy.SetConfigLoader(nil)
+		testProxy.policyMu.Lock()
+		// The previous policy has been retired, so a copy of it takes its place.
+		restored := *previous
+		restored.users = &policyUsers{}
+		testProxy.currentPolicy.Store(&restored)
+		testProxy.runtimeSettings = nil
+		testProxy.policyMu.Unlock()
+	})
+}
+
+func TestReloadConfig(t *testing.T) {
+	config := testProxy.loadPolicy().config
+	config.BannedDests = []string{"127.0.0.1"}
+	withConfigLoader(t, func() (Config, error) {
+		return config, nil
+	})
+
+	// A request that is in-flight when the configuration is reloaded finishes under the
+	// previous policy.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var inFlight RespResult
+	go func() {
+		defer wg.Done()
+		inFlight = getResultDef(Request{
+			Method: "GET",
+			Url:    testServerUrl + "/delay/0.5",
+		})
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, testProxy.Reload())
+	wg.Wait()
+	assert.True(t, inFlight.requestResponse.Success)
+	assert.Equal(t, 200, inFlight.requestResponse.Status)
+
+	// New requests use the new policy.
+	result := getResultDef(Request{
+		Method: "GET",
+		Url:    testServerUrl + "/get",
+	})
+	assert.False(t, result.requestResponse.Success)
+	assert.Contains(t, result.proxyResponse.Body.String(), "cannot be to this destination")
+}
+
+func TestReloadConfigKeepsListener(t *testing.T) {
+	withConfigLoader(t, func() (Config, error) {
+		return Config{Host: "localhost:1234", AllowedOrigins: []string{"*"}}, nil
+	})
+	assert.Nil(t, testProxy.updateConfig(func(config *Config) { config.Host = "localhost:9159" }))
+
+	assert.Nil(t, testProxy.Reload())
+	assert.Equal(t, "localhost:9159", testProxy.loadPolicy().config.Host)
+	assert.Equal(t, []string{"*"}, testProxy.loadPolicy().config.AllowedOrigins)
+}
+
+func TestReloadKeepsRuntimeSettings(t *testing.T) {
+	withConfigLoader(t, func() (Config, error) {
+		return Config{AccessToken: "file", AllowedOrigins: []string{"*"}, BodyLimits: BodyLimits{MaxUploadSize: 64}}, nil
+	})
+	testProxy.SetAccessToken("runtime")
+	testProxy.SetAccessToken("runtime, again")
+
+	assert.Nil(t, testProxy.Reload())
+	assert.Equal(t, "runtime, again", testProxy.AccessToken())
+	assert.Equal(t, ByteSize(64), testProxy.loadPolicy().config.BodyLimits.MaxUploadSize)
+	assert.Len(t, testProxy.runtimeSettings, 1)
+}
+
+func TestPolicyRelease(t *testing.T) {
+	users := &policyUsers{}
+	released := 0
+	assert.True(t, users.acquire())
+
+	// a retired policy is released once its last request has finished
+	users.retire(func() { released++ })
+	assert.Equal(t, 0, released)
+	assert.False(t, users.acquire())
+	users.done()
+	assert.Equal(t, 1, released)
+
+	users = &policyUsers{}
+	users.retire(func() { released++ })
+	assert.Equal(t, 2, released)
+}
+
+func TestReloadInvalidConfig(t *testing.T) {
+	withConfigLoader(t, func() (Config, error) {
+		return Config{RedactionRules: []RedactionRule{{Pattern: "("}}}, nil
+	})
+
+	previous := testProxy.loadPolicy()
+	assert.NotNil(t, testProxy.Reload())
+	// the previous policy is kept
+	assert.Equal(t, previous, testProxy.loadPolicy())
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`{"token": "before"}`), 0600))
+	withConfigLoader(t, func() (Config, error) {
+		config, _, err := ReadConfig(DefaultServerConfig, path)
+		return config, err
+	})
+
+	stop := testProxy.WatchConfigFile(path, 10*time.Millisecond)
+	defer stop()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, os.WriteFile(path, []byte(`{"token": "after!"}`), 0600))
+	assert.Eventually(t, func() bool {
+		return testProxy.AccessToken() == "after!"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestAdminReloadEndpoint(t *testing.T) {
+	withConfigLoader(t, func() (Config, error) {
+		config := testProxy.loadPolicy().config
+		config.AccessToken = "reloaded"
+		return config, nil
+	})
+	assert.Nil(t, testProxy.updateConfig(func(config *Config) { config.AdminToken = "admin" }))
+
+	for _, test := range []struct {
+		method        string
+		authorization string
+		status        int
+	}{
+		{"POST", "", http.StatusUnauthorized},
+		{"POST", "Bearer wrong", http.StatusUnauthorized},
+		{"GET", "Bearer admin", http.StatusMethodNotAllowed},
+		{"POST", "Bearer admin", http.StatusOK},
+	} {
+		request := httptest.NewRequest(test.method, "/admin/reload", nil)
+		request.Header.Set("Authorization", test.authorization)
+		response := httptest.NewRecorder()
+		testProxy.adminReloadHandler(response, request)
+		assert.Equal(t, test.status, response.Code, test)
+	}
+
+	assert.Equal(t, "reloaded", testProxy.AccessToken())
+}
@@ -4,40 +4,41 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
-
-	"github.com/google/uuid"
-)
-
-type statusChangeFunction func(status string, isListening bool)
-
-var (
-	accessToken        string
-	sessionFingerprint string
-	allowedOrigins     []string
-	bannedOutputs      []string
-	bannedDests        []string
+	"time"
 )
 
 type Request struct {
 	AccessToken string
+	// Session identifies the client's OAuth 2.0 credential cache (see OAuth2Request).
+	Session     string
 	WantsBinary bool
 	Method      string
 	Url         string
-	Auth        struct {
-		Username string
-		Password string
-	}
-	Headers map[string]string
-	Data    string
-	Params  map[string]string
+	Auth        RequestAuth
+	Headers     map[string]string
+	Data        string
+	Params      map[string]string
+	// Cache may be CacheBypass or CacheForce to change how the response cache is used.
+	Cache string
+	// Retry overrides the settings of the server's retry policy that it sets.
+	Retry *RetryPolicy
+	// UnixSocket is the name or path of the Unix socket to send the request to, which must be
+	// allowed by the server (see Config.UnixSockets). It may also be given in the URL, in the
+	// form unix://<socket>:<path>.
+	UnixSocket string
+	// Resolve maps host names, or host:port pairs, to the IP addresses to connect to instead, in
+	// addition to the server's DNS overrides (see DNSConfig.Overrides).
+	Resolve map[string]string
 }
 
 type Response struct {
@@ -47,140 +48,181 @@ type Response struct {
 	Data       string            `json:"data"`
 	StatusText string            `json:"statusText"`
 	Headers    map[string]string `json:"headers"`
+	// Truncated is set when the upstream response exceeded the maximum response size and only
+	// the first part of it is included in Data.
+	Truncated bool `json:"truncated,omitempty"`
+	// Cache reports whether the response was served from the cache ("hit"), fetched from the
+	// destination ("miss" or "bypass"), or served from the cache after the destination confirmed
+	// it was unchanged ("revalidated"). It is empty when caching is disabled.
+	Cache string `json:"cache,omitempty"`
+	// Attempts lists the attempts made at sending the request, if the retry policy allowed it to
+	// be sent more than once.
+	Attempts []RetryAttempt `json:"attempts,omitempty"`
+	// ResolvedAddresses lists the addresses the destination's host name resolved to, if a new
+	// connection was made to it, and RemoteAddress is the address the response came from.
+	ResolvedAddresses []string `json:"resolvedAddresses,omitempty"`
+	RemoteAddress     string   `json:"remoteAddress,omitempty"`
 }
 
-func isAllowedDest(dest string) bool {
-	for _, b := range bannedDests {
-		if b == dest {
-			return false
-		}
-	}
-
-	return true
-}
-
-func isAllowedOrigin(origin string) bool {
-	if allowedOrigins[0] == "*" {
-		return true
-	}
+const ErrorBodyInvalidRequest = "{\"success\": false, \"data\":{\"message\":\"(Proxy Error) Invalid request.\"}}"
+const ErrorBodyProxyRequestFailed = "{\"success\": false, \"data\":{\"message\":\"(Proxy Error) Request failed.\"}}"
+const maxMemory = int64(32 << 20) // multipartRequestDataKey currently its 32 MB
 
-	for _, b := range allowedOrigins {
-		if b == origin {
-			return true
-		}
-	}
+// Error codes returned in the structured error bodies.
+const (
+	ErrorCodeRateLimited      = "RATE_LIMITED"
+	ErrorCodeRequestTooLarge  = "REQUEST_TOO_LARGE"
+	ErrorCodeUploadTooLarge   = "UPLOAD_TOO_LARGE"
+	ErrorCodeResponseTooLarge = "RESPONSE_TOO_LARGE"
+	ErrorCodeUnauthorized     = "UNAUTHORIZED"
+	ErrorCodeReloadFailed     = "RELOAD_FAILED"
+	ErrorCodeHookFailed       = "HOOK_FAILED"
+	ErrorCodeAuthFailed       = "AUTH_FAILED"
+	ErrorCodeOAuth2Failed     = "OAUTH2_FAILED"
+	ErrorCodeSecretFailed     = "SECRET_FAILED"
+)
 
-	return false
+// errorBody is the structured form of the error bodies above, used for errors that carry more
+// detail than a message.
+type errorBody struct {
+	Success bool      `json:"success"`
+	Data    errorData `json:"data"`
 }
 
-func Initialize(
-	initialAccessToken string,
-	proxyURL string,
-	initialAllowedOrigins string,
-	initialBannedOutputs string,
-	initialBannedDests string,
-	onStatusChange statusChangeFunction,
-	withSSL bool,
-	finished chan bool,
-) {
-	if initialBannedOutputs != "" {
-		bannedOutputs = strings.Split(initialBannedOutputs, ",")
-	}
-	if initialBannedDests != "" {
-		bannedDests = strings.Split(initialBannedDests, ",")
-	} else {
-		bannedDests = []string{}
-	}
-	allowedOrigins = strings.Split(initialAllowedOrigins, ",")
-	accessToken = initialAccessToken
-	sessionFingerprint = uuid.New().String()
-	log.Println("Starting proxy server...")
-
-	http.HandleFunc("/", proxyHandler)
-
-	if !withSSL {
-		go func() {
-			httpServerError := http.ListenAndServe(proxyURL, nil)
-
-			if httpServerError != nil {
-				onStatusChange("An error occurred: "+httpServerError.Error(), false)
-			}
-
-			finished <- true
-		}()
-
-		onStatusChange("Listening on http://"+proxyURL+"/", true)
-	} else {
-		onStatusChange("Checking SSL certificate...", false)
+type errorData struct {
+	Message    string `json:"message"`
+	Code       string `json:"code,omitempty"`
+	Limit      string `json:"limit,omitempty"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+	MaxSize    int64  `json:"maxSize,omitempty"`
+	// Error is the error code returned by an OAuth 2.0 token endpoint.
+	Error string `json:"error,omitempty"`
+	// Attempts lists the attempts made at sending a request that failed (see Response.Attempts).
+	Attempts []RetryAttempt `json:"attempts,omitempty"`
+}
 
-		err := EnsurePrivateKeyInstalled()
-		if err != nil {
-			log.Println(err.Error())
-			onStatusChange("An error occurred.", false)
-		}
+func writeErrorBody(response http.ResponseWriter, data errorData) {
+	_ = json.NewEncoder(response).Encode(errorBody{Success: false, Data: data})
+}
 
-		go func() {
-			httpServerError := http.ListenAndServeTLS(proxyURL, GetOrCreateDataPath()+"/cert.pem", GetOrCreateDataPath()+"/key.pem", nil)
+// writeRateLimitError reports a rate limit rejection, including how long (in whole seconds) the
+// client should wait before retrying, both in the body and in the Retry-After header.
+func writeRateLimitError(response http.ResponseWriter, err *RateLimitError) {
+	retryAfter := int((err.RetryAfter + time.Second - 1) / time.Second)
+	response.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeErrorBody(response, errorData{
+		Message:    "(Proxy Error) Rate limit exceeded; please try again later.",
+		Code:       ErrorCodeRateLimited,
+		Limit:      err.Limit,
+		RetryAfter: retryAfter,
+	})
+}
 
-			if httpServerError != nil {
-				onStatusChange("An error occurred.", false)
-			}
-		}()
+// writeSizeLimitError reports that a body exceeded the given size limit.
+func writeSizeLimitError(response http.ResponseWriter, code string, message string, maxSize int64) {
+	writeErrorBody(response, errorData{
+		Message: "(Proxy Error) " + message,
+		Code:    code,
+		MaxSize: maxSize,
+	})
+}
 
-		onStatusChange("Listening on https://"+proxyURL+"/", true)
-		log.Println("Proxy server listening on https://" + proxyURL + "/")
+// redactedError formats err for logging, with any redacted values (which may appear in e.g.
+// URLs included in the error) removed.
+func (p *policy) redactedError(err error) string {
+	if err == nil {
+		return "<nil>"
 	}
-}
 
-func GetAccessToken() string {
-	return accessToken
+	return p.redactor.RedactString(err.Error())
 }
 
-func SetAccessToken(newAccessToken string) {
-	accessToken = newAccessToken
-}
+// clientIP returns the IP address of the client that made the request, without the port.
+func clientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
 
-const ErrorBodyInvalidRequest = "{\"success\": false, \"data\":{\"message\":\"(Proxy Error) Invalid request.\"}}"
-const ErrorBodyProxyRequestFailed = "{\"success\": false, \"data\":{\"message\":\"(Proxy Error) Request failed.\"}}"
-const maxMemory = int64(32 << 20) // multipartRequestDataKey currently its 32 MB
+	return host
+}
 
-func proxyHandler(response http.ResponseWriter, request *http.Request) {
+// handleCORS sets the CORS headers for a request to the proxy. It returns false if the request
+// has been answered, either because it was a preflight request or because its origin isn't
+// allowed.
+func (p *policy) handleCORS(response http.ResponseWriter, request *http.Request) bool {
 	// We want to allow all types of requests to the proxy, though we only want to allow certain
 	// origins.
 	response.Header().Add("Access-Control-Allow-Headers", "*")
 	if request.Method == "OPTIONS" {
 		response.Header().Add("Access-Control-Allow-Origin", "*")
 		response.WriteHeader(200)
-		return
+		return false
 	}
 
-	if request.Header.Get("Origin") == "" || !isAllowedOrigin(request.Header.Get("Origin")) {
+	if request.Header.Get("Origin") == "" || !p.isAllowedOrigin(request.Header.Get("Origin")) {
+		accessLogEntryFor(response).DeniedBy = "allowed-origins"
 		if strings.HasPrefix(request.Header.Get("Content-Type"), "application/json") {
 			response.Header().Add("Access-Control-Allow-Headers", "*")
 			response.Header().Add("Access-Control-Allow-Origin", "*")
 			response.WriteHeader(200)
 			_, _ = fmt.Fprintln(response, ErrorBodyProxyRequestFailed)
-			return
+			return false
 		}
 
 		// If it is not an allowed origin, redirect back to hoppscotch.io.
 		response.Header().Add("Location", "https://hoppscotch.io/")
 		response.WriteHeader(301)
-		return
+		return false
 	} else {
 		// Otherwise set the appropriate CORS policy and continue.
 		response.Header().Add("Access-Control-Allow-Origin", request.Header.Get("Origin"))
 	}
 
+	return true
+}
+
+// isAllowedAccessToken returns true if token permits use of the proxy.
+func (p *policy) isAllowedAccessToken(token string) bool {
+	return len(p.config.AccessToken) == 0 || token == p.config.AccessToken
+}
+
+func (proxy *Proxy) proxyHandler(response http.ResponseWriter, request *http.Request) {
+	// Handle the whole request under the same policy (see policyFor), even if it is reloaded part
+	// way through.
+	p := proxy.policyFor(request)
+
+	if !p.handleCORS(response, request) {
+		return
+	}
+
 	// For anything other than an POST request, we'll return an empty JSON object.
 	response.Header().Add("Content-Type", "application/json; charset=utf-8")
 	if request.Method != "POST" {
-		_, _ = fmt.Fprintln(response, "{\"success\": true, \"data\":{\"sessionFingerprint\":\""+sessionFingerprint+"\", \"isProtected\":"+strconv.FormatBool(len(accessToken) > 0)+"}}")
+		_, _ = fmt.Fprintln(response, "{\"success\": true, \"data\":{\"sessionFingerprint\":\""+proxy.sessionFingerprint+"\", \"isProtected\":"+strconv.FormatBool(len(p.config.AccessToken) > 0)+"}}")
 		return
 	}
 
-	// Attempt to parse request body.
+	// Attempt to parse request body. The spans are also ended when the handler returns, in case it
+	// returns early; ending a span twice has no effect.
+	_, parseSpan := startSpan(request.Context(), "parse")
+	defer parseSpan.End()
 	var requestData Request
+	var requestBody *limitedReader
+	maxRequestBodySize := int64(p.config.BodyLimits.MaxRequestBodySize)
+	if maxRequestBodySize > 0 {
+		requestBody = &limitedReader{R: request.Body, N: maxRequestBodySize}
+		request.Body = requestBody
+	}
+	requestTooLarge := func() bool {
+		if requestBody == nil || !requestBody.exceeded() {
+			return false
+		}
+
+		log.Print("A request exceeded the maximum request body size.")
+		writeSizeLimitError(response, ErrorCodeRequestTooLarge, "Request is too large.", maxRequestBodySize)
+		return true
+	}
 	isMultipart := strings.HasPrefix(request.Header.Get("content-type"), "multipart/form-data")
 	var multipartRequestDataKey = request.Header.Get("multipart-part-key")
 	if multipartRequestDataKey == "" {
@@ -188,8 +230,11 @@ func proxyHandler(response http.ResponseWriter, request *http.Request) {
 	}
 	if isMultipart {
 		var err = request.ParseMultipartForm(maxMemory)
+		if requestTooLarge() {
+			return
+		}
 		if err != nil {
-			log.Printf("Failed to parse request body: %v", err)
+			log.Printf("Failed to parse request body: %v", p.redactedError(err))
 			_, _ = fmt.Fprintln(response, ErrorBodyInvalidRequest)
 			return
 		}
@@ -198,40 +243,97 @@ func proxyHandler(response http.ResponseWriter, request *http.Request) {
 		if err != nil || len(requestData.Url) == 0 || len(requestData.Method) == 0 {
 			// If the logged err is nil here, it means either the URL or method were not supplied
 			// in the request data.
-			log.Printf("Failed to parse request body: %v", err)
+			log.Printf("Failed to parse request body: %v", p.redactedError(err))
 			_, _ = fmt.Fprintln(response, ErrorBodyInvalidRequest)
 			return
 		}
 	} else {
 		var err = json.NewDecoder(request.Body).Decode(&requestData)
+		if requestTooLarge() {
+			return
+		}
 		if err != nil || len(requestData.Url) == 0 || len(requestData.Method) == 0 {
 			// If the logged err is nil here, it means either the URL or method were not supplied
 			// in the request data.
-			log.Printf("Failed to parse request body: %v", err)
+			log.Printf("Failed to parse request body: %v", p.redactedError(err))
 			_, _ = fmt.Fprintln(response, ErrorBodyInvalidRequest)
 			return
 		}
 	}
 
-	if len(accessToken) > 0 && requestData.AccessToken != accessToken {
+	parseSpan.End()
+
+	_, policySpan := startSpan(request.Context(), "policy")
+	defer policySpan.End()
+	if !p.isAllowedAccessToken(requestData.AccessToken) {
 		log.Print("An unauthorized request was made.")
+		accessLogEntryFor(response).DeniedBy = "token"
 		_, _ = fmt.Fprintln(response, "{\"success\": false, \"data\":{\"message\":\"(Proxy Error) Unauthorized request; you may need to set your access token in Settings.\"}}")
 		return
 	}
 
+	// Substitute the secrets the request refers to, and keep them out of the response and logs.
+	resolver := secretResolver{store: proxy.secrets}
+	resolver.resolveRequest(&requestData)
+	if isMultipart {
+		for key, values := range request.MultipartForm.Value {
+			if key == multipartRequestDataKey {
+				continue
+			}
+			for i := range values {
+				values[i] = resolver.resolve(values[i])
+			}
+		}
+	}
+	if resolver.err != nil {
+		log.Print("Failed to resolve secrets: ", p.redactedError(resolver.err))
+		writeErrorBody(response, errorData{Message: "(Proxy Error) Failed to resolve secrets: " + p.redactedError(resolver.err) + ".", Code: ErrorCodeSecretFailed})
+		return
+	}
+	p = p.withRedactedValues(resolver.values)
+	logEntry := accessLogEntryFor(response)
+	logEntry.Token = p.accessTokenName()
+
+	// Requests to Unix sockets are only made to those the configuration allows, whatever their
+	// URL's host.
+	socket, err := p.unixSocketFor(&requestData)
+	if err != nil {
+		log.Print("A request to a Unix socket that isn't allowed was made: ", p.redactedError(err))
+		logEntry.DeniedBy = "unix-sockets"
+		_, _ = fmt.Fprintln(response, "{\"success\": false, \"data\":{\"message\":\"(Proxy Error) Request cannot be to this destination.\"}}")
+		return
+	}
+
 	// Make the request
 	var proxyRequest http.Request
 	proxyRequest.Header = make(http.Header)
 	proxyRequest.Method = requestData.Method
 	proxyRequest.URL, _ = url.Parse(requestData.Url)
+	logEntry.setDestination(p, proxyRequest.Method, proxyRequest.URL)
 
 	// Block requests to illegal destinations
-	if !isAllowedDest(proxyRequest.URL.Hostname()) {
+	if socket == "" && !p.isAllowedDest(proxyRequest.URL.Hostname()) {
 		log.Print("A request to a banned destination was made.")
+		logEntry.DeniedBy = "banned-dests"
 		_, _ = fmt.Fprintln(response, "{\"success\": false, \"data\":{\"message\":\"(Proxy Error) Request cannot be to this destination.\"}}")
 		return
 	}
 
+	limitKeys := rateLimitKeys{
+		Token:       requestData.AccessToken,
+		Origin:      request.Header.Get("Origin"),
+		ClientIP:    clientIP(request),
+		Destination: proxyRequest.URL.Hostname(),
+	}
+	release, limitErr := p.limiter.acquire(limitKeys)
+	if limitErr != nil {
+		log.Print("A request was rate limited: ", limitErr.Error())
+		writeRateLimitError(response, limitErr)
+		return
+	}
+	defer release()
+	policySpan.End()
+
 	var params = proxyRequest.URL.Query()
 
 	for k, v := range requestData.Params {
@@ -239,7 +341,12 @@ func proxyHandler(response http.ResponseWriter, request *http.Request) {
 	}
 	proxyRequest.URL.RawQuery = params.Encode()
 
-	if len(requestData.Auth.Username) > 0 && len(requestData.Auth.Password) > 0 {
+	if err := requestData.Auth.validate(); err != nil {
+		log.Print("Failed to parse request body: ", err)
+		writeErrorBody(response, errorData{Message: "(Proxy Error) Invalid request: " + err.Error() + ".", Code: ErrorCodeAuthFailed})
+		return
+	}
+	if requestData.Auth.usesBasicAuth() {
 		proxyRequest.SetBasicAuth(requestData.Auth.Username, requestData.Auth.Password)
 	}
 	for k, v := range requestData.Headers {
@@ -313,38 +420,227 @@ func proxyHandler(response http.ResponseWriter, request *http.Request) {
 		_ = proxyRequest.Body.Close()
 	}
 
-	var client http.Client
-	var proxyResponse *http.Response
-	proxyResponse, err := client.Do(&proxyRequest)
+	outgoingRequest := proxyRequest.WithContext(request.Context())
+	if err := p.beforeRequest(outgoingRequest); err != nil {
+		log.Print("A hook rejected a request: ", p.redactedError(err))
+		writeErrorBody(response, errorData{Message: "(Proxy Error) Request rejected: " + p.redactedError(err), Code: ErrorCodeHookFailed})
+		return
+	}
 
+	// Hooks may have changed the destination.
+	logEntry.setDestination(p, outgoingRequest.Method, outgoingRequest.URL)
+	if socket == "" && !p.isAllowedDest(outgoingRequest.URL.Hostname()) {
+		log.Print("A request to a banned destination was made.")
+		logEntry.DeniedBy = "banned-dests"
+		_, _ = fmt.Fprintln(response, "{\"success\": false, \"data\":{\"message\":\"(Proxy Error) Request cannot be to this destination.\"}}")
+		return
+	}
+	// Nor may the request's DNS overrides connect to one.
+	overrides, err := parseDNSOverrides(requestData.Resolve)
 	if err != nil {
-		log.Print("Failed to write response body: ", err.Error())
+		log.Print("A request had invalid DNS overrides: ", err)
+		writeErrorBody(response, errorData{Message: "(Proxy Error) Invalid request: " + err.Error() + "."})
+		return
+	}
+	for _, ip := range overrides {
+		if !p.isAllowedDest(ip.String()) {
+			log.Print("A request to a banned destination was made.")
+			logEntry.DeniedBy = "banned-dests"
+			_, _ = fmt.Fprintln(response, "{\"success\": false, \"data\":{\"message\":\"(Proxy Error) Request cannot be to this destination.\"}}")
+			return
+		}
+	}
+
+	// Secrets may only be sent to the hosts they're stored with, and not to an address of the
+	// client's choosing. A request to a Unix socket goes to localhost, whatever the socket.
+	err = resolver.allows(outgoingRequest.URL.Hostname())
+	if err == nil && len(resolver.secrets) > 0 && len(requestData.Resolve) > 0 {
+		err = errors.New("secrets can't be sent with DNS overrides")
+	}
+	if err == nil && len(resolver.secrets) > 0 && socket != "" {
+		err = errors.New("secrets can't be sent to Unix sockets")
+	}
+	if err != nil {
+		log.Print("A request sending a secret to a host it isn't allowed to be sent to was made: ", p.redactedError(err))
+		logEntry.DeniedBy = "secrets"
+		writeErrorBody(response, errorData{Message: "(Proxy Error) Failed to resolve secrets: " + p.redactedError(err) + ".", Code: ErrorCodeSecretFailed})
+		return
+	}
+
+	maxUploadSize := int64(p.config.BodyLimits.MaxUploadSize)
+	if maxUploadSize > 0 && outgoingRequest.ContentLength > maxUploadSize {
+		log.Print("A request exceeded the maximum upload size.")
+		writeSizeLimitError(response, ErrorCodeUploadTooLarge, "Request body is too large to send.", maxUploadSize)
+		return
+	}
+
+	// In mock mode, the response may be served from a mock instead of the destination.
+	mock, err := p.mocks.match(outgoingRequest)
+	if err != nil {
+		log.Print("A request didn't match any mock: ", p.redactedError(err))
+		writeErrorBody(response, errorData{Message: "(Proxy Error) No mock matches this request.", Code: ErrorCodeMockNotFound})
+		return
+	}
+	if mock != nil {
+		logEntry.Mock = mock.name
+	}
+	// Otherwise, a fresh cached response may be served instead, and a stale one is revalidated.
+	var cache *cacheLookup
+	if mock == nil {
+		cache = p.cache.lookup(outgoingRequest, requestData)
+	}
+
+	client := http.Client{Transport: proxy.transportFor(requestData.Auth, overrides, socket)}
+	if len(resolver.secrets) > 0 {
+		// Redirects to a host the secrets may not be sent to are returned to the client instead.
+		client.CheckRedirect = func(redirect *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if resolver.allows(redirect.URL.Hostname()) != nil {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		}
+	}
+	proxyResponse := cache.response(outgoingRequest)
+	// The conditions of a revalidation and the traceparent header are added before the request is
+	// signed, so that the signature covers them.
+	cache.addConditions(outgoingRequest)
+	outgoingRequest, upstreamSpan := startUpstreamSpan(outgoingRequest)
+	defer upstreamSpan.End()
+	// Any token and signature are added last, over the request exactly as it is sent. Signatures
+	// include a timestamp or nonce, so each retry is signed again from the unsigned headers.
+	unsigned := outgoingRequest.Header.Clone()
+	authorize := func(request *http.Request) error {
+		if requestData.Auth.Type == AuthTypeOAuth2 {
+			if err := proxy.attachOAuth2Token(p, request, requestData); err != nil {
+				return fmt.Errorf("couldn't attach the OAuth 2.0 token: %w", err)
+			}
+		}
+		if err := requestData.Auth.sign(request, p.kerberos); err != nil {
+			return fmt.Errorf("couldn't sign the request: %w", err)
+		}
+		return nil
+	}
+	if proxyResponse == nil {
+		if err := authorize(outgoingRequest); err != nil {
+			log.Print("Failed to authorize request: ", p.redactedError(err))
+			writeErrorBody(response, errorData{Message: "(Proxy Error) Failed to authorize request: " + p.redactedError(err) + ".", Code: ErrorCodeAuthFailed})
+			return
+		}
+	}
+
+	// If the client's session is being recorded, the exchange is added to the recording however
+	// it ends.
+	var recorded *exchange
+	if recording := proxy.recordingFor(p, requestData); recording != nil {
+		var err error
+		if outgoingRequest, recorded, err = newExchange(outgoingRequest); err != nil {
+			log.Print("Failed to record request: ", p.redactedError(err))
+			_, _ = fmt.Fprintln(response, ErrorBodyProxyRequestFailed)
+			return
+		}
+		defer recording.add(p, recorded)
+	}
+	var addresses resolvedAddresses
+	outgoingRequest = addresses.trace(outgoingRequest)
+	upstreamStart := time.Now()
+	var attempts []RetryAttempt
+	retry := p.config.Retry.override(requestData.Retry)
+	if mock != nil {
+		proxyResponse, attempts, err = retry.send(p, outgoingRequest, nil, mock.respond)
+	} else if proxyResponse == nil {
+		// Each retry counts against the rate limits as a request of its own.
+		prepare := func(request *http.Request) error {
+			if limitErr := p.limiter.spend(limitKeys); limitErr != nil {
+				return limitErr
+			}
+			request.Header = unsigned.Clone()
+			return authorize(request)
+		}
+		proxyResponse, attempts, err = retry.send(p, outgoingRequest, prepare, func(request *http.Request) (*http.Response, error) {
+			return requestData.Auth.sendWithAuth(&client, request, p.kerberos)
+		})
+		if err == nil {
+			proxyResponse = cache.complete(proxyResponse)
+		}
+	}
+	logEntry.Attempts = len(attempts)
+
+	if err != nil {
+		recorded.setResponse(nil, p.redactedError(err))
+		endUpstreamSpan(upstreamSpan, nil, p.redactedError(err))
+		log.Print("Failed to write response body: ", p.redactedError(err))
+		if attempts != nil {
+			writeErrorBody(response, errorData{Message: "(Proxy Error) Request failed.", Attempts: attempts})
+			return
+		}
 		_, _ = fmt.Fprintln(response, ErrorBodyProxyRequestFailed)
 		return
 	}
 
+	defer proxyResponse.Body.Close()
+	recorded.setResponse(proxyResponse, "")
+
+	maxResponseSize := int64(p.config.BodyLimits.MaxResponseSize)
+	if maxResponseSize > 0 && !p.config.BodyLimits.TruncateResponses && proxyResponse.ContentLength > maxResponseSize {
+		log.Print("A response exceeded the maximum response size.")
+		writeSizeLimitError(response, ErrorCodeResponseTooLarge, "Response is too large.", maxResponseSize)
+		return
+	}
+
 	var responseData Response
 	responseData.Success = true
 	responseData.Status = proxyResponse.StatusCode
 	responseData.StatusText = strings.Join(strings.Split(proxyResponse.Status, " ")[1:], " ")
-	responseBytes, _ := io.ReadAll(proxyResponse.Body)
+	responseBytes, truncated, err := readLimited(proxyResponse.Body, maxResponseSize)
+	recorded.setResponseBody(responseBytes, truncated)
+	if err != nil {
+		// A partly read body isn't cached or returned.
+		endUpstreamSpan(upstreamSpan, nil, p.redactedError(err))
+		log.Print("Failed to read response body: ", p.redactedError(err))
+		_, _ = fmt.Fprintln(response, ErrorBodyProxyRequestFailed)
+		return
+	}
+	cache.store(proxyResponse, responseBytes, truncated)
+	responseData.Cache = cache.cacheStatus()
+	responseData.Attempts = attempts
+	responseData.ResolvedAddresses, responseData.RemoteAddress = addresses.addresses()
+	logEntry.Cache = responseData.Cache
+	logEntry.setUpstream(proxyResponse.StatusCode, int64(len(responseBytes)), upstreamStart)
+	endUpstreamSpan(upstreamSpan, proxyResponse, "")
 	responseData.Headers = headerToArray(proxyResponse.Header)
 
-	if requestData.WantsBinary {
-		for _, bannedOutput := range bannedOutputs {
-			responseBytes = bytes.ReplaceAll(responseBytes, []byte(bannedOutput), []byte("[redacted]"))
+	if truncated {
+		if !p.config.BodyLimits.TruncateResponses {
+			log.Print("A response exceeded the maximum response size.")
+			writeSizeLimitError(response, ErrorCodeResponseTooLarge, "Response is too large.", maxResponseSize)
+			return
 		}
 
+		responseData.Truncated = true
+	}
+
+	responseData.Data = string(responseBytes)
+	if err := p.afterResponse(outgoingRequest, &responseData); err != nil {
+		log.Print("A hook rejected a response: ", p.redactedError(err))
+		writeErrorBody(response, errorData{Message: "(Proxy Error) Response rejected: " + p.redactedError(err), Code: ErrorCodeHookFailed})
+		return
+	}
+
+	// Redact the body before it is encoded, so the same rules apply to both formats.
+	destination := outgoingRequest.URL.Hostname()
+	responseBytes = p.redactor.RedactBody(destination, []byte(responseData.Data))
+	p.redactor.RedactHeaders(destination, responseData.Headers)
+
+	if requestData.WantsBinary {
 		// If using the new binary format, encode the response body.
 		responseData.Data = base64.RawStdEncoding.EncodeToString(responseBytes)
 		responseData.IsBinary = true
 	} else {
 		// Otherwise, simply return the old format.
 		responseData.Data = string(responseBytes)
-
-		for _, bannedOutput := range bannedOutputs {
-			responseData.Data = strings.Replace(responseData.Data, bannedOutput, "[redacted]", -1)
-		}
 	}
 
 	// Write the request body to the response.
@@ -25,9 +25,14 @@ func getResultDef(request Request) RespResult {
 
 var (
 	testServerUrl string
+	testProxy     *Proxy
 )
 
 func getResult(_req Request, origin string) RespResult {
+	return getResultFrom(testProxy, _req, origin)
+}
+
+func getResultFrom(proxy *Proxy, _req Request, origin string) RespResult {
 	var respResult RespResult
 	marshal, err := json.Marshal(_req)
 	respResult.proxyResponse = *httptest.NewRecorder()
@@ -37,7 +42,7 @@ func getResult(_req Request, origin string) RespResult {
 	}
 	request := httptest.NewRequest("POST", "/", bytes.NewReader(marshal))
 	request.Header.Set("Origin", origin)
-	proxyHandler(&respResult.proxyResponse, request)
+	proxy.ServeHTTP(&respResult.proxyResponse, request)
 	result := respResult.proxyResponse.Result()
 	err = json.NewDecoder(result.Body).Decode(&respResult.requestResponse)
 	respResult.err = err
@@ -45,7 +50,9 @@ func getResult(_req Request, origin string) RespResult {
 }
 
 func init() {
-	allowedOrigins = []string{"validorigin1.com", "validorigin2.com"}
+	testProxy, _ = New(Options{Config: Config{
+		AllowedOrigins: []string{"validorigin1.com", "validorigin2.com"},
+	}})
 
 	app := httpbin.New()
 	testServer := httptest.NewServer(app.Handler())
@@ -81,12 +88,12 @@ func TestNotAllowedOrigin(t *testing.T) {
 }
 
 func TestWildCardOrigin(t *testing.T) {
-	_allowedOrigins := allowedOrigins
-	allowedOrigins = []string{"*"}
+	_allowedOrigins := testProxy.loadPolicy().config.AllowedOrigins
+	_ = testProxy.updateConfig(func(config *Config) { config.AllowedOrigins = []string{"*"} })
 	defer func() {
 		// reset allowedOrigins
 		// for rest of test cases are not thread safe, will have to run one after others
-		allowedOrigins = _allowedOrigins
+		_ = testProxy.updateConfig(func(config *Config) { config.AllowedOrigins = _allowedOrigins })
 	}()
 	result := getResult(Request{
 		Method: "GET",
@@ -148,7 +155,7 @@ func TestAccessControlHeaders(t *testing.T) {
 func TestPreflightOptionsRequest(t *testing.T) {
 	request := httptest.NewRequest("OPTIONS", "/", nil)
 	resp := httptest.ResponseRecorder{}
-	proxyHandler(&resp, request)
+	testProxy.ServeHTTP(&resp, request)
 	headers := resp.Header()
 	// preflight request allow all origins
 	assert.Equal(t, "*", headers.Get("Access-Control-Allow-Origin"))
@@ -254,7 +261,7 @@ ranga
 	request.Header.Set("content-type", "multipart/form-data; boundary=61ed834ef57e878fad0a3d27d2b04fb1")
 	request.Header.Set("origin", "validorigin1.com")
 	resp := *httptest.NewRecorder()
-	proxyHandler(&resp, request)
+	testProxy.ServeHTTP(&resp, request)
 	var result Response
 	err := json.NewDecoder(resp.Body).Decode(&result)
 	assert.Nil(t, err)
@@ -264,9 +271,9 @@ ranga
 }
 
 func TestAccessTokenDisallowIncasNotAvailable(t *testing.T) {
-	accessToken = "some-access-token"
+	testProxy.SetAccessToken("some-access-token")
 	defer func() {
-		accessToken = "" // delete access token(cleanup)
+		testProxy.SetAccessToken("") // delete access token(cleanup)
 	}()
 	request := Request{
 		Method: "POST",
@@ -284,28 +291,28 @@ func TestAccessTokenDisallowIncasNotAvailable(t *testing.T) {
 }
 
 func TestAllowWithValidAccessToken(t *testing.T) {
-	accessToken = "some-access-token"
+	testProxy.SetAccessToken("some-access-token")
 	defer func() {
-		accessToken = "" // delete access token(cleanup)
+		testProxy.SetAccessToken("") // delete access token(cleanup)
 	}()
 	request := Request{
 		Method:      "POST",
 		Url:         testServerUrl + "/post",
-		AccessToken: accessToken,
+		AccessToken: testProxy.AccessToken(),
 	}
 	proxyResult := getResultDef(request)
 	checkErrorNUnmarshalHTTPBinResponse(proxyResult.requestResponse.Data, t)
 }
 
 func TestInvalidAccessTokenRequestShouldFail(t *testing.T) {
-	accessToken = "some-access-token"
+	testProxy.SetAccessToken("some-access-token")
 	defer func() {
-		accessToken = ""
+		testProxy.SetAccessToken("")
 	}()
 	request := Request{
 		Method:      "POST",
 		Url:         testServerUrl + "/",
-		AccessToken: accessToken + "1",
+		AccessToken: testProxy.AccessToken() + "1",
 	}
 	proxyResult := getResultDef(request)
 	assert.NotNil(t, proxyResult.err)
@@ -315,19 +322,42 @@ func TestInvalidAccessTokenRequestShouldFail(t *testing.T) {
 	assert.Equal(t, "false", fmt.Sprintf("%v", success))
 }
 
-//func TestBannedOutputs(t *testing.T) {
-//	// TODO
-//	// need clear understanding on banned outputs
-//}
+func TestBannedOutputs(t *testing.T) {
+	assert.Nil(t, testProxy.updateConfig(func(config *Config) {
+		config.BannedOutputs = []string{"ranga"}
+		config.RedactionRules = []RedactionRule{{Header: "X-Secret"}}
+	}))
+	defer func() {
+		_ = testProxy.updateConfig(func(config *Config) {
+			config.BannedOutputs = nil
+			config.RedactionRules = nil
+		})
+	}()
+
+	for _, wantsBinary := range []bool{false, true} {
+		resp := getResultDef(Request{
+			Method:      "GET",
+			Url:         testServerUrl + "/response-headers?ram=ranga&X-Secret=value",
+			WantsBinary: wantsBinary,
+		})
+		data := resp.requestResponse.Data
+		if wantsBinary {
+			decoded, err := base64.RawStdEncoding.DecodeString(data)
+			assert.Nil(t, err)
+			data = string(decoded)
+		}
+		// banned outputs are redacted from the body and headers in both formats
+		assert.NotContains(t, data, "ranga")
+		assert.Equal(t, "[redacted]", resp.requestResponse.Headers["ram"])
+		assert.Equal(t, "[redacted]", resp.requestResponse.Headers["x-secret"])
+	}
+}
 
 func TestBasicAuth(t *testing.T) {
 	request := Request{
 		Method: "GET",
 		Url:    testServerUrl + "/basic-auth/username/password",
-		Auth: struct {
-			Username string
-			Password string
-		}{
+		Auth: RequestAuth{
 			Username: "username",
 			Password: "password",
 		},
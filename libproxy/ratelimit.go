@@ -0,0 +1,310 @@
+package libproxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit describes a token bucket: Rate tokens are added per second, up to a maximum of
+// Burst tokens. A zero Rate disables the limit. In configuration files, it is written in the
+// format accepted by ParseRateLimit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits holds the limits applied to incoming proxy requests. Each bucket set is keyed
+// separately, so a request must have a token available in every enabled bucket to proceed.
+type RateLimits struct {
+	PerToken       RateLimit `json:"perToken,omitempty" yaml:"perToken,omitempty"`
+	PerOrigin      RateLimit `json:"perOrigin,omitempty" yaml:"perOrigin,omitempty"`
+	PerClientIP    RateLimit `json:"perClientIP,omitempty" yaml:"perClientIP,omitempty"`
+	PerDestination RateLimit `json:"perDestination,omitempty" yaml:"perDestination,omitempty"`
+
+	// MaxConcurrent is the maximum number of requests that may be in-flight to upstreams at
+	// any one time. Zero means unlimited.
+	MaxConcurrent int `json:"maxConcurrent,omitempty" yaml:"maxConcurrent,omitempty"`
+}
+
+// Enabled returns true if the limit is active.
+func (l RateLimit) Enabled() bool {
+	return l.Rate > 0
+}
+
+// ParseRateLimit parses a limit in the format "<count>/<s|m|h>[:<burst>]", e.g. "10/s" or
+// "600/m:50". If the burst is omitted, it defaults to the count. An empty string returns a
+// disabled limit.
+func ParseRateLimit(value string) (RateLimit, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return RateLimit{}, nil
+	}
+
+	spec, burstSpec, hasBurst := strings.Cut(value, ":")
+	countSpec, unitSpec, ok := strings.Cut(spec, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: expected <count>/<s|m|h>[:<burst>]", value)
+	}
+
+	count, err := strconv.Atoi(countSpec)
+	if err != nil || count < 1 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: count must be a positive integer", value)
+	}
+
+	var per time.Duration
+	switch unitSpec {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: unit must be one of s, m or h", value)
+	}
+
+	burst := count
+	if hasBurst {
+		burst, err = strconv.Atoi(burstSpec)
+		if err != nil || burst < 1 {
+			return RateLimit{}, fmt.Errorf("invalid rate limit %q: burst must be a positive integer", value)
+		}
+	}
+
+	return RateLimit{Rate: float64(count) / per.Seconds(), Burst: burst}, nil
+}
+
+// String formats the limit in the format accepted by ParseRateLimit, using the smallest unit
+// that gives a whole count.
+func (l RateLimit) String() string {
+	if !l.Enabled() {
+		return ""
+	}
+
+	count, unit := l.Rate*3600, "h"
+	for _, per := range []struct {
+		unit    string
+		seconds float64
+	}{{"s", 1}, {"m", 60}} {
+		if perUnit := l.Rate * per.seconds; perUnit >= 1 && perUnit == math.Trunc(perUnit) {
+			count, unit = perUnit, per.unit
+			break
+		}
+	}
+
+	return strconv.FormatFloat(math.Round(count), 'f', -1, 64) + "/" + unit + ":" + strconv.Itoa(l.Burst)
+}
+
+// UnmarshalText parses a limit in the format accepted by ParseRateLimit.
+func (l *RateLimit) UnmarshalText(text []byte) error {
+	limit, err := ParseRateLimit(string(text))
+	if err != nil {
+		return err
+	}
+
+	*l = limit
+	return nil
+}
+
+// MarshalText formats the limit in the format accepted by ParseRateLimit.
+func (l RateLimit) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// bucketSet is a set of token buckets sharing the same limit, keyed by e.g. origin.
+type bucketSet struct {
+	limit   RateLimit
+	buckets map[string]*tokenBucket
+}
+
+func newBucketSet(limit RateLimit) *bucketSet {
+	return &bucketSet{limit: limit, buckets: make(map[string]*tokenBucket)}
+}
+
+// refill returns the bucket for key with its tokens topped up to now. The returned bucket is
+// not stored until it is spent from.
+func (s *bucketSet) refill(key string, now time.Time) *tokenBucket {
+	bucket, ok := s.buckets[key]
+	if !ok {
+		return &tokenBucket{tokens: float64(s.limit.Burst), last: now}
+	}
+
+	bucket.tokens = math.Min(float64(s.limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*s.limit.Rate)
+	bucket.last = now
+	return bucket
+}
+
+// wait returns how long until the bucket has a whole token available.
+func (s *bucketSet) wait(bucket *tokenBucket) time.Duration {
+	if bucket.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - bucket.tokens) / s.limit.Rate * float64(time.Second))
+}
+
+// sweep drops buckets that would have completely refilled by now, as they are
+// indistinguishable from a freshly created bucket.
+func (s *bucketSet) sweep(now time.Time) {
+	full := time.Duration(float64(s.limit.Burst) / s.limit.Rate * float64(time.Second))
+	for key, bucket := range s.buckets {
+		if now.Sub(bucket.last) >= full {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// rateLimitKeys identifies the request being checked against each bucket set.
+type rateLimitKeys struct {
+	Token       string
+	Origin      string
+	ClientIP    string
+	Destination string
+}
+
+// ErrRateLimited is returned (wrapped in a RateLimitError) when a request exceeds a limit.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimitError reports which limit a request exceeded and how long the client should wait
+// before retrying.
+type RateLimitError struct {
+	Limit      string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s: %s (retry after %s)", ErrRateLimited, e.Limit, e.RetryAfter)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// sweepInterval is the number of requests between sweeps of idle buckets.
+const sweepInterval = 1024
+
+type rateLimiter struct {
+	mu       sync.Mutex
+	limits   RateLimits
+	sets     map[string]*bucketSet
+	inFlight int
+	requests int
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	limiter := &rateLimiter{limits: limits, sets: make(map[string]*bucketSet)}
+	for name, limit := range map[string]RateLimit{
+		"token":       limits.PerToken,
+		"origin":      limits.PerOrigin,
+		"client-ip":   limits.PerClientIP,
+		"destination": limits.PerDestination,
+	} {
+		if limit.Enabled() {
+			limiter.sets[name] = newBucketSet(limit)
+		}
+	}
+
+	return limiter
+}
+
+// acquire spends a token from every enabled bucket matching keys and reserves an in-flight
+// slot. Either every bucket is spent from or none are. On success, the returned function must
+// be called once the request has completed to release the in-flight slot.
+func (l *rateLimiter) acquire(keys rateLimitKeys) (func(), *RateLimitError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.requests++
+	if l.requests%sweepInterval == 0 {
+		for _, set := range l.sets {
+			set.sweep(now)
+		}
+	}
+
+	if l.limits.MaxConcurrent > 0 && l.inFlight >= l.limits.MaxConcurrent {
+		return nil, &RateLimitError{Limit: "concurrency", RetryAfter: time.Second}
+	}
+	if exceeded := l.spendLocked(keys, now); exceeded != nil {
+		return nil, exceeded
+	}
+
+	l.inFlight++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.inFlight--
+			l.mu.Unlock()
+		})
+	}, nil
+}
+
+// spend spends a token from every enabled bucket matching keys, for a request made on behalf
+// of one that already holds an in-flight slot, such as a retry. Either every bucket is spent
+// from or none are.
+func (l *rateLimiter) spend(keys rateLimitKeys) *RateLimitError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.spendLocked(keys, time.Now())
+}
+
+// spendLocked spends from the buckets matching keys, unless any is empty. l.mu must be held.
+func (l *rateLimiter) spendLocked(keys rateLimitKeys, now time.Time) *RateLimitError {
+	keyed := map[string]string{
+		"token":       keys.Token,
+		"origin":      keys.Origin,
+		"client-ip":   keys.ClientIP,
+		"destination": keys.Destination,
+	}
+	buckets := make(map[string]*tokenBucket, len(l.sets))
+	var exceeded *RateLimitError
+	for name, set := range l.sets {
+		bucket := set.refill(keyed[name], now)
+		// Report the longest wait, as the request can't succeed until every bucket allows it.
+		if wait := set.wait(bucket); wait > 0 && (exceeded == nil || wait > exceeded.RetryAfter) {
+			exceeded = &RateLimitError{Limit: name, RetryAfter: wait}
+		}
+		buckets[name] = bucket
+	}
+	if exceeded != nil {
+		return exceeded
+	}
+
+	for name, bucket := range buckets {
+		bucket.tokens--
+		l.sets[name].buckets[keyed[name]] = bucket
+	}
+
+	return nil
+}
+
+// rateLimitState is a snapshot of a rate limiter, as reported by the status endpoint.
+type rateLimitState struct {
+	Limits   RateLimits `json:"limits"`
+	InFlight int        `json:"inFlight"`
+	// Buckets is the number of keys (e.g. origins) each limit is currently tracking.
+	Buckets map[string]int `json:"buckets"`
+}
+
+func (l *rateLimiter) state() rateLimitState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state := rateLimitState{Limits: l.limits, InFlight: l.inFlight, Buckets: map[string]int{}}
+	for name, set := range l.sets {
+		state.Buckets[name] = len(set.buckets)
+	}
+	return state
+}
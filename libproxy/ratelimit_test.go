@@ -0,0 +1,86 @@
+package libproxy
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := ParseRateLimit("600/m:50")
+	assert.Nil(t, err)
+	assert.Equal(t, RateLimit{Rate: 10, Burst: 50}, limit)
+
+	limit, err = ParseRateLimit("5/s")
+	assert.Nil(t, err)
+	assert.Equal(t, RateLimit{Rate: 5, Burst: 5}, limit)
+
+	limit, err = ParseRateLimit("")
+	assert.Nil(t, err)
+	assert.False(t, limit.Enabled())
+
+	for _, invalid := range []string{"5", "five/s", "5/d", "5/s:0"} {
+		_, err = ParseRateLimit(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestRateLimitBuckets(t *testing.T) {
+	l := newRateLimiter(RateLimits{PerOrigin: RateLimit{Rate: 1, Burst: 2}})
+	keys := rateLimitKeys{Origin: "validorigin1.com"}
+
+	for i := 0; i < 2; i++ {
+		release, err := l.acquire(keys)
+		assert.Nil(t, err)
+		release()
+	}
+
+	_, err := l.acquire(keys)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "origin", err.Limit)
+		assert.True(t, err.RetryAfter > 0 && err.RetryAfter <= time.Second)
+	}
+
+	// Other origins have their own bucket.
+	_, err = l.acquire(rateLimitKeys{Origin: "validorigin2.com"})
+	assert.Nil(t, err)
+}
+
+func TestRateLimitConcurrency(t *testing.T) {
+	l := newRateLimiter(RateLimits{MaxConcurrent: 1})
+
+	release, err := l.acquire(rateLimitKeys{})
+	assert.Nil(t, err)
+	_, err = l.acquire(rateLimitKeys{})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "concurrency", err.Limit)
+	}
+
+	release()
+	_, err = l.acquire(rateLimitKeys{})
+	assert.Nil(t, err)
+}
+
+func TestRateLimitedRequest(t *testing.T) {
+	testProxy.SetRateLimits(RateLimits{PerDestination: RateLimit{Rate: 0.01, Burst: 1}})
+	defer testProxy.SetRateLimits(RateLimits{})
+
+	request := Request{
+		Method: "GET",
+		Url:    testServerUrl + "/get",
+	}
+	resp := getResultDef(request)
+	assert.True(t, resp.requestResponse.Success)
+
+	resp = getResultDef(request)
+	var body errorBody
+	err := json.Unmarshal(resp.proxyResponse.Body.Bytes(), &body)
+	assert.Nil(t, err)
+	assert.False(t, body.Success)
+	assert.Equal(t, ErrorCodeRateLimited, body.Data.Code)
+	assert.Equal(t, "destination", body.Data.Limit)
+	assert.Equal(t, 100, body.Data.RetryAfter)
+	assert.Equal(t, "100", resp.proxyResponse.Header().Get("Retry-After"))
+}
@@ -0,0 +1,747 @@
+package libproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// ErrorCodeRecordingFailed is returned when a recording couldn't be started or stopped.
+const ErrorCodeRecordingFailed = "RECORDING_FAILED"
+
+// defaultMaxRecordingEntries is the number of exchanges kept in a recording if
+// RecordingConfig.MaxEntries isn't set.
+const defaultMaxRecordingEntries = 1000
+
+// defaultMaxRecordingsPerToken is the number of recordings that may be in progress with an access
+// token if RecordingConfig.MaxPerToken isn't set.
+const defaultMaxRecordingsPerToken = 4
+
+// defaultMaxRecordingSize is the total size of the bodies kept in a recording if
+// RecordingConfig.MaxSize isn't set.
+const defaultMaxRecordingSize = 64 << 20
+
+// RecordingConfig configures the recording of proxied exchanges to HAR files.
+type RecordingConfig struct {
+	// Enabled allows clients to record the requests made in their session with the /recording
+	// endpoint. Recordings are written to the recordings folder of the data directory.
+	Enabled bool `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	// MaxEntries is the number of exchanges kept in a recording; any later ones are left out.
+	// Defaults to 1000.
+	MaxEntries int `json:"maxEntries,omitempty" yaml:"maxEntries,omitempty"`
+	// MaxPerToken is the number of recordings that may be in progress at once with the same
+	// access token. Defaults to 4.
+	MaxPerToken int `json:"maxPerToken,omitempty" yaml:"maxPerToken,omitempty"`
+	// MaxSize is the total size of the request and response bodies kept in a recording; any
+	// exchanges that don't fit are left out. Defaults to 64MB.
+	MaxSize ByteSize `json:"maxSize,omitempty" yaml:"maxSize,omitempty"`
+}
+
+// RecordingRequest is the body of a request to the /recording endpoint. Recordings are kept by
+// the proxy access token and Session, like OAuth 2.0 credentials.
+type RecordingRequest struct {
+	AccessToken string
+	// Session identifies the client whose requests are recorded (see Request.Session).
+	Session string
+	// Action is "start", "stop" or "status" (the default).
+	Action string
+}
+
+// RecordingInfo describes a recording.
+type RecordingInfo struct {
+	ID        string    `json:"id"`
+	Session   string    `json:"session"`
+	StartedAt time.Time `json:"startedAt"`
+	// Recording is false once the recording has been stopped.
+	Recording bool `json:"recording"`
+	Entries   int  `json:"entries"`
+	// Size is the total size of the bodies recorded.
+	Size int64 `json:"size"`
+	// Dropped is the number of exchanges left out because the recording was full.
+	Dropped int `json:"dropped,omitempty"`
+	// File is the path of the HAR file, once the recording has been written.
+	File string `json:"file,omitempty"`
+}
+
+// The HAR 1.2 format (http://www.softwareishard.com/blog/har-12-spec/).
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+	Comment string     `json:"comment,omitempty"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+	Comment     string         `json:"comment,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// harTimings are in milliseconds, with -1 for phases that didn't happen (e.g. DNS for a reused
+// connection).
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// harTimer records when each phase of an exchange happened. If the request is sent more than
+// once (e.g. to answer a Digest challenge), the connection phases are those of the last attempt.
+type harTimer struct {
+	mu                                sync.Mutex
+	start, getConn, dnsStart, dnsDone time.Time
+	connectStart, connectDone         time.Time
+	tlsStart, tlsDone, gotConn, wrote time.Time
+	firstByte, end                    time.Time
+	serverIP                          string
+}
+
+// trace returns the hooks that record the phases of the exchange.
+func (t *harTimer) trace() *httptrace.ClientTrace {
+	at := func(field *time.Time) func() {
+		return func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			*field = time.Now()
+		}
+	}
+
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.getConn = time.Now()
+			t.dnsStart, t.dnsDone, t.connectStart, t.connectDone, t.tlsStart, t.tlsDone = time.Time{}, time.Time{}, time.Time{}, time.Time{}, time.Time{}, time.Time{}
+		},
+		DNSStart: func(httptrace.DNSStartInfo) { at(&t.dnsStart)() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { at(&t.dnsDone)() },
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			// With several addresses, connections may be attempted in parallel.
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+		},
+		ConnectDone:       func(string, string, error) { at(&t.connectDone)() },
+		TLSHandshakeStart: at(&t.tlsStart),
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { at(&t.tlsDone)() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.gotConn = time.Now()
+			if host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String()); err == nil {
+				t.serverIP = host
+			}
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { at(&t.wrote)() },
+		GotFirstResponseByte: at(&t.firstByte),
+	}
+}
+
+// timings returns the HAR timings of the exchange, its total time and the IP address of the
+// server.
+func (t *harTimer) timings() (harTimings, float64, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	between := func(from, to time.Time) float64 {
+		if from.IsZero() || to.IsZero() || to.Before(from) {
+			return -1
+		}
+		return milliseconds(to.Sub(from))
+	}
+	timings := harTimings{
+		DNS:     between(t.dnsStart, t.dnsDone),
+		Connect: between(t.connectStart, t.connectDone),
+		SSL:     between(t.tlsStart, t.tlsDone),
+		Send:    between(t.gotConn, t.wrote),
+		Wait:    between(t.wrote, t.firstByte),
+		Receive: between(t.firstByte, t.end),
+	}
+	// In HAR, the connect time includes the TLS handshake.
+	if timings.SSL >= 0 {
+		timings.Connect = between(t.connectStart, t.tlsDone)
+	}
+	timings.Blocked = between(t.start, t.gotConn)
+	if timings.Blocked >= 0 {
+		for _, phase := range []float64{timings.DNS, timings.Connect} {
+			if phase > 0 {
+				timings.Blocked -= phase
+			}
+		}
+		if timings.Blocked < 0 {
+			timings.Blocked = 0
+		}
+	}
+
+	total := 0.0
+	for _, phase := range []float64{timings.Blocked, timings.DNS, timings.Connect, timings.Send, timings.Wait, timings.Receive} {
+		if phase > 0 {
+			total += phase
+		}
+	}
+	return timings, total, t.serverIP
+}
+
+// exchange collects a proxied exchange as it happens, to be added to a recording once it is
+// over. Its methods may be called on a nil exchange, which records nothing.
+type exchange struct {
+	startedAt   time.Time
+	request     *http.Request
+	requestBody []byte
+	timer       harTimer
+
+	response     *http.Response
+	responseBody []byte
+	truncated    bool
+	failure      string
+}
+
+// newExchange begins recording request, which is about to be sent. It reads the request's body,
+// replacing it so that it can still be sent, and returns the request to send with the timings
+// hooks added to its context.
+func newExchange(request *http.Request) (*http.Request, *exchange, error) {
+	body, err := bufferBody(request)
+	if err != nil {
+		return request, nil, err
+	}
+
+	e := &exchange{startedAt: time.Now(), request: request, requestBody: body}
+	e.timer.start = e.startedAt
+	return request.WithContext(httptrace.WithClientTrace(request.Context(), e.timer.trace())), e, nil
+}
+
+// setResponse records the response to the request, or why there wasn't one.
+func (e *exchange) setResponse(response *http.Response, failure string) {
+	if e == nil {
+		return
+	}
+
+	e.response, e.failure = response, failure
+	if response != nil && response.Request != nil {
+		// This is the request as it was last sent, e.g. with the answer to a Digest challenge.
+		e.request = response.Request
+	}
+	if response == nil {
+		e.timer.mu.Lock()
+		e.timer.end = time.Now()
+		e.timer.mu.Unlock()
+	}
+}
+
+// setResponseBody records the body of the response, as read.
+func (e *exchange) setResponseBody(body []byte, truncated bool) {
+	if e == nil {
+		return
+	}
+
+	e.responseBody, e.truncated = body, truncated
+	e.timer.mu.Lock()
+	e.timer.end = time.Now()
+	e.timer.mu.Unlock()
+}
+
+// harEntry converts the exchange into a HAR entry, redacting it under p.
+func (e *exchange) harEntry(p *policy) harEntry {
+	host := e.request.URL.Hostname()
+	redactedURL := *e.request.URL
+	redactedURL.User = nil
+
+	entry := harEntry{
+		StartedDateTime: e.startedAt,
+		Request: harRequest{
+			Method:      e.request.Method,
+			URL:         p.redactor.RedactString(redactedURL.String()),
+			HTTPVersion: "HTTP/1.1",
+			Headers:     harHeaders(p, host, requestHeaders(e.request)),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(e.requestBody),
+		},
+		Response: harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+	}
+	entry.Timings, entry.Time, entry.ServerIPAddress = e.timer.timings()
+
+	entry.Request.Cookies = harCookies((&http.Request{Header: harHeaderMap(entry.Request.Headers)}).Cookies())
+	for name, values := range e.request.URL.Query() {
+		for _, value := range values {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: p.redactor.RedactString(value)})
+		}
+	}
+	sort.SliceStable(entry.Request.QueryString, func(i, j int) bool { return entry.Request.QueryString[i].Name < entry.Request.QueryString[j].Name })
+	if e.requestBody != nil {
+		entry.Request.PostData = &harPostData{
+			MimeType: e.request.Header.Get("Content-Type"),
+			Text:     string(p.redactor.RedactBody(host, e.requestBody)),
+		}
+	}
+
+	if e.response == nil {
+		// HAR records requests that got no response with a status of 0.
+		entry.Response.HTTPVersion = "HTTP/1.1"
+		entry.Response.Comment = e.failure
+		return entry
+	}
+
+	response := &entry.Response
+	response.Status = e.response.StatusCode
+	response.StatusText = strings.TrimSpace(strings.TrimPrefix(e.response.Status, fmt.Sprint(e.response.StatusCode)))
+	response.HTTPVersion = e.response.Proto
+	response.Headers = harHeaders(p, host, e.response.Header)
+	response.Cookies = harCookies((&http.Response{Header: harHeaderMap(response.Headers)}).Cookies())
+	response.RedirectURL = p.redactor.RedactString(e.response.Header.Get("Location"))
+	response.BodySize = len(e.responseBody)
+
+	body := p.redactor.RedactBody(host, e.responseBody)
+	response.Content = harContent{Size: len(body), MimeType: e.response.Header.Get("Content-Type")}
+	if response.Content.MimeType == "" {
+		response.Content.MimeType = "application/octet-stream"
+	}
+	if utf8.Valid(body) {
+		response.Content.Text = string(body)
+	} else {
+		response.Content.Text = base64.StdEncoding.EncodeToString(body)
+		response.Content.Encoding = "base64"
+	}
+	if e.truncated {
+		response.Content.Comment = "The response was truncated to the maximum response size."
+	}
+	return entry
+}
+
+// requestHeaders returns the headers of request as sent, including the Host header.
+func requestHeaders(request *http.Request) http.Header {
+	headers := request.Header.Clone()
+	if headers.Get("Host") == "" {
+		headers.Set("Host", requestHost(request))
+	}
+
+	return headers
+}
+
+// credentialHeaders are always redacted from recordings, keeping only the authentication scheme.
+var credentialHeaders = map[string]bool{"Authorization": true, "Proxy-Authorization": true}
+
+// harHeaders converts headers to HAR, sorted by name and redacted.
+func harHeaders(p *policy, host string, headers http.Header) []harNameValue {
+	values := []harNameValue{}
+	for name, headerValues := range headers {
+		for _, value := range headerValues {
+			if credentialHeaders[http.CanonicalHeaderKey(name)] {
+				scheme, _, _ := strings.Cut(value, " ")
+				value = strings.TrimSpace(scheme + " " + DefaultRedactionReplacement)
+			}
+			values = append(values, harNameValue{Name: name, Value: p.redactor.redactHeader(host, name, value)})
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool { return values[i].Name < values[j].Name })
+
+	return values
+}
+
+func harHeaderMap(values []harNameValue) http.Header {
+	headers := http.Header{}
+	for _, value := range values {
+		headers.Add(value.Name, value.Value)
+	}
+
+	return headers
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	values := []harNameValue{}
+	for _, cookie := range cookies {
+		values = append(values, harNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+
+	return values
+}
+
+// recording is the exchanges recorded in a session so far.
+type recording struct {
+	mu sync.Mutex
+	// tokenKey identifies the access token the recording was started with (see
+	// recordingTokenKey).
+	tokenKey   string
+	info       RecordingInfo
+	maxEntries int
+	maxSize    int64
+	entries    []harEntry
+}
+
+// add adds the exchange to the recording, redacted under p, unless the recording is full.
+func (r *recording) add(p *policy, e *exchange) {
+	if r == nil || e == nil {
+		return
+	}
+
+	size := int64(len(e.requestBody) + len(e.responseBody))
+	entry := e.harEntry(p)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) >= r.maxEntries || r.info.Size+size > r.maxSize {
+		r.info.Dropped++
+		return
+	}
+	r.entries = append(r.entries, entry)
+	r.info.Entries = len(r.entries)
+	r.info.Size += size
+}
+
+func (r *recording) status() RecordingInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.info
+}
+
+// write writes the recording to a HAR file in the recordings folder of the data directory, and
+// marks it as stopped.
+func (r *recording) write(version string) (RecordingInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	file := harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "Proxyscotch", Version: version},
+		Entries: r.entries,
+	}}
+	if file.Log.Entries == nil {
+		file.Log.Entries = []harEntry{}
+	}
+	if r.info.Dropped > 0 {
+		file.Log.Comment = fmt.Sprintf("%d later exchanges were left out, as the recording was full.", r.info.Dropped)
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return r.info, err
+	}
+
+	dir := filepath.Join(GetOrCreateDataPath(), "recordings")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return r.info, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s-%s.har", r.info.StartedAt.Format("20060102-150405"), safeFileName(r.info.Session), r.info.ID[:8]))
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return r.info, err
+	}
+
+	r.info.Recording = false
+	r.info.File = path
+	return r.info, nil
+}
+
+// safeFileName returns name with anything but letters, digits, dashes and underscores removed,
+// for use in a file name.
+func safeFileName(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return -1
+	}, name)
+	if len(safe) > 32 {
+		safe = safe[:32]
+	}
+	if safe == "" {
+		return "session"
+	}
+
+	return safe
+}
+
+// recordings are the recordings in progress, by the key of their session (see recordingKey).
+// They live as long as the proxy, across configuration reloads.
+type recordings struct {
+	mu       sync.Mutex
+	sessions map[string]*recording
+}
+
+func recordingKey(accessToken string, session string) string {
+	key := sha256.Sum256([]byte(accessToken + "\x00" + session))
+	return hex.EncodeToString(key[:])
+}
+
+// recordingTokenKey identifies the recordings made with an access token, which are limited in
+// number.
+func recordingTokenKey(accessToken string) string {
+	key := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(key[:])
+}
+
+func (rs *recordings) get(key string) *recording {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.sessions[key]
+}
+
+// start starts recording the session with the given key, unless it already is. It fails if as
+// many recordings as config allows are already in progress with the access token.
+func (rs *recordings) start(key string, tokenKey string, session string, config RecordingConfig) (*recording, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if r, ok := rs.sessions[key]; ok {
+		return r, nil
+	}
+	maxEntries, maxPerToken, maxSize := config.MaxEntries, config.MaxPerToken, int64(config.MaxSize)
+	if maxEntries <= 0 {
+		maxEntries = defaultMaxRecordingEntries
+	}
+	if maxPerToken <= 0 {
+		maxPerToken = defaultMaxRecordingsPerToken
+	}
+	if maxSize <= 0 {
+		maxSize = defaultMaxRecordingSize
+	}
+	inProgress := 0
+	for _, r := range rs.sessions {
+		if r.tokenKey == tokenKey {
+			inProgress++
+		}
+	}
+	if inProgress >= maxPerToken {
+		return nil, fmt.Errorf("at most %d recordings may be in progress at once", maxPerToken)
+	}
+	if rs.sessions == nil {
+		rs.sessions = map[string]*recording{}
+	}
+
+	r := &recording{tokenKey: tokenKey, maxEntries: maxEntries, maxSize: maxSize, info: RecordingInfo{
+		ID:        uuid.New().String(),
+		Session:   session,
+		StartedAt: time.Now(),
+		Recording: true,
+	}}
+	rs.sessions[key] = r
+	return r, nil
+}
+
+// remove stops the recording with the given key, or if key is empty, the one with the given ID.
+func (rs *recordings) remove(key string, id string) *recording {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for k, r := range rs.sessions {
+		if k == key || (key == "" && r.info.ID == id) {
+			delete(rs.sessions, k)
+			return r
+		}
+	}
+
+	return nil
+}
+
+func (rs *recordings) list() []RecordingInfo {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	list := []RecordingInfo{}
+	for _, r := range rs.sessions {
+		list = append(list, r.status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+// recordingFor returns the recording of the session the request belongs to, or nil if it isn't
+// being recorded.
+func (proxy *Proxy) recordingFor(p *policy, requestData Request) *recording {
+	if !p.config.Recording.Enabled {
+		return nil
+	}
+
+	return proxy.recordings.get(recordingKey(requestData.AccessToken, requestData.Session))
+}
+
+// stopRecording stops the recording with the given key (or ID) and writes it to a file.
+func (proxy *Proxy) stopRecording(key string, id string) (RecordingInfo, error) {
+	r := proxy.recordings.remove(key, id)
+	if r == nil {
+		return RecordingInfo{}, errors.New("no recording is in progress")
+	}
+
+	proxy.serverMu.Lock()
+	version := proxy.versionName
+	proxy.serverMu.Unlock()
+
+	info, err := r.write(version)
+	if err != nil {
+		return info, err
+	}
+	log.Printf("A recording of %d exchanges was written to %s.", info.Entries, info.File)
+	return info, nil
+}
+
+// Recordings returns the recordings in progress.
+func (proxy *Proxy) Recordings() []RecordingInfo {
+	return proxy.recordings.list()
+}
+
+// StopRecording stops the recording with the given ID and writes it to a HAR file.
+func (proxy *Proxy) StopRecording(id string) (RecordingInfo, error) {
+	return proxy.stopRecording("", id)
+}
+
+// stopRecordings writes every recording in progress, e.g. as the proxy shuts down.
+func (proxy *Proxy) stopRecordings() {
+	for _, info := range proxy.recordings.list() {
+		if _, err := proxy.stopRecording("", info.ID); err != nil {
+			log.Printf("Failed to write a recording: %v", err)
+		}
+	}
+}
+
+// recordingHandler starts, stops or reports on the recording of the client's session.
+func (proxy *Proxy) recordingHandler(response http.ResponseWriter, request *http.Request) {
+	p := proxy.policyFor(request)
+	if !p.handleCORS(response, request) {
+		return
+	}
+
+	response.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if request.Method != "POST" {
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		writeErrorBody(response, errorData{Message: "(Proxy Error) Method not allowed."})
+		return
+	}
+
+	var recordingRequest RecordingRequest
+	if err := json.NewDecoder(io.LimitReader(request.Body, 1<<20)).Decode(&recordingRequest); err != nil {
+		_, _ = fmt.Fprintln(response, ErrorBodyInvalidRequest)
+		return
+	}
+	if !p.isAllowedAccessToken(recordingRequest.AccessToken) {
+		log.Print("An unauthorized request was made.")
+		accessLogEntryFor(response).DeniedBy = "token"
+		_, _ = fmt.Fprintln(response, "{\"success\": false, \"data\":{\"message\":\"(Proxy Error) Unauthorized request; you may need to set your access token in Settings.\"}}")
+		return
+	}
+	if !p.config.Recording.Enabled {
+		writeErrorBody(response, errorData{Message: "(Proxy Error) Recording is disabled on this proxy.", Code: ErrorCodeRecordingFailed})
+		return
+	}
+
+	key := recordingKey(recordingRequest.AccessToken, recordingRequest.Session)
+	var info RecordingInfo
+	switch recordingRequest.Action {
+	case "start":
+		r, err := proxy.recordings.start(key, recordingTokenKey(recordingRequest.AccessToken), recordingRequest.Session, p.config.Recording)
+		if err != nil {
+			log.Print("Failed to start a recording: ", err)
+			writeErrorBody(response, errorData{Message: "(Proxy Error) Failed to start recording: " + err.Error() + ".", Code: ErrorCodeRecordingFailed})
+			return
+		}
+		info = r.status()
+	case "stop":
+		var err error
+		if info, err = proxy.stopRecording(key, ""); err != nil {
+			log.Print("Failed to write a recording: ", err)
+			writeErrorBody(response, errorData{Message: "(Proxy Error) Failed to stop recording: " + err.Error() + ".", Code: ErrorCodeRecordingFailed})
+			return
+		}
+		// Only the name of the file is returned; the client needn't know where the data directory
+		// is.
+		info.File = filepath.Base(info.File)
+	case "", "status":
+		if r := proxy.recordings.get(key); r != nil {
+			info = r.status()
+		} else {
+			info = RecordingInfo{Session: recordingRequest.Session}
+		}
+	default:
+		_, _ = fmt.Fprintln(response, ErrorBodyInvalidRequest)
+		return
+	}
+
+	_ = json.NewEncoder(response).Encode(struct {
+		Success bool          `json:"success"`
+		Data    RecordingInfo `json:"data"`
+	}{true, info})
+}
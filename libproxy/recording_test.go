@@ -0,0 +1,175 @@
+package libproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postRecording(proxy *Proxy, request RecordingRequest) (RecordingInfo, errorData) {
+	body, _ := json.Marshal(request)
+	httpRequest := httptest.NewRequest("POST", "/recording", bytes.NewReader(body))
+	httpRequest.Header.Set("Origin", "https://hoppscotch.io")
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, httpRequest)
+
+	var result struct {
+		Success bool            `json:"success"`
+		Data    json.RawMessage `json:"data"`
+	}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &result)
+	var info RecordingInfo
+	var failure errorData
+	if result.Success {
+		_ = json.Unmarshal(result.Data, &info)
+	} else {
+		_ = json.Unmarshal(result.Data, &failure)
+	}
+	return info, failure
+}
+
+func readHAR(t *testing.T, path string) harFile {
+	t.Cleanup(func() { _ = os.Remove(path) })
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+
+	var har harFile
+	assert.Nil(t, json.Unmarshal(data, &har))
+	return har
+}
+
+func TestRecording(t *testing.T) {
+	proxy, err := New(Options{Config: Config{
+		AccessToken:    "token",
+		AllowedOrigins: []string{"*"},
+		BannedOutputs:  []string{"hunter2"},
+		Recording:      RecordingConfig{Enabled: true},
+	}})
+	assert.Nil(t, err)
+
+	info, _ := postRecording(proxy, RecordingRequest{AccessToken: "token", Session: "alice", Action: "start"})
+	assert.True(t, info.Recording)
+	assert.Equal(t, "alice", info.Session)
+
+	// the wrong access token doesn't see the recording
+	_, failure := postRecording(proxy, RecordingRequest{AccessToken: "wrong", Session: "alice", Action: "stop"})
+	assert.Contains(t, failure.Message, "Unauthorized")
+
+	resp := getResultFrom(proxy, Request{
+		AccessToken: "token",
+		Session:     "alice",
+		Method:      "POST",
+		Url:         testServerUrl + "/post?page=2",
+		Headers:     map[string]string{"Authorization": "Bearer abc123", "Content-Type": "application/json"},
+		Data:        `{"password":"hunter2"}`,
+	}, "https://hoppscotch.io")
+	assert.Equal(t, 200, resp.requestResponse.Status)
+	// other sessions aren't recorded
+	getResultFrom(proxy, Request{AccessToken: "token", Session: "bob", Method: "GET", Url: testServerUrl + "/get"}, "https://hoppscotch.io")
+
+	info, _ = postRecording(proxy, RecordingRequest{AccessToken: "token", Session: "alice"})
+	assert.True(t, info.Recording)
+	assert.Equal(t, 1, info.Entries)
+
+	info, _ = postRecording(proxy, RecordingRequest{AccessToken: "token", Session: "alice", Action: "stop"})
+	assert.False(t, info.Recording)
+	assert.Equal(t, filepath.Base(info.File), info.File)
+	har := readHAR(t, filepath.Join(GetOrCreateDataPath(), "recordings", info.File))
+
+	assert.Equal(t, "1.2", har.Log.Version)
+	assert.Equal(t, "Proxyscotch", har.Log.Creator.Name)
+	assert.Len(t, har.Log.Entries, 1)
+	entry := har.Log.Entries[0]
+
+	headers := map[string]string{}
+	for _, header := range entry.Request.Headers {
+		headers[header.Name] = header.Value
+	}
+	assert.Equal(t, "POST", entry.Request.Method)
+	assert.Equal(t, testServerUrl+"/post?page=2", entry.Request.URL)
+	assert.Equal(t, []harNameValue{{Name: "page", Value: "2"}}, entry.Request.QueryString)
+	assert.Equal(t, "Proxyscotch/1.1", headers["Via"])
+	assert.Equal(t, "192.0.2.1:1234", headers["X-Forwarded-For"])
+	assert.Equal(t, "Bearer [redacted]", headers["Authorization"])
+	assert.Equal(t, `{"password":"[redacted]"}`, entry.Request.PostData.Text)
+	assert.Equal(t, "application/json", entry.Request.PostData.MimeType)
+
+	assert.Equal(t, 200, entry.Response.Status)
+	assert.Equal(t, "OK", entry.Response.StatusText)
+	assert.Equal(t, "application/json; charset=utf-8", entry.Response.Content.MimeType)
+	assert.Contains(t, entry.Response.Content.Text, "[redacted]")
+	assert.NotContains(t, entry.Response.Content.Text, "hunter2")
+
+	assert.Greater(t, entry.Time, 0.0)
+	assert.GreaterOrEqual(t, entry.Timings.Wait, 0.0)
+	assert.GreaterOrEqual(t, entry.Timings.Connect, 0.0)
+	assert.Equal(t, -1.0, entry.Timings.SSL)
+	assert.Equal(t, "127.0.0.1", entry.ServerIPAddress)
+
+	// there is nothing left to stop
+	_, failure = postRecording(proxy, RecordingRequest{AccessToken: "token", Session: "alice", Action: "stop"})
+	assert.Equal(t, ErrorCodeRecordingFailed, failure.Code)
+}
+
+func TestRecordingFailedRequest(t *testing.T) {
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, Recording: RecordingConfig{Enabled: true, MaxEntries: 1}}})
+	assert.Nil(t, err)
+
+	postRecording(proxy, RecordingRequest{Action: "start"})
+	getResultFrom(proxy, Request{Method: "GET", Url: "http://localhost:1/"}, "https://hoppscotch.io")
+	getResultFrom(proxy, Request{Method: "GET", Url: testServerUrl + "/get"}, "https://hoppscotch.io")
+
+	// the admin API lists and stops recordings too
+	client := proxy.LocalAdminClient()
+	recordings, err := client.Recordings()
+	assert.Nil(t, err)
+	assert.Len(t, recordings, 1)
+	assert.Equal(t, 1, recordings[0].Entries)
+	assert.Equal(t, 1, recordings[0].Dropped)
+
+	info, err := client.StopRecording(recordings[0].ID)
+	assert.Nil(t, err)
+	har := readHAR(t, info.File)
+	assert.Contains(t, har.Log.Comment, "1 later exchanges were left out")
+	assert.Equal(t, 0, har.Log.Entries[0].Response.Status)
+	assert.Contains(t, har.Log.Entries[0].Response.Comment, "connection refused")
+
+	_, err = client.StopRecording(recordings[0].ID)
+	assert.Equal(t, ErrorCodeRecordingFailed, err.(*AdminError).Code)
+}
+
+func TestRecordingDisabled(t *testing.T) {
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}}})
+	assert.Nil(t, err)
+
+	_, failure := postRecording(proxy, RecordingRequest{Action: "start"})
+	assert.Equal(t, ErrorCodeRecordingFailed, failure.Code)
+}
+
+func TestRecordingLimits(t *testing.T) {
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, Recording: RecordingConfig{Enabled: true, MaxPerToken: 1, MaxSize: 16}}})
+	assert.Nil(t, err)
+	defer func() {
+		proxy.recordings.remove(recordingKey("a", "alice"), "")
+		proxy.recordings.remove(recordingKey("b", "bob"), "")
+	}()
+
+	// only so many recordings may be in progress with an access token
+	_, failure := postRecording(proxy, RecordingRequest{AccessToken: "a", Session: "alice", Action: "start"})
+	assert.Empty(t, failure.Code)
+	_, failure = postRecording(proxy, RecordingRequest{AccessToken: "a", Session: "bob", Action: "start"})
+	assert.Equal(t, ErrorCodeRecordingFailed, failure.Code)
+	_, failure = postRecording(proxy, RecordingRequest{AccessToken: "b", Session: "bob", Action: "start"})
+	assert.Empty(t, failure.Code)
+
+	// and exchanges whose bodies don't fit in the recording are left out
+	getResultFrom(proxy, Request{AccessToken: "a", Session: "alice", Method: "POST", Url: testServerUrl + "/anything", Data: "more than sixteen bytes"}, "https://hoppscotch.io")
+	info, _ := postRecording(proxy, RecordingRequest{AccessToken: "a", Session: "alice"})
+	assert.Equal(t, 0, info.Entries)
+	assert.Equal(t, 1, info.Dropped)
+}
@@ -0,0 +1,398 @@
+package libproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultRedactionReplacement is the text redacted values are replaced with.
+const DefaultRedactionReplacement = "[redacted]"
+
+// RedactionRule describes a value to redact from responses (and from anything proxyscotch logs
+// or records). Exactly one of Literal, Pattern, JSONPath, Header or Detector should be set.
+type RedactionRule struct {
+	// Name is an optional human-readable name for the rule.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Hosts restricts the rule to requests made to the given destination hosts. A leading "*."
+	// matches any subdomain. If empty, the rule applies to every destination.
+	Hosts []string `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+
+	// Literal redacts every occurrence of the given string.
+	Literal string `json:"literal,omitempty" yaml:"literal,omitempty"`
+	// Pattern redacts every match of the given regular expression. If the pattern contains a
+	// group named "secret", only that group is redacted.
+	Pattern string `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+	// JSONPath redacts the value(s) at the given path in JSON bodies, e.g. "$.user.password" or
+	// "$.items[*].token". Responses with a redacted JSON path are re-encoded.
+	JSONPath string `json:"jsonPath,omitempty" yaml:"jsonPath,omitempty"`
+	// Header redacts the entire value of the named header.
+	Header string `json:"header,omitempty" yaml:"header,omitempty"`
+	// Detector redacts values found by one of the built-in detectors (see RedactionDetectors).
+	Detector string `json:"detector,omitempty" yaml:"detector,omitempty"`
+
+	// Replacement is the text to replace redacted values with. Defaults to "[redacted]".
+	Replacement string `json:"replacement,omitempty" yaml:"replacement,omitempty"`
+}
+
+// RedactionDetectors are the names of the built-in detectors that may be used in
+// RedactionRule.Detector.
+var RedactionDetectors = []string{"aws-access-key", "aws-secret-key", "jwt", "credit-card"}
+
+var detectorPatterns = map[string]*regexp.Regexp{
+	"aws-access-key": regexp.MustCompile(`\b(?:AKIA|ASIA|AGPA|AIDA|AROA|AIPA|ANPA|ANVA)[A-Z0-9]{16}\b`),
+	"aws-secret-key": regexp.MustCompile(`(?i)(?:aws_?secret_?(?:access_?)?key|secretAccessKey)["']?\s*[:=]\s*["']?(?P<secret>[A-Za-z0-9/+=]{40})\b`),
+	"jwt":            regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	"credit-card":    regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+}
+
+// detectorValidators further check matches of a detector's pattern, to avoid false positives.
+var detectorValidators = map[string]func([]byte) bool{
+	"credit-card": isLuhnValid,
+}
+
+// isLuhnValid returns true if the digits in number pass the Luhn checksum used by payment card
+// numbers. Any non-digit characters (i.e. separators) are ignored.
+func isLuhnValid(number []byte) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		if number[i] < '0' || number[i] > '9' {
+			continue
+		}
+
+		digit := int(number[i] - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+
+	return sum%10 == 0
+}
+
+type compiledRule struct {
+	RedactionRule
+	pattern  *regexp.Regexp
+	validate func([]byte) bool
+	path     []string
+}
+
+// appliesTo returns true if the rule applies to requests made to host. An empty host (e.g. for
+// log lines that aren't associated with a destination) matches every rule.
+func (r *compiledRule) appliesTo(host string) bool {
+	if len(r.Hosts) == 0 || host == "" {
+		return true
+	}
+
+	for _, h := range r.Hosts {
+		if hostMatches(h, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hostMatches returns true if host is pattern, or a subdomain of it if pattern starts with "*.".
+func hostMatches(pattern string, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+	return pattern == host || (strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]))
+}
+
+// redactContent applies a literal, pattern or detector rule to data.
+func (r *compiledRule) redactContent(data []byte) []byte {
+	replacement := []byte(r.Replacement)
+	if r.Literal != "" {
+		return bytes.ReplaceAll(data, []byte(r.Literal), replacement)
+	}
+	if r.pattern == nil {
+		return data
+	}
+
+	// Only the secret group is redacted, if there is one and it took part in the match.
+	// Otherwise, the whole match is.
+	secret := r.pattern.SubexpIndex("secret")
+	matches := r.pattern.FindAllSubmatchIndex(data, -1)
+	if len(matches) == 0 {
+		return data
+	}
+	redacted := make([]byte, 0, len(data))
+	last := 0
+	for _, groups := range matches {
+		if r.validate != nil && !r.validate(data[groups[0]:groups[1]]) {
+			continue
+		}
+		start, end := groups[0], groups[1]
+		if secret >= 0 && groups[2*secret] >= 0 {
+			start, end = groups[2*secret], groups[2*secret+1]
+		}
+		redacted = append(redacted, data[last:start]...)
+		redacted = append(redacted, replacement...)
+		last = end
+	}
+
+	return append(redacted, data[last:]...)
+}
+
+// Redactor applies a set of redaction rules to response bodies, headers and log output.
+type Redactor struct {
+	rules []compiledRule
+}
+
+// NewRedactor compiles rules into a Redactor.
+func NewRedactor(rules []RedactionRule) (*Redactor, error) {
+	redactor := &Redactor{}
+	for i, rule := range rules {
+		compiled := compiledRule{RedactionRule: rule}
+		if compiled.Replacement == "" {
+			compiled.Replacement = DefaultRedactionReplacement
+		}
+
+		name := rule.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i+1)
+		}
+
+		switch {
+		case rule.Literal != "":
+		case rule.Header != "":
+		case rule.Pattern != "":
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("redaction rule %s: invalid pattern: %w", name, err)
+			}
+			compiled.pattern = pattern
+		case rule.Detector != "":
+			pattern, ok := detectorPatterns[rule.Detector]
+			if !ok {
+				return nil, fmt.Errorf("redaction rule %s: unknown detector %q (must be one of %s)", name, rule.Detector, strings.Join(RedactionDetectors, ", "))
+			}
+			compiled.pattern = pattern
+			compiled.validate = detectorValidators[rule.Detector]
+		case rule.JSONPath != "":
+			path, err := parseJSONPath(rule.JSONPath)
+			if err != nil {
+				return nil, fmt.Errorf("redaction rule %s: %w", name, err)
+			}
+			compiled.path = path
+		default:
+			return nil, fmt.Errorf("redaction rule %s: one of literal, pattern, jsonPath, header or detector must be set", name)
+		}
+
+		redactor.rules = append(redactor.rules, compiled)
+	}
+
+	return redactor, nil
+}
+
+// LoadRedactionRules reads a JSON array of redaction rules from the file at path.
+func LoadRedactionRules(path string) ([]RedactionRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []RedactionRule
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse redaction rules %s: %w", path, err)
+	}
+
+	return rules, nil
+}
+
+// LiteralRedactionRules returns a literal rule for each of values.
+func LiteralRedactionRules(values []string) []RedactionRule {
+	rules := make([]RedactionRule, 0, len(values))
+	for _, value := range values {
+		if value != "" {
+			rules = append(rules, RedactionRule{Literal: value})
+		}
+	}
+
+	return rules
+}
+
+// RedactBody redacts a response body received from host.
+func (r *Redactor) RedactBody(host string, body []byte) []byte {
+	if r == nil {
+		return body
+	}
+
+	hasPaths := false
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if !rule.appliesTo(host) {
+			continue
+		}
+		if rule.path != nil {
+			hasPaths = true
+			continue
+		}
+		body = rule.redactContent(body)
+	}
+
+	if hasPaths {
+		body = r.redactJSONPaths(host, body)
+	}
+
+	return body
+}
+
+// redactJSONPaths redacts the JSON path rules for host from body. If the body isn't JSON, or
+// none of the paths matched, the body is returned unmodified.
+func (r *Redactor) redactJSONPaths(host string, body []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var document interface{}
+	if decoder.Decode(&document) != nil {
+		return body
+	}
+
+	redacted := false
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if rule.path != nil && rule.appliesTo(host) {
+			document = redactJSONPath(document, rule.path, rule.Replacement, &redacted)
+		}
+	}
+	if !redacted {
+		return body
+	}
+
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		return body
+	}
+
+	return encoded
+}
+
+// RedactHeaders redacts the values of headers received from host, in place.
+func (r *Redactor) RedactHeaders(host string, headers map[string]string) {
+	if r == nil {
+		return
+	}
+
+	for name, value := range headers {
+		headers[name] = r.redactHeader(host, name, value)
+	}
+}
+
+// redactHeader redacts the value of the header name sent to or received from host.
+func (r *Redactor) redactHeader(host string, name string, value string) string {
+	if r == nil {
+		return value
+	}
+
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if !rule.appliesTo(host) || rule.path != nil {
+			continue
+		}
+
+		if rule.Header != "" {
+			if strings.EqualFold(rule.Header, name) {
+				value = rule.Replacement
+			}
+			continue
+		}
+		value = string(rule.redactContent([]byte(value)))
+	}
+
+	return value
+}
+
+// RedactString redacts a string, such as a log line, that isn't associated with a specific
+// destination. Every content rule is applied, regardless of its hosts.
+func (r *Redactor) RedactString(value string) string {
+	if r == nil {
+		return value
+	}
+
+	data := []byte(value)
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if rule.path == nil && rule.Header == "" {
+			data = rule.redactContent(data)
+		}
+	}
+
+	return string(data)
+}
+
+// parseJSONPath parses a path of the form "$.a.b[0].c" or "$.items[*].token" into segments,
+// where "*" matches every array element or object member.
+func parseJSONPath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("invalid JSON path %q: must start with $", path)
+	}
+
+	var segments []string
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid JSON path %q: empty member name", path)
+			}
+			segments = append(segments, rest[1:end+1])
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSON path %q: unterminated [", path)
+			}
+			segments = append(segments, strings.Trim(rest[1:end], `'"`))
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid JSON path %q: unexpected %q", path, rest[0])
+		}
+	}
+
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("invalid JSON path %q: the root document cannot be redacted", path)
+	}
+
+	return segments, nil
+}
+
+// redactJSONPath replaces the value(s) at path within node with replacement, setting redacted if
+// anything was replaced.
+func redactJSONPath(node interface{}, path []string, replacement string, redacted *bool) interface{} {
+	if len(path) == 0 {
+		*redacted = true
+		return replacement
+	}
+
+	segment := path[0]
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if segment == "*" || segment == key {
+				value[key] = redactJSONPath(child, path[1:], replacement, redacted)
+			}
+		}
+	case []interface{}:
+		for index, child := range value {
+			if segment == "*" || segment == strconv.Itoa(index) {
+				value[index] = redactJSONPath(child, path[1:], replacement, redacted)
+			}
+		}
+	}
+
+	return node
+}
@@ -0,0 +1,250 @@
+package libproxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultRetryBackoff and defaultRetryMaxBackoff are used if RetryPolicy.Backoff and
+	// RetryPolicy.MaxBackoff aren't set.
+	defaultRetryBackoff    = Duration(200 * time.Millisecond)
+	defaultRetryMaxBackoff = Duration(10 * time.Second)
+	// maxRetryAttempts caps RetryPolicy.MaxAttempts, so that a client can't make the proxy send
+	// a request indefinitely.
+	maxRetryAttempts = 10
+)
+
+// defaultRetryStatuses are the statuses retried if RetryPolicy.Statuses isn't set.
+var defaultRetryStatuses = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// idempotentMethods are the methods of requests that may be sent more than once with the same
+// effect (RFC 9110 section 9.2.2).
+var idempotentMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodOptions: true, http.MethodTrace: true, http.MethodPut: true, http.MethodDelete: true,
+}
+
+// RetryPolicy configures how requests whose destination fails, or couldn't be reached, are sent
+// again.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request may be sent, including the first (at most 10).
+	// Requests aren't retried if it is 0 or 1.
+	MaxAttempts int `json:"maxAttempts,omitempty" yaml:"maxAttempts,omitempty"`
+	// Backoff is the delay before the first retry, which doubles for each retry after it. A random
+	// jitter of up to half the delay is taken off. Defaults to 200ms.
+	Backoff Duration `json:"backoff,omitempty" yaml:"backoff,omitempty"`
+	// MaxBackoff caps the delay between attempts. A response whose Retry-After header asks for a
+	// longer delay isn't retried. Defaults to 10s.
+	MaxBackoff Duration `json:"maxBackoff,omitempty" yaml:"maxBackoff,omitempty"`
+	// Statuses are the statuses of the responses that are retried, in addition to requests that
+	// failed without a response. Defaults to 429, 502, 503 and 504.
+	Statuses []int `json:"statuses,omitempty" yaml:"statuses,omitempty"`
+	// NonIdempotent retries requests whose method isn't idempotent, such as POST, too. Requests
+	// with an Idempotency-Key header are always retried.
+	NonIdempotent bool `json:"nonIdempotent,omitempty" yaml:"nonIdempotent,omitempty"`
+}
+
+// RetryAttempt describes one attempt at sending a request.
+type RetryAttempt struct {
+	// Status is the status of the response, or 0 if the attempt failed without one.
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Duration is how long the attempt took, and Delay how long the proxy then waited before the
+	// next one, in milliseconds.
+	Duration float64 `json:"durationMs"`
+	Delay    float64 `json:"delayMs,omitempty"`
+}
+
+func (r RetryPolicy) validate() error {
+	if r.MaxAttempts < 0 || r.MaxAttempts > maxRetryAttempts {
+		return fmt.Errorf("invalid retry max attempts %d: must be between 0 and %d", r.MaxAttempts, maxRetryAttempts)
+	}
+	if r.Backoff < 0 || r.MaxBackoff < 0 {
+		return errors.New("invalid retry backoff: must not be negative")
+	}
+	for _, status := range r.Statuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("invalid retry status %d", status)
+		}
+	}
+
+	return nil
+}
+
+// override returns the policy with the settings of request in place of its own, where they are
+// set. The request's delays are capped at the policy's maximum, so that a client can't hold a
+// request open for longer than the configuration allows.
+func (r RetryPolicy) override(request *RetryPolicy) RetryPolicy {
+	if request == nil {
+		return r
+	}
+
+	maxDelay := Duration(r.maxBackoff())
+	if request.MaxAttempts > 0 {
+		r.MaxAttempts = request.MaxAttempts
+	}
+	if request.Backoff > 0 {
+		r.Backoff = request.Backoff
+		if r.Backoff > maxDelay {
+			r.Backoff = maxDelay
+		}
+	}
+	if request.MaxBackoff > 0 {
+		r.MaxBackoff = request.MaxBackoff
+		if r.MaxBackoff > maxDelay {
+			r.MaxBackoff = maxDelay
+		}
+	}
+	if len(request.Statuses) > 0 {
+		r.Statuses = request.Statuses
+	}
+	r.NonIdempotent = r.NonIdempotent || request.NonIdempotent
+	if r.MaxAttempts > maxRetryAttempts {
+		r.MaxAttempts = maxRetryAttempts
+	}
+	return r
+}
+
+func (r RetryPolicy) retriesStatus(status int) bool {
+	statuses := r.Statuses
+	if len(statuses) == 0 {
+		statuses = defaultRetryStatuses
+	}
+	for _, retried := range statuses {
+		if status == retried {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r RetryPolicy) maxBackoff() time.Duration {
+	if r.MaxBackoff <= 0 {
+		return time.Duration(defaultRetryMaxBackoff)
+	}
+
+	return time.Duration(r.MaxBackoff)
+}
+
+// backoff returns the delay before the given retry (counting from 1).
+func (r RetryPolicy) backoff(retry int) time.Duration {
+	delay, maxDelay := time.Duration(r.Backoff), r.maxBackoff()
+	if delay <= 0 {
+		delay = time.Duration(defaultRetryBackoff)
+	}
+	for i := 1; i < retry && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryAfter returns the delay asked for by the Retry-After header of response, if it has one.
+func retryAfter(response *http.Response, now time.Time) (time.Duration, bool) {
+	value := response.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if delay, err := strconv.Atoi(value); err == nil && delay >= 0 {
+		return time.Duration(delay) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if date.Before(now) {
+			return 0, true
+		}
+		return date.Sub(now), true
+	}
+
+	return 0, false
+}
+
+// send sends request with send, and again after a delay while the destination fails and the
+// policy allows it. Each retry is a copy of request, which prepare (if not nil) is called with
+// before it is sent, e.g. to sign it again; if prepare fails, the outcome of the last attempt is
+// returned. send returns the history of the attempts, or nil if the request may only be sent
+// once.
+func (r RetryPolicy) send(p *policy, request *http.Request, prepare func(retry *http.Request) error, send func(request *http.Request) (*http.Response, error)) (*http.Response, []RetryAttempt, error) {
+	if r.MaxAttempts <= 1 || !(r.NonIdempotent || idempotentMethods[request.Method] || request.Header.Get("Idempotency-Key") != "") {
+		response, err := send(request)
+		return response, nil, err
+	}
+	// The body is sent again with each attempt.
+	if request.GetBody == nil {
+		if _, err := bufferBody(request); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var attempts []RetryAttempt
+	attempt := request
+	for {
+		start := time.Now()
+		response, err := send(attempt)
+		record := RetryAttempt{Duration: float64(time.Since(start)) / float64(time.Millisecond)}
+		if err != nil {
+			record.Error = p.redactedError(err)
+		} else {
+			record.Status = response.StatusCode
+		}
+		attempts = append(attempts, record)
+
+		// Failures caused by the client going away, or the proxy shutting down, aren't retried.
+		if len(attempts) >= r.MaxAttempts || request.Context().Err() != nil || (err == nil && !r.retriesStatus(response.StatusCode)) {
+			return response, attempts, err
+		}
+		delay := r.backoff(len(attempts))
+		if err == nil {
+			if after, ok := retryAfter(response, time.Now()); ok {
+				if after > r.maxBackoff() {
+					return response, attempts, nil
+				}
+				delay = after
+			}
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-request.Context().Done():
+			timer.Stop()
+			return response, attempts, err
+		case <-timer.C:
+		}
+
+		next, retryErr := cloneWithBody(request)
+		if retryErr == nil && prepare != nil {
+			retryErr = prepare(next)
+		}
+		if retryErr != nil {
+			log.Print("A request couldn't be retried: ", p.redactedError(retryErr))
+			return response, attempts, err
+		}
+		if response != nil {
+			discardResponse(response)
+		}
+		attempts[len(attempts)-1].Delay = float64(delay) / float64(time.Millisecond)
+		attempt = next
+	}
+}
+
+// cloneWithBody returns a copy of request with a new reader of its body.
+func cloneWithBody(request *http.Request) (*http.Request, error) {
+	clone := request.Clone(request.Context())
+	if request.GetBody != nil && request.Body != nil && request.Body != http.NoBody {
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+
+	return clone, nil
+}
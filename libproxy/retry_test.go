@@ -0,0 +1,170 @@
+package libproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFlakyBackend returns a server that answers the first failures requests with status, and
+// later ones with the body of the request. It counts the requests it receives.
+func newFlakyBackend(t *testing.T, failures int64, status int, retryAfter string) (*httptest.Server, *int64) {
+	var requests int64
+	backend := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if atomic.AddInt64(&requests, 1) <= failures {
+			if retryAfter != "" {
+				response.Header().Set("Retry-After", retryAfter)
+			}
+			response.WriteHeader(status)
+			return
+		}
+		body, _ := io.ReadAll(request.Body)
+		_, _ = response.Write(body)
+	}))
+	t.Cleanup(backend.Close)
+	return backend, &requests
+}
+
+func TestRetry(t *testing.T) {
+	backend, requests := newFlakyBackend(t, 2, http.StatusServiceUnavailable, "")
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, Retry: RetryPolicy{MaxAttempts: 3, Backoff: Duration(time.Millisecond)}}})
+	assert.Nil(t, err)
+
+	resp := getResultFrom(proxy, Request{Method: "PUT", Url: backend.URL, Data: "hello"}, "https://hoppscotch.io")
+	assert.Equal(t, 200, resp.requestResponse.Status)
+	// the body is sent again with each attempt
+	assert.Equal(t, "hello", resp.requestResponse.Data)
+	assert.Equal(t, int64(3), atomic.LoadInt64(requests))
+	assert.Len(t, resp.requestResponse.Attempts, 3)
+	assert.Equal(t, 503, resp.requestResponse.Attempts[0].Status)
+	assert.Greater(t, resp.requestResponse.Attempts[0].Delay, 0.0)
+	assert.Equal(t, 200, resp.requestResponse.Attempts[2].Status)
+	assert.Equal(t, 0.0, resp.requestResponse.Attempts[2].Delay)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	backend, requests := newFlakyBackend(t, 5, http.StatusBadGateway, "")
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, Retry: RetryPolicy{MaxAttempts: 2, Backoff: Duration(time.Millisecond)}}})
+	assert.Nil(t, err)
+
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: backend.URL}, "https://hoppscotch.io")
+	assert.Equal(t, 502, resp.requestResponse.Status)
+	assert.Len(t, resp.requestResponse.Attempts, 2)
+
+	// non-idempotent requests are only sent once
+	resp = getResultFrom(proxy, Request{Method: "POST", Url: backend.URL}, "https://hoppscotch.io")
+	assert.Empty(t, resp.requestResponse.Attempts)
+	assert.Equal(t, int64(3), atomic.LoadInt64(requests))
+
+	// unless they have an idempotency key, or the request allows it
+	resp = getResultFrom(proxy, Request{Method: "POST", Url: backend.URL, Headers: map[string]string{"Idempotency-Key": "abc"}}, "https://hoppscotch.io")
+	assert.Len(t, resp.requestResponse.Attempts, 2)
+	resp = getResultFrom(proxy, Request{Method: "POST", Url: backend.URL, Retry: &RetryPolicy{NonIdempotent: true, MaxAttempts: 3}}, "https://hoppscotch.io")
+	assert.Equal(t, 200, resp.requestResponse.Status)
+	assert.Len(t, resp.requestResponse.Attempts, 1)
+	assert.Equal(t, int64(6), atomic.LoadInt64(requests))
+}
+
+func TestRetryAfter(t *testing.T) {
+	backend, _ := newFlakyBackend(t, 1, http.StatusTooManyRequests, "1")
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, Retry: RetryPolicy{MaxAttempts: 2, Backoff: Duration(time.Millisecond)}}})
+	assert.Nil(t, err)
+
+	start := time.Now()
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: backend.URL}, "https://hoppscotch.io")
+	assert.Equal(t, 200, resp.requestResponse.Status)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	assert.Equal(t, 1000.0, resp.requestResponse.Attempts[0].Delay)
+
+	// a longer delay than the maximum backoff isn't waited for
+	backend, _ = newFlakyBackend(t, 1, http.StatusTooManyRequests, "60")
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: backend.URL, Retry: &RetryPolicy{MaxBackoff: Duration(time.Second)}}, "https://hoppscotch.io")
+	assert.Equal(t, 429, resp.requestResponse.Status)
+	assert.Len(t, resp.requestResponse.Attempts, 1)
+}
+
+func TestRetryNetworkErrors(t *testing.T) {
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}}})
+	assert.Nil(t, err)
+
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: "http://localhost:1/", Retry: &RetryPolicy{MaxAttempts: 3, Backoff: Duration(time.Millisecond)}}, "https://hoppscotch.io")
+	var body struct {
+		Success bool      `json:"success"`
+		Data    errorData `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(resp.proxyResponse.Body.Bytes(), &body))
+	assert.False(t, body.Success)
+	assert.Len(t, body.Data.Attempts, 3)
+	assert.Contains(t, body.Data.Attempts[2].Error, "connection refused")
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{Backoff: Duration(100 * time.Millisecond), MaxBackoff: Duration(time.Second)}
+	for retry, max := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		delay := policy.backoff(retry + 1)
+		assert.LessOrEqual(t, delay, max)
+		assert.GreaterOrEqual(t, delay, max/2)
+	}
+
+	// a request can't wait for longer than the configured maximum backoff
+	retry := policy.override(&RetryPolicy{Backoff: Duration(24 * time.Hour), MaxBackoff: Duration(24 * time.Hour)})
+	assert.Equal(t, Duration(time.Second), retry.Backoff)
+	assert.Equal(t, Duration(time.Second), retry.MaxBackoff)
+	retry = RetryPolicy{}.override(&RetryPolicy{MaxBackoff: Duration(time.Hour)})
+	assert.Equal(t, Duration(10*time.Second), retry.MaxBackoff)
+
+	_, err := New(Options{Config: Config{Retry: RetryPolicy{MaxAttempts: 11}}})
+	assert.NotNil(t, err)
+	_, err = New(Options{Config: Config{Retry: RetryPolicy{Statuses: []int{42}}}})
+	assert.NotNil(t, err)
+}
+
+func TestRetrySignsEachAttempt(t *testing.T) {
+	var authorizations []string
+	backend := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		authorizations = append(authorizations, request.Header.Get("Authorization"))
+		if len(authorizations) < 3 {
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, Retry: RetryPolicy{MaxAttempts: 3, Backoff: Duration(time.Millisecond)}}})
+	assert.Nil(t, err)
+
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: backend.URL, Auth: RequestAuth{Type: AuthTypeOAuth1, OAuth1: OAuth1Auth{ConsumerKey: "key", ConsumerSecret: "secret"}}}, "https://hoppscotch.io")
+	assert.Equal(t, 200, resp.requestResponse.Status)
+	// each attempt has a nonce and signature of its own, rather than replaying the first
+	assert.Len(t, authorizations, 3)
+	assert.NotEqual(t, authorizations[0], authorizations[1])
+	assert.NotEqual(t, authorizations[1], authorizations[2])
+	for _, authorization := range authorizations {
+		assert.Equal(t, 1, strings.Count(authorization, "oauth_signature="))
+	}
+}
+
+func TestRetryRateLimit(t *testing.T) {
+	backend, requests := newFlakyBackend(t, 5, http.StatusServiceUnavailable, "")
+	proxy, err := New(Options{Config: Config{
+		AllowedOrigins: []string{"*"},
+		Retry:          RetryPolicy{MaxAttempts: 5, Backoff: Duration(time.Millisecond)},
+		RateLimits:     RateLimits{PerDestination: RateLimit{Rate: 0.001, Burst: 2}},
+	}})
+	assert.Nil(t, err)
+
+	// each retry is charged to the destination's limit, and retrying stops once it is reached
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: backend.URL}, "https://hoppscotch.io")
+	assert.Equal(t, 503, resp.requestResponse.Status)
+	assert.Len(t, resp.requestResponse.Attempts, 2)
+	assert.Equal(t, int64(2), atomic.LoadInt64(requests))
+
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: backend.URL}, "https://hoppscotch.io")
+	assert.Equal(t, ErrorCodeRateLimited, getErrorBody(t, resp).Data.Code)
+	assert.Equal(t, int64(2), atomic.LoadInt64(requests))
+}
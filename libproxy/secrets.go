@@ -0,0 +1,535 @@
+package libproxy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// SecretsKeyEnvironmentVariable is the environment variable the master key of the default secret
+// store is read from. If it is unset, a key file in the data directory is used instead.
+const SecretsKeyEnvironmentVariable = "PROXYSCOTCH_SECRETS_KEY"
+
+// secretPlaceholder matches a reference to a secret, e.g. {{secret:prod_api_key}}.
+var secretPlaceholder = regexp.MustCompile(`\{\{secret:([^{}]*)\}\}`)
+
+// validSecretName matches the names secrets may be stored under.
+var validSecretName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ErrSecretNotFound is returned when a secret that doesn't exist is referenced or deleted.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// secretsFile is the format of the encrypted secret store. The secrets are a JSON object,
+// encrypted with AES-256-GCM under a key derived from the master key with scrypt.
+type secretsFile struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// secretsAdditionalData binds the ciphertext to the format version.
+var secretsAdditionalData = []byte("proxyscotch-secrets-v1")
+
+// storedSecret is a secret, and the destination hosts it may be sent to.
+type storedSecret struct {
+	Value string `json:"value"`
+	// Hosts are host names, or patterns such as *.example.com matching any subdomain. Secrets
+	// stored before hosts were required have none, and can't be sent anywhere until they're set.
+	Hosts []string `json:"hosts"`
+}
+
+// UnmarshalJSON reads a secret, which older stores kept as its bare value.
+func (s *storedSecret) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*s = storedSecret{}
+		return json.Unmarshal(data, &s.Value)
+	}
+
+	type secret storedSecret
+	return json.Unmarshal(data, (*secret)(s))
+}
+
+// allows returns true if the secret may be sent to host.
+func (s storedSecret) allows(host string) bool {
+	for _, pattern := range s.Hosts {
+		if hostMatches(pattern, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SecretStore is an encrypted file of named secrets, which requests can reference with
+// {{secret:name}} placeholders instead of sending the values themselves. Each secret may only be
+// sent to the destination hosts it is stored with. The file is re-read when it changes, so
+// secrets may be managed by another process while the proxy is running.
+type SecretStore struct {
+	path      string
+	masterKey func() ([]byte, error)
+
+	mu      sync.Mutex
+	secrets map[string]storedSecret
+	modTime time.Time
+	size    int64
+	// salt and key are those the store was last read or written with, so that the key isn't
+	// derived again unless the salt changes.
+	salt []byte
+	key  []byte
+}
+
+// NewSecretStore returns the store in the file at path, encrypted with the key returned by
+// masterKey. The file is created when the first secret is set.
+func NewSecretStore(path string, masterKey func() ([]byte, error)) *SecretStore {
+	return &SecretStore{path: path, masterKey: masterKey}
+}
+
+// DefaultSecretStore returns the store in secrets.enc in the data directory. Its master key is
+// read from the PROXYSCOTCH_SECRETS_KEY environment variable or, if that is unset, from
+// secrets.key in the data directory, which is generated if it doesn't exist.
+func DefaultSecretStore() *SecretStore {
+	dataDir := GetOrCreateDataPath()
+	return NewSecretStore(filepath.Join(dataDir, "secrets.enc"), func() ([]byte, error) {
+		if key, ok := os.LookupEnv(SecretsKeyEnvironmentVariable); ok && key != "" {
+			return []byte(key), nil
+		}
+
+		return readOrCreateKeyFile(filepath.Join(dataDir, "secrets.key"))
+	})
+}
+
+// readOrCreateKeyFile returns the key in the file at path, generating a random key if the file
+// doesn't exist. The file should only be readable by the user the proxy runs as.
+func readOrCreateKeyFile(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		return bytes.TrimSpace(key), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	key = []byte(base64.StdEncoding.EncodeToString(random))
+
+	// Don't overwrite a key written by another process in the meantime.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return readOrCreateKeyFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Write(key); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return key, file.Close()
+}
+
+// deriveKey derives the encryption key from the master key, unless it was already derived for
+// salt. The caller must hold s.mu.
+func (s *SecretStore) deriveKey(salt []byte) ([]byte, error) {
+	if s.key != nil && bytes.Equal(s.salt, salt) {
+		return s.key, nil
+	}
+
+	masterKey, err := s.masterKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the secrets master key: %w", err)
+	}
+	if len(masterKey) == 0 {
+		return nil, errors.New("the secrets master key is empty")
+	}
+
+	key, err := scrypt.Key(masterKey, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	s.salt, s.key = salt, key
+	return key, nil
+}
+
+// load reads the store, if it has changed since it was last read. The caller must hold s.mu.
+func (s *SecretStore) load() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.secrets = map[string]storedSecret{}
+		s.modTime, s.size = time.Time{}, -1
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.secrets != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	var file secretsFile
+	if err = json.Unmarshal(data, &file); err != nil || file.Version != 1 {
+		return fmt.Errorf("%s is not a valid secret store", s.path)
+	}
+
+	key, err := s.deriveKey(file.Salt)
+	if err != nil {
+		return err
+	}
+	aead, err := newSecretsCipher(key)
+	if err != nil {
+		return err
+	}
+	plaintext, err := aead.Open(nil, file.Nonce, file.Ciphertext, secretsAdditionalData)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s; the master key may be wrong", s.path)
+	}
+
+	secrets := map[string]storedSecret{}
+	if err = json.Unmarshal(plaintext, &secrets); err != nil {
+		return fmt.Errorf("%s is not a valid secret store", s.path)
+	}
+
+	s.secrets = secrets
+	s.modTime, s.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// save encrypts and writes secrets to the store, replacing the file atomically. The caller must
+// hold s.mu.
+func (s *SecretStore) save(secrets map[string]storedSecret) error {
+	salt := s.salt
+	if salt == nil {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+	}
+	key, err := s.deriveKey(salt)
+	if err != nil {
+		return err
+	}
+	aead, err := newSecretsCipher(key)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(secretsFile{
+		Version:    1,
+		Salt:       salt,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, secretsAdditionalData),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(s.path), ".secrets-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err = temp.Write(data); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(temp.Name(), s.path); err != nil {
+		return err
+	}
+
+	// Force the next read to pick up the new file.
+	s.secrets = nil
+	return nil
+}
+
+func newSecretsCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// lookup returns the named secret.
+func (s *SecretStore) lookup(name string) (storedSecret, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return storedSecret{}, err
+	}
+
+	secret, ok := s.secrets[name]
+	if !ok {
+		return storedSecret{}, fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+
+	return secret, nil
+}
+
+// Get returns the value of the named secret.
+func (s *SecretStore) Get(name string) (string, error) {
+	secret, err := s.lookup(name)
+	return secret.Value, err
+}
+
+// Hosts returns the destination hosts the named secret may be sent to.
+func (s *SecretStore) Hosts(name string) ([]string, error) {
+	secret, err := s.lookup(name)
+	return secret.Hosts, err
+}
+
+// Names returns the names of the stored secrets, in order.
+func (s *SecretStore) Names() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(s.secrets))
+	for name := range s.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Set stores a secret, which may only be sent to the given destination hosts, replacing any
+// secret with the same name. Names may contain letters, digits, '_', '.' and '-'. Hosts are
+// host names, or patterns such as *.example.com matching any subdomain.
+func (s *SecretStore) Set(name string, value string, hosts []string) error {
+	if !validSecretName.MatchString(name) {
+		return fmt.Errorf("invalid secret name %q: names may only contain letters, digits, '_', '.' and '-'", name)
+	}
+	hosts, err := normalizeSecretHosts(hosts)
+	if err != nil {
+		return err
+	}
+
+	return s.update(func(secrets map[string]storedSecret) error {
+		secrets[name] = storedSecret{Value: value, Hosts: hosts}
+		return nil
+	})
+}
+
+// SetHosts replaces the destination hosts the named secret may be sent to.
+func (s *SecretStore) SetHosts(name string, hosts []string) error {
+	hosts, err := normalizeSecretHosts(hosts)
+	if err != nil {
+		return err
+	}
+
+	return s.update(func(secrets map[string]storedSecret) error {
+		secret, ok := secrets[name]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+		}
+
+		secret.Hosts = hosts
+		secrets[name] = secret
+		return nil
+	})
+}
+
+// normalizeSecretHosts checks the hosts a secret may be sent to, of which there must be at least
+// one, and returns them in lower case.
+func normalizeSecretHosts(hosts []string) ([]string, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("a secret must be allowed to be sent to at least one host")
+	}
+
+	normalized := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if host == "" || host == "*." || strings.ContainsAny(host, ":/@ ") || strings.Contains(host[1:], "*") {
+			return nil, fmt.Errorf("invalid host %q: expected a host name, e.g. api.example.com or *.example.com", host)
+		}
+		normalized = append(normalized, strings.ToLower(host))
+	}
+
+	return normalized, nil
+}
+
+// Delete removes the named secret.
+func (s *SecretStore) Delete(name string) error {
+	return s.update(func(secrets map[string]storedSecret) error {
+		if _, ok := secrets[name]; !ok {
+			return fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+		}
+
+		delete(secrets, name)
+		return nil
+	})
+}
+
+// update applies change to a copy of the secrets and saves the result.
+func (s *SecretStore) update(change func(secrets map[string]storedSecret) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	secrets := make(map[string]storedSecret, len(s.secrets)+1)
+	for name, secret := range s.secrets {
+		secrets[name] = secret
+	}
+	if err := change(secrets); err != nil {
+		return err
+	}
+
+	return s.save(secrets)
+}
+
+// secretResolver replaces the secret placeholders in a request, recording the values it
+// substitutes so that they can be redacted, and the secrets so that the destination can be
+// checked against the hosts they may be sent to.
+type secretResolver struct {
+	store *SecretStore
+	// values are the secrets that have been substituted.
+	values []string
+	// secrets are the substituted secrets, by name.
+	secrets map[string]storedSecret
+	err     error
+}
+
+// resolve replaces the placeholders in value. Once an error occurs, resolve leaves values
+// unchanged; the error is reported by r.err.
+func (r *secretResolver) resolve(value string) string {
+	if r.err != nil || !strings.Contains(value, "{{secret:") {
+		return value
+	}
+	if r.store == nil {
+		r.err = errors.New("secrets are not available on this proxy")
+		return value
+	}
+
+	return secretPlaceholder.ReplaceAllStringFunc(value, func(placeholder string) string {
+		if r.err != nil {
+			return placeholder
+		}
+
+		name := secretPlaceholder.FindStringSubmatch(placeholder)[1]
+		secret, err := r.store.lookup(name)
+		if err != nil {
+			r.err = err
+			return placeholder
+		}
+
+		if r.secrets == nil {
+			r.secrets = map[string]storedSecret{}
+		}
+		r.secrets[name] = secret
+		r.values = append(r.values, secret.Value)
+		return secret.Value
+	})
+}
+
+// resolveRequest replaces the secret placeholders in the URL, headers, parameters, body and
+// credentials of a request. Placeholders may not be used in the URL's host (nor anywhere before
+// its path), as the secret would be sent to whichever host it named.
+func (r *secretResolver) resolveRequest(request *Request) {
+	if strings.Contains(request.Url, "{{secret:") {
+		parsed, err := url.Parse(request.Url)
+		if err != nil || strings.Contains(parsed.Host, "{{secret:") || strings.Contains(parsed.User.String(), "{{secret:") {
+			r.err = errors.New("secrets may only be used in the path and query of the URL")
+			return
+		}
+	}
+
+	request.Url = r.resolve(request.Url)
+	request.Data = r.resolve(request.Data)
+	for name, value := range request.Headers {
+		request.Headers[name] = r.resolve(value)
+	}
+	for name, value := range request.Params {
+		request.Params[name] = r.resolve(value)
+	}
+
+	auth := &request.Auth
+	for _, field := range []*string{
+		&auth.Username, &auth.Password,
+		&auth.AWS.AccessKeyID, &auth.AWS.SecretAccessKey, &auth.AWS.SessionToken,
+		&auth.OAuth1.ConsumerKey, &auth.OAuth1.ConsumerSecret, &auth.OAuth1.Token, &auth.OAuth1.TokenSecret,
+		&auth.HMAC.Secret,
+	} {
+		*field = r.resolve(*field)
+	}
+}
+
+// allows returns an error unless every substituted secret may be sent to host.
+func (r *secretResolver) allows(host string) error {
+	names := make([]string, 0, len(r.secrets))
+	for name := range r.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !r.secrets[name].allows(host) {
+			return fmt.Errorf("the secret %q may not be sent to %s", name, host)
+		}
+	}
+
+	return nil
+}
+
+// withRedactedValues returns a copy of the policy that also redacts values, e.g. the secrets
+// substituted into a request, from the response and log output.
+func (p *policy) withRedactedValues(values []string) *policy {
+	if len(values) == 0 {
+		return p
+	}
+
+	// Redact longer values first, in case one secret contains another.
+	values = append([]string{}, values...)
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	literals, _ := NewRedactor(LiteralRedactionRules(values))
+	redactor := &Redactor{rules: literals.rules}
+	if p.redactor != nil {
+		redactor.rules = append(redactor.rules, p.redactor.rules...)
+	}
+
+	next := *p
+	next.redactor = redactor
+	return &next
+}
@@ -0,0 +1,191 @@
+package libproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSecretStore(t *testing.T, masterKey string) *SecretStore {
+	path := filepath.Join(t.TempDir(), "secrets.enc")
+	return NewSecretStore(path, func() ([]byte, error) { return []byte(masterKey), nil })
+}
+
+func TestSecretStore(t *testing.T) {
+	store := newTestSecretStore(t, "master key")
+
+	names, err := store.Names()
+	assert.Nil(t, err)
+	assert.Empty(t, names)
+
+	assert.Nil(t, store.Set("prod_api_key", "sk-123", []string{"API.example.com"}))
+	assert.Nil(t, store.Set("db.password", "hunter2", []string{"*.example.com"}))
+	assert.NotNil(t, store.Set("not a name", "x", []string{"example.com"}))
+	assert.NotNil(t, store.Set("no_hosts", "x", nil))
+	assert.NotNil(t, store.Set("bad_host", "x", []string{"https://example.com"}))
+
+	value, err := store.Get("prod_api_key")
+	assert.Nil(t, err)
+	assert.Equal(t, "sk-123", value)
+	hosts, err := store.Hosts("prod_api_key")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"api.example.com"}, hosts)
+	_, err = store.Get("missing")
+	assert.True(t, errors.Is(err, ErrSecretNotFound))
+
+	// The values are encrypted at rest, and another store with the same key can read them.
+	data, err := os.ReadFile(store.path)
+	assert.Nil(t, err)
+	assert.False(t, strings.Contains(string(data), "sk-123"))
+	other := NewSecretStore(store.path, store.masterKey)
+	names, err = other.Names()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"db.password", "prod_api_key"}, names)
+
+	// Changes made by another store are picked up.
+	assert.Nil(t, other.Delete("db.password"))
+	assert.True(t, errors.Is(other.Delete("db.password"), ErrSecretNotFound))
+	names, err = store.Names()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"prod_api_key"}, names)
+
+	assert.Nil(t, store.SetHosts("prod_api_key", []string{"api.example.com", "*.api.example.com"}))
+	hosts, err = other.Hosts("prod_api_key")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"api.example.com", "*.api.example.com"}, hosts)
+	assert.True(t, errors.Is(store.SetHosts("missing", []string{"example.com"}), ErrSecretNotFound))
+
+	wrongKey := NewSecretStore(store.path, func() ([]byte, error) { return []byte("wrong"), nil })
+	_, err = wrongKey.Get("prod_api_key")
+	assert.ErrorContains(t, err, "master key")
+}
+
+func TestLegacySecretStore(t *testing.T) {
+	// Stores written before secrets had hosts hold bare values, which may not be sent anywhere.
+	store := newTestSecretStore(t, "master key")
+	store.mu.Lock()
+	assert.Nil(t, store.load())
+	assert.Nil(t, store.save(nil))
+	store.mu.Unlock()
+	key, err := store.deriveKey(store.salt)
+	assert.Nil(t, err)
+	aead, err := newSecretsCipher(key)
+	assert.Nil(t, err)
+	nonce := make([]byte, aead.NonceSize())
+	data, err := json.Marshal(secretsFile{Version: 1, Salt: store.salt, Nonce: nonce, Ciphertext: aead.Seal(nil, nonce, []byte(`{"token":"s3cr3t"}`), secretsAdditionalData)})
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(store.path, data, 0600))
+
+	value, err := store.Get("token")
+	assert.Nil(t, err)
+	assert.Equal(t, "s3cr3t", value)
+	hosts, err := store.Hosts("token")
+	assert.Nil(t, err)
+	assert.Empty(t, hosts)
+
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}}, Secrets: store})
+	assert.Nil(t, err)
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: testServerUrl + "/get", Headers: map[string]string{"X-Token": "{{secret:token}}"}}, "validorigin1.com")
+	assert.Equal(t, ErrorCodeSecretFailed, getErrorBody(t, resp).Data.Code)
+}
+
+func TestKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.key")
+	key, err := readOrCreateKeyFile(path)
+	assert.Nil(t, err)
+	assert.Len(t, key, 44)
+
+	again, err := readOrCreateKeyFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, key, again)
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	if os.PathSeparator == '/' {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+func TestSecretPlaceholders(t *testing.T) {
+	testHost := strings.Split(strings.TrimPrefix(testServerUrl, "http://"), ":")[0]
+	store := newTestSecretStore(t, "master key")
+	assert.Nil(t, store.Set("token", "s3cr3t-t0ken", []string{testHost}))
+	assert.Nil(t, store.Set("user", "alice", []string{testHost}))
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}}, Secrets: store})
+	assert.Nil(t, err)
+
+	resp := getResultFrom(proxy, Request{
+		Method:  "POST",
+		Url:     testServerUrl + "/anything?key={{secret:token}}",
+		Headers: map[string]string{"X-Token": "Bearer {{secret:token}}", "Content-Type": "text/plain"},
+		Params:  map[string]string{"user": "{{secret:user}}"},
+		Data:    "token={{secret:token}}",
+		Auth:    RequestAuth{Username: "{{secret:user}}", Password: "{{secret:token}}"},
+	}, "validorigin1.com")
+	assert.Nil(t, resp.err)
+	assert.Equal(t, 200, resp.requestResponse.Status)
+
+	// httpbin echoes the request, with the secrets substituted, but they are redacted from the
+	// response.
+	r := checkErrorNUnmarshalHTTPBinResponse(resp.requestResponse.Data, t)
+	assert.Equal(t, "Bearer [redacted]", r.Headers.Get("X-Token"))
+	assert.Equal(t, "[redacted]", r.Args.Get("key"))
+	assert.Equal(t, "[redacted]", r.Args.Get("user"))
+	assert.Equal(t, "token=[redacted]", r.Data)
+	assert.False(t, strings.Contains(resp.proxyResponse.Body.String(), "s3cr3t-t0ken"))
+	assert.False(t, strings.Contains(resp.proxyResponse.Body.String(), "{{secret:"))
+
+	// Requests that don't refer to a secret are unaffected.
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: testServerUrl + "/get?user=alice"}, "validorigin1.com")
+	r = checkErrorNUnmarshalHTTPBinResponse(resp.requestResponse.Data, t)
+	assert.Equal(t, "alice", r.Args.Get("user"))
+
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: testServerUrl + "/get?key={{secret:missing}}"}, "validorigin1.com")
+	assert.Equal(t, ErrorCodeSecretFailed, getErrorBody(t, resp).Data.Code)
+}
+
+func TestSecretHosts(t *testing.T) {
+	testHost := strings.Split(strings.TrimPrefix(testServerUrl, "http://"), ":")[0]
+	store := newTestSecretStore(t, "master key")
+	assert.Nil(t, store.Set("token", "s3cr3t-t0ken", []string{"api.example.com"}))
+	assert.Nil(t, store.Set("local", "l0cal-t0ken", []string{testHost}))
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}}, Secrets: store})
+	assert.Nil(t, err)
+
+	// A secret is never sent to a host outside its list.
+	for _, request := range []Request{
+		{Method: "GET", Url: testServerUrl + "/get", Headers: map[string]string{"X-Token": "{{secret:token}}"}},
+		{Method: "GET", Url: testServerUrl + "/get?key={{secret:token}}"},
+		{Method: "POST", Url: testServerUrl + "/post", Data: "{{secret:token}}"},
+		{Method: "GET", Url: testServerUrl + "/get", Auth: RequestAuth{Type: AuthTypeBasic, Username: "user", Password: "{{secret:token}}"}},
+		// nor may it name the host
+		{Method: "GET", Url: "http://{{secret:local}}.example.com/"},
+		{Method: "GET", Url: "http://{{secret:local}}@" + testServerUrl[len("http://"):] + "/get"},
+		// nor connect to an address of the client's choosing
+		{Method: "GET", Url: testServerUrl + "/get", Headers: map[string]string{"X-Token": "{{secret:local}}"}, Resolve: map[string]string{testHost: "127.0.0.1"}},
+	} {
+		resp := getResultFrom(proxy, request, "validorigin1.com")
+		assert.Equal(t, ErrorCodeSecretFailed, getErrorBody(t, resp).Data.Code, request)
+		assert.False(t, strings.Contains(resp.proxyResponse.Body.String(), "t0ken"), request)
+	}
+
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: testServerUrl + "/get", Headers: map[string]string{"X-Token": "{{secret:local}}"}}, "validorigin1.com")
+	assert.Equal(t, 200, resp.requestResponse.Status)
+
+	// Redirects to other hosts aren't followed.
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: testServerUrl + "/redirect-to?url=http://api.example.org/", Headers: map[string]string{"X-Token": "{{secret:local}}"}}, "validorigin1.com")
+	assert.Equal(t, 302, resp.requestResponse.Status)
+}
+
+func TestSecretPlaceholdersWithoutStore(t *testing.T) {
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}}})
+	assert.Nil(t, err)
+
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: testServerUrl + "/get?key={{secret:token}}"}, "validorigin1.com")
+	assert.Equal(t, ErrorCodeSecretFailed, getErrorBody(t, resp).Data.Code)
+}
@@ -0,0 +1,495 @@
+package libproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type statusChangeFunction func(status string, isListening bool)
+
+// Options configures a Proxy.
+type Options struct {
+	Config
+
+	// OnStatusChange is called as the proxy starts and stops listening. It may be nil.
+	OnStatusChange func(status string, isListening bool)
+	// ConfigLoader re-reads the configuration when the proxy is reloaded (see Proxy.Reload). It
+	// may be nil, in which case the configuration can only be changed programmatically.
+	ConfigLoader func() (Config, error)
+	// Hooks are run on each request, before any hooks in the configuration (see Proxy.Use).
+	Hooks []Hook
+	// Secrets is the store {{secret:name}} placeholders in requests are resolved from. If nil,
+	// requests with placeholders are rejected.
+	Secrets *SecretStore
+}
+
+// Proxy is an instance of the proxy server. It implements http.Handler, so it may be mounted in
+// an existing server, or it can listen on its own with Start.
+type Proxy struct {
+	sessionFingerprint string
+	onStatusChange     statusChangeFunction
+	mux                *http.ServeMux
+	// transport makes the proxied requests. Each proxy has its own, so that its connections to
+	// destinations can be closed when it shuts down.
+	transport *http.Transport
+	// authTransports hold the connections authenticated with NTLM or Negotiate, by credentials,
+	// and those made with a request's DNS overrides (see transportFor).
+	authTransportsMu sync.Mutex
+	authTransports   map[string]*http.Transport
+	// secrets resolves the secret placeholders in requests. It may be nil.
+	secrets *SecretStore
+	// oauth2 holds the tokens fetched through /oauth2/token. It is kept across reloads.
+	oauth2 *oauth2Cache
+	// recordings are the sessions being recorded through /recording. They are kept across
+	// reloads.
+	recordings recordings
+	// inFlight is the number of requests being handled.
+	inFlight int64
+	// metrics are kept across reloads.
+	metrics *proxyMetrics
+	// openConnections is the number of connections to destinations (see countConnections).
+	openConnections int64
+	startedAt       time.Time
+	// active are the requests in progress, listed by the admin API.
+	active activeRequests
+	// certificate is the *tls.Certificate the proxy serves HTTPS with (see
+	// RegenerateCertificate).
+	certificate atomic.Value
+
+	// policyMu serializes updates to the current policy, config loader and runtime settings.
+	// Readers of the policy don't need it.
+	policyMu      sync.Mutex
+	currentPolicy atomic.Value
+	configLoader  func() (Config, error)
+	// runtimeSettings are the settings changed while the proxy runs, in the order they were
+	// last changed, which are applied again whenever the configuration is reloaded.
+	runtimeSettings []runtimeSetting
+
+	serverMu    sync.Mutex
+	versionName string
+	versionCode string
+	server      *http.Server
+	listeners   []net.Listener
+	// adminServer serves the metrics on the admin listener, or is nil if there is none.
+	adminServer   *http.Server
+	adminListener net.Listener
+	// cancelRequests aborts the requests in progress if they don't finish before the shutdown
+	// deadline.
+	cancelRequests context.CancelFunc
+	shuttingDown   bool
+	done           chan struct{}
+	doneOnce       sync.Once
+	serveErr       error
+}
+
+// New creates a proxy with the given options. It returns an error if the configuration is
+// invalid.
+func New(options Options) (*Proxy, error) {
+	proxy := &Proxy{
+		sessionFingerprint: uuid.New().String(),
+		onStatusChange:     options.OnStatusChange,
+		configLoader:       options.ConfigLoader,
+		mux:                http.NewServeMux(),
+		transport:          http.DefaultTransport.(*http.Transport).Clone(),
+		authTransports:     map[string]*http.Transport{},
+		secrets:            options.Secrets,
+		oauth2:             newOAuth2Cache(),
+		startedAt:          time.Now(),
+	}
+	if proxy.onStatusChange == nil {
+		proxy.onStatusChange = func(string, bool) {}
+	}
+	proxy.metrics = newProxyMetrics(proxy)
+	resolveConnections(proxy.transport, func() *dnsResolver { return proxy.loadPolicy().resolver })
+	countConnections(proxy.transport, &proxy.openConnections)
+
+	initial, err := newPolicy(options.Config, &policy{})
+	if err != nil {
+		return nil, err
+	}
+	initial.registeredHooks = options.Hooks
+	proxy.currentPolicy.Store(initial)
+
+	proxy.mux.HandleFunc("/", proxy.proxyHandler)
+	proxy.registerAdminHandlers()
+	proxy.mux.HandleFunc("/oauth2/token", proxy.oauth2Handler)
+	proxy.mux.HandleFunc("/recording", proxy.recordingHandler)
+	proxy.mux.HandleFunc("/healthz", proxy.healthHandler)
+	proxy.mux.HandleFunc("/readyz", proxy.readyHandler)
+	proxy.mux.HandleFunc("/status", proxy.statusHandler)
+
+	return proxy, nil
+}
+
+// ServeHTTP handles a request made to the proxy.
+func (proxy *Proxy) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	atomic.AddInt64(&proxy.inFlight, 1)
+	defer atomic.AddInt64(&proxy.inFlight, -1)
+
+	p, done := proxy.acquirePolicy()
+	defer done()
+	request = request.WithContext(context.WithValue(request.Context(), policyKey{}, p))
+	writer := beginAccessLog(response, request)
+	var span trace.Span
+	if p.tracer != nil {
+		request, span = p.tracer.startRequestSpan(request)
+		writer.entry.TraceID = span.SpanContext().TraceID().String()
+	}
+	untrack := proxy.active.track(writer.entry)
+	proxy.mux.ServeHTTP(writer, request)
+	untrack()
+
+	writer.complete()
+	proxy.metrics.observe(writer.entry)
+	if span != nil {
+		endRequestSpan(span, writer.entry)
+	}
+	if p.accessLog != nil {
+		p.accessLog.log(writer.entry)
+	}
+}
+
+// ErrAlreadyStarted is returned by Start if the proxy is already listening.
+var ErrAlreadyStarted = errors.New("the proxy has already been started")
+
+// Start starts listening on the configured host, over HTTPS if WithSSL is set, and on any other
+// addresses in Listen. HTTPS is served with the certificate configured in TLS, if any, or else the
+// one in the data directory. It returns once the proxy is listening (or has failed to); use Wait to
+// block until it stops.
+func (proxy *Proxy) Start() error {
+	proxy.serverMu.Lock()
+	defer proxy.serverMu.Unlock()
+
+	if proxy.server != nil {
+		return ErrAlreadyStarted
+	}
+
+	config := proxy.loadPolicy().config
+	addresses, err := listenAddresses(config)
+	if err != nil {
+		return err
+	}
+	socketMode, err := parseSocketMode(config.ListenSocketMode)
+	if err != nil {
+		return err
+	}
+	withTLS := false
+	for _, address := range addresses {
+		withTLS = withTLS || address.tls
+	}
+	log.Println("Starting proxy server...")
+
+	// Requests are made with a context derived from baseContext, so that they can be aborted if
+	// they're still running when the shutdown deadline passes.
+	baseContext, cancelRequests := context.WithCancel(context.Background())
+	server := &http.Server{
+		Handler:     proxy,
+		BaseContext: func(net.Listener) context.Context { return baseContext },
+	}
+	if config.TLS.ACME.enabled() {
+		// Certificates are obtained when they're first needed, and renewed before they expire.
+		manager, err := newACMEManager(config.TLS.ACME)
+		if err != nil {
+			cancelRequests()
+			proxy.onStatusChange("An error occurred: "+err.Error(), false)
+			return err
+		}
+		server.TLSConfig = manager.TLSConfig()
+		// The HTTP-01 challenge is answered on the HTTP listeners, if there are any.
+		server.Handler = manager.HTTPHandler(proxy)
+	} else if withTLS && config.TLS.CertFile != "" {
+		files, err := loadCertificateFiles(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			cancelRequests()
+			proxy.onStatusChange("An error occurred: "+err.Error(), false)
+			return err
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: files.getCertificate}
+	} else if withTLS {
+		proxy.onStatusChange("Checking SSL certificate...", false)
+
+		err := EnsurePrivateKeyInstalled()
+		if err != nil {
+			log.Println(err.Error())
+			proxy.onStatusChange("An error occurred.", false)
+		}
+
+		certificate, err := tls.LoadX509KeyPair(GetOrCreateDataPath()+"/cert.pem", GetOrCreateDataPath()+"/key.pem")
+		if err != nil {
+			cancelRequests()
+			proxy.onStatusChange("An error occurred.", false)
+			return err
+		}
+		proxy.certificate.Store(&certificate)
+		server.TLSConfig = &tls.Config{GetCertificate: proxy.getCertificate}
+	}
+
+	var listeners []net.Listener
+	var listenerTLS []bool
+	closeListeners := func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	}
+	for _, address := range addresses {
+		opened, err := address.listen(socketMode)
+		if err != nil {
+			closeListeners()
+			cancelRequests()
+			proxy.onStatusChange("An error occurred: "+err.Error(), false)
+			return err
+		}
+		for _, listener := range opened {
+			listeners = append(listeners, listener)
+			listenerTLS = append(listenerTLS, address.tls)
+		}
+	}
+
+	var adminListener net.Listener
+	if config.AdminHost != "" {
+		adminListener, err = net.Listen("tcp", config.AdminHost)
+		if err != nil {
+			closeListeners()
+			cancelRequests()
+			proxy.onStatusChange("An error occurred: "+err.Error(), false)
+			return err
+		}
+	}
+
+	proxy.server = server
+	proxy.listeners = listeners
+	proxy.cancelRequests = cancelRequests
+	proxy.done = make(chan struct{})
+	// Report the addresses we're actually listening on, in case a port was 0.
+	var urls []string
+	for i, listener := range listeners {
+		urls = append(urls, listenURL(listener, listenerTLS[i]))
+		go func(listener net.Listener, withTLS bool) {
+			var err error
+			if withTLS {
+				err = server.ServeTLS(listener, "", "")
+			} else {
+				err = server.Serve(listener)
+			}
+
+			// If the server was shut down, Shutdown signals done once the requests have drained.
+			if err != http.ErrServerClosed {
+				cancelRequests()
+				_ = server.Close()
+				proxy.stopped("An error occurred: "+err.Error(), err)
+			}
+		}(listener, listenerTLS[i])
+	}
+
+	if adminListener != nil {
+		proxy.adminServer = &http.Server{Handler: proxy.AdminHandler()}
+		proxy.adminListener = adminListener
+		go func(adminServer *http.Server) {
+			if err := adminServer.Serve(adminListener); err != http.ErrServerClosed {
+				log.Printf("The admin listener stopped: %v", err)
+			}
+		}(proxy.adminServer)
+		log.Println("Admin listener serving on http://" + adminListener.Addr().String() + "/")
+	}
+
+	proxy.onStatusChange("Listening on "+strings.Join(urls, ", "), true)
+	if withTLS {
+		log.Println("Proxy server listening on " + strings.Join(urls, ", "))
+	}
+
+	return nil
+}
+
+// Addr returns the address the proxy is listening on, or nil if it hasn't been started. This is
+// useful if the proxy was started on port 0. If the proxy listens on several addresses, Addr
+// returns the first (see Addrs).
+func (proxy *Proxy) Addr() net.Addr {
+	proxy.serverMu.Lock()
+	defer proxy.serverMu.Unlock()
+
+	if len(proxy.listeners) == 0 {
+		return nil
+	}
+
+	return proxy.listeners[0].Addr()
+}
+
+// Addrs returns the addresses the proxy is listening on: Host first, if it is set, followed by
+// those in Listen.
+func (proxy *Proxy) Addrs() []net.Addr {
+	proxy.serverMu.Lock()
+	defer proxy.serverMu.Unlock()
+
+	var addrs []net.Addr
+	for _, listener := range proxy.listeners {
+		addrs = append(addrs, listener.Addr())
+	}
+	return addrs
+}
+
+// AdminAddr returns the address of the admin listener, or nil if there is none or the proxy
+// hasn't been started.
+func (proxy *Proxy) AdminAddr() net.Addr {
+	proxy.serverMu.Lock()
+	defer proxy.serverMu.Unlock()
+
+	if proxy.adminListener == nil {
+		return nil
+	}
+
+	return proxy.adminListener.Addr()
+}
+
+// Wait blocks until the proxy stops, returning the error that caused it to stop (or nil if it
+// was shut down). If the proxy is shutting down, Wait returns once the requests in progress have
+// finished or been aborted. It returns immediately if the proxy hasn't been started.
+func (proxy *Proxy) Wait() error {
+	proxy.serverMu.Lock()
+	done := proxy.done
+	proxy.serverMu.Unlock()
+
+	if done == nil {
+		return nil
+	}
+
+	<-done
+	return proxy.serveErr
+}
+
+// Shutdown stops the proxy from accepting new connections and waits for the requests in progress
+// to finish. If ctx is done first, the remaining requests are aborted and their connections
+// closed, and ctx's error is returned. Either way, the proxy's connections to destinations are
+// closed, and any traces exported, before Shutdown returns.
+func (proxy *Proxy) Shutdown(ctx context.Context) error {
+	proxy.serverMu.Lock()
+	server, adminServer, done := proxy.server, proxy.adminServer, proxy.done
+	alreadyShuttingDown := proxy.shuttingDown
+	proxy.shuttingDown = true
+	proxy.serverMu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	if alreadyShuttingDown {
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if inFlight := atomic.LoadInt64(&proxy.inFlight); inFlight > 0 {
+		proxy.onStatusChange(fmt.Sprintf("Shutting down (waiting for %d requests)...", inFlight), false)
+	} else {
+		proxy.onStatusChange("Shutting down...", false)
+	}
+	log.Println("Shutting down proxy server...")
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Aborting %d requests still in progress.", atomic.LoadInt64(&proxy.inFlight))
+		proxy.cancelRequests()
+		_ = server.Close()
+	}
+	proxy.cancelRequests()
+	proxy.closeIdleConnections()
+	proxy.stopRecordings()
+	// The metrics stay available while the requests drain.
+	if adminServer != nil {
+		_ = adminServer.Close()
+	}
+	if flushErr := proxy.loadPolicy().tracer.flush(ctx); flushErr != nil {
+		log.Printf("Failed to export traces: %v", flushErr)
+	}
+
+	proxy.stopped("Stopped.", nil)
+
+	return err
+}
+
+// stopped reports that the proxy has stopped (unless it already has) and signals Wait.
+func (proxy *Proxy) stopped(status string, err error) {
+	proxy.doneOnce.Do(func() {
+		proxy.serveErr = err
+		proxy.onStatusChange(status, false)
+		close(proxy.done)
+	})
+}
+
+var (
+	defaultProxyOnce sync.Once
+	defaultProxy     *Proxy
+)
+
+// Default returns the proxy used by Initialize and the package-level functions, such as
+// SetAccessToken.
+func Default() *Proxy {
+	defaultProxyOnce.Do(func() {
+		// An empty configuration is always valid.
+		defaultProxy, _ = New(Options{Secrets: DefaultSecretStore()})
+	})
+
+	return defaultProxy
+}
+
+// Shutdown gracefully shuts down the default proxy, waiting up to timeout for the requests in
+// progress to finish (see Proxy.Shutdown).
+func Shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return Default().Shutdown(ctx)
+}
+
+// Initialize starts the default proxy server with the given configuration. onStatusChange is
+// called as the server starts (or fails to), and if finished is not nil, it is signalled once
+// the server stops.
+func Initialize(
+	config Config,
+	onStatusChange statusChangeFunction,
+	finished chan bool,
+) {
+	proxy := Default()
+	proxy.serverMu.Lock()
+	proxy.onStatusChange = onStatusChange
+	proxy.serverMu.Unlock()
+
+	signalFinished := func() {
+		if finished != nil {
+			finished <- true
+		}
+	}
+
+	err := proxy.updateConfig(func(current *Config) {
+		*current = config
+	})
+	if err != nil {
+		onStatusChange("An error occurred: "+err.Error(), false)
+		go signalFinished()
+		return
+	}
+
+	// Start reports its own errors through onStatusChange.
+	if proxy.Start() != nil {
+		go signalFinished()
+		return
+	}
+
+	go func() {
+		_ = proxy.Wait()
+		signalFinished()
+	}()
+}
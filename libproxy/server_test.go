@@ -0,0 +1,159 @@
+package libproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// postToProxy makes a request through a proxy listening at proxyURL, returning whether it
+// succeeded.
+func postToProxy(t *testing.T, proxyURL string, origin string, request Request) bool {
+	body, err := json.Marshal(request)
+	assert.Nil(t, err)
+
+	httpRequest, err := http.NewRequest("POST", proxyURL, bytes.NewReader(body))
+	assert.Nil(t, err)
+	httpRequest.Header.Set("Origin", origin)
+
+	httpResponse, err := http.DefaultClient.Do(httpRequest)
+	assert.Nil(t, err)
+	defer httpResponse.Body.Close()
+
+	var response struct {
+		Success bool `json:"success"`
+	}
+	assert.Nil(t, json.NewDecoder(httpResponse.Body).Decode(&response))
+	return response.Success
+}
+
+func TestEmbeddedProxyInstances(t *testing.T) {
+	t.Parallel()
+
+	first, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, AccessToken: "first"}})
+	assert.Nil(t, err)
+	second, err := New(Options{Config: Config{AllowedOrigins: []string{"*"}, BannedDests: []string{"127.0.0.1"}}})
+	assert.Nil(t, err)
+
+	firstServer := httptest.NewServer(first)
+	defer firstServer.Close()
+	secondServer := httptest.NewServer(second)
+	defer secondServer.Close()
+
+	request := Request{Method: "GET", Url: testServerUrl + "/get", AccessToken: "first"}
+	assert.True(t, postToProxy(t, firstServer.URL, "validorigin1.com", request))
+	// each instance applies its own policy
+	assert.False(t, postToProxy(t, secondServer.URL, "validorigin1.com", request))
+
+	request.AccessToken = ""
+	assert.False(t, postToProxy(t, firstServer.URL, "validorigin1.com", request))
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	_, err := New(Options{Config: Config{RedactionRules: []RedactionRule{{Pattern: "("}}}})
+	assert.NotNil(t, err)
+}
+
+func TestStartShutdown(t *testing.T) {
+	t.Parallel()
+
+	var statuses []string
+	proxy, err := New(Options{
+		Config: Config{Host: "127.0.0.1:0", AllowedOrigins: []string{"*"}},
+		OnStatusChange: func(status string, isListening bool) {
+			statuses = append(statuses, status)
+		},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, proxy.Addr())
+
+	assert.Nil(t, proxy.Start())
+	assert.Equal(t, ErrAlreadyStarted, proxy.Start())
+
+	address := proxy.Addr().String()
+	assert.True(t, postToProxy(t, "http://"+address+"/", "validorigin1.com", Request{
+		Method: "GET",
+		Url:    testServerUrl + "/get",
+	}))
+
+	assert.Nil(t, proxy.Shutdown(context.Background()))
+	assert.Nil(t, proxy.Wait())
+	assert.Equal(t, []string{"Listening on http://" + address + "/", "Shutting down...", "Stopped."}, statuses)
+
+	// shutting down again is harmless
+	assert.Nil(t, proxy.Shutdown(context.Background()))
+}
+
+// startTestProxy starts a proxy on a random port, returning its URL.
+func startTestProxy(t *testing.T) (*Proxy, string) {
+	proxy, err := New(Options{Config: Config{Host: "127.0.0.1:0", AllowedOrigins: []string{"*"}}})
+	assert.Nil(t, err)
+	assert.Nil(t, proxy.Start())
+
+	return proxy, "http://" + proxy.Addr().String() + "/"
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	t.Parallel()
+
+	proxy, proxyURL := startTestProxy(t)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.True(t, postToProxy(t, proxyURL, "validorigin1.com", Request{
+			Method: "GET",
+			Url:    testServerUrl + "/delay/0.5",
+		}))
+	}()
+
+	// wait for the request to reach the proxy
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, proxy.Shutdown(ctx))
+	assert.Nil(t, proxy.Wait())
+	wg.Wait()
+
+	// new connections are refused
+	_, err := http.Post(proxyURL, "application/json", bytes.NewReader([]byte("{}")))
+	assert.NotNil(t, err)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	t.Parallel()
+
+	proxy, proxyURL := startTestProxy(t)
+
+	go func() {
+		request, _ := json.Marshal(Request{Method: "GET", Url: testServerUrl + "/delay/5"})
+		httpRequest, _ := http.NewRequest("POST", proxyURL, bytes.NewReader(request))
+		httpRequest.Header.Set("Origin", "validorigin1.com")
+		if response, err := http.DefaultClient.Do(httpRequest); err == nil {
+			response.Body.Close()
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, proxy.Shutdown(ctx))
+	assert.Nil(t, proxy.Wait())
+	assert.Less(t, time.Since(start), 2*time.Second)
+	// the proxied request is aborted rather than left running
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&proxy.inFlight) == 0
+	}, time.Second, 10*time.Millisecond)
+}
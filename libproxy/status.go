@@ -0,0 +1,205 @@
+package libproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxyStatus is the state of the proxy reported by the status endpoint.
+type proxyStatus struct {
+	VersionName string    `json:"versionName"`
+	VersionCode string    `json:"versionCode"`
+	StartedAt   time.Time `json:"startedAt"`
+	Uptime      float64   `json:"uptimeSeconds"`
+	Listening   bool      `json:"listening"`
+	Ready       bool      `json:"ready"`
+	InFlight    int64     `json:"inFlight"`
+
+	Config     statusConfig   `json:"config"`
+	Pool       poolStatus     `json:"pool"`
+	RateLimits rateLimitState `json:"rateLimits"`
+}
+
+// statusConfig summarizes the current configuration. It leaves out anything that might be
+// sensitive, such as tokens and banned outputs.
+type statusConfig struct {
+	Host                string     `json:"host"`
+	Listen              []string   `json:"listen,omitempty"`
+	AdminHost           string     `json:"adminHost,omitempty"`
+	WithSSL             bool       `json:"ssl"`
+	IsProtected         bool       `json:"isProtected"`
+	AllowedOrigins      []string   `json:"allowedOrigins"`
+	BannedDests         int        `json:"bannedDests"`
+	BannedOutputs       int        `json:"bannedOutputs"`
+	RedactionRules      int        `json:"redactionRules"`
+	BodyLimits          BodyLimits `json:"bodyLimits"`
+	Hooks               []string   `json:"hooks"`
+	AccessLog           []string   `json:"accessLog"`
+	Tracing             bool       `json:"tracing"`
+	Recording           bool       `json:"recording"`
+	Mock                bool       `json:"mock"`
+	Cache               bool       `json:"cache"`
+	Kerberos            bool       `json:"kerberos"`
+	ConfigFileReloading bool       `json:"configFileReloading"`
+}
+
+// poolStatus describes the connections to destinations.
+type poolStatus struct {
+	// OpenConnections is the number of connections to destinations, whether in use or idle.
+	OpenConnections int64 `json:"openConnections"`
+	// AuthTransports is the number of transports holding NTLM or Negotiate authenticated
+	// connections (see transportFor).
+	AuthTransports int `json:"authTransports"`
+}
+
+// countingConn is a connection counted in Proxy.openConnections until it is closed.
+type countingConn struct {
+	net.Conn
+	count     *int64
+	closeOnce sync.Once
+}
+
+func (c *countingConn) Close() error {
+	c.closeOnce.Do(func() { atomic.AddInt64(c.count, -1) })
+	return c.Conn.Close()
+}
+
+// countConnections wraps the transport's dialer so that the connections it opens are counted in
+// count.
+func countConnections(transport *http.Transport, count *int64) {
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		atomic.AddInt64(count, 1)
+		return &countingConn{Conn: conn, count: count}, nil
+	}
+}
+
+// SetVersion sets the version reported by the status endpoint.
+func (proxy *Proxy) SetVersion(name, code string) {
+	proxy.serverMu.Lock()
+	defer proxy.serverMu.Unlock()
+
+	proxy.versionName, proxy.versionCode = name, code
+}
+
+// isReady returns false once the proxy has begun shutting down, so that load balancers stop
+// sending it requests while the requests in progress drain.
+func (proxy *Proxy) isReady() bool {
+	proxy.serverMu.Lock()
+	defer proxy.serverMu.Unlock()
+
+	return !proxy.shuttingDown
+}
+
+// status returns a snapshot of the state of the proxy.
+func (proxy *Proxy) status() proxyStatus {
+	p := proxy.loadPolicy()
+
+	proxy.serverMu.Lock()
+	status := proxyStatus{
+		VersionName: proxy.versionName,
+		VersionCode: proxy.versionCode,
+		StartedAt:   proxy.startedAt,
+		Uptime:      time.Since(proxy.startedAt).Seconds(),
+		Listening:   len(proxy.listeners) > 0 && !proxy.shuttingDown,
+		Ready:       !proxy.shuttingDown,
+		InFlight:    atomic.LoadInt64(&proxy.inFlight),
+	}
+	proxy.serverMu.Unlock()
+
+	proxy.policyMu.Lock()
+	reloadable := proxy.configLoader != nil
+	proxy.policyMu.Unlock()
+
+	config := p.config
+	status.Config = statusConfig{
+		Host:                config.Host,
+		Listen:              config.Listen,
+		AdminHost:           config.AdminHost,
+		WithSSL:             config.WithSSL,
+		IsProtected:         len(config.AccessToken) > 0,
+		AllowedOrigins:      config.AllowedOrigins,
+		BannedDests:         len(config.BannedDests),
+		BannedOutputs:       len(config.BannedOutputs),
+		RedactionRules:      len(config.RedactionRules),
+		BodyLimits:          config.BodyLimits,
+		Hooks:               []string{},
+		AccessLog:           config.AccessLog.Sinks,
+		Tracing:             p.tracer != nil,
+		Recording:           config.Recording.Enabled,
+		Mock:                config.Mock.Enabled(),
+		Cache:               config.Cache.Enabled,
+		Kerberos:            p.kerberos != nil,
+		ConfigFileReloading: reloadable,
+	}
+	for _, hook := range config.Hooks {
+		status.Config.Hooks = append(status.Config.Hooks, hook.Name)
+	}
+
+	status.Pool.OpenConnections = atomic.LoadInt64(&proxy.openConnections)
+	proxy.authTransportsMu.Lock()
+	status.Pool.AuthTransports = len(proxy.authTransports)
+	proxy.authTransportsMu.Unlock()
+
+	status.RateLimits = p.limiter.state()
+	return status
+}
+
+// healthHandler reports that the proxy is alive. Unlike the proxy route, it doesn't check the
+// request's origin, so it can be used by health checks.
+func (proxy *Proxy) healthHandler(response http.ResponseWriter, _ *http.Request) {
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = response.Write([]byte("{\"success\": true, \"data\":{\"status\":\"ok\"}}\n"))
+}
+
+// readyHandler reports whether the proxy is accepting requests. It fails once the proxy begins
+// shutting down.
+func (proxy *Proxy) readyHandler(response http.ResponseWriter, _ *http.Request) {
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !proxy.isReady() {
+		response.WriteHeader(http.StatusServiceUnavailable)
+		writeErrorBody(response, errorData{Message: "(Proxy Error) Shutting down."})
+		return
+	}
+
+	_, _ = response.Write([]byte("{\"success\": true, \"data\":{\"status\":\"ready\"}}\n"))
+}
+
+// statusHandler reports the state of the proxy to an admin.
+func (proxy *Proxy) statusHandler(response http.ResponseWriter, request *http.Request) {
+	if !proxy.authorizeAdmin(response, request) {
+		return
+	}
+
+	writeAdminData(response, proxy.status())
+}
+
+// AdminHandler returns a handler serving the endpoints of the admin listener (see
+// Config.AdminHost): /metrics, /healthz, /readyz, /status and the admin API under /admin/. It may
+// also be mounted elsewhere.
+func (proxy *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", proxy)
+	mux.Handle("/metrics", proxy.MetricsHandler())
+	mux.HandleFunc("/healthz", proxy.healthHandler)
+	mux.HandleFunc("/readyz", proxy.readyHandler)
+	mux.HandleFunc("/status", proxy.statusHandler)
+	return mux
+}
+
+// SetVersion sets the version reported by the status endpoint of the default proxy.
+func SetVersion(name, code string) {
+	Default().SetVersion(name, code)
+}
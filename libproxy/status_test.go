@@ -0,0 +1,104 @@
+package libproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	proxy, err := New(Options{Config: Config{AllowedOrigins: []string{"https://hoppscotch.io"}}})
+	assert.Nil(t, err)
+
+	// health checks don't send an Origin, but aren't redirected
+	for _, path := range []string{"/healthz", "/readyz"} {
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusOK, recorder.Code, path)
+		assert.Contains(t, recorder.Body.String(), `"success": true`, path)
+	}
+
+	proxy.serverMu.Lock()
+	proxy.shuttingDown = true
+	proxy.serverMu.Unlock()
+
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	recorder = httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestStatus(t *testing.T) {
+	proxy, err := New(Options{Config: Config{
+		Host:           "127.0.0.1:0",
+		AdminHost:      "127.0.0.1:0",
+		AccessToken:    "secret-token",
+		AdminToken:     "admin-token",
+		AllowedOrigins: []string{"*"},
+		BannedOutputs:  []string{"banned-value"},
+		RateLimits:     RateLimits{PerOrigin: RateLimit{Rate: 10, Burst: 10}, MaxConcurrent: 5},
+		Hooks:          []HookConfig{{Name: "set-header", Options: map[string]string{"header": "X-Team", "value": "platform"}}},
+	}})
+	assert.Nil(t, err)
+	proxy.SetVersion("2.0.0", "20")
+	assert.Nil(t, proxy.Start())
+	defer proxy.Shutdown(context.Background())
+
+	resp := getResultFrom(proxy, Request{AccessToken: "secret-token", Method: "GET", Url: testServerUrl + "/get"}, "validorigin1.com")
+	assert.Equal(t, 200, resp.requestResponse.Status)
+
+	getStatus := func(token string) (int, map[string]interface{}) {
+		request, _ := http.NewRequest("GET", "http://"+proxy.AdminAddr().String()+"/status", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		response, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		defer response.Body.Close()
+
+		var body struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		assert.Nil(t, json.NewDecoder(response.Body).Decode(&body))
+		return response.StatusCode, body.Data
+	}
+
+	code, _ := getStatus("wrong-token")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, status := getStatus("admin-token")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "2.0.0", status["versionName"])
+	assert.Equal(t, "20", status["versionCode"])
+	assert.Equal(t, true, status["listening"])
+	assert.Equal(t, true, status["ready"])
+	assert.Greater(t, status["uptimeSeconds"], 0.0)
+
+	config := status["config"].(map[string]interface{})
+	assert.Equal(t, true, config["isProtected"])
+	assert.Equal(t, 1.0, config["bannedOutputs"])
+	assert.Equal(t, []interface{}{"set-header"}, config["hooks"])
+	// secrets are left out of the summary
+	raw, _ := json.Marshal(status)
+	assert.NotContains(t, string(raw), "secret-token")
+	assert.NotContains(t, string(raw), "admin-token")
+	assert.NotContains(t, string(raw), "banned-value")
+
+	pool := status["pool"].(map[string]interface{})
+	assert.Equal(t, 1.0, pool["openConnections"])
+
+	rateLimits := status["rateLimits"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"origin": 1.0}, rateLimits["buckets"])
+	assert.Equal(t, 0.0, rateLimits["inFlight"])
+	assert.Equal(t, "10/s:10", rateLimits["limits"].(map[string]interface{})["perOrigin"])
+
+	// the health endpoints are also served by the admin listener
+	response, err := http.Get("http://" + proxy.AdminAddr().String() + "/healthz")
+	assert.Nil(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+}
@@ -0,0 +1,241 @@
+package libproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig configures the export of OpenTelemetry traces.
+type TracingConfig struct {
+	// Endpoint is the URL of the OTLP/HTTP collector traces are sent to, e.g.
+	// http://localhost:4318. If it has no path, /v1/traces is used. If blank, tracing is disabled.
+	Endpoint string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	// ServiceName is the service.name of the proxy's spans. It defaults to "proxyscotch".
+	ServiceName string `json:"serviceName,omitempty" yaml:"serviceName,omitempty"`
+	// Headers are sent with each export, e.g. for authentication with the collector.
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+}
+
+const tracerName = "github.com/hoppscotch/proxyscotch/libproxy"
+
+// traceContext propagates the trace from clients and to destinations in W3C traceparent and
+// tracestate headers.
+var traceContext = propagation.TraceContext{}
+
+// proxyTracer exports the spans of a proxy.
+type proxyTracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// newProxyTracer creates a tracer exporting to the endpoint in config, or returns nil if tracing
+// is disabled.
+func newProxyTracer(config TracingConfig) (*proxyTracer, error) {
+	if config.Endpoint == "" {
+		return nil, nil
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid tracing endpoint %q; expected a URL such as http://localhost:4318", config.Endpoint)
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint.Host)}
+	if endpoint.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if path := strings.TrimSuffix(endpoint.Path, "/"); path != "" {
+		options = append(options, otlptracehttp.WithURLPath(path))
+	}
+	if len(config.Headers) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(config.Headers))
+	}
+	// Creating the exporter doesn't connect to the collector, so this never blocks.
+	exporter, err := otlptrace.New(context.Background(), otlptracehttp.NewClient(options...))
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "proxyscotch"
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+
+	return &proxyTracer{provider: provider, tracer: provider.Tracer(tracerName)}, nil
+}
+
+// flush exports the spans that have ended but haven't been sent yet.
+func (t *proxyTracer) flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	return t.provider.ForceFlush(ctx)
+}
+
+// shutdown exports any remaining spans and stops the tracer. It is safe to call on a nil tracer.
+func (t *proxyTracer) shutdown() {
+	if t == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = t.provider.Shutdown(ctx)
+}
+
+// startRequestSpan starts the span of a request made to the proxy, continuing the client's trace
+// if it sent a traceparent header.
+func (t *proxyTracer) startRequestSpan(request *http.Request) (*http.Request, trace.Span) {
+	ctx := traceContext.Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+	ctx, span := t.tracer.Start(ctx, "proxyscotch "+request.URL.Path,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(request.Method),
+			semconv.HTTPTargetKey.String(request.URL.Path),
+			semconv.HTTPClientIPKey.String(clientIP(request)),
+		),
+	)
+
+	return request.WithContext(ctx), span
+}
+
+// endRequestSpan records the outcome of a request, as recorded in the access log, and ends its
+// span.
+func endRequestSpan(span trace.Span, entry *accessLogEntry) {
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(entry.Status))
+	if entry.Destination != "" {
+		span.SetAttributes(attribute.String("proxyscotch.destination", entry.Destination))
+	}
+	if entry.ErrorCode != "" {
+		span.SetAttributes(attribute.String("proxyscotch.error_code", entry.ErrorCode))
+	}
+	if entry.DeniedBy != "" {
+		span.SetAttributes(attribute.String("proxyscotch.denied_by", entry.DeniedBy))
+	}
+	if entry.RateLimit != "" {
+		span.SetAttributes(attribute.String("proxyscotch.rate_limit", entry.RateLimit))
+	}
+	// Rejected requests are the client's error, not the proxy's, so only failures mark the span.
+	if entry.level == accessLogError {
+		span.SetStatus(codes.Error, entry.Error)
+	} else if entry.Error != "" {
+		span.SetAttributes(attribute.String("proxyscotch.error", entry.Error))
+	}
+	span.End()
+}
+
+// startSpan starts a span within the request's trace. If the proxy isn't tracing, the span does
+// nothing.
+func startSpan(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name, options...)
+}
+
+// startUpstreamSpan starts the span of the request to the destination, and adds its traceparent
+// to the request. The connection made for the request, if any, is traced in child spans.
+func startUpstreamSpan(request *http.Request) (*http.Request, trace.Span) {
+	ctx, span := startSpan(request.Context(), "upstream "+request.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(request.Method),
+			semconv.NetPeerNameKey.String(request.URL.Hostname()),
+		),
+	)
+	if !span.IsRecording() {
+		return request, span
+	}
+
+	traceContext.Inject(ctx, propagation.HeaderCarrier(request.Header))
+	return request.WithContext(httptrace.WithClientTrace(ctx, connectionTrace(ctx, span))), span
+}
+
+// endUpstreamSpan records the response of the destination, or the (redacted) error if the
+// request failed, and ends the span.
+func endUpstreamSpan(span trace.Span, response *http.Response, failure string) {
+	if response == nil {
+		span.SetStatus(codes.Error, failure)
+	} else {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(response.StatusCode))
+	}
+	span.End()
+}
+
+// connectionTrace traces the DNS lookup, connection and TLS handshake made for a request. The
+// transport may dial several addresses at once, so the callbacks may run concurrently.
+func connectionTrace(ctx context.Context, parent trace.Span) *httptrace.ClientTrace {
+	var mu sync.Mutex
+	var dnsSpan, tlsSpan trace.Span
+	connectSpans := map[string]trace.Span{}
+
+	start := func(name string, attributes ...attribute.KeyValue) trace.Span {
+		_, span := startSpan(ctx, name, trace.WithAttributes(attributes...))
+		return span
+	}
+	end := func(span trace.Span, err error) {
+		if span == nil {
+			return
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			parent.SetAttributes(attribute.Bool("proxyscotch.connection_reused", info.Reused))
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			dnsSpan = start("dns", semconv.NetPeerNameKey.String(info.Host))
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			end(dnsSpan, info.Err)
+		},
+		ConnectStart: func(network, address string) {
+			mu.Lock()
+			defer mu.Unlock()
+			connectSpans[network+" "+address] = start("connect", attribute.String("net.transport", network), attribute.String("net.peer.address", address))
+		},
+		ConnectDone: func(network, address string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			end(connectSpans[network+" "+address], err)
+			delete(connectSpans, network+" "+address)
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsSpan = start("tls")
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			end(tlsSpan, err)
+		},
+	}
+}
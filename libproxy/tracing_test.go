@@ -0,0 +1,129 @@
+package libproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+type collectedSpan struct {
+	name         string
+	traceID      string
+	parentSpanID string
+	attributes   map[string]string
+}
+
+// startTestCollector starts a stand-in for an OTLP/HTTP collector, returning its URL and a
+// function returning the spans received so far.
+func startTestCollector(t *testing.T) (string, func() []collectedSpan) {
+	var mu sync.Mutex
+	var spans []collectedSpan
+
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		assert.Equal(t, "/v1/traces", request.URL.Path)
+		body, _ := io.ReadAll(request.Body)
+		var export collectortrace.ExportTraceServiceRequest
+		assert.Nil(t, proto.Unmarshal(body, &export))
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, resourceSpans := range export.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				for _, span := range scopeSpans.Spans {
+					attributes := map[string]string{}
+					for _, attribute := range span.Attributes {
+						attributes[attribute.Key] = attribute.Value.GetStringValue()
+					}
+					spans = append(spans, collectedSpan{
+						name:         span.Name,
+						traceID:      hex.EncodeToString(span.TraceId),
+						parentSpanID: hex.EncodeToString(span.ParentSpanId),
+						attributes:   attributes,
+					})
+				}
+			}
+		}
+		response.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL, func() []collectedSpan {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]collectedSpan(nil), spans...)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	collectorURL, collected := startTestCollector(t)
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	proxy, err := New(Options{Config: Config{
+		AllowedOrigins: []string{"*"},
+		Tracing:        TracingConfig{Endpoint: collectorURL},
+		AccessLog:      AccessLogConfig{Sinks: []string{"file"}, File: logPath},
+	}})
+	assert.Nil(t, err)
+
+	const clientTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const clientSpanID = "00f067aa0ba902b7"
+	body, _ := json.Marshal(Request{Method: "GET", Url: testServerUrl + "/headers"})
+	request := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	request.Header.Set("Origin", "validorigin1.com")
+	request.Header.Set("Traceparent", "00-"+clientTraceID+"-"+clientSpanID+"-01")
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, request)
+
+	var response Response
+	assert.Nil(t, json.NewDecoder(recorder.Body).Decode(&response))
+	assert.Equal(t, 200, response.Status)
+	// the destination is sent the trace, as a child of the client's span
+	assert.Contains(t, response.Data, "00-"+clientTraceID+"-")
+	assert.NotContains(t, response.Data, clientSpanID)
+
+	assert.Nil(t, proxy.loadPolicy().tracer.flush(context.Background()))
+	spans := map[string]collectedSpan{}
+	for _, span := range collected() {
+		assert.Equal(t, clientTraceID, span.traceID)
+		spans[span.name] = span
+	}
+	for _, name := range []string{"proxyscotch /", "parse", "policy", "connect", "upstream GET"} {
+		assert.Contains(t, spans, name)
+	}
+	assert.Equal(t, clientSpanID, spans["proxyscotch /"].parentSpanID)
+	assert.Equal(t, testServerUrl+"/headers", spans["proxyscotch /"].attributes["proxyscotch.destination"])
+
+	entries := readAccessLog(t, logPath)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, clientTraceID, entries[0].TraceID)
+}
+
+func TestTracingDisabled(t *testing.T) {
+	body, _ := json.Marshal(Request{Method: "GET", Url: testServerUrl + "/headers"})
+	request := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	request.Header.Set("Origin", "validorigin1.com")
+	recorder := httptest.NewRecorder()
+	testProxy.ServeHTTP(recorder, request)
+
+	var response Response
+	assert.Nil(t, json.NewDecoder(recorder.Body).Decode(&response))
+	assert.Equal(t, 200, response.Status)
+	assert.NotContains(t, response.Data, "Traceparent")
+}
+
+func TestInvalidTracingEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"localhost:4318", "grpc://localhost:4317", "http://"} {
+		_, err := New(Options{Config: Config{Tracing: TracingConfig{Endpoint: endpoint}}})
+		assert.NotNil(t, err, endpoint)
+	}
+}
@@ -0,0 +1,59 @@
+package libproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// unixScheme is the scheme of URLs naming the Unix socket a request is sent to, in the form
+// unix://<socket>:<path>, e.g. unix:///var/run/docker.sock:/v1.43/containers/json.
+const unixScheme = "unix://"
+
+// validateUnixSockets checks the allowlist of Unix sockets (see Config.UnixSockets).
+func validateUnixSockets(sockets map[string]string) error {
+	for name, path := range sockets {
+		if name == "" || path == "" {
+			return fmt.Errorf("invalid Unix socket %q: both a name and a path are required", name+"="+path)
+		}
+	}
+
+	return nil
+}
+
+// unixSocketFor returns the path of the Unix socket the request is sent to, or a blank string if
+// it is sent over TCP. The socket may be given by its name or path, in Request.UnixSocket or the
+// URL, and must be allowed by the configuration. A URL naming a socket is replaced with an
+// http://localhost URL with the same path.
+func (p *policy) unixSocketFor(requestData *Request) (string, error) {
+	socket := requestData.UnixSocket
+	if len(requestData.Url) >= len(unixScheme) && strings.EqualFold(requestData.Url[:len(unixScheme)], unixScheme) {
+		// The socket's path may contain colons (e.g. on Windows), so it ends at the first ":/".
+		var path string
+		socket, path, _ = strings.Cut(requestData.Url[len(unixScheme):], ":/")
+		requestData.Url = "http://localhost/" + path
+	}
+	if socket == "" {
+		return "", nil
+	}
+
+	for name, path := range p.config.UnixSockets {
+		if socket == name || filepath.Clean(socket) == filepath.Clean(path) {
+			requestData.UnixSocket = path
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("the Unix socket %q isn't allowed", socket)
+}
+
+// dialUnixSocket makes the transport connect to the Unix socket at path, whatever the address of
+// the request.
+func dialUnixSocket(transport *http.Transport, path string) {
+	dialer := &net.Dialer{}
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+}
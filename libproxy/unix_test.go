@@ -0,0 +1,71 @@
+package libproxy
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "proxyscotch")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("Unix sockets aren't supported: ", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		_, _ = response.Write([]byte(request.Host + " " + request.URL.RequestURI()))
+	})}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	proxy, err := New(Options{Config: Config{
+		AllowedOrigins: []string{"*"},
+		BannedDests:    []string{"localhost"},
+		UnixSockets:    map[string]string{"docker": path},
+	}})
+	assert.Nil(t, err)
+
+	resp := getResultFrom(proxy, Request{Method: "GET", Url: "unix://" + path + ":/v1.43/containers/json?all=1"}, "https://hoppscotch.io")
+	assert.Equal(t, 200, resp.requestResponse.Status)
+	assert.Equal(t, "localhost /v1.43/containers/json?all=1", resp.requestResponse.Data)
+	assert.Equal(t, path, resp.requestResponse.RemoteAddress)
+
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: "unix://docker:/_ping"}, "https://hoppscotch.io")
+	assert.Equal(t, "localhost /_ping", resp.requestResponse.Data)
+
+	resp = getResultFrom(proxy, Request{Method: "GET", Url: "http://api.docker/version", UnixSocket: "docker"}, "https://hoppscotch.io")
+	assert.Equal(t, "api.docker /version", resp.requestResponse.Data)
+
+	// only the allowed sockets may be used
+	for _, request := range []Request{
+		{Method: "GET", Url: "unix:///var/run/other.sock:/version"},
+		{Method: "GET", Url: "http://localhost/version", UnixSocket: "other"},
+	} {
+		resp = getResultFrom(proxy, request, "https://hoppscotch.io")
+		assert.Contains(t, resp.proxyResponse.Body.String(), "Request cannot be to this destination", request)
+	}
+
+	// secrets aren't sent to sockets, whose requests all go to localhost
+	store := newTestSecretStore(t, "master key")
+	assert.Nil(t, store.Set("local", "l0cal-t0ken", []string{"localhost"}))
+	proxy, err = New(Options{Config: Config{AllowedOrigins: []string{"*"}, UnixSockets: map[string]string{"docker": path}}, Secrets: store})
+	assert.Nil(t, err)
+	for _, request := range []Request{
+		{Method: "GET", Url: "unix://docker:/_ping", Headers: map[string]string{"X-Token": "{{secret:local}}"}},
+		{Method: "GET", Url: "http://localhost/_ping?token={{secret:local}}", UnixSocket: "docker"},
+	} {
+		resp = getResultFrom(proxy, request, "https://hoppscotch.io")
+		assert.Equal(t, ErrorCodeSecretFailed, getErrorBody(t, resp).Data.Code, request)
+		assert.Contains(t, getErrorBody(t, resp).Data.Message, "Unix sockets", request)
+	}
+
+	_, err = New(Options{Config: Config{UnixSockets: map[string]string{"docker": ""}}})
+	assert.NotNil(t, err)
+}
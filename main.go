@@ -1,6 +1,10 @@
 package main
 
 import (
+	"flag"
+	"strings"
+	"time"
+
 	"github.com/atotto/clipboard"
 	"github.com/getlantern/systray"
 	"github.com/pkg/browser"
@@ -21,7 +25,13 @@ var (
 	mCopyAccessToken *systray.MenuItem
 )
 
+// admin manages the proxy through the same admin API as the server's CLI, in-process.
+var admin = libproxy.Default().LocalAdminClient()
+
+var configPath = flag.String("config", "", "the path to a YAML or JSON configuration file (default: config.yaml, config.yml or config.json in the data directory).")
+
 func main() {
+	flag.Parse()
 	systray.Run(onReady, onExit)
 }
 
@@ -48,6 +58,14 @@ func onReady() {
 	mViewHelp := systray.AddMenuItem("Help...", "")
 	// Set Proxy Authentication Token
 	mSetAccessToken := systray.AddMenuItem("Set Access Token...", "")
+	// Set Allowed Origins
+	mSetAllowedOrigins := systray.AddMenuItem("Set Allowed Origins...", "")
+	// Regenerate Certificate
+	mRegenerateCertificate := systray.AddMenuItem("Regenerate Certificate...", "")
+	// Manage Secrets
+	mSecrets := systray.AddMenuItem("Secrets", "")
+	mAddSecret := mSecrets.AddSubMenuItem("Add Secret...", "")
+	mRemoveSecret := mSecrets.AddSubMenuItem("Remove Secret...", "")
 	// Check for Updates
 	mUpdateCheck := systray.AddMenuItem("Check for Updates...", "")
 
@@ -66,7 +84,12 @@ func onReady() {
 			_ = browser.OpenURL("https://hoppscotch.io/")
 
 		case <-mCopyAccessToken.ClickedCh:
-			_ = clipboard.WriteAll(libproxy.GetAccessToken())
+			accessToken, err := admin.AccessToken()
+			if err != nil {
+				notifyAdminError(err)
+				break
+			}
+			_ = clipboard.WriteAll(accessToken)
 			_ = notifier.Notify("Proxyscotch", "Proxy Access Token copied...", "The Proxy Access Token has been copied to your clipboard.", notifier.GetIcon())
 
 		case <-mViewHelp.ClickedCh:
@@ -75,20 +98,38 @@ func onReady() {
 		case <-mSetAccessToken.ClickedCh:
 			newAccessToken, success := inputbox.InputBox("Proxyscotch", "Please enter the new Proxy Access Token...\n(Leave this blank to disable access checks.)", "")
 			if success {
-				libproxy.SetAccessToken(newAccessToken)
-
-				if len(newAccessToken) == 0 {
+				if err := admin.SetAccessToken(newAccessToken); err != nil {
+					notifyAdminError(err)
+				} else if len(newAccessToken) == 0 {
 					_ = notifier.Notify("Proxyscotch", "Proxy Access check disabled.", "**Anyone can access your proxy server!** The Proxy Access Token check has been disabled.", notifier.GetIcon())
 				} else {
 					_ = notifier.Notify("Proxyscotch", "Proxy Access Token updated...", "The Proxy Access Token has been updated.", notifier.GetIcon())
 				}
 			}
 
+		case <-mSetAllowedOrigins.ClickedCh:
+			setAllowedOrigins()
+
+		case <-mRegenerateCertificate.ClickedCh:
+			if err := admin.RegenerateCertificate(); err != nil {
+				notifyAdminError(err)
+			} else {
+				_ = notifier.Notify("Proxyscotch", "Certificate regenerated...", "A new certificate has been created in the data directory. You'll need to install and trust it again.", notifier.GetIcon())
+			}
+
+		case <-mAddSecret.ClickedCh:
+			addSecret()
+
+		case <-mRemoveSecret.ClickedCh:
+			removeSecret()
+
 		case <-mUpdateCheck.ClickedCh:
 			// TODO: Add update check.
 			_ = browser.OpenURL("https://github.com/hoppscotch/proxyscotch")
 
 		case <-mQuit.ClickedCh:
+			// Give requests in progress a moment to finish before exiting.
+			_ = libproxy.Shutdown(5 * time.Second)
 			systray.Quit()
 			return
 		}
@@ -98,8 +139,107 @@ func onReady() {
 func onExit() {
 }
 
+// notifyAdminError reports a change that the proxy rejected.
+func notifyAdminError(err error) {
+	_ = notifier.Notify("Proxyscotch", "An error occurred...", err.Error(), notifier.GetIcon())
+}
+
+// setAllowedOrigins prompts for the origins allowed to use the proxy.
+func setAllowedOrigins() {
+	origins, err := admin.AllowedOrigins()
+	if err != nil {
+		notifyAdminError(err)
+		return
+	}
+
+	value, success := inputbox.InputBox("Proxyscotch", "Please enter the allowed origins, separated by commas...\n(Use * to allow any origin.)", strings.Join(origins, ","))
+	if !success {
+		return
+	}
+	origins = nil
+	for _, origin := range strings.Split(value, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+
+	if err := admin.SetAllowedOrigins(origins); err != nil {
+		notifyAdminError(err)
+		return
+	}
+	_ = notifier.Notify("Proxyscotch", "Allowed origins updated...", "The allowed origins have been updated.", notifier.GetIcon())
+}
+
+// addSecret prompts for the name and value of a secret to add to the secret store.
+func addSecret() {
+	name, success := inputbox.InputBox("Proxyscotch", "Please enter the name of the secret...\n(Requests can then refer to it as {{secret:name}}.)", "")
+	if !success || len(name) == 0 {
+		return
+	}
+	value, success := inputbox.InputBox("Proxyscotch", "Please enter the value of the secret '"+name+"'...", "")
+	if !success || len(value) == 0 {
+		return
+	}
+	hostList, success := inputbox.InputBox("Proxyscotch", "Please enter the hosts the secret '"+name+"' may be sent to...\n(A comma separated list, e.g. api.example.com,*.example.org.)", "")
+	if !success || len(hostList) == 0 {
+		return
+	}
+	var hosts []string
+	for _, host := range strings.Split(hostList, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	if err := libproxy.DefaultSecretStore().Set(name, value, hosts); err != nil {
+		_ = notifier.Notify("Proxyscotch", "Failed to add secret.", err.Error(), notifier.GetIcon())
+		return
+	}
+	_ = notifier.Notify("Proxyscotch", "Secret added...", "Requests can now use {{secret:"+name+"}} in place of the secret.", notifier.GetIcon())
+}
+
+// removeSecret prompts for the name of a secret to remove from the secret store.
+func removeSecret() {
+	store := libproxy.DefaultSecretStore()
+	names, err := store.Names()
+	if err != nil {
+		_ = notifier.Notify("Proxyscotch", "Failed to read secrets.", err.Error(), notifier.GetIcon())
+		return
+	}
+	if len(names) == 0 {
+		_ = notifier.Notify("Proxyscotch", "No secrets.", "There are no secrets to remove.", notifier.GetIcon())
+		return
+	}
+
+	name, success := inputbox.InputBox("Proxyscotch", "Please enter the name of the secret to remove...\n(Secrets: "+strings.Join(names, ", ")+")", "")
+	if !success || len(name) == 0 {
+		return
+	}
+
+	if err := store.Delete(name); err != nil {
+		_ = notifier.Notify("Proxyscotch", "Failed to remove secret.", err.Error(), notifier.GetIcon())
+		return
+	}
+	_ = notifier.Notify("Proxyscotch", "Secret removed...", "The secret '"+name+"' has been removed.", notifier.GetIcon())
+}
+
 func runHoppscotchProxy() {
-	libproxy.Initialize("hoppscotch", "127.0.0.1:9159", "https://hoppscotch.io", "", "", onProxyStateChange, true, nil)
+	libproxy.SetVersion(VersionName, VersionCode)
+	config, path, err := libproxy.ReadConfig(libproxy.DefaultDesktopConfig, *configPath)
+	if err != nil {
+		onProxyStateChange("An error occurred: "+err.Error(), false)
+		return
+	}
+
+	if path != "" {
+		libproxy.SetConfigLoader(func() (libproxy.Config, error) {
+			config, _, err := libproxy.ReadConfig(libproxy.DefaultDesktopConfig, path)
+			return config, err
+		})
+		libproxy.WatchConfigFile(path, 2*time.Second)
+	}
+
+	libproxy.Initialize(config, onProxyStateChange, nil)
 }
 
 func onProxyStateChange(status string, isListening bool) {
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/hoppscotch/proxyscotch/libproxy"
+)
+
+const adminUsage = `Usage: server admin [--url <url>] [--token <token>] <command> [arguments]
+
+Manages a running proxy through its admin API. The URL defaults to $PROXYSCOTCH_ADMIN_URL, or
+else http://localhost:9159, and the admin token to $PROXYSCOTCH_ADMIN_TOKEN. Changes are made to
+the running configuration only, and are lost when it is reloaded from a file.
+
+Commands:
+  config                                print the running configuration
+  origins | dests | outputs             list the allowed origins, banned destinations or banned
+                                        outputs
+  origins | dests | outputs set <list>  replace them with a comma separated list
+  origins | dests | outputs add <value> add a value
+  origins | dests | outputs remove <value>
+                                        remove a value
+  redaction-rules                       print the redaction rules
+  redaction-rules set <file>            replace the redaction rules with those in a JSON file
+  access-token                          print the access token
+  access-token set [token]              replace the access token (disabling it if blank)
+  admin-token set <token>               replace the admin token
+  connections                           list the connections and requests in progress
+  connections close-idle                close the idle connections to destinations
+  recordings                            list the recordings in progress
+  recordings stop <id>                  stop a recording, writing it to a HAR file
+  regenerate-cert                       regenerate the certificate
+  reload                                reload the configuration from its file
+`
+
+// adminLists are the list settings managed by the origins, dests and outputs commands.
+var adminLists = map[string]struct {
+	get func(client *libproxy.AdminClient) ([]string, error)
+	set func(client *libproxy.AdminClient, values []string) error
+}{
+	"origins": {(*libproxy.AdminClient).AllowedOrigins, (*libproxy.AdminClient).SetAllowedOrigins},
+	"dests":   {(*libproxy.AdminClient).BannedDests, (*libproxy.AdminClient).SetBannedDests},
+	"outputs": {(*libproxy.AdminClient).BannedOutputs, (*libproxy.AdminClient).SetBannedOutputs},
+}
+
+// runAdminCommand runs the admin subcommand with the given arguments, returning the exit status.
+func runAdminCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("admin", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	url := os.Getenv("PROXYSCOTCH_ADMIN_URL")
+	if url == "" {
+		url = "http://localhost:9159"
+	}
+	urlPtr := flags.String("url", url, "")
+	tokenPtr := flags.String("token", os.Getenv("PROXYSCOTCH_ADMIN_TOKEN"), "")
+	if err := flags.Parse(args); err != nil || flags.NArg() == 0 {
+		_, _ = fmt.Fprint(stderr, adminUsage)
+		return 2
+	}
+	args = flags.Args()
+
+	client := libproxy.NewAdminClient(*urlPtr, *tokenPtr)
+	printJSON := func(value interface{}) {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(value)
+	}
+
+	var err error
+	switch command := args[0]; {
+	case command == "config" && len(args) == 1:
+		var config libproxy.Config
+		if config, err = client.Config(); err == nil {
+			printJSON(config)
+		}
+
+	case adminLists[command].get != nil:
+		list := adminLists[command]
+		var values []string
+		if values, err = list.get(client); err != nil {
+			break
+		}
+
+		switch {
+		case len(args) == 1:
+			for _, value := range values {
+				_, _ = fmt.Fprintln(stdout, value)
+			}
+		case len(args) == 3 && args[1] == "set":
+			values = nil
+			for _, value := range strings.Split(args[2], ",") {
+				if value = strings.TrimSpace(value); value != "" {
+					values = append(values, value)
+				}
+			}
+			err = list.set(client, values)
+		case len(args) == 3 && args[1] == "add":
+			err = list.set(client, append(values, args[2]))
+		case len(args) == 3 && args[1] == "remove":
+			var remaining []string
+			for _, value := range values {
+				if value != args[2] {
+					remaining = append(remaining, value)
+				}
+			}
+			if len(remaining) == len(values) {
+				err = fmt.Errorf("%q is not in the list", args[2])
+			} else {
+				err = list.set(client, remaining)
+			}
+		default:
+			_, _ = fmt.Fprint(stderr, adminUsage)
+			return 2
+		}
+
+	case command == "redaction-rules" && len(args) == 1:
+		var rules []libproxy.RedactionRule
+		if rules, err = client.RedactionRules(); err == nil {
+			printJSON(rules)
+		}
+
+	case command == "redaction-rules" && len(args) == 3 && args[1] == "set":
+		var rules []libproxy.RedactionRule
+		if rules, err = libproxy.LoadRedactionRules(args[2]); err == nil {
+			err = client.SetRedactionRules(rules)
+		}
+
+	case command == "access-token" && len(args) == 1:
+		var token string
+		if token, err = client.AccessToken(); err == nil {
+			_, _ = fmt.Fprintln(stdout, token)
+		}
+
+	case command == "access-token" && (len(args) == 2 || len(args) == 3) && args[1] == "set":
+		err = client.SetAccessToken(strings.Join(args[2:], ""))
+
+	case command == "admin-token" && len(args) == 3 && args[1] == "set":
+		err = client.SetAdminToken(args[2])
+
+	case command == "connections" && len(args) == 1:
+		var connections libproxy.AdminConnections
+		if connections, err = client.Connections(); err == nil {
+			printJSON(connections)
+		}
+
+	case command == "connections" && len(args) == 2 && args[1] == "close-idle":
+		err = client.CloseIdleConnections()
+
+	case command == "recordings" && len(args) == 1:
+		var recordings []libproxy.RecordingInfo
+		if recordings, err = client.Recordings(); err == nil {
+			printJSON(recordings)
+		}
+
+	case command == "recordings" && len(args) == 3 && args[1] == "stop":
+		var recording libproxy.RecordingInfo
+		if recording, err = client.StopRecording(args[2]); err == nil {
+			_, _ = fmt.Fprintln(stdout, recording.File)
+		}
+
+	case command == "regenerate-cert" && len(args) == 1:
+		err = client.RegenerateCertificate()
+
+	case command == "reload" && len(args) == 1:
+		err = client.Reload()
+
+	case command == "help" || command == "-h" || command == "--help":
+		_, _ = fmt.Fprint(stdout, adminUsage)
+
+	default:
+		_, _ = fmt.Fprint(stderr, adminUsage)
+		return 2
+	}
+
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hoppscotch/proxyscotch/libproxy"
+)
+
+const secretsUsage = `Usage: server secrets <command> [arguments]
+
+Manages the encrypted secrets that requests can refer to with {{secret:name}} placeholders.
+Each secret may only be sent to the hosts it is stored with: a comma separated list of host
+names, or patterns such as *.example.com. The master key is read from $PROXYSCOTCH_SECRETS_KEY,
+or else from secrets.key in the data directory.
+
+Commands:
+  list                         list the names of the stored secrets, and their hosts
+  set <name> <hosts> [value]   store a secret, reading the value from standard input if not given
+  hosts <name> <hosts>         change the hosts a secret may be sent to
+  delete <name>                delete a secret
+`
+
+// runSecretsCommand runs the secrets subcommand with the given arguments, returning the exit
+// status.
+func runSecretsCommand(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		_, _ = fmt.Fprint(stderr, secretsUsage)
+		return 2
+	}
+
+	store := libproxy.DefaultSecretStore()
+	var err error
+	switch command := args[0]; {
+	case command == "list" && len(args) == 1:
+		var names []string
+		if names, err = store.Names(); err == nil {
+			for _, name := range names {
+				var hosts []string
+				if hosts, err = store.Hosts(name); err != nil {
+					break
+				}
+				if len(hosts) == 0 {
+					hosts = []string{"(no hosts; set them with the hosts command)"}
+				}
+				_, _ = fmt.Fprintln(stdout, name+"\t"+strings.Join(hosts, ","))
+			}
+		}
+
+	case command == "set" && (len(args) == 3 || len(args) == 4):
+		var value string
+		if len(args) == 4 {
+			value = args[3]
+		} else {
+			// Reading the value from standard input keeps it out of the shell history.
+			value, err = bufio.NewReader(stdin).ReadString('\n')
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			value = strings.TrimRight(value, "\r\n")
+		}
+		if err == nil && value == "" {
+			err = errors.New("the value is empty")
+		}
+		if err == nil {
+			err = store.Set(args[1], value, splitHosts(args[2]))
+		}
+
+	case command == "hosts" && len(args) == 3:
+		err = store.SetHosts(args[1], splitHosts(args[2]))
+
+	case command == "delete" && len(args) == 2:
+		err = store.Delete(args[1])
+
+	case command == "help" || command == "-h" || command == "--help":
+		_, _ = fmt.Fprint(stdout, secretsUsage)
+
+	default:
+		_, _ = fmt.Fprint(stderr, secretsUsage)
+		return 2
+	}
+
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// splitHosts splits a comma separated list of hosts.
+func splitHosts(value string) []string {
+	var hosts []string
+	for _, host := range strings.Split(value, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
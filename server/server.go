@@ -2,26 +2,124 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/hoppscotch/proxyscotch/libproxy"
 )
 
+// VersionName and VersionCode are set at build time (see build.sh), and reported by /status.
+var (
+	VersionName string
+	VersionCode string
+)
+
+// optionFlag records the value of a command-line flag so that it can be applied on top of the
+// configuration file and environment, once those have been loaded.
+type optionFlag struct {
+	option libproxy.ConfigOption
+	value  string
+}
+
+func (f *optionFlag) String() string {
+	return f.value
+}
+
+func (f *optionFlag) Set(value string) error {
+	f.value = value
+	return nil
+}
+
+func (f *optionFlag) IsBoolFlag() bool {
+	return f.option.IsBool
+}
+
 func main() {
-	hostPtr := flag.String("host", "localhost:9159", "the hostname that the server should listen on.")
-	tokenPtr := flag.String("token", "", "the Proxy Access Token used to restrict access to the server.")
-	allowedOriginsPtr := flag.String("allowed-origins", "*", "a comma separated list of allowed origins.")
-	bannedOutputsPtr := flag.String("banned-outputs", "", "a comma separated list of banned outputs.")
-	bannedDestsPtr := flag.String("banned-dests", "", "a comma separated list of banned proxy destinations.")
+	if len(os.Args) > 1 && os.Args[1] == "secrets" {
+		os.Exit(runSecretsCommand(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(runAdminCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	configPtr := flag.String("config", "", "the path to a YAML or JSON configuration file (default: config.yaml, config.yml or config.json in the data directory).")
+	watchConfigPtr := flag.Bool("watch-config", true, "reload the configuration when the configuration file changes.")
+	shutdownTimeoutPtr := flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for requests in progress to finish when shutting down.")
+	for _, option := range libproxy.ConfigOptions {
+		flag.Var(&optionFlag{option: option}, option.Name, option.Usage)
+	}
 
 	flag.Parse()
 
+	config, configPath, err := loadConfig(*configPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	libproxy.SetConfigLoader(func() (libproxy.Config, error) {
+		config, _, err := loadConfig(*configPtr)
+		return config, err
+	})
+	if configPath != "" && *watchConfigPtr {
+		libproxy.WatchConfigFile(configPath, 2*time.Second)
+	}
+
+	// Reload the configuration on SIGHUP.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := libproxy.ReloadConfig(); err != nil {
+				log.Printf("Failed to reload configuration: %v", err)
+			}
+		}
+	}()
+
+	// Shut down gracefully on SIGINT or SIGTERM. A second signal exits immediately.
+	shutdown := make(chan os.Signal, 2)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-shutdown
+		go func() {
+			<-shutdown
+			log.Fatal("Exiting without waiting for requests to finish.")
+		}()
+
+		if err := libproxy.Shutdown(*shutdownTimeoutPtr); err != nil {
+			log.Printf("Requests in progress were aborted: %v", err)
+		}
+	}()
+
+	libproxy.SetVersion(VersionName, VersionCode)
 	finished := make(chan bool)
-	libproxy.Initialize(*tokenPtr, *hostPtr, *allowedOriginsPtr, *bannedOutputsPtr, *bannedDestsPtr, onProxyStateChangeServer, false, finished)
+	libproxy.Initialize(config, onProxyStateChangeServer, finished)
 
 	<-finished
 }
 
+// loadConfig reads the configuration. Settings are applied in order of precedence: defaults,
+// then the configuration file, then environment variables and finally command-line flags.
+func loadConfig(path string) (libproxy.Config, string, error) {
+	config, path, err := libproxy.ReadConfig(libproxy.DefaultServerConfig, path)
+	if err != nil {
+		return config, path, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		if option, ok := f.Value.(*optionFlag); ok && err == nil {
+			if err = option.option.Set(&config, option.value); err != nil {
+				err = fmt.Errorf("invalid value for --%s: %w", f.Name, err)
+			}
+		}
+	})
+
+	return config, path, err
+}
+
 func onProxyStateChangeServer(status string, isListening bool) {
 	log.Printf("[ready=%v] %s", isListening, status)
 }